@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/ratelimit"
+	"context"
+	"flag"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+)
+
+// rateFlag is a byte rate flag accepting sizes like 512KiB
+type rateFlag int64
+
+func (r *rateFlag) String() string {
+	if *r == 0 {
+		return "0"
+	}
+	return humanize.IBytes(uint64(*r))
+}
+
+func (r *rateFlag) Set(s string) error {
+	n, err := ratelimit.ParseRate(s)
+	*r = rateFlag(n)
+	return err
+}
+
+// scheduleFlag collects the repeatable -rate-schedule flag
+type scheduleFlag []ratelimit.Rule
+
+func (s *scheduleFlag) String() string {
+	return strconv.Itoa(len(*s)) + " rules"
+}
+
+func (s *scheduleFlag) Set(v string) error {
+	rule, err := ratelimit.ParseRule(v)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, rule)
+	return nil
+}
+
+// bandwidthFlags are the native engine's rate limiting flags
+type bandwidthFlags struct {
+	down, up               rateFlag
+	torrentDown, torrentUp rateFlag
+	peerDown, peerUp       rateFlag
+	burst                  rateFlag
+	schedule               scheduleFlag
+
+	global *ratelimit.Bucket
+}
+
+func (b *bandwidthFlags) register(fs *flag.FlagSet) {
+	fs.Var(&b.down, "down-rate", "global download limit per second, 0 for unlimited")
+	fs.Var(&b.up, "up-rate", "global upload limit per second, 0 for unlimited")
+	fs.Var(&b.torrentDown, "torrent-down-rate", "download limit per second of each torrent")
+	fs.Var(&b.torrentUp, "torrent-up-rate", "upload limit per second of each torrent")
+	fs.Var(&b.peerDown, "peer-down-rate", "download limit per second of each peer")
+	fs.Var(&b.peerUp, "peer-up-rate", "upload limit per second of each peer")
+	fs.Var(&b.burst, "burst", "bytes allowed above the limits at once, defaults to one second worth")
+	fs.Var(&b.schedule, "rate-schedule", `global limits during a time window, as "mon-fri 09:00-18:00 1MiB/256KiB" (repeatable)`)
+}
+
+func (b *bandwidthFlags) limits(down, up rateFlag) ratelimit.Limits {
+	return ratelimit.Limits{
+		Down: ratelimit.Limit{Rate: int64(down), Burst: int(b.burst)},
+		Up:   ratelimit.Limit{Rate: int64(up), Burst: int(b.burst)},
+	}
+}
+
+// start creates the global bucket and keeps it following the schedule until ctx is done
+func (b *bandwidthFlags) start(ctx context.Context) {
+	schedule := ratelimit.Schedule{Default: b.limits(b.down, b.up), Rules: b.schedule}
+	b.global = ratelimit.NewBucket(schedule.Default)
+	if len(schedule.Rules) > 0 {
+		go schedule.Run(ctx, b.global)
+	}
+}
+
+// forTorrent returns the buckets of a new torrent, sharing the global one
+func (b *bandwidthFlags) forTorrent() p2p.Bandwidth {
+	return p2p.Bandwidth{
+		Global:  b.global,
+		Torrent: ratelimit.NewBucket(b.limits(b.torrentDown, b.torrentUp)),
+		Peer:    b.limits(b.peerDown, b.peerUp),
+	}
+}
@@ -1,5 +1,7 @@
 package bitfield
 
+import "math/bits"
+
 type Bitfield []byte
 
 // hasPiece returns true if the bitfield has the given piece.
@@ -21,3 +23,12 @@ func (bf Bitfield) SetPiece(index int) {
 	}
 	bf[byteIndex] |= 1 << (7 - offset)
 }
+
+// Count returns how many pieces are set in the bitfield.
+func (bf Bitfield) Count() int {
+	n := 0
+	for _, b := range bf {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
@@ -47,3 +47,8 @@ func TestSetPiece(t *testing.T) {
 		assert.Equal(t, bf, test.outpt)
 	}
 }
+
+func TestCount(t *testing.T) {
+	assert.Equal(t, 0, Bitfield{}.Count())
+	assert.Equal(t, 6, Bitfield{0b00101010, 0b01010001}.Count())
+}
@@ -3,11 +3,18 @@ package client
 import (
 	"bit_torrent_cli/bitfield"
 	"bit_torrent_cli/handshake"
+	"bit_torrent_cli/logging"
 	"bit_torrent_cli/message"
+	"bit_torrent_cli/mse"
 	"bit_torrent_cli/peers"
+	"bit_torrent_cli/transport"
+	"bit_torrent_cli/wiretrace"
 	"bytes"
+	"context"
 	"fmt"
+	"log/slog"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -18,29 +25,40 @@ type Client struct {
 	infoHash [20]byte
 	peerID   [20]byte
 	Choked   bool
+	// Extensions is whether the peer speaks the extension protocol (BEP 10)
+	Extensions bool
+	// RemoteID is the peer ID the peer sent in its handshake
+	RemoteID [20]byte
+	// Logger logs the messages exchanged at debug level
+	Logger *slog.Logger
+	// Recorder, set by Record, writes every message exchanged to a capture
+	Recorder *wiretrace.Recorder
+	// opening records what was exchanged before the client was returned, once Record is called
+	opening []func(r *wiretrace.Recorder)
 }
 
 // NewClient creates a new client instance with the given connection and infoHash
-func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Handshake, error) {
+func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (req, res *handshake.Handshake, err error) {
 	conn.SetDeadline(time.Now().Add(time.Second * 3))
 	defer conn.SetDeadline(time.Time{}) // disable the deadline
-	req := handshake.New(infohash, peerID)
-	_, err := conn.Write(req.Serialize())
+	req = handshake.New(infohash, peerID)
+	req.EnableExtensions()
+	_, err = conn.Write(req.Serialize())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	res, err := handshake.Read(conn)
+	res, err = handshake.Read(conn)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if !bytes.Equal(res.InfoHash[:], infohash[:]) {
-		return nil, fmt.Errorf("expected infohas %v but got %x ", res.InfoHash, infohash)
+		return nil, nil, fmt.Errorf("expected infohas %v but got %x ", res.InfoHash, infohash)
 	}
-	return res, nil
+	return req, res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
+func recvBitfield(conn net.Conn) (*message.Message, error) {
 	conn.SetDeadline(time.Now().Add(time.Second * 5))
 	defer conn.SetDeadline(time.Time{})
 
@@ -56,68 +74,195 @@ func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
 		err := fmt.Errorf("expected bitfield but got Id %d", msg.ID)
 		return nil, err
 	}
-	return msg.Payload, nil
+	return msg, nil
 }
 
 func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), time.Second*3)
+	return Dial(nil, peer, peerID, infoHash, mse.PolicyPrefer)
+}
+
+// dialEncrypted connects to the peer and runs the encryption handshake the policy asks for
+func dialEncrypted(d transport.Dialer, peer peers.Peer, infoHash [20]byte, policy mse.Policy) (net.Conn, error) {
+	conn, err := d.DialContext(context.Background(), "tcp", peer.String())
+	if err != nil {
+		return nil, err
+	}
+	if policy == mse.PolicyDisable {
+		return conn, nil
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	defer conn.SetDeadline(time.Time{})
+	ec, err := mse.Initiate(conn, infoHash, policy)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ec, nil
+}
+
+// Dial connects to the peer through d, nil meaning TCP, encrypting the connection according to policy.
+// With mse.PolicyPrefer a peer that fails the encryption handshake is retried in plaintext.
+func Dial(d transport.Dialer, peer peers.Peer, peerID, infoHash [20]byte, policy mse.Policy) (*Client, error) {
+	if d == nil {
+		d = transport.TCP
+	}
+	logger := logging.For(nil, "client").With(logging.KeyPeer, peer.String())
+	conn, err := dialEncrypted(d, peer, infoHash, policy)
+	if err != nil && policy == mse.PolicyPrefer {
+		logger.Debug("encryption handshake failed, retrying in plaintext", logging.Err(err))
+		conn, err = dialEncrypted(d, peer, infoHash, mse.PolicyDisable)
+	}
 	if err != nil {
 		return nil, err
 	}
 	// tcp握手
-	_, err = completeHandshake(conn, infoHash, peerID)
+	sentAt := time.Now()
+	req, hs, err := completeHandshake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	receivedAt := time.Now()
 
 	bf, err := recvBitfield(conn)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	bfAt := time.Now()
+	addr := peer.String()
 	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
+		Conn:       conn,
+		Choked:     true,
+		Bitfield:   bf.Payload,
+		peer:       peer,
+		infoHash:   infoHash,
+		peerID:     peerID,
+		Extensions: hs.SupportsExtensions(),
+		RemoteID:   hs.PeerID,
+		Logger:     logger,
+		opening: []func(r *wiretrace.Recorder){
+			func(r *wiretrace.Recorder) { r.Handshake(sentAt, addr, wiretrace.Sent, req) },
+			func(r *wiretrace.Recorder) { r.Handshake(receivedAt, addr, wiretrace.Received, hs) },
+			func(r *wiretrace.Recorder) { r.Message(bfAt, addr, wiretrace.Received, bf) },
+		},
 	}, nil
 }
 
+// Accept completes the handshake of an inbound connection whose handshake has already been read
+func Accept(conn net.Conn, hs *handshake.Handshake, peerID [20]byte, numPieces int) (*Client, error) {
+	receivedAt := time.Now()
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	defer conn.SetDeadline(time.Time{})
+	res := handshake.New(hs.InfoHash, peerID)
+	res.EnableExtensions()
+	_, err := conn.Write(res.Serialize())
+	if err != nil {
+		return nil, err
+	}
+	sentAt := time.Now()
+	peer := peerFromAddr(conn.RemoteAddr())
+	addr := peer.String()
+	return &Client{
+		Conn:       conn,
+		Choked:     true,
+		Bitfield:   make(bitfield.Bitfield, (numPieces+7)/8),
+		peer:       peer,
+		infoHash:   hs.InfoHash,
+		peerID:     peerID,
+		Extensions: hs.SupportsExtensions(),
+		RemoteID:   hs.PeerID,
+		Logger:     logging.For(nil, "client").With(logging.KeyPeer, addr),
+		opening: []func(r *wiretrace.Recorder){
+			func(r *wiretrace.Recorder) { r.Handshake(receivedAt, addr, wiretrace.Received, hs) },
+			func(r *wiretrace.Recorder) { r.Handshake(sentAt, addr, wiretrace.Sent, res) },
+		},
+	}, nil
+}
+
+// peerFromAddr works for the addresses of every transport, the zero peer if there is no IP in it
+func peerFromAddr(addr net.Addr) peers.Peer {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return peers.Peer{}
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return peers.Peer{}
+	}
+	return peers.Peer{IP: net.ParseIP(host), Port: uint16(p)}
+}
+
+// Peer returns the address of the remote peer
+func (c *Client) Peer() peers.Peer {
+	return c.peer
+}
+
+// Record makes r write the handshakes exchanged so far and every message from now on
+func (c *Client) Record(r *wiretrace.Recorder) {
+	c.Recorder = r
+	for _, record := range c.opening {
+		record(r)
+	}
+	c.opening = nil
+}
+
 func (c *Client) Read() (*message.Message, error) {
 	msg, err := message.Read(c.Conn)
+	if err == nil {
+		c.Logger.Debug("received", "msg", msg)
+	}
+	if c.Recorder != nil {
+		if err != nil {
+			c.Recorder.Error(time.Now(), c.peer.String(), err)
+		} else {
+			c.Recorder.Message(time.Now(), c.peer.String(), wiretrace.Received, msg)
+		}
+	}
 	return msg, err
 }
 
-func (c *Client) SendRequest(index, begin, length int) error {
-	req := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Setialize())
+// send writes a message to the peer
+func (c *Client) send(msg *message.Message) error {
+	c.Logger.Debug("sending", "msg", msg)
+	if c.Recorder != nil {
+		c.Recorder.Message(time.Now(), c.peer.String(), wiretrace.Sent, msg)
+	}
+	_, err := c.Conn.Write(msg.Setialize())
 	return err
 }
 
+func (c *Client) SendRequest(index, begin, length int) error {
+	return c.send(message.FormatRequest(index, begin, length))
+}
+
 // SendPiece sends a piece message to the peer
 func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
-	_, err := c.Conn.Write(msg.Setialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgInterested})
 }
 
 func (c *Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
-	_, err := c.Conn.Write(msg.Setialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgNotInterested})
 }
 
 func (c *Client) Sendunchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
-	_, err := c.Conn.Write(msg.Setialize())
-	return err
+	return c.send(&message.Message{ID: message.MsgUnchoke})
 }
 
 func (c *Client) SendHave(index int) error {
-	msg := message.FormatHave(index)
-	_, err := c.Conn.Write(msg.Setialize())
-	return err
+	return c.send(message.FormatHave(index))
+}
+
+// SendExtended sends a message of the extension protocol
+func (c *Client) SendExtended(extendedID byte, payload []byte) error {
+	return c.send(message.FormatExtended(extendedID, payload))
+}
+
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	return c.send(&message.Message{ID: message.MsgBitfield, Payload: bf})
+}
+
+// SendPiece sends a block of a piece the peer requested
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	return c.send(message.FormatPiece(index, begin, block))
 }
@@ -0,0 +1,121 @@
+package client_test
+
+import (
+	"bit_torrent_cli/client"
+	"bit_torrent_cli/message"
+	"bit_torrent_cli/mse"
+	"bit_torrent_cli/swarm"
+	"bit_torrent_cli/wiretrace"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDial(t *testing.T) {
+	content := swarm.NewContent("data.bin", 16<<10, 1, 100<<10)
+	tests := map[string]struct {
+		behavior swarm.Behavior
+		policy   mse.Policy
+		ok       bool
+	}{
+		"encrypted":           {swarm.Behavior{}, mse.PolicyRequire, true},
+		"plaintext fallback":  {swarm.Behavior{Encryption: mse.PolicyDisable}, mse.PolicyPrefer, true},
+		"plaintext refused":   {swarm.Behavior{Encryption: mse.PolicyDisable}, mse.PolicyRequire, false},
+		"encryption disabled": {swarm.Behavior{Encryption: mse.PolicyRequire}, mse.PolicyDisable, false},
+		"wrong info hash":     {swarm.Behavior{WrongInfoHash: true}, mse.PolicyPrefer, false},
+	}
+	for name, test := range tests {
+		p, err := swarm.NewPeer(content, test.behavior)
+		require.Nil(t, err)
+		c, err := client.Dial(nil, p.Addr(), [20]byte{1}, content.Torrent.Infohash, test.policy)
+		if !test.ok {
+			assert.NotNil(t, err, name)
+			p.Close()
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, len(content.Torrent.PieceHashes), c.Bitfield.Count(), name)
+		c.Conn.Close()
+		p.Close()
+	}
+}
+
+func TestRequest(t *testing.T) {
+	content := swarm.NewContent("data.bin", 16<<10, 1, 40<<10)
+	p, err := swarm.NewPeer(content, swarm.Behavior{Have: []int{2}})
+	require.Nil(t, err)
+	defer p.Close()
+	c, err := client.New(p.Addr(), [20]byte{1}, content.Torrent.Infohash)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.False(t, c.Bitfield.HasPiece(0))
+	assert.True(t, c.Bitfield.HasPiece(2))
+
+	require.Nil(t, c.SendInterested())
+	msg, err := c.Read()
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgUnchoke, msg.ID)
+
+	require.Nil(t, c.SendRequest(2, 1024, 2048))
+	msg, err = c.Read()
+	require.Nil(t, err)
+	buf := make([]byte, 8<<10)
+	n, err := message.ParsePiece(2, buf, msg)
+	require.Nil(t, err)
+	assert.Equal(t, 2048, n)
+	assert.Equal(t, content.Piece(2)[1024:3072], buf[1024:3072])
+	assert.Equal(t, 1, p.Served())
+}
+
+func TestRecord(t *testing.T) {
+	content := swarm.NewContent("data.bin", 16<<10, 1, 40<<10)
+	p, err := swarm.NewPeer(content, swarm.Behavior{Have: []int{2}, Disconnect: 1})
+	require.Nil(t, err)
+	defer p.Close()
+	c, err := client.New(p.Addr(), [20]byte{1}, content.Torrent.Infohash)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	var buf bytes.Buffer
+	rec := wiretrace.NewRecorder(&buf)
+	c.Record(rec)
+
+	require.Nil(t, c.SendInterested())
+	_, err = c.Read()
+	require.Nil(t, err)
+	require.Nil(t, c.SendRequest(2, 0, 1024))
+	_, err = c.Read()
+	require.Nil(t, err)
+	_, err = c.Read()
+	require.NotNil(t, err)
+	require.Nil(t, rec.Close())
+
+	var kinds []string
+	r := wiretrace.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		assert.Equal(t, p.Addr().String(), record.Peer)
+		kinds = append(kinds, record.Dir+" "+record.Kind+" "+record.Summary)
+	}
+	assert.Equal(t, []string{
+		"send handshake ",
+		"recv handshake ",
+		"recv message has 1 of up to 8 pieces",
+		"send message ",
+		"recv message ",
+		"send message piece 2 offset 0 length 1024",
+		"recv message piece 2 offset 0, 1024 bytes",
+		"recv error ",
+	}, kinds)
+
+	var out strings.Builder
+	require.Nil(t, wiretrace.Timeline(&out, bytes.NewReader(buf.Bytes()), ""))
+	assert.Contains(t, out.String(), "<- Piece [1032]: piece 2 offset 0, 1024 bytes\n")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bit_torrent_cli/peerid"
+	"bit_torrent_cli/torrentfile"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// createCmd writes the .torrent file of a file or directory
+func createCmd(args []string) error {
+	fs := newFlagSet("create", "[flags] <file|dir>")
+	out := fs.String("o", "", "path of the .torrent file, <name>.torrent when empty")
+	var opts torrentfile.CreateOptions
+	fs.StringVar(&opts.Announce, "announce", "", "announce URL of the tracker")
+	fs.StringVar(&opts.Comment, "comment", "", "comment stored in the torrent")
+	fs.Func("webseed", "URL of a web seed serving the data (repeatable)", func(s string) error {
+		opts.WebSeeds = append(opts.WebSeeds, s)
+		return nil
+	})
+	var pieceLength rateFlag
+	fs.Var(&pieceLength, "piece-length", "bytes of each piece, a power of two picked from the size when 0")
+	err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if pieceLength < 0 || pieceLength&(pieceLength-1) != 0 {
+		return usageError(fs, fmt.Errorf("piece length %d is not a power of two", pieceLength))
+	}
+	opts.PieceLength = int(pieceLength)
+	opts.CreatedBy = "bit_torrent_cli " + peerid.DefaultPrefix
+
+	bto, err := torrentfile.Create(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	path := *out
+	if path == "" {
+		path = filepath.Base(filepath.Clean(fs.Arg(0))) + ".torrent"
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = bto.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	tf, err := torrentfile.Open(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s, infohash %x\n", path, tf.Infohash)
+	return nil
+}
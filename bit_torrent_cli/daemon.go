@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bit_torrent_cli/daemon"
+	"bit_torrent_cli/mse"
+	"bit_torrent_cli/peerid"
+	"bit_torrent_cli/ratelimit"
+	"bit_torrent_cli/session"
+	"bit_torrent_cli/tracing"
+	"bit_torrent_cli/transmission"
+	"bit_torrent_cli/transport"
+	"bit_torrent_cli/wiretrace"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+)
+
+// sessionFlags configure a session of the native engine
+type sessionFlags struct {
+	dir                string
+	storage            string
+	listen             string
+	dht                bool
+	lsd                bool
+	holepunch          bool
+	portmap            bool
+	peerIDPrefix       string
+	maxDownloads       int
+	maxSeeds           int
+	maxConns           int
+	maxConnsPerTorrent int
+	encryption         mse.Policy
+	utp                bool
+	proxy              string
+	bw                 bandwidthFlags
+	hash               hashFlags
+	metrics            string
+	trace              string
+	log                logFlags
+	record             string
+	recorder           *wiretrace.Recorder
+}
+
+func (f *sessionFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.dir, "dir", ".", "directory the torrents are written to")
+	fs.StringVar(&f.storage, "storage", "", storageUsage)
+	fs.StringVar(&f.listen, "listen", ":6881", "address accepting peer connections, its port possibly a range like 6881-6889, empty to disable")
+	fs.BoolVar(&f.portmap, "portmap", false, "forward the listen port on the router with UPnP, NAT-PMP or PCP")
+	fs.BoolVar(&f.dht, "dht", false, "find peers on the DHT as well as the trackers")
+	fs.BoolVar(&f.lsd, "lsd", false, "find peers on the local network by multicast announces")
+	fs.BoolVar(&f.holepunch, "holepunch", false, "reach peers behind NATs through the peers connected to both, best with -utp")
+	fs.IntVar(&f.maxDownloads, "max-downloads", 3, "torrents downloading at once, 0 for no limit")
+	fs.IntVar(&f.maxSeeds, "max-seeds", 3, "torrents seeding at once, 0 for no limit")
+	fs.IntVar(&f.maxConns, "max-conns", 200, "peer connections of the whole session, 0 for no cap")
+	fs.IntVar(&f.maxConnsPerTorrent, "max-conns-per-torrent", 50, "peer connections of each torrent, 0 for no cap")
+	fs.BoolVar(&f.utp, "utp", false, "also connect to peers over uTP, trying it before TCP")
+	fs.StringVar(&f.proxy, "proxy", "", "connect to peers through a socks5://[user:pass@]host:port or http://host:port proxy")
+	fs.Var(&f.encryption, "encryption", "peer connection encryption: prefer, require or disable")
+	fs.StringVar(&f.peerIDPrefix, "peer-id-prefix", peerid.DefaultPrefix, "start of our peer ID, Azureus-style like -XX0100-")
+	f.bw.register(fs)
+	f.hash.register(fs)
+	fs.StringVar(&f.metrics, "metrics", "", "serve Prometheus metrics at /metrics on this address, like :9090")
+	fs.StringVar(&f.trace, "trace", "", tracing.Usage)
+	f.log.register(fs)
+	fs.StringVar(&f.record, "record", "", "capture the handshakes and messages of every peer connection to this file, for the decode command")
+}
+
+// startRecording creates the capture of -record for start to hand to the session
+func (f *sessionFlags) startRecording() (stop func(), err error) {
+	f.recorder, stop, err = startRecording(f.record)
+	return stop, err
+}
+
+// start starts the bandwidth schedule and the session
+func (f *sessionFlags) start(ctx context.Context) (*session.Session, error) {
+	var dialer transport.Dialer
+	if f.proxy != "" {
+		if f.utp {
+			return nil, errors.New("-utp would go around the proxy")
+		}
+		var err error
+		dialer, err = transport.ParseProxy(f.proxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	backend, err := openStorage(f.storage, f.dir)
+	if err != nil {
+		return nil, err
+	}
+	f.bw.start(ctx)
+	return session.New(session.Config{
+		DataDir:            f.dir,
+		Storage:            backend,
+		ListenAddr:         f.listen,
+		DHT:                f.dht,
+		LSD:                f.lsd,
+		Holepunch:          f.holepunch,
+		PortMapping:        f.portmap,
+		PeerIDPrefix:       f.peerIDPrefix,
+		MaxActiveDownloads: f.maxDownloads,
+		MaxActiveSeeds:     f.maxSeeds,
+		MaxConns:           f.maxConns,
+		MaxConnsPerTorrent: f.maxConnsPerTorrent,
+		HashWorkers:        f.hash.workers,
+		MaxUnverifiedBytes: int64(f.hash.maxUnverified),
+		Global:             f.bw.global,
+		TorrentLimits:      f.bw.limits(f.bw.torrentDown, f.bw.torrentUp),
+		PeerLimits:         f.bw.limits(f.bw.peerDown, f.bw.peerUp),
+		Encryption:         f.encryption,
+		UTP:                f.utp,
+		Dialer:             dialer,
+		Logger:             slog.Default(),
+		Recorder:           f.recorder,
+	})
+}
+
+// daemonCmd runs a session controlled through the daemon API until interrupted
+func daemonCmd(args []string) error {
+	fs := newFlagSet("daemon", "[flags] [torrent]...")
+	api := fs.String("api", daemon.DefaultAddr, "loopback address of the control API, or unix:/path for a Unix socket")
+	var sf sessionFlags
+	sf.register(fs)
+	err := parseArgs(fs, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	err = sf.log.setup()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	stopTracing, err := startTracing(sf.trace)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	stopRecording, err := sf.startRecording()
+	if err != nil {
+		return err
+	}
+	defer stopRecording()
+	s, err := sf.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if sf.metrics != "" {
+		defer serveMetrics(sf.metrics)()
+	}
+	for _, path := range fs.Args() {
+		_, err = s.AddFile(path)
+		if err != nil {
+			return fmt.Errorf("adding %s: %w", path, err)
+		}
+	}
+	l, err := daemon.Listen(*api)
+	if err != nil {
+		return err
+	}
+	// Transmission frontends talk to the same session next to the daemon's own API, for loopback names as well
+	mux := http.NewServeMux()
+	mux.Handle("/", daemon.NewServer(s))
+	mux.Handle(transmission.Path, daemon.LocalOnly(transmission.NewHandler(s)))
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("daemon API on %s, Transmission RPC at %s", *api, transmission.Path)
+	err = srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+const ctlUsage = `usage: %s ctl [flags] <command> [args]
+
+commands:
+  list
+  add <file.torrent|magnet>
+  info <infohash>
+  pause <infohash>
+  resume <infohash>
+  remove [-delete-data] <infohash>
+  priority <infohash> <file index> <skip|normal|high>
+  limits [<down rate> <up rate>]
+  torrent-limits <infohash> <down rate> <up rate>
+  peers <infohash>
+  pieces <infohash>
+`
+
+// ctlCmd controls a running daemon
+func ctlCmd(args []string) error {
+	fs := newFlagSet("ctl", "")
+	api := fs.String("api", daemon.DefaultAddr, "address of the daemon API, or unix:/path for a Unix socket")
+	asJSON := fs.Bool("json", false, "print the daemon's answers as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), ctlUsage, prog())
+		fmt.Fprintln(fs.Output(), "\nflags:")
+		fs.PrintDefaults()
+	}
+	err := parseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	c := daemon.NewClient(*api)
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	need := func(n int) error {
+		if len(args) != n {
+			return usageError(fs, fmt.Errorf("%s takes %d arguments", cmd, n))
+		}
+		return nil
+	}
+	var out any
+	switch cmd {
+	case "list":
+		out, err = c.List()
+	case "add":
+		if err = need(1); err != nil {
+			return err
+		}
+		out, err = ctlAdd(c, args[0])
+	case "info":
+		if err = need(1); err != nil {
+			return err
+		}
+		out, err = c.Get(args[0])
+	case "pause":
+		if err = need(1); err != nil {
+			return err
+		}
+		out, err = c.Pause(args[0])
+	case "resume":
+		if err = need(1); err != nil {
+			return err
+		}
+		out, err = c.Resume(args[0])
+	case "remove":
+		rfs := newFlagSet("ctl remove", "[flags] <infohash>")
+		deleteData := rfs.Bool("delete-data", false, "also delete the downloaded files")
+		if err = parseArgs(rfs, args, 1, 1); err != nil {
+			return err
+		}
+		return c.Remove(rfs.Arg(0), *deleteData)
+	case "priority":
+		if err = need(3); err != nil {
+			return err
+		}
+		var index int
+		index, err = strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		out, err = c.SetPriority(args[0], index, args[2])
+	case "limits":
+		if len(args) == 0 {
+			out, err = c.Limits()
+			break
+		}
+		if err = need(2); err != nil {
+			return err
+		}
+		var l daemon.Limits
+		l, err = parseLimits(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		out, err = c.SetLimits(l)
+	case "torrent-limits":
+		if err = need(3); err != nil {
+			return err
+		}
+		var l daemon.Limits
+		l, err = parseLimits(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		out, err = c.SetTorrentLimits(args[0], l)
+	case "peers":
+		if err = need(1); err != nil {
+			return err
+		}
+		out, err = c.Peers(args[0])
+	case "pieces":
+		if err = need(1); err != nil {
+			return err
+		}
+		out, err = c.Pieces(args[0])
+	default:
+		return usageError(fs, fmt.Errorf("unknown command %q", cmd))
+	}
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	printCtl(out)
+	return nil
+}
+
+// ctlAdd sends a magnet link as is and a .torrent file's content, the daemon possibly running elsewhere
+func ctlAdd(c *daemon.Client, arg string) (daemon.Torrent, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		return c.Add(daemon.AddRequest{Magnet: arg})
+	}
+	b, err := os.ReadFile(arg)
+	if err != nil {
+		return daemon.Torrent{}, err
+	}
+	return c.Add(daemon.AddRequest{Metainfo: b})
+}
+
+func parseLimits(down, up string) (daemon.Limits, error) {
+	d, err := ratelimit.ParseRate(down)
+	if err != nil {
+		return daemon.Limits{}, err
+	}
+	u, err := ratelimit.ParseRate(up)
+	if err != nil {
+		return daemon.Limits{}, err
+	}
+	return daemon.Limits{DownRate: d, UpRate: u}, nil
+}
+
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return humanize.IBytes(uint64(rate)) + "/s"
+}
+
+// printCtl prints an answer of the daemon for humans
+func printCtl(out any) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	switch v := out.(type) {
+	case []daemon.Torrent:
+		fmt.Fprintln(w, "INFOHASH\tNAME\tSTATE\tDONE\tPEERS\tDOWN\tUP")
+		for _, t := range v {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", t.InfoHash, t.Name, t.State, progress(t),
+				t.Peers, humanize.IBytes(uint64(t.Downloaded)), humanize.IBytes(uint64(t.Uploaded)))
+		}
+	case daemon.Torrent:
+		fmt.Fprintf(w, "infohash:\t%s\n", v.InfoHash)
+		fmt.Fprintf(w, "name:\t%s\n", v.Name)
+		fmt.Fprintf(w, "state:\t%s\n", v.State)
+		fmt.Fprintf(w, "done:\t%s of %s\n", progress(v), humanize.IBytes(uint64(v.Length)))
+		fmt.Fprintf(w, "peers:\t%d\n", v.Peers)
+		fmt.Fprintf(w, "limits:\t%s down, %s up\n", formatRate(v.Limits.DownRate), formatRate(v.Limits.UpRate))
+		if v.Error != "" {
+			fmt.Fprintf(w, "error:\t%s\n", v.Error)
+		}
+		for _, f := range v.Files {
+			fmt.Fprintf(w, "file %d:\t%s\t%s\t%s\n", f.Index, f.Path, humanize.IBytes(uint64(f.Length)), f.Priority)
+		}
+	case []daemon.Peer:
+		fmt.Fprintln(w, "ADDR\tCHOKED\tPIECES\tPIECE\tDOWN\tUP")
+		for _, p := range v {
+			fmt.Fprintf(w, "%s\t%t\t%d\t%d\t%s\t%s\n", p.Addr, p.Choked, p.Pieces, p.Piece,
+				humanize.IBytes(uint64(p.Downloaded)), humanize.IBytes(uint64(p.Uploaded)))
+		}
+	case []daemon.Piece:
+		// one character per piece: done, downloading, pending or not wanted
+		marks := map[string]byte{"done": '#', "downloading": '>', "pending": '.', "idle": ' '}
+		line := make([]byte, 0, 64)
+		for _, p := range v {
+			line = append(line, marks[p.State])
+			if len(line) == cap(line) {
+				fmt.Fprintf(w, "%s\n", line)
+				line = line[:0]
+			}
+		}
+		if len(line) > 0 {
+			fmt.Fprintf(w, "%s\n", line)
+		}
+	case daemon.Limits:
+		fmt.Fprintf(w, "down:\t%s\nup:\t%s\n", formatRate(v.DownRate), formatRate(v.UpRate))
+	}
+}
+
+func progress(t daemon.Torrent) string {
+	if t.Length == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(t.Completed)/float64(t.Length)*100)
+}
@@ -0,0 +1,148 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client talks to a daemon's API
+type Client struct {
+	base string
+	http *http.Client
+}
+
+// NewClient connects to a daemon listening on a TCP address, or on a Unix socket for "unix:/path"
+func NewClient(addr string) *Client {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return &Client{base: "http://" + addr, http: &http.Client{}}
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return &Client{base: "http://daemon", http: &http.Client{Transport: transport}}
+}
+
+// do sends the request and decodes the JSON response into out, if not nil
+func (c *Client) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	// the daemon wants it on every request changing the session, with a body or not
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var e errorJSON
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("daemon answered %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func torrentPath(infoHash string, rest ...string) string {
+	return "/api/v1/torrents/" + url.PathEscape(infoHash) + strings.Join(rest, "")
+}
+
+func (c *Client) List() ([]Torrent, error) {
+	var list []Torrent
+	err := c.do(http.MethodGet, "/api/v1/torrents", nil, &list)
+	return list, err
+}
+
+func (c *Client) Get(infoHash string) (Torrent, error) {
+	var t Torrent
+	err := c.do(http.MethodGet, torrentPath(infoHash), nil, &t)
+	return t, err
+}
+
+func (c *Client) Add(req AddRequest) (Torrent, error) {
+	var t Torrent
+	err := c.do(http.MethodPost, "/api/v1/torrents", req, &t)
+	return t, err
+}
+
+func (c *Client) Remove(infoHash string, deleteData bool) error {
+	path := torrentPath(infoHash)
+	if deleteData {
+		path += "?delete_data=true"
+	}
+	return c.do(http.MethodDelete, path, nil, nil)
+}
+
+func (c *Client) Pause(infoHash string) (Torrent, error) {
+	var t Torrent
+	err := c.do(http.MethodPost, torrentPath(infoHash, "/pause"), nil, &t)
+	return t, err
+}
+
+func (c *Client) Resume(infoHash string) (Torrent, error) {
+	var t Torrent
+	err := c.do(http.MethodPost, torrentPath(infoHash, "/resume"), nil, &t)
+	return t, err
+}
+
+func (c *Client) SetPriority(infoHash string, file int, priority string) (Torrent, error) {
+	var t Torrent
+	err := c.do(http.MethodPut, torrentPath(infoHash, fmt.Sprintf("/files/%d/priority", file)), PriorityRequest{Priority: priority}, &t)
+	return t, err
+}
+
+func (c *Client) SetTorrentLimits(infoHash string, l Limits) (Torrent, error) {
+	var t Torrent
+	err := c.do(http.MethodPut, torrentPath(infoHash, "/limits"), l, &t)
+	return t, err
+}
+
+func (c *Client) Peers(infoHash string) ([]Peer, error) {
+	var list []Peer
+	err := c.do(http.MethodGet, torrentPath(infoHash, "/peers"), nil, &list)
+	return list, err
+}
+
+func (c *Client) Pieces(infoHash string) ([]Piece, error) {
+	var list []Piece
+	err := c.do(http.MethodGet, torrentPath(infoHash, "/pieces"), nil, &list)
+	return list, err
+}
+
+func (c *Client) Limits() (Limits, error) {
+	var l Limits
+	err := c.do(http.MethodGet, "/api/v1/limits", nil, &l)
+	return l, err
+}
+
+func (c *Client) SetLimits(l Limits) (Limits, error) {
+	err := c.do(http.MethodPut, "/api/v1/limits", l, &l)
+	return l, err
+}
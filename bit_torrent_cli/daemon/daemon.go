@@ -0,0 +1,447 @@
+package daemon
+
+import (
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/ratelimit"
+	"bit_torrent_cli/session"
+	"bit_torrent_cli/torrentfile"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAddr is where the daemon listens and the client connects when not told otherwise
+const DefaultAddr = "localhost:6880"
+
+// MagnetTimeout bounds how long adding a magnet link waits for its metadata
+const MagnetTimeout = 2 * time.Minute
+
+// Torrent is a torrent of the session as reported by the API
+type Torrent struct {
+	InfoHash   string    `json:"infohash"`
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	AddedAt    time.Time `json:"added_at"`
+	Complete   bool      `json:"complete"`
+	Error      string    `json:"error,omitempty"`
+	Length     int64     `json:"length"`
+	Completed  int64     `json:"completed"`
+	Pieces     int       `json:"pieces"`
+	PiecesDone int       `json:"pieces_done"`
+	Peers      int       `json:"peers"`
+	Downloaded int64     `json:"downloaded"`
+	Uploaded   int64     `json:"uploaded"`
+	Limits     Limits    `json:"limits"`
+	Files      []File    `json:"files,omitempty"`
+}
+
+// File is one file of a torrent as reported by the API
+type File struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Priority string `json:"priority"`
+}
+
+// Peer is one connection of a torrent as reported by the API
+type Peer struct {
+	Addr           string `json:"addr"`
+	Client         string `json:"client"`
+	Downloaded     int64  `json:"downloaded"`
+	Uploaded       int64  `json:"uploaded"`
+	Choked         bool   `json:"choked"`
+	Interested     bool   `json:"interested"`
+	PeerInterested bool   `json:"peerInterested"`
+	Pieces         int    `json:"pieces"`
+	Piece          int    `json:"piece"`
+}
+
+// Piece is one piece of a torrent as reported by the API
+type Piece struct {
+	Index    int    `json:"index"`
+	Priority string `json:"priority"`
+	State    string `json:"state"`
+}
+
+// Limits are rates in bytes per second, 0 meaning unlimited
+type Limits struct {
+	DownRate int64 `json:"down_rate"`
+	UpRate   int64 `json:"up_rate"`
+}
+
+// AddRequest adds a torrent from exactly one of its fields
+type AddRequest struct {
+	// Path is a .torrent file on the daemon's machine
+	Path string `json:"path,omitempty"`
+	// Metainfo is the content of a .torrent file
+	Metainfo []byte `json:"metainfo,omitempty"`
+	Magnet   string `json:"magnet,omitempty"`
+}
+
+// PriorityRequest sets the priority of a file: skip, normal or high
+type PriorityRequest struct {
+	Priority string `json:"priority"`
+}
+
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+// ParsePriority parses the file priorities a user may set
+func ParsePriority(s string) (p2p.Priority, error) {
+	switch s {
+	case "skip":
+		return p2p.PrioritySkip, nil
+	case "normal":
+		return p2p.PriorityNormal, nil
+	case "high":
+		return p2p.PriorityHigh, nil
+	default:
+		return 0, fmt.Errorf("bad priority %q, want skip, normal or high", s)
+	}
+}
+
+func (l Limits) limits() ratelimit.Limits {
+	return ratelimit.Limits{Down: ratelimit.Limit{Rate: l.DownRate}, Up: ratelimit.Limit{Rate: l.UpRate}}
+}
+
+func limitsJSON(l ratelimit.Limits) Limits {
+	return Limits{DownRate: l.Down.Rate, UpRate: l.Up.Rate}
+}
+
+func torrentJSON(st session.Status, withFiles bool) Torrent {
+	t := Torrent{
+		InfoHash:   hex.EncodeToString(st.InfoHash[:]),
+		Name:       st.Name,
+		State:      st.State.String(),
+		AddedAt:    st.AddedAt,
+		Complete:   st.Complete,
+		Completed:  int64(st.Stats.Completed),
+		Pieces:     st.Stats.Pieces,
+		PiecesDone: st.Stats.PiecesDone,
+		Peers:      st.Stats.Peers,
+		Downloaded: st.Stats.Downloaded,
+		Uploaded:   st.Stats.Uploaded,
+		Limits:     limitsJSON(st.Limits),
+	}
+	if st.Err != nil {
+		t.Error = st.Err.Error()
+	}
+	for i, f := range st.Files {
+		t.Length += int64(f.Length)
+		if withFiles {
+			t.Files = append(t.Files, File{Index: i, Path: f.Path, Length: int64(f.Length), Priority: f.Priority.String()})
+		}
+	}
+	return t
+}
+
+// Server exposes a session over a REST API. It only answers requests for a loopback name,
+// and the ones changing the session must be JSON, which no other site's page can send it.
+type Server struct {
+	s       *session.Session
+	mux     *http.ServeMux
+	handler http.Handler
+}
+
+func NewServer(s *session.Session) *Server {
+	srv := &Server{s: s, mux: http.NewServeMux()}
+	srv.handler = LocalOnly(requireJSON(srv.mux))
+	srv.mux.HandleFunc("GET /api/v1/torrents", srv.handleList)
+	srv.mux.HandleFunc("POST /api/v1/torrents", srv.handleAdd)
+	srv.mux.HandleFunc("GET /api/v1/torrents/{infohash}", srv.withTorrent(srv.handleGet))
+	srv.mux.HandleFunc("DELETE /api/v1/torrents/{infohash}", srv.withTorrent(srv.handleRemove))
+	srv.mux.HandleFunc("POST /api/v1/torrents/{infohash}/pause", srv.withTorrent(srv.handlePause))
+	srv.mux.HandleFunc("POST /api/v1/torrents/{infohash}/resume", srv.withTorrent(srv.handleResume))
+	srv.mux.HandleFunc("PUT /api/v1/torrents/{infohash}/files/{index}/priority", srv.withTorrent(srv.handlePriority))
+	srv.mux.HandleFunc("PUT /api/v1/torrents/{infohash}/limits", srv.withTorrent(srv.handleTorrentLimits))
+	srv.mux.HandleFunc("GET /api/v1/torrents/{infohash}/peers", srv.withTorrent(srv.handlePeers))
+	srv.mux.HandleFunc("GET /api/v1/torrents/{infohash}/pieces", srv.withTorrent(srv.handlePieces))
+	srv.mux.HandleFunc("GET /api/v1/limits", srv.handleLimits)
+	srv.mux.HandleFunc("PUT /api/v1/limits", srv.handleSetLimits)
+	return srv
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.handler.ServeHTTP(w, r)
+}
+
+// LocalOnly answers the requests of this machine alone: those over a Unix socket, or from a loopback address
+// for a loopback Host, which a page whose name was rebound to the daemon's address does not send.
+// The API has no other authentication.
+func LocalOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !localRequest(r) {
+			writeJSON(w, http.StatusForbidden, errorJSON{Error: "only local requests for a loopback host are answered"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func localRequest(r *http.Request) bool {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local != nil && local.Network() == "unix" {
+		return true
+	}
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !loopback(remote) {
+		return false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return loopback(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+// loopback tells whether host is localhost or a loopback IP
+func loopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireJSON refuses the requests other than GET without a JSON body type, which forms cannot send
+// and other sites' scripts cannot either without a preflight the API does not answer
+func requireJSON(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && mediaType != "application/json" {
+			writeJSON(w, http.StatusUnsupportedMediaType, errorJSON{Error: "the request must have Content-Type application/json"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Listen listens on a loopback TCP address, or on a Unix socket for "unix:/path". Other addresses are refused,
+// the API having no authentication.
+func Listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if !loopback(host) {
+			return nil, fmt.Errorf("refusing to serve the API on %s, which is not a loopback address", addr)
+		}
+		return net.Listen("tcp", addr)
+	}
+	// a socket left over by a daemon that did not shut down cleanly
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, session.ErrNotFound), errors.Is(err, session.ErrNoFile):
+		status = http.StatusNotFound
+	case errors.Is(err, session.ErrExists):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, errorJSON{Error: err.Error()})
+}
+
+func parseInfoHash(s string) ([20]byte, error) {
+	var ih [20]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(ih) {
+		return ih, fmt.Errorf("bad info hash %q", s)
+	}
+	copy(ih[:], b)
+	return ih, nil
+}
+
+// withTorrent parses the info hash of the request's path
+func (srv *Server) withTorrent(h func(w http.ResponseWriter, r *http.Request, ih [20]byte)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ih, err := parseInfoHash(r.PathValue("infohash"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		h(w, r, ih)
+	}
+}
+
+func (srv *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	list := []Torrent{}
+	for _, st := range srv.s.List() {
+		list = append(list, torrentJSON(st, false))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (srv *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	var req AddRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var ih [20]byte
+	switch {
+	case req.Path != "":
+		ih, err = srv.s.AddFile(req.Path)
+	case len(req.Metainfo) > 0:
+		var tf torrentfile.Torrentfile
+		tf, err = torrentfile.Parse(bytes.NewReader(req.Metainfo))
+		if err == nil {
+			ih, err = srv.s.Add(tf)
+		}
+	case req.Magnet != "":
+		ctx, cancel := context.WithTimeout(r.Context(), MagnetTimeout)
+		defer cancel()
+		ih, err = srv.s.AddMagnet(ctx, req.Magnet)
+	default:
+		err = errors.New("one of path, metainfo or magnet is required")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	st, _ := srv.s.Get(ih)
+	writeJSON(w, http.StatusCreated, torrentJSON(st, true))
+}
+
+func (srv *Server) handleGet(w http.ResponseWriter, r *http.Request, ih [20]byte) {
+	st, ok := srv.s.Get(ih)
+	if !ok {
+		writeError(w, session.ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, torrentJSON(st, true))
+}
+
+func (srv *Server) handleRemove(w http.ResponseWriter, r *http.Request, ih [20]byte) {
+	deleteData, _ := strconv.ParseBool(r.URL.Query().Get("delete_data"))
+	err := srv.s.Remove(ih, deleteData)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) handlePause(w http.ResponseWriter, r *http.Request, ih [20]byte) {
+	srv.respond(w, ih, srv.s.Pause(ih))
+}
+
+func (srv *Server) handleResume(w http.ResponseWriter, r *http.Request, ih [20]byte) {
+	srv.respond(w, ih, srv.s.Resume(ih))
+}
+
+// respond writes the torrent after a successful change, or the error
+func (srv *Server) respond(w http.ResponseWriter, ih [20]byte, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	st, _ := srv.s.Get(ih)
+	writeJSON(w, http.StatusOK, torrentJSON(st, true))
+}
+
+func (srv *Server) handlePriority(w http.ResponseWriter, r *http.Request, ih [20]byte) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req PriorityRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	prio, err := ParsePriority(req.Priority)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	srv.respond(w, ih, srv.s.SetFilePriority(ih, index, prio))
+}
+
+func (srv *Server) handleTorrentLimits(w http.ResponseWriter, r *http.Request, ih [20]byte) {
+	var l Limits
+	err := json.NewDecoder(r.Body).Decode(&l)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	srv.respond(w, ih, srv.s.SetTorrentLimits(ih, l.limits()))
+}
+
+func (srv *Server) handlePeers(w http.ResponseWriter, r *http.Request, ih [20]byte) {
+	if _, ok := srv.s.Get(ih); !ok {
+		writeError(w, session.ErrNotFound)
+		return
+	}
+	list := []Peer{}
+	if pt := srv.s.Torrent(ih); pt != nil {
+		for _, p := range pt.PeerStats() {
+			list = append(list, Peer(p))
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (srv *Server) handlePieces(w http.ResponseWriter, r *http.Request, ih [20]byte) {
+	if _, ok := srv.s.Get(ih); !ok {
+		writeError(w, session.ErrNotFound)
+		return
+	}
+	list := []Piece{}
+	if pt := srv.s.Torrent(ih); pt != nil {
+		for i, p := range pt.PieceStats() {
+			list = append(list, Piece{Index: i, Priority: p.Priority.String(), State: p.State})
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (srv *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, limitsJSON(srv.s.Limits()))
+}
+
+func (srv *Server) handleSetLimits(w http.ResponseWriter, r *http.Request) {
+	var l Limits
+	err := json.NewDecoder(r.Body).Decode(&l)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	srv.s.SetLimits(l.limits())
+	writeJSON(w, http.StatusOK, limitsJSON(srv.s.Limits()))
+}
@@ -0,0 +1,212 @@
+package daemon
+
+import (
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/session"
+	"bit_torrent_cli/torrentfile"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T) (*Client, *session.Session) {
+	s, err := session.New(session.Config{DataDir: t.TempDir()})
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(NewServer(s))
+	t.Cleanup(srv.Close)
+	return NewClient(srv.Listener.Addr().String()), s
+}
+
+func addTestTorrent(t *testing.T, s *session.Session) string {
+	tf := torrentfile.Torrentfile{
+		Name:        "dir",
+		PieceHashes: [][20]byte{{1}, {2}},
+		PieceLength: 16,
+		Length:      32,
+		Infohash:    [20]byte{0xab},
+		Files: []p2p.File{
+			{Path: "a", Length: 16, Priority: p2p.PriorityNormal},
+			{Path: "b", Length: 16, Offset: 16, Priority: p2p.PriorityNormal},
+		},
+	}
+	ih, err := s.Add(tf)
+	require.Nil(t, err)
+	return hex.EncodeToString(ih[:])
+}
+
+func TestTorrents(t *testing.T) {
+	c, s := newTestClient(t)
+	ih := addTestTorrent(t, s)
+
+	list, err := c.List()
+	require.Nil(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, ih, list[0].InfoHash)
+	assert.Equal(t, "downloading", list[0].State)
+	assert.Equal(t, int64(32), list[0].Length)
+
+	tor, err := c.Pause(ih)
+	require.Nil(t, err)
+	assert.Equal(t, "paused", tor.State)
+	tor, err = c.Resume(ih)
+	require.Nil(t, err)
+	assert.Equal(t, "downloading", tor.State)
+
+	tor, err = c.SetPriority(ih, 1, "skip")
+	require.Nil(t, err)
+	assert.Equal(t, "skip", tor.Files[1].Priority)
+	pieces, err := c.Pieces(ih)
+	require.Nil(t, err)
+	assert.Equal(t, []Piece{{Index: 0, Priority: "normal", State: "pending"}, {Index: 1, Priority: "skip", State: "idle"}}, pieces)
+	_, err = c.SetPriority(ih, 2, "skip")
+	assert.NotNil(t, err)
+	_, err = c.SetPriority(ih, 0, "now")
+	assert.NotNil(t, err)
+
+	tor, err = c.SetTorrentLimits(ih, Limits{DownRate: 1000})
+	require.Nil(t, err)
+	assert.Equal(t, Limits{DownRate: 1000}, tor.Limits)
+
+	peers, err := c.Peers(ih)
+	require.Nil(t, err)
+	assert.Empty(t, peers)
+
+	require.Nil(t, c.Remove(ih, true))
+	_, err = c.Get(ih)
+	assert.NotNil(t, err)
+}
+
+func TestAddErrors(t *testing.T) {
+	c, s := newTestClient(t)
+	addTestTorrent(t, s)
+
+	tests := map[string]AddRequest{
+		"empty":       {},
+		"missing":     {Path: filepath.Join(t.TempDir(), "missing.torrent")},
+		"bad magnet":  {Magnet: "magnet:?dn=nothing"},
+		"bad content": {Metainfo: []byte("not bencode")},
+	}
+	for name, req := range tests {
+		_, err := c.Add(req)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c, _ := newTestClient(t)
+	l, err := c.SetLimits(Limits{DownRate: 1 << 20, UpRate: 1 << 18})
+	require.Nil(t, err)
+	assert.Equal(t, Limits{DownRate: 1 << 20, UpRate: 1 << 18}, l)
+	l, err = c.Limits()
+	require.Nil(t, err)
+	assert.Equal(t, int64(1<<20), l.DownRate)
+}
+
+func TestBadInfoHash(t *testing.T) {
+	c, _ := newTestClient(t)
+	resp, err := c.http.Get(c.base + "/api/v1/torrents/nothex")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, err = c.Get("0000000000000000000000000000000000000000")
+	assert.NotNil(t, err)
+}
+
+func TestForeignRequests(t *testing.T) {
+	c, s := newTestClient(t)
+	ih := addTestTorrent(t, s)
+	tests := map[string]struct {
+		method      string
+		host        string
+		contentType string
+		status      int
+	}{
+		"rebound name":         {method: http.MethodGet, host: "evil.example", status: http.StatusForbidden},
+		"rebound name posting": {method: http.MethodPost, host: "evil.example:6880", contentType: "application/json", status: http.StatusForbidden},
+		"form":                 {method: http.MethodPost, contentType: "application/x-www-form-urlencoded", status: http.StatusUnsupportedMediaType},
+		"no body type":         {method: http.MethodPost, status: http.StatusUnsupportedMediaType},
+		"localhost":            {method: http.MethodGet, host: "localhost:6880", status: http.StatusOK},
+		"json":                 {method: http.MethodPost, contentType: "application/json; charset=utf-8", status: http.StatusOK},
+	}
+	for name, test := range tests {
+		req, err := http.NewRequest(test.method, c.base+"/api/v1/torrents/"+ih+"/pause", nil)
+		require.Nil(t, err, name)
+		if test.method == http.MethodGet {
+			req.URL.Path = "/api/v1/torrents"
+		}
+		if test.host != "" {
+			req.Host = test.host
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		resp, err := c.http.Do(req)
+		require.Nil(t, err, name)
+		resp.Body.Close()
+		assert.Equal(t, test.status, resp.StatusCode, name)
+	}
+	st, err := c.Get(ih)
+	require.Nil(t, err)
+	assert.Equal(t, "paused", st.State, "paused by the JSON request only")
+}
+
+func TestUnixSocket(t *testing.T) {
+	s, err := session.New(session.Config{DataDir: t.TempDir()})
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	addr := "unix:" + filepath.Join(t.TempDir(), "daemon.sock")
+	l, err := Listen(addr)
+	require.Nil(t, err)
+	srv := &http.Server{Handler: NewServer(s)}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	ih := addTestTorrent(t, s)
+	c := NewClient(addr)
+	_, err = c.Pause(ih)
+	require.Nil(t, err)
+}
+
+func TestLocalRequests(t *testing.T) {
+	s, err := session.New(session.Config{DataDir: t.TempDir()})
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	srv := NewServer(s)
+	tests := map[string]struct {
+		remote string
+		host   string
+		status int
+	}{
+		"loopback":               {remote: "127.0.0.1:5000", host: "localhost:6880", status: http.StatusOK},
+		"ipv6 loopback":          {remote: "[::1]:5000", host: "[::1]:6880", status: http.StatusOK},
+		"lan peer":               {remote: "192.168.1.7:5000", host: "localhost:6880", status: http.StatusForbidden},
+		"lan peer for daemon ip": {remote: "192.168.1.7:5000", host: "192.168.1.5:6880", status: http.StatusForbidden},
+		"rebound name":           {remote: "127.0.0.1:5000", host: "evil.example", status: http.StatusForbidden},
+	}
+	for name, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/torrents", nil)
+		req.RemoteAddr = test.remote
+		req.Host = test.host
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		assert.Equal(t, test.status, w.Code, name)
+	}
+}
+
+func TestListenLoopbackOnly(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0", "192.168.1.5:0", "example.com:0"} {
+		_, err := Listen(addr)
+		assert.ErrorContains(t, err, "not a loopback address", addr)
+	}
+	for _, addr := range []string{"127.0.0.1:0", "localhost:0"} {
+		l, err := Listen(addr)
+		require.Nil(t, err, addr)
+		l.Close()
+	}
+}
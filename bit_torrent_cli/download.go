@@ -1,146 +1,336 @@
 package main
 
 import (
+	"bit_torrent_cli/httpserve"
+	"bit_torrent_cli/metrics"
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/peerid"
+	"bit_torrent_cli/torrentfile"
+	"bit_torrent_cli/tui"
 	"context"
+	"errors"
 	"expvar"
+	"flag"
 	"fmt"
 	"io"
-	stdLog "log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/anacrolix/bargle"
-	"github.com/anacrolix/envpprof"
 	"github.com/anacrolix/log"
-	"github.com/anacrolix/tagflag"
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/iplist"
 	"github.com/anacrolix/torrent/metainfo"
 	pp "github.com/anacrolix/torrent/peer_protocol"
-	"github.com/anacrolix/torrent/storage"
+	astorage "github.com/anacrolix/torrent/storage"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/dustin/go-humanize"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
-	"go.opentelemetry.io/otel/sdk/trace"
 	"golang.org/x/time/rate"
 )
 
-func mainErr(ctx context.Context) error {
-	// Set up logging.
-	defer stdLog.SetFlags(stdLog.Flags() | stdLog.Lshortfile)
-	// Set up tracing.
-	tracingExporter, err := otlptracegrpc.New(ctx)
+// downloadCmd downloads torrents into -dir, one .torrent file at a time on the native engine
+func downloadCmd(args []string) error {
+	fs := newFlagSet("download", "[flags] <torrent|magnet>...")
+	eng := engineFlag(fs)
+	dir := fs.String("dir", ".", "directory the torrents are written to")
+	storageKind := storageFlag(fs)
+	var files fileRules
+	fs.Var(&files, "file", "download only matching files, as [skip:|normal:|high:]glob (repeatable)")
+	metricsAddr := metricsFlag(fs)
+	traceSpec := traceFlag(fs)
+	ef := engineFlags{}
+	var bw bandwidthFlags
+	var prefix, recordPath, progress *string
+	var hf hashFlags
+	var lf logFlags
+	ef.only(fs, engineNative, func() {
+		bw.register(fs)
+		prefix = peerIDFlag(fs)
+		recordPath = recordFlag(fs)
+		hf.register(fs)
+		lf.register(fs)
+		progress = fs.String("progress", "auto", "how to show progress: bar, json lines, quiet, or auto for bars on a terminal and json otherwise")
+	})
+	ef.share(fs, "down-rate", "up-rate", "max-unverified-bytes")
+	var af anacrolixFlags
+	ef.only(fs, engineAnacrolix, func() {
+		af.registerSwarm(fs)
+		af.register(fs)
+	})
+	err := parseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	err = ef.check(fs, *eng)
+	if err != nil {
+		return usageError(fs, err)
+	}
+	if *eng == engineAnacrolix {
+		af.dir = *dir
+		af.storage = *storageKind
+		af.files = files
+		af.metrics = *metricsAddr
+		af.downRate, af.upRate = int64(bw.down), int64(bw.up)
+		af.maxUnverifiedBytes = hf.maxUnverified
+		af.torrents = fs.Args()
+		return runAnacrolix(*traceSpec, af)
+	}
+	if fs.NArg() != 1 || strings.HasPrefix(fs.Arg(0), "magnet:") {
+		return usageError(fs, errors.New("the native engine downloads a single .torrent file, use the session command or -engine=anacrolix for more or for magnets"))
+	}
+
+	backend, err := openStorage(*storageKind, *dir)
+	if err != nil {
+		return usageError(fs, err)
+	}
+	if backend != nil {
+		defer backend.Close()
+	}
+	err = lf.setup()
 	if err != nil {
-		return fmt.Errorf("creating tracing exporter: %w", err)
-	}
-	// Set up the tracer provider.
-	tracerProvider := trace.NewTracerProvider(trace.WithBatcher(tracingExporter))
-	// 关闭 tracerProvider
-	defer shutdownTracerProvider(ctx, tracerProvider)
-	// Set the global logger.
-	fmt.Println("Hello, world!")
-	otel.SetTracerProvider(tracerProvider)
-
-	main := bargle.Main{}
-	// stop the profiler
-	main.Defer(envpprof.Stop)
-	// stop the tracer provider
-	main.Defer(func() { shutdownTracerProvider(ctx, tracerProvider) })
-
-	debug := false
-	debugFlag := bargle.NewFlag(&debug)
-	debugFlag.AddLong("debug")
-	main.Options = append(main.Options, debugFlag.Make())
-	main.Positionals = append(main.Positionals, bargle.Subcommand{Name: "download", Command: func() bargle.Command {
-		dlc := DownloadCmd{}
-		cmd := bargle.FromStruct(&dlc)
-		cmd.DefaultAction = func() error {
-			return downloadErr(downloadFlags{Debug: debug, DownloadCmd: dlc})
+		return err
+	}
+	mode, err := tui.ParseMode(*progress)
+	if err != nil {
+		return err
+	}
+	tf, err := torrentfile.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	tf.Storage = backend
+	err = tf.SelectFiles(files)
+	if err != nil {
+		return err
+	}
+	tf.PeerID, err = peerid.New(*prefix)
+	if err != nil {
+		return err
+	}
+	if *metricsAddr != "" {
+		defer serveMetrics(*metricsAddr)()
+	}
+	stopTracing, err := startTracing(*traceSpec)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	rec, stopRecording, err := startRecording(*recordPath)
+	if err != nil {
+		return err
+	}
+	defer stopRecording()
+	bw.start(context.Background())
+	tf.Bandwidth = bw.forTorrent()
+	tf.Recorder = rec
+	tf.Hasher = hf.hasher()
+	defer tf.Hasher.Close()
+	torrent, err := tf.StartDownload()
+	if err != nil {
+		return err
+	}
+	defer torrent.Close()
+	stop := watchProgress(mode, tf, torrent)
+	err = torrent.Wait()
+	stop()
+	if err != nil || tf.StoredInPlace() {
+		return err
+	}
+	return tf.WriteFiles(torrent, filepath.Join(*dir, tf.Name))
+}
+
+// seedCmd seeds torrents already downloaded into -dir, fetching the pieces missing or corrupt there
+func seedCmd(args []string) error {
+	fs := newFlagSet("seed", "[flags] <torrent>...")
+	eng := engineFlag(fs)
+	ef := engineFlags{}
+	var sf sessionFlags
+	ef.only(fs, engineNative, func() { sf.register(fs) })
+	ef.share(fs, "dir", "storage", "listen", "dht", "utp", "portmap", "down-rate", "up-rate", "max-unverified-bytes", "metrics", "trace")
+	var af anacrolixFlags
+	ef.only(fs, engineAnacrolix, func() { af.register(fs) })
+	err := parseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	err = ef.check(fs, *eng)
+	if err != nil {
+		return usageError(fs, err)
+	}
+	for _, arg := range fs.Args() {
+		if strings.HasPrefix(arg, "magnet:") {
+			return usageError(fs, errors.New("seeding needs the .torrent file, not a magnet link"))
 		}
-		return cmd
-	}()})
-	main.Run()
+	}
+	if *eng == engineAnacrolix {
+		af.dir = sf.dir
+		af.storage = sf.storage
+		af.listen, af.dht, af.utp, af.portmap = sf.listen, sf.dht, sf.utp, sf.portmap
+		af.metrics = sf.metrics
+		af.downRate, af.upRate = int64(sf.bw.down), int64(sf.bw.up)
+		af.maxUnverifiedBytes = sf.hash.maxUnverified
+		af.seed = true
+		af.torrents = fs.Args()
+		return runAnacrolix(sf.trace, af)
+	}
 
+	err = sf.log.setup()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopTracing, err := startTracing(sf.trace)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	stopRecording, err := sf.startRecording()
+	if err != nil {
+		return err
+	}
+	defer stopRecording()
+	s, err := sf.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if sf.metrics != "" {
+		defer serveMetrics(sf.metrics)()
+	}
+	for _, path := range fs.Args() {
+		tf, err := torrentfile.Open(path)
+		if err != nil {
+			return err
+		}
+		// the pieces found intact are seeded right away, the others downloaded first
+		data := tf.OpenData(filepath.Join(sf.dir, tf.Name))
+		defer data.Close()
+		tf.Data = data
+		_, err = s.Add(tf)
+		if err != nil {
+			return fmt.Errorf("adding %s: %w", path, err)
+		}
+	}
+	<-ctx.Done()
 	return nil
 }
 
-// Shutdown the tracer provider.
-func shutdownTracerProvider(ctx context.Context, tp *trace.TracerProvider) {
-	started := time.Now()
-	err := tp.Shutdown(ctx)
-	elapsed := time.Since(started)
-	log.Levelf(log.Error, "shutting down tracer provider (took %v): %v", elapsed, err)
+// anacrolixFlags configure the anacrolix engine, some of them filled from the flags both engines take
+type anacrolixFlags struct {
+	dir      string
+	storage  string
+	listen   string
+	dht      bool
+	utp      bool
+	portmap  bool
+	downRate int64
+	upRate   int64
+	// maxUnverifiedBytes is 0 for the engine's default
+	maxUnverifiedBytes rateFlag
+	metrics            string
+	files              []torrentfile.FileRule
+	torrents           []string
+	seed               bool
+	serve              string
+
+	tcp                  bool
+	pex                  bool
+	webtorrent           bool
+	webseeds             bool
+	ipv4                 bool
+	ipv6                 bool
+	publicIP             net.IP
+	blocklist            string
+	requireFastExtension bool
+	saveMetainfos        bool
+	linearDiscard        bool
+	peers                []string
+	stats                bool
+	debug                bool
+	quiet                bool
 }
 
-type DownloadCmd struct {
-	SaveMetainfos      bool
-	Mmap               bool           `help:"memory-map torrent data"`
-	Seed               bool           `help:"seed after download is complete"`
-	Addr               string         `help:"network listen addr"`
-	MaxUnverifiedBytes *tagflag.Bytes `help:"maximum number bytes to have pending verification"`
-	UploadRate         *tagflag.Bytes `help:"max piece bytes to send per second"`
-	DownloadRate       *tagflag.Bytes `help:"max bytes per second down from peers"`
-	PackedBlocklist    string
-	PublicIP           net.IP
-	Progress           bool `default:"true"`
-	PieceStates        bool `help:"Output piece state runs at progress intervals."`
-	Quiet              bool `help:"discard client logging"`
-	Stats              bool `help:"print stats at termination"`
-	Dht                bool `default:"true"`
-	PortForward        bool `default:"true"`
-
-	TcpPeers        bool `default:"true"`
-	UtpPeers        bool `default:"true"`
-	Webtorrent      bool `default:"true"`
-	DisableWebseeds bool
-	// Don't progress past handshake for peer connections where the peer doesn't offer the fast
-	// extension.
-	RequireFastExtension bool
-
-	Ipv4 bool `default:"true"`
-	Ipv6 bool `default:"true"`
-	Pex  bool `default:"true"`
-
-	LinearDiscard bool     `help:"Read and discard selected regions from start to finish. Useful for testing simultaneous Reader and static file prioritization."`
-	TestPeer      []string `help:"addresses of some starting peers"`
-
-	File    []string
-	Torrent []string `arity:"+" help:"torrent file path or magnet uri" arg:"positional"`
+// registerSwarm registers the flags joining swarms that the native engine only takes in sessions
+func (f *anacrolixFlags) registerSwarm(fs *flag.FlagSet) {
+	fs.StringVar(&f.listen, "listen", "", "address accepting peer connections, the engine's default when empty")
+	fs.BoolVar(&f.dht, "dht", true, "find peers on the DHT as well as the trackers")
+	fs.BoolVar(&f.utp, "utp", true, "also connect to peers over uTP")
+	fs.BoolVar(&f.portmap, "portmap", true, "forward the listen port on the router with UPnP or NAT-PMP")
 }
 
-type downloadFlags struct {
-	Debug bool
-	DownloadCmd
+func (f *anacrolixFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.tcp, "tcp", true, "connect to peers over TCP")
+	fs.BoolVar(&f.pex, "pex", true, "exchange peers with the connected peers")
+	fs.BoolVar(&f.webtorrent, "webtorrent", true, "connect to WebTorrent peers over WebRTC")
+	fs.BoolVar(&f.webseeds, "webseeds", true, "download from the web seeds of the torrents")
+	fs.BoolVar(&f.ipv4, "ipv4", true, "connect to peers over IPv4")
+	fs.BoolVar(&f.ipv6, "ipv6", true, "connect to peers over IPv6")
+	fs.Func("public-ip", "our public IP address, told to peers", func(s string) error {
+		f.publicIP = net.ParseIP(s)
+		if f.publicIP == nil {
+			return fmt.Errorf("invalid IP address %q", s)
+		}
+		return nil
+	})
+	fs.StringVar(&f.blocklist, "blocklist", "", "packed IP blocklist file of peers never to connect to")
+	fs.BoolVar(&f.requireFastExtension, "require-fast-extension", false, "drop peers not offering the fast extension after the handshake")
+	fs.BoolVar(&f.saveMetainfos, "save-metainfos", false, "write the metainfo of each torrent to <infohash>.torrent once known")
+	fs.BoolVar(&f.linearDiscard, "linear-discard", false, "read the selected data from start to end and discard it, to test readers along with file priorities")
+	fs.Func("peer", "address of a peer to start with (repeatable)", func(s string) error {
+		f.peers = append(f.peers, s)
+		return nil
+	})
+	fs.BoolVar(&f.stats, "stats", false, "print the client's stats at exit")
+	fs.BoolVar(&f.debug, "debug", false, "log the client's debug messages")
+	fs.BoolVar(&f.quiet, "quiet", false, "discard the client's log")
 }
 
-func downloadErr(flags downloadFlags) error {
-	fmt.Println("Downloading...")
+// runAnacrolix runs the anacrolix engine with the trace spans of spec exported
+func runAnacrolix(spec string, flags anacrolixFlags) error {
+	// tracing is off unless asked for, the OTLP exporter needing a collector to talk to
+	stopTracing, err := startTracing(spec)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	return downloadErr(flags)
+}
+
+func downloadErr(flags anacrolixFlags) error {
 	cliConfig := torrent.NewDefaultClientConfig()
-	cliConfig.DisableWebseeds = flags.DisableWebseeds
-	cliConfig.DisableTCP = !flags.TcpPeers
-	cliConfig.DisableUTP = !flags.UtpPeers
-	cliConfig.DisableIPv4 = !flags.Ipv4
-	cliConfig.DisableIPv6 = !flags.Ipv6
+	cliConfig.DataDir = flags.dir
+	switch flags.storage {
+	case "", "file":
+	case "mmap":
+		cliConfig.DefaultStorage = astorage.NewMMap(flags.dir)
+	default:
+		return fmt.Errorf("-storage=%s needs -engine=native, the anacrolix engine taking file or mmap", flags.storage)
+	}
+	cliConfig.DisableWebseeds = !flags.webseeds
+	cliConfig.DisableTCP = !flags.tcp
+	cliConfig.DisableUTP = !flags.utp
+	cliConfig.DisableIPv4 = !flags.ipv4
+	cliConfig.DisableIPv6 = !flags.ipv6
 	cliConfig.DisableAcceptRateLimiting = true
-	cliConfig.NoDHT = !flags.Dht
-	cliConfig.Debug = flags.Debug
-	cliConfig.Seed = flags.Seed
-	cliConfig.PublicIp4 = flags.PublicIP.To4()
-	cliConfig.PublicIp6 = flags.PublicIP
-	cliConfig.DisablePEX = !flags.Pex
-	cliConfig.DisableWebtorrent = !flags.PortForward
-	cliConfig.NoDefaultPortForwarding = !flags.PortForward
+	cliConfig.NoDHT = !flags.dht
+	cliConfig.Debug = flags.debug
+	cliConfig.Seed = flags.seed
+	cliConfig.PublicIp4 = flags.publicIP.To4()
+	cliConfig.PublicIp6 = flags.publicIP
+	cliConfig.DisablePEX = !flags.pex
+	cliConfig.DisableWebtorrent = !flags.webtorrent
+	cliConfig.NoDefaultPortForwarding = !flags.portmap
 
 	//
-	if flags.PackedBlocklist != "" {
-		blocklist, err := iplist.MMapPackedFile(flags.PackedBlocklist)
+	if flags.blocklist != "" {
+		blocklist, err := iplist.MMapPackedFile(flags.blocklist)
 		if err != nil {
 			return fmt.Errorf("loading packed blocklist: %v", err)
 		}
@@ -149,38 +339,38 @@ func downloadErr(flags downloadFlags) error {
 	}
 
 	// 设置监听地址
-	if flags.Addr != "" {
-		cliConfig.SetListenAddr(flags.Addr)
+	if flags.listen != "" {
+		cliConfig.SetListenAddr(flags.listen)
 	}
 
 	// 设置上传速率限制
-	if flags.UploadRate != nil {
+	if flags.upRate != 0 {
 		// 256KB/s is the default upload rate limit.
-		cliConfig.UploadRateLimiter = rate.NewLimiter(rate.Limit(*flags.UploadRate), 256<<10)
+		cliConfig.UploadRateLimiter = rate.NewLimiter(rate.Limit(flags.upRate), 256<<10)
 	}
 
 	// 设置下载速率限制
-	if flags.DownloadRate != nil {
-		cliConfig.DownloadRateLimiter = rate.NewLimiter(rate.Limit(*flags.DownloadRate), 1<<16)
+	if flags.downRate != 0 {
+		cliConfig.DownloadRateLimiter = rate.NewLimiter(rate.Limit(flags.downRate), 1<<16)
 	}
 
 	// set up the logger
 	{
 		logger := log.Default.WithNames("main", "client")
-		if flags.Quiet {
+		if flags.quiet {
 			logger = logger.WithFilterLevel(log.Critical)
 		}
 		cliConfig.Logger = logger
 	}
 
 	// 是否开启扩展功能
-	if flags.RequireFastExtension {
+	if flags.requireFastExtension {
 		cliConfig.MinPeerExtensions.SetBit(pp.ExtensionBitFast, true)
 	}
 
 	// 设置最大未验证的字节数
-	if flags.MaxUnverifiedBytes != nil {
-		cliConfig.MaxUnverifiedBytes = flags.MaxUnverifiedBytes.Int64()
+	if flags.maxUnverifiedBytes != 0 {
+		cliConfig.MaxUnverifiedBytes = int64(flags.maxUnverifiedBytes)
 	}
 
 	// 程序接收到中段或终止信号
@@ -193,14 +383,30 @@ func downloadErr(flags downloadFlags) error {
 		return fmt.Errorf("creating client: %w", err)
 	}
 
-	// 开启http服务
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		client.WriteStatus(w)
-	})
+	// 开启http服务：状态页、文件内容（支持 Range）和 JSON 接口
+	var srv *httpserve.Server
+	if flags.serve != "" {
+		srv = httpserve.New()
+		srv.Status = client.WriteStatus
+		httpServer := &http.Server{Addr: flags.serve, Handler: srv}
+		go func() {
+			err := httpServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Levelf(log.Error, "http server: %v", err)
+			}
+		}()
+		defer httpServer.Close()
+		log.Printf("serving on http://%s/", flags.serve)
+	}
+
+	if flags.metrics != "" {
+		registerClientMetrics(client)
+		defer serveMetrics(flags.metrics)()
+	}
 
 	wg := sync.WaitGroup{}
 	fataErr := make(chan error, 1)
-	err = addTorrents(ctx, client, flags, &wg, func(err error) {
+	err = addTorrents(ctx, client, flags, srv, &wg, func(err error) {
 		select {
 		case fataErr <- err:
 		default:
@@ -225,8 +431,8 @@ func downloadErr(flags downloadFlags) error {
 
 	select {
 	case <-wgWaited:
-		if ctx.Err() != nil {
-			log.Print("downloaded All the torrents")
+		if ctx.Err() == nil {
+			log.Print("downloaded all the torrents")
 		} else {
 			err = ctx.Err()
 		}
@@ -234,9 +440,13 @@ func downloadErr(flags downloadFlags) error {
 	}
 
 	clientConnStats := client.ConnStats()
-	log.Printf("average download rate %s/s", humanize.Bytes(uint64(float64(clientConnStats.BytesReadUsefulData.Int64()/int64(time.Since(started).Seconds())))))
+	log.Printf("average download rate %s/s", humanize.Bytes(uint64(float64(clientConnStats.BytesReadUsefulData.Int64())/time.Since(started).Seconds())))
 
-	if flags.Seed {
+	if flags.serve != "" && !flags.seed {
+		<-ctx.Done()
+	}
+
+	if flags.seed {
 		if len(client.Torrents()) == 0 {
 			log.Print("no torrent to seed")
 		} else {
@@ -246,8 +456,10 @@ func downloadErr(flags downloadFlags) error {
 
 	}
 
-	fmt.Printf("chunks received :%v\n", &torrent.ChunksReceived)
-	spew.Dump(client.ConnStats())
+	if flags.stats {
+		fmt.Printf("chunks received :%v\n", &torrent.ChunksReceived)
+		spew.Dump(client.ConnStats())
+	}
 	clStats := client.ConnStats()
 	sentOverhead := clStats.BytesWritten.Int64() - clStats.BytesReadUsefulData.Int64()
 	log.Printf(" client read %v , %.1f%% was useful data . sent %v non-data bytes ",
@@ -258,11 +470,11 @@ func downloadErr(flags downloadFlags) error {
 	return err
 }
 
-func addTorrents(ctx context.Context, cli *torrent.Client, flags downloadFlags, wg *sync.WaitGroup, fataErr func(err error)) error {
+func addTorrents(ctx context.Context, cli *torrent.Client, flags anacrolixFlags, srv *httpserve.Server, wg *sync.WaitGroup, fataErr func(err error)) error {
 	// 装载节点信息
-	testPeers := resolveTestPeers(flags.TestPeer)
+	testPeers := resolveTestPeers(flags.peers)
 	// 遍历 args
-	for _, arg := range flags.Torrent {
+	for _, arg := range flags.torrents {
 		t, err := func() (*torrent.Torrent, error) {
 			if strings.HasPrefix(arg, "magnet:") {
 				t, err := cli.AddMagnet(arg)
@@ -292,6 +504,9 @@ func addTorrents(ctx context.Context, cli *torrent.Client, flags downloadFlags,
 			fataErr(err)
 		})
 		t.AddPeers(testPeers)
+		if srv != nil {
+			srv.Add(httpserve.Anacrolix(t))
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -301,7 +516,7 @@ func addTorrents(ctx context.Context, cli *torrent.Client, flags downloadFlags,
 			case <-t.GotInfo():
 			}
 			// 种子下载完成后，将种子文件保存到本地
-			if flags.SaveMetainfos {
+			if flags.saveMetainfos {
 				path := fmt.Sprintf("%v.torrent", t.InfoHash().HexString())
 				// 将给定元信息对象写入到文件中
 				err := writeMetainfoToFile(t.Metainfo(), path)
@@ -311,7 +526,7 @@ func addTorrents(ctx context.Context, cli *torrent.Client, flags downloadFlags,
 					log.Printf("error writing %q: %s", path, err)
 				}
 			}
-			if len(flags.File) == 0 {
+			if len(flags.files) == 0 {
 				t.DownloadAll()
 				wg.Add(1)
 				go func() {
@@ -322,7 +537,7 @@ func addTorrents(ctx context.Context, cli *torrent.Client, flags downloadFlags,
 				done := make(chan struct{})
 				go func() {
 					defer close(done)
-					if flags.LinearDiscard {
+					if flags.linearDiscard {
 						r := t.NewReader()
 						io.Copy(io.Discard, r)
 						r.Close()
@@ -333,20 +548,49 @@ func addTorrents(ctx context.Context, cli *torrent.Client, flags downloadFlags,
 				case <-ctx.Done():
 				}
 			} else {
-				// for _, f := range t.Files() {
-
-				// }
+				// 按规则设置每个文件的优先级，只下载被选中的文件
+				for _, f := range t.Files() {
+					prio := filePiecePriority(torrentfile.RulePriority(flags.files, f.DisplayPath()))
+					f.SetPriority(prio)
+					if prio == torrent.PiecePriorityNone {
+						continue
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						waitForPieces(ctx, t, f.BeginPieceIndex(), f.EndPieceIndex())
+					}()
+					if flags.linearDiscard {
+						r := f.NewReader()
+						go func() {
+							defer r.Close()
+							io.Copy(io.Discard, r)
+						}()
+					}
+				}
 			}
 		}()
 	}
 	return nil
 }
 
+// 将文件选择规则的优先级转换为 anacrolix 的块优先级
+func filePiecePriority(prio p2p.Priority) torrent.PiecePriority {
+	switch prio {
+	case p2p.PriorityHigh:
+		return torrent.PiecePriorityHigh
+	case p2p.PriorityNormal:
+		return torrent.PiecePriorityNormal
+	default:
+		return torrent.PiecePriorityNone
+	}
+}
+
 // 监控特定范围内torrent数据的下载进度， 在后台持续检查块的状态，直到所有目前块的下载都达到要求的完成状态
 func waitForPieces(ctx context.Context, t *torrent.Torrent, beginIndex, endIndex int) {
 	sub := t.SubscribePieceStateChanges()
 	defer sub.Close()
-	expected := storage.Completion{
+	expected := astorage.Completion{
 		Complete: true,
 		Ok:       true,
 	}
@@ -398,9 +642,58 @@ func resolveTestPeers(addrs []string) (ret []torrent.PeerInfo) {
 	return
 }
 
+// registerClientMetrics exports the connection stats of the anacrolix client and the peers of its torrents
+func registerClientMetrics(cl *torrent.Client) {
+	metrics.NewCounterFunc("anacrolix_transferred_bytes_total",
+		"Bytes exchanged with peers by the anacrolix engine, split into piece data and protocol overhead.",
+		[]string{"direction", "kind"}, func(emit func(float64, ...string)) {
+			st := cl.ConnStats()
+			emit(float64(st.BytesReadUsefulData.Int64()), "down", "data")
+			emit(float64(st.BytesRead.Int64()-st.BytesReadUsefulData.Int64()), "down", "overhead")
+			emit(float64(st.BytesWrittenData.Int64()), "up", "data")
+			emit(float64(st.BytesWritten.Int64()-st.BytesWrittenData.Int64()), "up", "overhead")
+		})
+	metrics.NewCounterFunc("anacrolix_pieces_total",
+		"Pieces written by the anacrolix engine, by hash check result.",
+		[]string{"result"}, func(emit func(float64, ...string)) {
+			st := cl.ConnStats()
+			emit(float64(st.PiecesDirtiedGood.Int64()), "verified")
+			emit(float64(st.PiecesDirtiedBad.Int64()), "failed")
+		})
+	metrics.NewCounterFunc("anacrolix_chunks_read_total",
+		"Blocks received by the anacrolix engine, useful or wasted on pieces already had.",
+		[]string{"kind"}, func(emit func(float64, ...string)) {
+			st := cl.ConnStats()
+			emit(float64(st.ChunksReadUseful.Int64()), "useful")
+			emit(float64(st.ChunksReadWasted.Int64()), "wasted")
+		})
+	metrics.NewGaugeFunc("anacrolix_peers",
+		"Peers of the anacrolix engine's torrents by state.",
+		[]string{"state"}, func(emit func(float64, ...string)) {
+			var total, pending, active, seeders, halfOpen int
+			for _, t := range cl.Torrents() {
+				st := t.Stats()
+				total += st.TotalPeers
+				pending += st.PendingPeers
+				active += st.ActivePeers
+				seeders += st.ConnectedSeeders
+				halfOpen += st.HalfOpenPeers
+			}
+			emit(float64(total), "known")
+			emit(float64(pending), "pending")
+			emit(float64(halfOpen), "half_open")
+			emit(float64(active), "connected")
+			emit(float64(seeders), "seeders")
+		})
+	metrics.NewGaugeFunc("anacrolix_torrents", "Torrents of the anacrolix client.",
+		nil, func(emit func(float64, ...string)) {
+			emit(float64(len(cl.Torrents())))
+		})
+}
+
 // 根据用户的配置选项输出 torrent 客户端的统计信息和状态报告
-func optputStats(cl *torrent.Client, args downloadFlags) {
-	if !args.Stats {
+func optputStats(cl *torrent.Client, args anacrolixFlags) {
+	if !args.stats {
 		return
 	}
 
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// engine is the BitTorrent implementation a command runs on
+type engine string
+
+const (
+	engineNative    engine = "native"
+	engineAnacrolix engine = "anacrolix"
+)
+
+func (e *engine) String() string {
+	return string(*e)
+}
+
+func (e *engine) Set(s string) error {
+	switch engine(s) {
+	case engineNative, engineAnacrolix:
+		*e = engine(s)
+		return nil
+	}
+	return fmt.Errorf("unknown engine %q, want native or anacrolix", s)
+}
+
+// engineFlag registers the -engine flag, native by default
+func engineFlag(fs *flag.FlagSet) *engine {
+	e := engineNative
+	fs.Var(&e, "engine", "engine running the command: native or anacrolix")
+	return &e
+}
+
+// engineFlags remembers the flags only one engine takes, to mark them in the help and reject them on the other
+type engineFlags map[string]engine
+
+// only registers flags taken by e alone
+func (m engineFlags) only(fs *flag.FlagSet, e engine, register func()) {
+	before := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) { before[f.Name] = true })
+	register()
+	fs.VisitAll(func(f *flag.Flag) {
+		if !before[f.Name] {
+			m[f.Name] = e
+			f.Usage += m.suffix(e)
+		}
+	})
+}
+
+// share lets both engines take flags registered by only
+func (m engineFlags) share(fs *flag.FlagSet, names ...string) {
+	for _, name := range names {
+		f := fs.Lookup(name)
+		f.Usage = strings.TrimSuffix(f.Usage, m.suffix(m[name]))
+		delete(m, name)
+	}
+}
+
+func (m engineFlags) suffix(e engine) string {
+	return " (" + string(e) + " engine)"
+}
+
+// check fails on the first flag set on the command line that the engine does not take
+func (m engineFlags) check(fs *flag.FlagSet, e engine) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if want, ok := m[f.Name]; ok && want != e && err == nil {
+			err = fmt.Errorf("-%s needs -engine=%s", f.Name, want)
+		}
+	})
+	return err
+}
@@ -8,10 +8,24 @@ import (
 // Handshake is the initial message sent by a client to initiate a connection.
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// extensionBit is the reserved bit advertising the extension protocol (BEP 10)
+const extensionBit = 0x10
+
+// EnableExtensions advertises support for the extension protocol.
+func (h *Handshake) EnableExtensions() {
+	h.Reserved[5] |= extensionBit
+}
+
+// SupportsExtensions reports whether the peer speaks the extension protocol.
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&extensionBit != 0
+}
+
 func New(infoHash, peerID [20]byte) *Handshake {
 	return &Handshake{
 		Pstr:     "BitTorrent protocol",
@@ -27,6 +41,7 @@ func (h *Handshake) Serialize() []byte {
 	buf := make([]byte, bufLen)
 	buf[0] = byte(pstrlen) // pstrlen
 	copy(buf[1:], h.Pstr)  // pstr
+	copy(buf[1+pstrlen:], h.Reserved[:])
 	copy(buf[1+pstrlen+8:], h.InfoHash[:])
 	copy(buf[1+pstrlen+8+20:], h.PeerID[:])
 	return buf
@@ -53,12 +68,15 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
+	copy(reserved[:], handshakeBuf[pstrLen:pstrLen+8])
 	copy(infoHash[:], handshakeBuf[pstrLen+8:pstrLen+8+20])
 	copy(peerID[:], handshakeBuf[pstrLen+8+20:])
 
 	h := &Handshake{
 		Pstr:     string(handshakeBuf[:pstrLen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
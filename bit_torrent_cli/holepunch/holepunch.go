@@ -0,0 +1,103 @@
+package holepunch
+
+import (
+	"bit_torrent_cli/peers"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ExtensionName is the name of the extension in the extension handshake (BEP 55)
+const ExtensionName = "ut_holepunch"
+
+type msgType uint8
+
+const (
+	// Rendezvous asks the relaying peer to connect us with the target
+	Rendezvous msgType = iota
+	// Connect tells both ends to connect to each other at once
+	Connect
+	// Error tells the initiator why the relaying peer could not help
+	Error
+)
+
+type ErrCode uint32
+
+const (
+	NoError ErrCode = iota
+	// NoSuchPeer means the target endpoint is invalid
+	NoSuchPeer
+	// NotConnected means the relaying peer is not connected to the target
+	NotConnected
+	// NoSupport means the target does not support holepunching
+	NoSupport
+	// NoSelf means the target is the initiator
+	NoSelf
+)
+
+func (e ErrCode) String() string {
+	switch e {
+	case NoError:
+		return "no error"
+	case NoSuchPeer:
+		return "no such peer"
+	case NotConnected:
+		return "not connected"
+	case NoSupport:
+		return "no support"
+	case NoSelf:
+		return "no self"
+	}
+	return fmt.Sprintf("error %d", uint32(e))
+}
+
+const (
+	addrIPv4 = 0
+	addrIPv6 = 1
+)
+
+// Msg is a ut_holepunch message
+type Msg struct {
+	Type msgType
+	Addr peers.Peer
+	Err  ErrCode
+}
+
+func (m Msg) Marshal() []byte {
+	buf := []byte{byte(m.Type), addrIPv4}
+	if ip4 := m.Addr.IP.To4(); ip4 != nil {
+		buf = append(buf, ip4...)
+	} else {
+		buf[1] = addrIPv6
+		buf = append(buf, m.Addr.IP.To16()...)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, m.Addr.Port)
+	return binary.BigEndian.AppendUint32(buf, uint32(m.Err))
+}
+
+func Parse(buf []byte) (Msg, error) {
+	var m Msg
+	if len(buf) < 2 {
+		return m, fmt.Errorf("holepunch message of %d bytes", len(buf))
+	}
+	m.Type = msgType(buf[0])
+	if m.Type > Error {
+		return m, fmt.Errorf("unknown holepunch message type %d", m.Type)
+	}
+	ipLen := net.IPv4len
+	switch buf[1] {
+	case addrIPv4:
+	case addrIPv6:
+		ipLen = net.IPv6len
+	default:
+		return m, fmt.Errorf("unknown holepunch address type %d", buf[1])
+	}
+	buf = buf[2:]
+	if len(buf) != ipLen+6 {
+		return m, fmt.Errorf("holepunch message with %d bytes of address", len(buf))
+	}
+	m.Addr.IP = append(net.IP(nil), buf[:ipLen]...)
+	m.Addr.Port = binary.BigEndian.Uint16(buf[ipLen:])
+	m.Err = ErrCode(binary.BigEndian.Uint32(buf[ipLen+2:]))
+	return m, nil
+}
@@ -0,0 +1,51 @@
+package holepunch
+
+import (
+	"bit_torrent_cli/peers"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := map[string]struct {
+		input  Msg
+		output []byte
+	}{
+		"rendezvous ipv4": {
+			input:  Msg{Type: Rendezvous, Addr: peers.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}},
+			output: []byte{0, 0, 10, 0, 0, 1, 0x1a, 0xe1, 0, 0, 0, 0},
+		},
+		"error ipv6": {
+			input: Msg{Type: Error, Addr: peers.Peer{IP: net.ParseIP("fd00::1"), Port: 1}, Err: NotConnected},
+			output: []byte{2, 1, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0, 1, 0, 0, 0, 2},
+		},
+	}
+	for name, test := range tests {
+		buf := test.input.Marshal()
+		assert.Equal(t, test.output, buf, name)
+		m, err := Parse(buf)
+		require.Nil(t, err, name)
+		assert.True(t, test.input.Addr.IP.Equal(m.Addr.IP), name)
+		assert.Equal(t, test.input.Addr.Port, m.Addr.Port, name)
+		assert.Equal(t, test.input.Type, m.Type, name)
+		assert.Equal(t, test.input.Err, m.Err, name)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string][]byte{
+		"too short":         {0},
+		"unknown type":      {3, 0, 10, 0, 0, 1, 0, 1, 0, 0, 0, 0},
+		"unknown addr type": {1, 2, 10, 0, 0, 1, 0, 1, 0, 0, 0, 0},
+		"truncated":         {1, 0, 10, 0, 0, 1, 0, 1},
+		"ipv6 too short":    {1, 1, 10, 0, 0, 1, 0, 1, 0, 0, 0, 0},
+	}
+	for name, buf := range tests {
+		_, err := Parse(buf)
+		assert.NotNil(t, err, name)
+	}
+}
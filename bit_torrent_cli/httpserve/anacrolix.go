@@ -0,0 +1,55 @@
+package httpserve
+
+import (
+	"io"
+
+	"github.com/anacrolix/torrent"
+)
+
+type anacrolixTorrent struct {
+	t *torrent.Torrent
+}
+
+// Anacrolix adapts an anacrolix torrent for the server. Files are listed once its info is known.
+func Anacrolix(t *torrent.Torrent) Torrent {
+	return anacrolixTorrent{t: t}
+}
+
+func (a anacrolixTorrent) InfoHash() string {
+	return a.t.InfoHash().HexString()
+}
+
+func (a anacrolixTorrent) Name() string {
+	return a.t.Name()
+}
+
+func (a anacrolixTorrent) Files() []File {
+	if a.t.Info() == nil {
+		return nil
+	}
+	var files []File
+	for _, f := range a.t.Files() {
+		files = append(files, File{Path: f.DisplayPath(), Length: f.Length(), Completed: f.BytesCompleted()})
+	}
+	return files
+}
+
+func (a anacrolixTorrent) Stats() Stats {
+	if a.t.Info() == nil {
+		return Stats{}
+	}
+	st := a.t.Stats()
+	return Stats{
+		Length:     a.t.Length(),
+		Completed:  a.t.BytesCompleted(),
+		Pieces:     a.t.NumPieces(),
+		PiecesDone: st.PiecesComplete,
+		Peers:      st.ActivePeers,
+	}
+}
+
+func (a anacrolixTorrent) NewFileReader(index int) io.ReadSeekCloser {
+	r := a.t.Files()[index].NewReader()
+	r.SetResponsive()
+	return r
+}
@@ -0,0 +1,240 @@
+package httpserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Torrent is what the server needs from a torrent of either engine
+type Torrent interface {
+	InfoHash() string
+	Name() string
+	Files() []File
+	Stats() Stats
+	// NewFileReader returns a reader that prioritizes the pieces around its read position
+	NewFileReader(index int) io.ReadSeekCloser
+}
+
+// File is one file of a torrent as listed by the server
+type File struct {
+	Path      string `json:"path"`
+	Length    int64  `json:"length"`
+	Completed int64  `json:"completed"`
+}
+
+// Stats is the progress of a torrent as reported by the server
+type Stats struct {
+	Length     int64 `json:"length"`
+	Completed  int64 `json:"completed"`
+	Pieces     int   `json:"pieces"`
+	PiecesDone int   `json:"pieces_done"`
+	Peers      int   `json:"peers"`
+}
+
+// Server serves a status page, the torrents' files with Range support and JSON endpoints
+type Server struct {
+	// Status optionally writes engine specific status at the top of the status page
+	Status func(w io.Writer)
+
+	mu       sync.Mutex
+	torrents map[string]Torrent
+	mux      *http.ServeMux
+	started  time.Time
+}
+
+func New() *Server {
+	s := &Server{torrents: make(map[string]Torrent), mux: http.NewServeMux(), started: time.Now()}
+	s.mux.HandleFunc("GET /{$}", s.handleStatus)
+	s.mux.HandleFunc("GET /files/{infohash}/{path...}", s.handleFiles)
+	s.mux.HandleFunc("GET /api/torrents", s.handleTorrents)
+	s.mux.HandleFunc("GET /api/torrents/{infohash}", s.handleTorrent)
+	return s
+}
+
+// Add makes the torrent available on the server
+func (s *Server) Add(t Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[t.InfoHash()] = t
+}
+
+// Remove takes the torrent off the server
+func (s *Server) Remove(infoHash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) torrent(infoHash string) (Torrent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[strings.ToLower(infoHash)]
+	return t, ok
+}
+
+// sorted returns the torrents ordered by name
+func (s *Server) sorted() []Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts := make([]Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Name() < ts[j].Name() })
+	return ts
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if s.Status != nil {
+		s.Status(w)
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "uptime: %v\n", time.Since(s.started).Truncate(time.Second))
+	for _, t := range s.sorted() {
+		st := t.Stats()
+		percent := 0.0
+		if st.Length > 0 {
+			percent = float64(st.Completed) / float64(st.Length) * 100
+		}
+		fmt.Fprintf(w, "%s %s: %0.2f%% (%d/%d pieces, %d peers) /files/%s/\n",
+			t.InfoHash(), t.Name(), percent, st.PiecesDone, st.Pieces, st.Peers, t.InfoHash())
+	}
+}
+
+type torrentJSON struct {
+	InfoHash string `json:"infohash"`
+	Name     string `json:"name"`
+	Stats
+	Files []File `json:"files,omitempty"`
+}
+
+func torrentInfo(t Torrent, withFiles bool) torrentJSON {
+	info := torrentJSON{InfoHash: t.InfoHash(), Name: t.Name(), Stats: t.Stats()}
+	if withFiles {
+		info.Files = t.Files()
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	enc.Encode(v)
+}
+
+func (s *Server) handleTorrents(w http.ResponseWriter, r *http.Request) {
+	infos := []torrentJSON{}
+	for _, t := range s.sorted() {
+		infos = append(infos, torrentInfo(t, false))
+	}
+	writeJSON(w, infos)
+}
+
+func (s *Server) handleTorrent(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.torrent(r.PathValue("infohash"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, torrentInfo(t, true))
+}
+
+// handleFiles serves a file of the torrent, or lists the entries of a directory
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.torrent(r.PathValue("infohash"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	name := r.PathValue("path")
+	files := t.Files()
+	for i, f := range files {
+		if f.Path != name {
+			continue
+		}
+		reader := t.NewFileReader(i)
+		defer reader.Close()
+		http.ServeContent(w, r, path.Base(f.Path), time.Time{}, reader)
+		return
+	}
+
+	dir := strings.TrimSuffix(name, "/")
+	entries := listDir(files, dir)
+	if len(entries) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if dir != "" && !strings.HasSuffix(name, "/") {
+		http.Redirect(w, r, path.Base(dir)+"/", http.StatusMovedPermanently)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	listingTemplate.Execute(w, struct {
+		Title   string
+		Entries []dirEntry
+	}{path.Join(t.Name(), dir), entries})
+}
+
+type dirEntry struct {
+	Name   string
+	Dir    bool
+	Length int64
+}
+
+// listDir returns the files and subdirectories directly under dir
+func listDir(files []File, dir string) []dirEntry {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	seen := make(map[string]bool)
+	var entries []dirEntry
+	for _, f := range files {
+		if !strings.HasPrefix(f.Path, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(f.Path, prefix)
+		name, _, isDir := strings.Cut(rest, "/")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		entry := dirEntry{Name: name, Dir: isDir}
+		if !isDir {
+			entry.Length = f.Length
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Dir != entries[j].Dir {
+			return entries[i].Dir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<ul>
+{{range .Entries}}{{if .Dir}}<li><a href="./{{.Name}}/">{{.Name}}/</a></li>
+{{else}}<li><a href="./{{.Name}}">{{.Name}}</a> ({{.Length}} bytes)</li>
+{{end}}{{end}}</ul>
+</body></html>
+`))
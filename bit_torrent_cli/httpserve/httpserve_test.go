@@ -0,0 +1,95 @@
+package httpserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTorrent struct {
+	files []File
+	data  [][]byte
+}
+
+func (f *fakeTorrent) InfoHash() string { return "0123456789abcdef0123456789abcdef01234567" }
+func (f *fakeTorrent) Name() string     { return "dataset" }
+func (f *fakeTorrent) Files() []File    { return f.files }
+func (f *fakeTorrent) Stats() Stats {
+	return Stats{Length: 11, Completed: 11, Pieces: 1, PiecesDone: 1}
+}
+
+func (f *fakeTorrent) NewFileReader(index int) io.ReadSeekCloser {
+	return nopCloser{bytes.NewReader(f.data[index])}
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+func newTestServer() *Server {
+	s := New()
+	s.Add(&fakeTorrent{
+		files: []File{{Path: "logs/build.log", Length: 6}, {Path: "README", Length: 5}},
+		data:  [][]byte{[]byte("hello\n"), []byte("read!")},
+	})
+	return s
+}
+
+func get(s *Server, url string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeFileRange(t *testing.T) {
+	s := newTestServer()
+	w := get(s, "/files/0123456789abcdef0123456789abcdef01234567/logs/build.log", http.Header{"Range": {"bytes=1-3"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "ell", w.Body.String())
+
+	w = get(s, "/files/0123456789abcdef0123456789abcdef01234567/README", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "read!", w.Body.String())
+}
+
+func TestListing(t *testing.T) {
+	s := newTestServer()
+	w := get(s, "/files/0123456789abcdef0123456789abcdef01234567/", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `href="./logs/"`)
+	assert.Contains(t, w.Body.String(), `href="./README"`)
+
+	w = get(s, "/files/0123456789abcdef0123456789abcdef01234567/logs", nil)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+
+	w = get(s, "/files/0123456789abcdef0123456789abcdef01234567/missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestJSON(t *testing.T) {
+	s := newTestServer()
+	w := get(s, "/api/torrents/0123456789abcdef0123456789abcdef01234567", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var info torrentJSON
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, "dataset", info.Name)
+	assert.Len(t, info.Files, 2)
+	assert.Equal(t, int64(11), info.Length)
+
+	w = get(s, "/api/torrents", nil)
+	var infos []torrentJSON
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	assert.Len(t, infos, 1)
+}
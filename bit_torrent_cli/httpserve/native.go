@@ -0,0 +1,47 @@
+package httpserve
+
+import (
+	"bit_torrent_cli/p2p"
+	"encoding/hex"
+	"io"
+)
+
+type nativeTorrent struct {
+	t *p2p.Torrent
+}
+
+// Native adapts a started native torrent for the server
+func Native(t *p2p.Torrent) Torrent {
+	return nativeTorrent{t: t}
+}
+
+func (n nativeTorrent) InfoHash() string {
+	return hex.EncodeToString(n.t.InfoHash[:])
+}
+
+func (n nativeTorrent) Name() string {
+	return n.t.Name
+}
+
+func (n nativeTorrent) Files() []File {
+	files := make([]File, len(n.t.Files))
+	for i, f := range n.t.Files {
+		files[i] = File{Path: f.Path, Length: int64(f.Length), Completed: int64(n.t.BytesCompleted(f))}
+	}
+	return files
+}
+
+func (n nativeTorrent) Stats() Stats {
+	st := n.t.Stats()
+	return Stats{
+		Length:     int64(n.t.Length),
+		Completed:  int64(st.Completed),
+		Pieces:     st.Pieces,
+		PiecesDone: st.PiecesDone,
+		Peers:      st.Peers,
+	}
+}
+
+func (n nativeTorrent) NewFileReader(index int) io.ReadSeekCloser {
+	return n.t.NewFileReader(n.t.Files[index])
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bit_torrent_cli/torrentfile"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// infoCmd prints what a .torrent file holds, for people or as JSON
+func infoCmd(args []string) error {
+	fs := newFlagSet("info", "[flags] <torrent>")
+	asJSON := fs.Bool("json", false, "print the details as JSON, the format of the torrentfile golden files")
+	raw := fs.Bool("raw", false, "print the whole bencoded metainfo as JSON, strings that are not UTF-8 as {\"hex\": ...}")
+	err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *asJSON && *raw {
+		return usageError(fs, errors.New("-json and -raw print different things, pick one"))
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *raw {
+		v, err := torrentfile.Raw(data)
+		if err != nil {
+			return err
+		}
+		return printJSON(v)
+	}
+	d, err := torrentfile.Inspect(data)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(d)
+	}
+	printDetails(os.Stdout, d)
+	return nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printDetails(out io.Writer, d torrentfile.Details) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "name:\t%s\n", d.Name)
+	if d.InfohashV1 != "" {
+		fmt.Fprintf(w, "infohash v1:\t%s\n", d.InfohashV1)
+	}
+	if d.InfohashV2 != "" {
+		fmt.Fprintf(w, "infohash v2:\t%s\n", d.InfohashV2)
+	}
+	fmt.Fprintf(w, "size:\t%s (%d bytes)\n", humanize.IBytes(uint64(d.Length)), d.Length)
+	fmt.Fprintf(w, "pieces:\t%d of %s\n", d.Pieces, humanize.IBytes(uint64(d.PieceLength)))
+	fmt.Fprintf(w, "private:\t%t\n", d.Private)
+	if d.CreatedBy != "" {
+		fmt.Fprintf(w, "created by:\t%s\n", d.CreatedBy)
+	}
+	if d.CreationDate != nil {
+		fmt.Fprintf(w, "created:\t%s\n", d.CreationDate.Format(time.RFC3339))
+	}
+	if d.Comment != "" {
+		fmt.Fprintf(w, "comment:\t%s\n", d.Comment)
+	}
+	for i, tier := range d.Trackers {
+		fmt.Fprintf(w, "tracker tier %d:\t%s\n", i, strings.Join(tier, " "))
+	}
+	for _, u := range d.WebSeeds {
+		fmt.Fprintf(w, "web seed:\t%s\n", u)
+	}
+	w.Flush()
+
+	fmt.Fprintln(out, "files:")
+	printTree(out, d.Files)
+}
+
+// printTree prints the files indented under their directories, each directory once, sizes lined up
+func printTree(w io.Writer, files []torrentfile.FileDetails) {
+	type line struct {
+		text string
+		size string
+	}
+	var lines []line
+	var dirs []string
+	width := 0
+	for _, f := range files {
+		parts := strings.Split(f.Path, "/")
+		// the directories shared with the previous file are already printed
+		same := 0
+		for same < len(dirs) && same < len(parts)-1 && dirs[same] == parts[same] {
+			same++
+		}
+		dirs = dirs[:same]
+		for _, dir := range parts[same : len(parts)-1] {
+			lines = append(lines, line{text: strings.Repeat("  ", len(dirs)+1) + dir + "/"})
+			dirs = append(dirs, dir)
+		}
+		name := parts[len(parts)-1]
+		if f.Padding {
+			name += " (padding)"
+		}
+		l := line{strings.Repeat("  ", len(dirs)+1) + name, humanize.IBytes(uint64(f.Length))}
+		width = max(width, len(l.text))
+		lines = append(lines, l)
+	}
+	for _, l := range lines {
+		if l.size == "" {
+			fmt.Fprintln(w, l.text)
+			continue
+		}
+		fmt.Fprintf(w, "%-*s  %s\n", width, l.text, l.size)
+	}
+}
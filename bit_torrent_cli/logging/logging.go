@@ -0,0 +1,216 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// the keys of the attributes shared by every package, so the logs can be filtered on them
+const (
+	KeySubsystem = "subsystem"
+	KeyInfohash  = "infohash"
+	KeyPeer      = "peer"
+	KeyPiece     = "piece"
+	KeyErr       = "err"
+)
+
+// LevelUsage describes the spec taken by ParseLevels, for flag help
+const LevelUsage = "log level, optionally per subsystem: e.g. info or warn,p2p=debug,tracker=info (subsystems: p2p, client, tracker, session, lsd, portmap)"
+
+// Levels is the minimum level logged, by subsystem
+type Levels struct {
+	Default    slog.Level
+	Subsystems map[string]slog.Level
+}
+
+// ParseLevels parses a comma separated list of levels, a bare level setting the default
+// and subsystem=level the level of one subsystem
+func ParseLevels(spec string) (Levels, error) {
+	levels := Levels{Default: slog.LevelInfo}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, level, found := strings.Cut(part, "=")
+		if !found {
+			level, name = name, ""
+		}
+		var l slog.Level
+		err := l.UnmarshalText([]byte(level))
+		if err != nil {
+			return Levels{}, fmt.Errorf("invalid log level %q", part)
+		}
+		if name == "" {
+			levels.Default = l
+			continue
+		}
+		if levels.Subsystems == nil {
+			levels.Subsystems = make(map[string]slog.Level)
+		}
+		levels.Subsystems[name] = l
+	}
+	return levels, nil
+}
+
+// For returns the level of the subsystem
+func (l Levels) For(subsystem string) slog.Level {
+	level, ok := l.Subsystems[subsystem]
+	if !ok {
+		return l.Default
+	}
+	return level
+}
+
+// min is the lowest level logged by any subsystem
+func (l Levels) min() slog.Level {
+	m := l.Default
+	for _, level := range l.Subsystems {
+		m = min(m, level)
+	}
+	return m
+}
+
+// handler drops the records below the level of the subsystem the logger was made for
+type handler struct {
+	inner     slog.Handler
+	levels    Levels
+	subsystem string
+}
+
+// New creates a logger writing to w in the format, text or json, at the levels
+func New(w io.Writer, format string, levels Levels) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: levels.min()}
+	var inner slog.Handler
+	switch format {
+	case "", "text":
+		inner = slog.NewTextHandler(w, opts)
+	case "json":
+		inner = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, want text or json", format)
+	}
+	return slog.New(&handler{inner: inner, levels: levels}), nil
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.levels.For(h.subsystem)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if h.subsystem != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String(KeySubsystem, h.subsystem))
+	}
+	return h.inner.Handle(ctx, r)
+}
+
+// WithAttrs keeps the subsystem aside, a logger of a subsystem derived from another one being logged
+// with the subsystem of the last
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	subsystem := h.subsystem
+	kept := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		if a.Key == KeySubsystem {
+			subsystem = a.Value.String()
+			continue
+		}
+		kept = append(kept, a)
+	}
+	return &handler{inner: h.inner.WithAttrs(kept), levels: h.levels, subsystem: subsystem}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{inner: h.inner.WithGroup(name), levels: h.levels, subsystem: h.subsystem}
+}
+
+// For returns the logger of the subsystem derived from l, the default logger if nil
+func For(l *slog.Logger, subsystem string) *slog.Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return l.With(KeySubsystem, subsystem)
+}
+
+// Err is the attribute of an error, its message along with its class
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+	return slog.Group(KeyErr, "msg", err.Error(), "class", ErrClass(err))
+}
+
+// Classed is implemented by the errors of the packages that know which class they are in
+type Classed interface {
+	ErrClass() string
+}
+
+// ErrClass sorts errors into a few classes worth filtering on: timeout, eof, closed, refused,
+// reset, canceled, dns, network, or the class of an error implementing Classed; other for the rest
+func ErrClass(err error) string {
+	var classed Classed
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &classed):
+		return classed.ErrClass()
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	if errors.As(err, &opErr) {
+		return "network"
+	}
+	return "other"
+}
+
+// SwitchWriter is a writer whose destination can be changed while logging to it,
+// for moving the log out of the way of a progress display
+type SwitchWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewSwitchWriter(w io.Writer) *SwitchWriter {
+	return &SwitchWriter{w: w}
+}
+
+// Set changes the destination, returning the previous one
+func (s *SwitchWriter) Set(w io.Writer) io.Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.w
+	s.w = w
+	return old
+}
+
+func (s *SwitchWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLevels(t *testing.T) {
+	tests := map[string]struct {
+		spec  string
+		want  Levels
+		fails bool
+	}{
+		"empty": {
+			spec: "",
+			want: Levels{Default: slog.LevelInfo},
+		},
+		"default only": {
+			spec: "debug",
+			want: Levels{Default: slog.LevelDebug},
+		},
+		"per subsystem": {
+			spec: "warn, p2p=debug,tracker=INFO",
+			want: Levels{Default: slog.LevelWarn, Subsystems: map[string]slog.Level{
+				"p2p":     slog.LevelDebug,
+				"tracker": slog.LevelInfo,
+			}},
+		},
+		"unknown level": {
+			spec:  "p2p=loud",
+			fails: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			levels, err := ParseLevels(test.spec)
+			if test.fails {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, test.want, levels)
+		})
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	levels, err := ParseLevels("warn,p2p=debug")
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	l, err := New(&buf, "text", levels)
+	require.Nil(t, err)
+
+	p2p := For(l, "p2p").With(KeyInfohash, "abcd")
+	p2p.Debug("connected", KeyPeer, "1.2.3.4:6881")
+	// a client logger derived from the p2p one keeps its fields under its own subsystem
+	client := For(p2p, "client")
+	client.Debug("sending")
+	client.Warn("slow")
+	l.Info("not shown")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `msg=connected infohash=abcd peer=1.2.3.4:6881 subsystem=p2p`)
+	assert.Contains(t, lines[1], `msg=slow infohash=abcd subsystem=client`)
+	assert.Equal(t, 1, strings.Count(lines[1], "subsystem="))
+	assert.False(t, l.Enabled(context.Background(), slog.LevelInfo))
+	assert.True(t, p2p.Enabled(context.Background(), slog.LevelDebug))
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, "json", Levels{Default: slog.LevelInfo})
+	require.Nil(t, err)
+	For(l, "tracker").Warn("announce failed", Err(fmt.Errorf("announcing: %w", io.EOF)))
+
+	var record map[string]any
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "tracker", record[KeySubsystem])
+	assert.Equal(t, map[string]any{"msg": "announcing: EOF", "class": "eof"}, record[KeyErr])
+
+	_, err = New(&buf, "xml", Levels{})
+	assert.NotNil(t, err)
+}
+
+type classed struct{}
+
+func (classed) Error() string    { return "bad piece" }
+func (classed) ErrClass() string { return "integrity" }
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestErrClass(t *testing.T) {
+	opErr := func(err error) error { return &net.OpError{Op: "dial", Net: "tcp", Err: err} }
+	tests := map[string]struct {
+		err  error
+		want string
+	}{
+		"nil":       {nil, ""},
+		"classed":   {fmt.Errorf("peer: %w", classed{}), "integrity"},
+		"eof":       {io.ErrUnexpectedEOF, "eof"},
+		"deadline":  {opErr(os.ErrDeadlineExceeded), "timeout"},
+		"net error": {timeoutErr{}, "timeout"},
+		"refused":   {opErr(&os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}), "refused"},
+		"reset":     {opErr(syscall.ECONNRESET), "reset"},
+		"closed":    {opErr(net.ErrClosed), "closed"},
+		"canceled":  {context.Canceled, "canceled"},
+		"dns":       {&net.DNSError{Err: "no such host", Name: "tracker.invalid"}, "dns"},
+		"network":   {opErr(errors.New("no route to host")), "network"},
+		"other":     {errors.New("bad handshake"), "other"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.want, ErrClass(test.err))
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package lsd
+
+import (
+	"bit_torrent_cli/logging"
+	"bit_torrent_cli/peers"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Port = 6771
+	// Interval is how often every torrent is announced
+	Interval = 5 * time.Minute
+	// MaxInfoHashes is how many info hashes go in one announce, keeping it within a datagram
+	MaxInfoHashes = 16
+)
+
+var (
+	GroupIPv4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: Port}
+	GroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: Port}
+)
+
+// Announce is a BT-SEARCH message
+type Announce struct {
+	Host       string
+	Port       uint16
+	InfoHashes [][20]byte
+	Cookie     string
+}
+
+func (a Announce) Marshal() []byte {
+	var b bytes.Buffer
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", a.Host)
+	fmt.Fprintf(&b, "Port: %d\r\n", a.Port)
+	for _, ih := range a.InfoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", ih)
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", a.Cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// Parse reads a BT-SEARCH message, skipping info hashes it cannot decode
+func Parse(msg []byte) (Announce, error) {
+	var a Announce
+	sc := bufio.NewScanner(bytes.NewReader(msg))
+	if !sc.Scan() || !strings.HasPrefix(sc.Text(), "BT-SEARCH * HTTP/1.1") {
+		return a, errors.New("not a BT-SEARCH message")
+	}
+	for sc.Scan() {
+		name, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(name) {
+		case "host":
+			a.Host = value
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return a, fmt.Errorf("bad port %q", value)
+			}
+			a.Port = uint16(port)
+		case "infohash":
+			var ih [20]byte
+			b, err := hex.DecodeString(value)
+			if err != nil || len(b) != len(ih) {
+				continue
+			}
+			copy(ih[:], b)
+			a.InfoHashes = append(a.InfoHashes, ih)
+		case "cookie":
+			a.Cookie = value
+		}
+	}
+	if a.Port == 0 || len(a.InfoHashes) == 0 {
+		return a, errors.New("BT-SEARCH without port or info hash")
+	}
+	return a, nil
+}
+
+// Service announces torrents to the local network and reports the peers announcing them (BEP 14)
+type Service struct {
+	port   uint16
+	cookie string
+	found  func(infoHash [20]byte, p peers.Peer)
+
+	mu sync.Mutex
+	// groups are the joined groups with the socket announcing to each, apart from the listening one
+	// as that has multicast loopback off and peers on this host would not hear it
+	groups map[*net.UDPAddr]*net.UDPConn
+	conns  []*net.UDPConn
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// New joins the IPv4 and IPv6 groups, whichever the host has, to announce peers listening on port.
+// found is called for every info hash another peer announces.
+func New(port uint16, found func(infoHash [20]byte, p peers.Peer)) (*Service, error) {
+	var cookie [8]byte
+	_, err := rand.Read(cookie[:])
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{port: port, cookie: hex.EncodeToString(cookie[:]), found: found, groups: make(map[*net.UDPAddr]*net.UDPConn)}
+	var errs []error
+	for network, group := range map[string]*net.UDPAddr{"udp4": GroupIPv4, "udp6": GroupIPv6} {
+		conn, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		send, err := net.ListenUDP(network, nil)
+		if err != nil {
+			conn.Close()
+			errs = append(errs, err)
+			continue
+		}
+		s.groups[group] = send
+		s.conns = append(s.conns, conn, send)
+		s.wg.Add(1)
+		go s.readLoop(conn)
+	}
+	if len(s.groups) == 0 {
+		return nil, fmt.Errorf("joining local service discovery: %w", errors.Join(errs...))
+	}
+	return s, nil
+}
+
+// Announce tells the local network we have peers for the info hashes
+func (s *Service) Announce(infoHashes ...[20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(infoHashes) > 0 && !s.closed {
+		n := min(len(infoHashes), MaxInfoHashes)
+		for group, conn := range s.groups {
+			a := Announce{Host: group.String(), Port: s.port, InfoHashes: infoHashes[:n], Cookie: s.cookie}
+			_, err := conn.WriteToUDP(a.Marshal(), group)
+			if err != nil {
+				logging.For(nil, "lsd").Warn("announce failed", "group", group.String(), logging.Err(err))
+			}
+		}
+		infoHashes = infoHashes[n:]
+	}
+}
+
+func (s *Service) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Service) readLoop(conn *net.UDPConn) {
+	defer s.wg.Done()
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.handle(buf[:n], from)
+	}
+}
+
+// handle reports the peer behind an announce, unless it is one of ours
+func (s *Service) handle(msg []byte, from *net.UDPAddr) {
+	a, err := Parse(msg)
+	if err != nil || a.Cookie == s.cookie {
+		return
+	}
+	p := peers.Peer{IP: from.IP, Port: a.Port}
+	for _, ih := range a.InfoHashes {
+		s.found(ih, p)
+	}
+}
@@ -0,0 +1,80 @@
+package lsd
+
+import (
+	"bit_torrent_cli/peers"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalParse(t *testing.T) {
+	a := Announce{
+		Host:       "239.192.152.143:6771",
+		Port:       6881,
+		InfoHashes: [][20]byte{{1, 2, 3}, {0xff}},
+		Cookie:     "abc",
+	}
+	got, err := Parse(a.Marshal())
+	require.Nil(t, err)
+	assert.Equal(t, a, got)
+}
+
+func TestParse(t *testing.T) {
+	ih := [20]byte{0xab, 0xcd}
+	tests := map[string]struct {
+		msg    string
+		output Announce
+		fails  bool
+	}{
+		"upper case hex and header names": {
+			msg:    "BT-SEARCH * HTTP/1.1\r\nHOST: 239.192.152.143:6771\r\nport: 51413\r\nINFOHASH: ABCD000000000000000000000000000000000000\r\n\r\n\r\n",
+			output: Announce{Host: "239.192.152.143:6771", Port: 51413, InfoHashes: [][20]byte{ih}},
+		},
+		"bad info hash skipped": {
+			msg:    "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: abcd\r\nInfohash: abcd000000000000000000000000000000000000\r\n\r\n",
+			output: Announce{Port: 1, InfoHashes: [][20]byte{ih}},
+		},
+		"not a search": {
+			msg:   "M-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: abcd000000000000000000000000000000000000\r\n\r\n",
+			fails: true,
+		},
+		"no info hash": {
+			msg:   "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n",
+			fails: true,
+		},
+		"bad port": {
+			msg:   "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: abcd000000000000000000000000000000000000\r\n\r\n",
+			fails: true,
+		},
+	}
+	for name, test := range tests {
+		a, err := Parse([]byte(test.msg))
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, test.output, a, name)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	type found struct {
+		ih [20]byte
+		p  peers.Peer
+	}
+	var got []found
+	s := &Service{cookie: "ours", found: func(ih [20]byte, p peers.Peer) {
+		got = append(got, found{ih, p})
+	}}
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 5), Port: Port}
+
+	s.handle(Announce{Port: 6881, InfoHashes: [][20]byte{{1}}, Cookie: "ours"}.Marshal(), from)
+	assert.Empty(t, got, "our own announce")
+
+	s.handle(Announce{Port: 6881, InfoHashes: [][20]byte{{1}, {2}}, Cookie: "theirs"}.Marshal(), from)
+	p := peers.Peer{IP: from.IP, Port: 6881}
+	assert.Equal(t, []found{{[20]byte{1}, p}, {[20]byte{2}, p}}, got)
+}
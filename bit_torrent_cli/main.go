@@ -1,24 +1,600 @@
 package main
 
 import (
+	"bit_torrent_cli/httpserve"
+	"bit_torrent_cli/logging"
+	"bit_torrent_cli/metrics"
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/peerid"
+	"bit_torrent_cli/storage"
 	"bit_torrent_cli/torrentfile"
+	"bit_torrent_cli/tracing"
+	"bit_torrent_cli/tui"
+	"bit_torrent_cli/wiretrace"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anacrolix/envpprof"
+)
+
+// fileRules collects the repeatable -file flag
+type fileRules []torrentfile.FileRule
+
+func (r *fileRules) String() string {
+	patterns := make([]string, len(*r))
+	for i, rule := range *r {
+		patterns[i] = rule.Priority.String() + ":" + rule.Pattern
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (r *fileRules) Set(s string) error {
+	rule, err := torrentfile.ParseFileRule(s)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// peerIDFlag registers the -peer-id-prefix flag, the ID being generated once for every torrent of the run
+func peerIDFlag(fs *flag.FlagSet) *string {
+	return fs.String("peer-id-prefix", peerid.DefaultPrefix, "start of our peer ID, Azureus-style like -XX0100-")
+}
+
+// metricsFlag registers the -metrics flag
+func metricsFlag(fs *flag.FlagSet) *string {
+	return fs.String("metrics", "", "serve Prometheus metrics at /metrics on this address, like :9090")
+}
+
+// serveMetrics serves the metrics registered by the engine on addr until the returned func is called
+func serveMetrics(addr string) (stop func()) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics server: %v", err)
+		}
+	}()
+	log.Printf("metrics on http://%s/metrics", addr)
+	return func() { srv.Close() }
+}
+
+// traceFlag registers the -trace flag
+func traceFlag(fs *flag.FlagSet) *string {
+	return fs.String("trace", "", tracing.Usage)
+}
+
+// startTracing sets up the exporter of spec, returning the func flushing the spans at exit
+func startTracing(spec string) (stop func(), err error) {
+	shutdown, err := tracing.Setup(context.Background(), spec)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := shutdown(ctx)
+		if err != nil {
+			log.Printf("flushing trace spans: %v", err)
+		}
+	}, nil
+}
+
+// recordFlag registers the -record flag
+func recordFlag(fs *flag.FlagSet) *string {
+	return fs.String("record", "", "capture the handshakes and messages of every peer connection to this file, for the decode command")
+}
+
+// startRecording creates the capture at path, returning a nil recorder without a path
+func startRecording(path string) (rec *wiretrace.Recorder, stop func(), err error) {
+	if path == "" {
+		return nil, func() {}, nil
+	}
+	rec, err = wiretrace.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rec, func() {
+		err := rec.Close()
+		if err != nil {
+			log.Printf("writing capture: %v", err)
+		}
+	}, nil
+}
+
+// logOutput is where the log goes, moved out of the way of the progress bars
+var logOutput = logging.NewSwitchWriter(os.Stderr)
+
+// logFlags choose the level of each subsystem and the format of the log
+type logFlags struct {
+	level  string
+	format string
+}
+
+func (f *logFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.level, "log-level", "info", logging.LevelUsage)
+	fs.StringVar(&f.format, "log-format", "text", "log format: text or json")
+}
+
+// setup makes the logger of the flags the default one, the standard log going through it as well
+func (f *logFlags) setup() error {
+	levels, err := logging.ParseLevels(f.level)
+	if err != nil {
+		return err
+	}
+	logger, err := logging.New(logOutput, f.format, levels)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// storageUsage describes the -storage flag
+const storageUsage = "where the data is kept while downloading: " + storage.Kinds +
+	", empty for the engine's default, memory for native and file for anacrolix. " +
+	"file and mmap write the files in -dir as they download, piece and sqlite keep the pieces under -dir"
+
+// storageFlag registers the -storage flag
+func storageFlag(fs *flag.FlagSet) *string {
+	return fs.String("storage", "", storageUsage)
+}
+
+// openStorage makes the backend of -storage keeping its data under dir, nil for memory which the native engine defaults to
+func openStorage(kind, dir string) (storage.Backend, error) {
+	if kind == "" || kind == "memory" {
+		return nil, nil
+	}
+	return storage.New(kind, dir)
+}
+
+// hashFlags size the pool checking the hashes of the downloaded pieces
+type hashFlags struct {
+	workers       int
+	maxUnverified rateFlag
+}
+
+func (f *hashFlags) register(fs *flag.FlagSet) {
+	fs.IntVar(&f.workers, "hash-workers", 0, "pieces hash checked at once, 0 for one per CPU")
+	fs.Var(&f.maxUnverified, "max-unverified-bytes", "bytes downloading or downloaded but not yet hash checked at most, 0 for the engine's default")
+}
+
+// hasher starts the pool shared by the torrents of the command
+func (f *hashFlags) hasher() *p2p.Hasher {
+	return p2p.NewHasher(f.workers, int64(f.maxUnverified))
+}
+
+// watchProgress shows the torrent's progress until the returned func is called.
+// Bars go to stderr with the log printed above them, JSON lines to stdout.
+func watchProgress(mode tui.Mode, tf torrentfile.Torrentfile, torrent *p2p.Torrent) (stop func()) {
+	mode = mode.Resolve(os.Stderr)
+	switch mode {
+	case tui.ModeQuiet:
+		old := logOutput.Set(io.Discard)
+		return func() { logOutput.Set(old) }
+	case tui.ModeJSON:
+		d := tui.New(os.Stdout, mode, tf.Name, torrent, tf.Files)
+		d.Start()
+		return d.Stop
+	}
+	d := tui.New(os.Stderr, mode, tf.Name, torrent, tf.Files)
+	old := logOutput.Set(d)
+	d.Start()
+	return func() {
+		d.Stop()
+		logOutput.Set(old)
+	}
+}
+
+// the exit codes of every command
+const (
+	exitFailure = 1
+	exitUsage   = 2
 )
 
+// errUsage is returned once a command has printed its usage, exiting with exitUsage
+var errUsage = errors.New("usage")
+
+// command is a subcommand of the CLI
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"download", "download a torrent into -dir", downloadCmd},
+	{"seed", "seed torrents whose data is in -dir", seedCmd},
+	{"serve", "serve torrents over HTTP while they download", serveCmd},
+	{"stream", "write a torrent, or one file of it, to stdout while it downloads", streamCmd},
+	{"info", "print what a .torrent file holds", infoCmd},
+	{"create", "make a .torrent file of a file or directory", createCmd},
+	{"verify", "check downloaded data against the piece hashes", verifyCmd},
+	{"scrape", "ask the tracker how many peers a torrent has", scrapeCmd},
+	{"session", "download many torrents at once on the native engine", sessionCmd},
+	{"daemon", "run a native session controlled through an HTTP API", daemonCmd},
+	{"ctl", "control a running daemon", ctlCmd},
+	{"decode", "print a capture of -record as a timeline", decodeCmd},
+}
+
+// prog is the name the CLI was run as
+func prog() string {
+	return filepath.Base(os.Args[0])
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [args]\n\ncommands:\n", prog())
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\ndownload, seed and serve run on the native engine, or on anacrolix with -engine=anacrolix.\n")
+	fmt.Fprintf(w, "Run %q for the flags of a command. The exit status is %d on failure and %d on bad usage.\n",
+		prog()+" <command> -h", exitFailure, exitUsage)
+}
+
+// newFlagSet makes the flag set of a command, its -h printing the usage line above the flags
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s %s\n", prog(), name, args)
+		fmt.Fprintln(fs.Output(), "\nflags:")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags and checks there are between min and max arguments left, max < 0 for no limit
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) error {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	if err != nil {
+		// the flag package printed the error and the usage
+		return errUsage
+	}
+	if fs.NArg() < min || max >= 0 && fs.NArg() > max {
+		return usageError(fs, errors.New("wrong number of arguments"))
+	}
+	return nil
+}
+
+// usageError prints err and the usage of the command, returning errUsage
+func usageError(fs *flag.FlagSet, err error) error {
+	fmt.Fprintf(fs.Output(), "%s %s: %v\n", prog(), fs.Name(), err)
+	fs.Usage()
+	return errUsage
+}
+
 func main() {
-	inPath := os.Args[1]
-	outPath := os.Args[2]
-	tf, err := torrentfile.Open(inPath)
+	code := run(os.Args[1:])
+	// the exit skips deferred calls
+	envpprof.Stop()
+	os.Exit(code)
+}
+
+// run runs the command of args, returning the exit code
+func run(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return exitUsage
+	}
+	name := args[0]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			return run([]string{args[1], "-h"})
+		}
+		usage(os.Stdout)
+		return 0
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		err := c.run(args[1:])
+		switch {
+		case err == nil, errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return exitUsage
+		}
+		fmt.Fprintf(os.Stderr, "%s %s: %v\n", prog(), name, err)
+		return exitFailure
+	}
+	fmt.Fprintf(os.Stderr, "%s: unknown command %q\n\n", prog(), name)
+	usage(os.Stderr)
+	return exitUsage
+}
+
+// streamCmd writes the torrent, or one file of it, to stdout in order while it downloads
+func streamCmd(args []string) error {
+	fs := newFlagSet("stream", "[flags] <torrent> [file]")
+	readahead := fs.Int("readahead", p2p.DefaultReadahead, "bytes past the read position to fetch first")
+	dir := fs.String("dir", ".", "directory of the -storage on disk")
+	storageKind := storageFlag(fs)
+	var bw bandwidthFlags
+	bw.register(fs)
+	prefix := peerIDFlag(fs)
+	metricsAddr := metricsFlag(fs)
+	traceSpec := traceFlag(fs)
+	recordPath := recordFlag(fs)
+	var hf hashFlags
+	hf.register(fs)
+	var lf logFlags
+	lf.register(fs)
+	err := parseArgs(fs, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	backend, err := openStorage(*storageKind, *dir)
+	if err != nil {
+		return usageError(fs, err)
+	}
+	if backend != nil {
+		defer backend.Close()
+	}
+	err = lf.setup()
+	if err != nil {
+		return err
+	}
+	tf, err := torrentfile.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	tf.Storage = backend
+	// stream a single file by fetching only that file in the background
+	name := fs.Arg(1)
+	file := -1
+	if name != "" {
+		for i, f := range tf.Files {
+			if f.Path == name {
+				file = i
+			}
+		}
+		if file < 0 {
+			return fmt.Errorf("no file %q in %s", name, tf.Name)
+		}
+		err = tf.SelectFiles([]torrentfile.FileRule{{Pattern: name, Priority: p2p.PriorityNormal}})
+		if err != nil {
+			return err
+		}
+	}
+	tf.PeerID, err = peerid.New(*prefix)
+	if err != nil {
+		return err
+	}
+	if *metricsAddr != "" {
+		defer serveMetrics(*metricsAddr)()
+	}
+	stopTracing, err := startTracing(*traceSpec)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	rec, stopRecording, err := startRecording(*recordPath)
+	if err != nil {
+		return err
+	}
+	defer stopRecording()
+	bw.start(context.Background())
+	tf.Bandwidth = bw.forTorrent()
+	tf.Recorder = rec
+	tf.Hasher = hf.hasher()
+	defer tf.Hasher.Close()
+	torrent, err := tf.StartDownload()
+	if err != nil {
+		return err
+	}
+	defer torrent.Close()
+
+	var r *p2p.Reader
+	if file < 0 {
+		r = torrent.NewReader()
+	} else {
+		r = torrent.NewFileReader(tf.Files[file])
+	}
+	defer r.Close()
+	r.SetReadahead(*readahead)
+	_, err = io.Copy(os.Stdout, r)
+	return err
+}
+
+// serveCmd downloads the torrents in the background and serves them over HTTP
+func serveCmd(args []string) error {
+	fs := newFlagSet("serve", "[flags] <torrent>...")
+	eng := engineFlag(fs)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	dir := fs.String("dir", ".", "directory the torrents are written to by a -storage on disk")
+	storageKind := storageFlag(fs)
+	var files fileRules
+	fs.Var(&files, "file", "download only matching files in the background, as [skip:|normal:|high:]glob (repeatable)")
+	metricsAddr := metricsFlag(fs)
+	traceSpec := traceFlag(fs)
+	ef := engineFlags{}
+	var bw bandwidthFlags
+	var lazy *bool
+	var prefix, recordPath *string
+	var hf hashFlags
+	var lf logFlags
+	ef.only(fs, engineNative, func() {
+		lazy = fs.Bool("lazy", false, "download nothing in the background, only the pieces being read")
+		bw.register(fs)
+		prefix = peerIDFlag(fs)
+		recordPath = recordFlag(fs)
+		hf.register(fs)
+		lf.register(fs)
+	})
+	ef.share(fs, "down-rate", "up-rate", "max-unverified-bytes")
+	var af anacrolixFlags
+	ef.only(fs, engineAnacrolix, func() {
+		af.registerSwarm(fs)
+		af.register(fs)
+	})
+	err := parseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	err = ef.check(fs, *eng)
+	if err != nil {
+		return usageError(fs, err)
+	}
+	if *eng == engineAnacrolix {
+		af.serve = *addr
+		af.dir = *dir
+		af.storage = *storageKind
+		af.files = files
+		af.metrics = *metricsAddr
+		af.downRate, af.upRate = int64(bw.down), int64(bw.up)
+		af.maxUnverifiedBytes = hf.maxUnverified
+		af.torrents = fs.Args()
+		return runAnacrolix(*traceSpec, af)
+	}
+	err = lf.setup()
+	if err != nil {
+		return err
+	}
+	peerID, err := peerid.New(*prefix)
+	if err != nil {
+		return err
+	}
+	if *metricsAddr != "" {
+		defer serveMetrics(*metricsAddr)()
+	}
+	stopTracing, err := startTracing(*traceSpec)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	rec, stopRecording, err := startRecording(*recordPath)
+	if err != nil {
+		return err
+	}
+	defer stopRecording()
+	backend, err := openStorage(*storageKind, *dir)
+	if err != nil {
+		return usageError(fs, err)
+	}
+	if backend != nil {
+		defer backend.Close()
+	}
+	bw.start(context.Background())
+	hasher := hf.hasher()
+	defer hasher.Close()
+	srv := httpserve.New()
+	for _, path := range fs.Args() {
+		tf, err := torrentfile.Open(path)
+		if err != nil {
+			return err
+		}
+		err = tf.SelectFiles(files)
+		if err != nil {
+			return err
+		}
+		if *lazy {
+			for i := range tf.Files {
+				tf.Files[i].Priority = p2p.PrioritySkip
+			}
+		}
+		tf.Bandwidth = bw.forTorrent()
+		tf.PeerID = peerID
+		tf.Recorder = rec
+		tf.Hasher = hasher
+		tf.Storage = backend
+		torrent, err := tf.StartDownload()
+		if err != nil {
+			return err
+		}
+		defer torrent.Close()
+		srv.Add(httpserve.Native(torrent))
+	}
+	log.Printf("serving on http://%s/", *addr)
+	return http.ListenAndServe(*addr, srv)
+}
+
+// sessionCmd downloads many torrents at once in one session, queueing those past the limits
+func sessionCmd(args []string) error {
+	fs := newFlagSet("session", "[flags] <torrent>...")
+	var sf sessionFlags
+	sf.register(fs)
+	seed := fs.Bool("seed", false, "keep seeding once every torrent is downloaded")
+	err := parseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	err = sf.log.setup()
+	if err != nil {
+		return err
+	}
+	stopTracing, err := startTracing(sf.trace)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	stopRecording, err := sf.startRecording()
+	if err != nil {
+		return err
+	}
+	defer stopRecording()
+	s, err := sf.start(context.Background())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if sf.metrics != "" {
+		defer serveMetrics(sf.metrics)()
+	}
+	for _, path := range fs.Args() {
+		_, err = s.AddFile(path)
+		if err != nil {
+			return fmt.Errorf("adding %s: %w", path, err)
+		}
+	}
+	for ; ; time.Sleep(time.Second) {
+		if *seed {
+			continue
+		}
+		done := true
+		for _, st := range s.List() {
+			if st.Err != nil {
+				return fmt.Errorf("%s: %w", st.Name, st.Err)
+			}
+			done = done && st.Complete
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// decodeCmd prints a capture of the -record flag as a timeline
+func decodeCmd(args []string) error {
+	fs := newFlagSet("decode", "[flags] <capture>")
+	peer := fs.String("peer", "", "only show the connection to this peer, as host:port")
+	err := parseArgs(fs, args, 1, 1)
 	if err != nil {
-		log.Fatal(err)
-		fmt.Printf("err: %v\n", err)
-		return
+		return err
 	}
-	err = tf.DownloadToFile(outPath)
+	f, err := os.Open(fs.Arg(0))
 	if err != nil {
-		log.Fatal(err)
-		fmt.Printf("err: %v\n", err)
+		return err
 	}
+	defer f.Close()
+	return wiretrace.Timeline(os.Stdout, f, *peer)
 }
@@ -20,6 +20,12 @@ const (
 	MsgCancel
 )
 
+// MsgExtended carries the messages of the extension protocol (BEP 10)
+const MsgExtended messageID = 20
+
+// MaxLength bounds the messages Read accepts, well above a block or the bitfield of a huge torrent
+const MaxLength = 1 << 21
+
 type Message struct {
 	Payload []byte
 	ID      messageID
@@ -39,6 +45,56 @@ func FormatHave(index int) *Message {
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
+// FormatPiece creates a piece message carrying a block of the piece
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// FormatExtended creates an extension message, extended ID 0 being the extension handshake
+func FormatExtended(extendedID byte, payload []byte) *Message {
+	return &Message{ID: MsgExtended, Payload: append([]byte{extendedID}, payload...)}
+}
+
+// ParseExtended splits an extension message into its extended ID and payload
+func ParseExtended(msg *Message) (extendedID byte, payload []byte, err error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("expected extended (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("extended message without extended ID")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// ParseRequest parses a request (or cancel) message
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("expected request (ID %d), got ID %d", MsgRequest, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// PieceIndex returns the index of the piece a piece message carries a block of
+func PieceIndex(msg *Message) (int, error) {
+	if msg.ID != MsgPiece {
+		return 0, fmt.Errorf("expected piece (ID %d), got ID %d", MsgPiece, msg.ID)
+	}
+	if len(msg.Payload) < 8 {
+		return 0, fmt.Errorf("payload too short . %d < 8", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload[0:4])), nil
+}
+
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	if msg.ID != MsgPiece {
 		return 0, fmt.Errorf("expected piece (ID %d), got ID %d", MsgPiece, msg.ID)
@@ -96,6 +152,9 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > MaxLength {
+		return nil, fmt.Errorf("message of %d bytes is longer than %d", length, MaxLength)
+	}
 
 	messageBuf := make([]byte, length)
 	_, err = io.ReadFull(r, messageBuf)
@@ -133,6 +192,8 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -0,0 +1,257 @@
+package metadata
+
+import (
+	"bit_torrent_cli/handshake"
+	"bit_torrent_cli/message"
+	"bit_torrent_cli/peers"
+	"bit_torrent_cli/transport"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	// BlockSize is the size of every metadata piece but the last
+	BlockSize = 16384
+	// MaxSize bounds the metadata size a peer may claim
+	MaxSize = 16 << 20
+	// MaxParallel is how many peers are asked at once
+	MaxParallel = 8
+
+	// utMetadataID is the extended message ID we ask peers to use for ut_metadata
+	utMetadataID = 1
+	fetchTimeout = 30 * time.Second
+)
+
+const (
+	msgRequest = iota
+	msgData
+	msgReject
+)
+
+// ErrNoPeers is returned when no peer could send the metadata
+var ErrNoPeers = errors.New("no peer sent the metadata")
+
+// Fetch downloads the info dictionary of a torrent from the first of the peers that has it (BEP 9).
+// Peers are dialed through d, nil meaning TCP.
+func Fetch(ctx context.Context, d transport.Dialer, infoHash, peerID [20]byte, ps []peers.Peer) ([]byte, error) {
+	if d == nil {
+		d = transport.TCP
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan []byte)
+	errs := make(chan error)
+	slots := make(chan struct{}, MaxParallel)
+	go func() {
+		for _, p := range ps {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(p peers.Peer) {
+				defer func() { <-slots }()
+				buf, err := fetchFrom(ctx, d, p, infoHash, peerID)
+				if err != nil {
+					select {
+					case errs <- fmt.Errorf("%s: %w", p, err):
+					case <-ctx.Done():
+					}
+					return
+				}
+				select {
+				case results <- buf:
+				case <-ctx.Done():
+				}
+			}(p)
+		}
+	}()
+
+	var lastErr error
+	for range ps {
+		select {
+		case buf := <-results:
+			return buf, nil
+		case lastErr = <-errs:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoPeers, lastErr)
+	}
+	return nil, ErrNoPeers
+}
+
+type extHandshake struct {
+	M            map[string]int64
+	MetadataSize int64
+}
+
+func parseExtHandshake(payload []byte) (extHandshake, error) {
+	v, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return extHandshake{}, err
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return extHandshake{}, fmt.Errorf("extension handshake is not a dictionary")
+	}
+	hs := extHandshake{M: make(map[string]int64)}
+	if m, ok := d["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if n, ok := id.(int64); ok {
+				hs.M[name] = n
+			}
+		}
+	}
+	hs.MetadataSize, _ = d["metadata_size"].(int64)
+	return hs, nil
+}
+
+// fetchFrom downloads the metadata from one peer and checks it against the info hash
+func fetchFrom(ctx context.Context, d transport.Dialer, peer peers.Peer, infoHash, peerID [20]byte) ([]byte, error) {
+	conn, err := d.DialContext(ctx, "tcp", peer.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(fetchTimeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req := handshake.New(infoHash, peerID)
+	req.EnableExtensions()
+	_, err = conn.Write(req.Serialize())
+	if err != nil {
+		return nil, err
+	}
+	res, err := handshake.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+	if res.InfoHash != infoHash {
+		return nil, fmt.Errorf("peer answered for info hash %x", res.InfoHash)
+	}
+	if !res.SupportsExtensions() {
+		return nil, fmt.Errorf("peer does not support extensions")
+	}
+	var payload bytes.Buffer
+	err = bencode.Marshal(&payload, map[string]interface{}{
+		"m": map[string]interface{}{"ut_metadata": utMetadataID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(message.FormatExtended(0, payload.Bytes()).Setialize())
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	var received []bool
+	remaining := 0
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		id, body, err := message.ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case id == 0 && buf == nil:
+			hs, err := parseExtHandshake(body)
+			if err != nil {
+				return nil, err
+			}
+			remoteID, ok := hs.M["ut_metadata"]
+			if !ok || remoteID == 0 {
+				return nil, fmt.Errorf("peer does not support ut_metadata")
+			}
+			if hs.MetadataSize <= 0 || hs.MetadataSize > MaxSize {
+				return nil, fmt.Errorf("bad metadata size %d", hs.MetadataSize)
+			}
+			buf = make([]byte, hs.MetadataSize)
+			remaining = (len(buf) + BlockSize - 1) / BlockSize
+			received = make([]bool, remaining)
+			for i := 0; i < remaining; i++ {
+				err = requestPiece(conn, byte(remoteID), i)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case id == utMetadataID && buf != nil:
+			done, err := storePiece(buf, received, body)
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				remaining--
+			}
+			if remaining == 0 {
+				if sha1.Sum(buf) != infoHash {
+					return nil, fmt.Errorf("metadata does not match info hash")
+				}
+				return buf, nil
+			}
+		}
+	}
+}
+
+func requestPiece(conn net.Conn, remoteID byte, piece int) error {
+	var payload bytes.Buffer
+	err := bencode.Marshal(&payload, map[string]interface{}{"msg_type": msgRequest, "piece": piece})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(message.FormatExtended(remoteID, payload.Bytes()).Setialize())
+	return err
+}
+
+// storePiece copies a data message into buf, reporting whether it was a piece not received yet
+func storePiece(buf []byte, received []bool, body []byte) (bool, error) {
+	v, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("metadata message is not a dictionary")
+	}
+	msgType, _ := d["msg_type"].(int64)
+	piece, _ := d["piece"].(int64)
+	switch msgType {
+	case msgReject:
+		return false, fmt.Errorf("peer rejected metadata piece %d", piece)
+	case msgData:
+	default:
+		return false, nil
+	}
+	if piece < 0 || int(piece) >= len(received) {
+		return false, fmt.Errorf("bad metadata piece %d", piece)
+	}
+	begin := int(piece) * BlockSize
+	length := min(BlockSize, len(buf)-begin)
+	if len(body) < length {
+		return false, fmt.Errorf("short metadata piece %d", piece)
+	}
+	// the data follows the dictionary
+	copy(buf[begin:], body[len(body)-length:])
+	if received[piece] {
+		return false, nil
+	}
+	received[piece] = true
+	return true, nil
+}
@@ -0,0 +1,87 @@
+package metadata
+
+import (
+	"bit_torrent_cli/handshake"
+	"bit_torrent_cli/message"
+	"bit_torrent_cli/peers"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveMetadata answers ut_metadata requests of one connection like a seeder would
+func serveMetadata(t *testing.T, conn net.Conn, metadata []byte) {
+	defer conn.Close()
+	hs, err := handshake.Read(conn)
+	if err != nil {
+		return
+	}
+	res := handshake.New(hs.InfoHash, [20]byte{'s'})
+	res.EnableExtensions()
+	conn.Write(res.Serialize())
+
+	var payload bytes.Buffer
+	bencode.Marshal(&payload, map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": 3},
+		"metadata_size": len(metadata),
+	})
+	conn.Write(message.FormatExtended(0, payload.Bytes()).Setialize())
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		id, body, err := message.ParseExtended(msg)
+		if err != nil || id != 3 {
+			continue
+		}
+		v, err := bencode.Decode(bytes.NewReader(body))
+		require.Nil(t, err)
+		piece := int(v.(map[string]interface{})["piece"].(int64))
+		end := min((piece+1)*BlockSize, len(metadata))
+		var data bytes.Buffer
+		bencode.Marshal(&data, map[string]interface{}{"msg_type": msgData, "piece": piece, "total_size": len(metadata)})
+		data.Write(metadata[piece*BlockSize : end])
+		conn.Write(message.FormatExtended(utMetadataID, data.Bytes()).Setialize())
+	}
+}
+
+func listen(t *testing.T, metadata []byte) peers.Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveMetadata(t, conn, metadata)
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestFetch(t *testing.T) {
+	metadata := bytes.Repeat([]byte("d4:name4:test"), 3000)
+	infoHash := sha1.Sum(metadata)
+	seeder := listen(t, metadata)
+	liar := listen(t, []byte("not the metadata"))
+
+	got, err := Fetch(context.Background(), nil, infoHash, [20]byte{'l'}, []peers.Peer{liar, seeder})
+	require.Nil(t, err)
+	assert.Equal(t, metadata, got)
+}
+
+func TestFetchNoPeers(t *testing.T) {
+	liar := listen(t, []byte("not the metadata"))
+	_, err := Fetch(context.Background(), nil, [20]byte{1}, [20]byte{'l'}, []peers.Peer{liar})
+	assert.ErrorIs(t, err, ErrNoPeers)
+}
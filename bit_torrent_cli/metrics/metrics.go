@@ -0,0 +1,286 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the upper bounds of histograms measuring seconds
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry holds metric families and writes them in the Prometheus text format
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Default is the registry the packages of the engine register their metrics in
+var Default = NewRegistry()
+
+// family is one metric name with a series per combination of label values
+type family struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64
+	// collect reports the series at scrape time instead of the stored ones
+	collect func(emit func(v float64, labelValues ...string))
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// counts and sum of a histogram, counts[i] being the observations up to buckets[i]
+	counts []uint64
+	sum    float64
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[f.name]; ok {
+		panic("metrics: " + f.name + " registered twice")
+	}
+	f.series = make(map[string]*series)
+	r.families[f.name] = f
+	return f
+}
+
+// get returns the series of the label values, creating it on first use
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes labels %v, got %d values", f.name, f.labels, len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up, like a number of bytes sent
+type Counter struct{ f *family }
+
+// NewCounter registers a counter with the label names its series are told apart by
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&family{name: name, help: help, typ: "counter", labels: labels})}
+}
+
+// Add adds v, which must not be negative, to the series of the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.get(labelValues).value += v
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a value that goes up and down, like a number of connections
+type Gauge struct{ f *family }
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&family{name: name, help: help, typ: "gauge", labels: labels})}
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(labelValues).value = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(labelValues).value += v
+}
+
+// Histogram counts observations, like durations, in buckets
+type Histogram struct{ f *family }
+
+// NewHistogram registers a histogram with the upper bounds of its buckets in increasing order
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(&family{name: name, help: help, typ: "histogram", labels: labels, buckets: buckets})}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(labelValues)
+	i := sort.SearchFloat64s(h.f.buckets, v)
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.value++
+}
+
+// NewCounterFunc registers a counter whose series collect reports at every scrape,
+// for counts kept elsewhere
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func(emit func(v float64, labelValues ...string))) {
+	r.register(&family{name: name, help: help, typ: "counter", labels: labels, collect: collect})
+}
+
+// NewGaugeFunc registers a gauge whose series collect reports at every scrape
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, labelValues ...string))) {
+	r.register(&family{name: name, help: help, typ: "gauge", labels: labels, collect: collect})
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+func NewCounterFunc(name, help string, labels []string, collect func(emit func(v float64, labelValues ...string))) {
+	Default.NewCounterFunc(name, help, labels, collect)
+}
+
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, labelValues ...string))) {
+	Default.NewGaugeFunc(name, help, labels, collect)
+}
+
+// snapshot copies the series of the family sorted by label values
+func (f *family) snapshot() []series {
+	var out []series
+	if f.collect != nil {
+		f.collect(func(v float64, labelValues ...string) {
+			out = append(out, series{labelValues: labelValues, value: v})
+		})
+	} else {
+		f.mu.Lock()
+		for _, s := range f.series {
+			c := *s
+			c.counts = append([]uint64(nil), s.counts...)
+			out = append(out, c)
+		}
+		f.mu.Unlock()
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].labelValues, "\xff") < strings.Join(out[j].labelValues, "\xff")
+	})
+	return out
+}
+
+// WriteTo writes every family in the Prometheus text format, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, f := range families {
+		fmt.Fprintf(cw, "# HELP %s %s\n", f.name, escape(f.help, false))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.snapshot() {
+			if f.typ != "histogram" {
+				fmt.Fprintf(cw, "%s%s %s\n", f.name, labelSet(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", f.name, labelSet(f.labels, s.labelValues, "le", formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(cw, "%s_bucket%s %s\n", f.name, labelSet(f.labels, s.labelValues, "le", "+Inf"), formatFloat(s.value))
+			fmt.Fprintf(cw, "%s_sum%s %s\n", f.name, labelSet(f.labels, s.labelValues, "", ""), formatFloat(s.sum))
+			fmt.Fprintf(cw, "%s_count%s %s\n", f.name, labelSet(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+		}
+	}
+	err := bw.Flush()
+	if cw.err != nil {
+		err = cw.err
+	}
+	return cw.n, err
+}
+
+// ServeHTTP answers scrapes
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// labelSet prints {name="value",...}, with the extra label last, or nothing without labels
+func labelSet(names, values []string, extraName, extraValue string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, name+`="`+escape(values[i], true)+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// escape escapes backslashes and newlines, and double quotes in label values
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_bytes_total", "Bytes sent.", "direction")
+	c.Add(10, "up")
+	c.Inc("down")
+	c.Add(5, "up")
+	g := r.NewGauge("test_conns", "Open connections.\nNot closed yet.")
+	g.Add(3)
+	g.Add(-1)
+	h := r.NewHistogram("test_seconds", "Time taken.", []float64{0.1, 1}, "result")
+	h.Observe(0.05, "ok")
+	h.Observe(0.5, "ok")
+	h.Observe(2, "ok")
+	r.NewGaugeFunc("test_peers", "Peers by state.", []string{"state"}, func(emit func(float64, ...string)) {
+		emit(2, `say "hi"`)
+		emit(1, "choked")
+	})
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	require.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, `# HELP test_bytes_total Bytes sent.
+# TYPE test_bytes_total counter
+test_bytes_total{direction="down"} 1
+test_bytes_total{direction="up"} 15
+# HELP test_conns Open connections.\nNot closed yet.
+# TYPE test_conns gauge
+test_conns 2
+# HELP test_peers Peers by state.
+# TYPE test_peers gauge
+test_peers{state="choked"} 1
+test_peers{state="say \"hi\""} 2
+# HELP test_seconds Time taken.
+# TYPE test_seconds histogram
+test_seconds_bucket{result="ok",le="0.1"} 1
+test_seconds_bucket{result="ok",le="1"} 2
+test_seconds_bucket{result="ok",le="+Inf"} 3
+test_seconds_sum{result="ok"} 2.55
+test_seconds_count{result="ok"} 3
+`, buf.String())
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Things.", "kind")
+	assert.Panics(t, func() { r.NewGauge("test_total", "Again.") }, "registered twice")
+	assert.Panics(t, func() { c.Inc() }, "missing label value")
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Things.").Inc()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "test_total 1\n")
+}
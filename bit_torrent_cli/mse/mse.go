@@ -0,0 +1,428 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Policy decides whether peer connections are encrypted
+type Policy int
+
+const (
+	// PolicyPrefer encrypts when the peer can, falling back to plaintext
+	PolicyPrefer Policy = iota
+	// PolicyRequire refuses plaintext connections
+	PolicyRequire
+	// PolicyDisable only makes and accepts plaintext connections
+	PolicyDisable
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyPrefer:
+		return "prefer"
+	case PolicyRequire:
+		return "require"
+	case PolicyDisable:
+		return "disable"
+	default:
+		return "unknown"
+	}
+}
+
+// Set makes a Policy usable as a flag.Value
+func (p *Policy) Set(s string) error {
+	policy, err := ParsePolicy(s)
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "prefer":
+		return PolicyPrefer, nil
+	case "require":
+		return PolicyRequire, nil
+	case "disable":
+		return PolicyDisable, nil
+	default:
+		return 0, fmt.Errorf("bad encryption policy %q, want prefer, require or disable", s)
+	}
+}
+
+// Method is a bit of the crypto_provide and crypto_select fields
+type Method uint32
+
+const (
+	MethodPlaintext Method = 1
+	MethodRC4       Method = 2
+)
+
+const (
+	keyLength = 96
+	maxPad    = 512
+	// discard is how much of the RC4 keystream is thrown away
+	discard = 1024
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	// vc is the verification constant, eight zero bytes
+	vc [8]byte
+	// plainHandshake starts every unencrypted BitTorrent handshake
+	plainHandshake = []byte("\x13BitTorrent protocol")
+)
+
+var (
+	ErrPlaintextRefused = errors.New("peer connection is not encrypted")
+	ErrEncryptedRefused = errors.New("peer connection is encrypted")
+	ErrNoCommonMethod   = errors.New("no common crypto method")
+	ErrUnknownSKey      = errors.New("encrypted connection for an unknown torrent")
+)
+
+func hash(parts ...[]byte) [20]byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	var sum [20]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (keyPair, error) {
+	// 160 bits of private key are plenty for a 768 bit group
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return keyPair{}, err
+	}
+	x := new(big.Int).SetBytes(b)
+	y := new(big.Int).Exp(generator, x, prime)
+	return keyPair{private: x, public: y.FillBytes(make([]byte, keyLength))}, nil
+}
+
+func (k keyPair) secret(peerPublic []byte) []byte {
+	y := new(big.Int).SetBytes(peerPublic)
+	return new(big.Int).Exp(y, k.private, prime).FillBytes(make([]byte, keyLength))
+}
+
+func newCipher(key string, s []byte, skey [20]byte) *rc4.Cipher {
+	k := hash([]byte(key), s, skey[:])
+	c, _ := rc4.NewCipher(k[:])
+	var junk [discard]byte
+	c.XORKeyStream(junk[:], junk[:])
+	return c
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	_, err := rand.Read(n[:])
+	if err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPad+1))
+	_, err = rand.Read(pad)
+	return pad, err
+}
+
+// goWrite writes in the background so that both ends may send their keys at once over unbuffered pipes
+func goWrite(w io.Writer, b []byte) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(b)
+		done <- err
+	}()
+	return done
+}
+
+// syncTo reads until just past pattern, which must show up within limit bytes
+func syncTo(r *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit+len(pattern))
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("could not synchronize encrypted handshake")
+}
+
+// Conn is a peer connection after the encryption handshake, encrypted or not
+type Conn struct {
+	net.Conn
+	r       io.Reader
+	pending []byte // plaintext received during the handshake
+	dec     *rc4.Cipher
+
+	wmu sync.Mutex
+	enc *rc4.Cipher
+	// Method is the negotiated crypto method, 0 for a plaintext connection without handshake
+	Method Method
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(p)
+	if c.dec != nil {
+		c.dec.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(p)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
+
+// Initiate runs the outgoing side of the handshake for the torrent whose info hash is skey.
+// PolicyPrefer offers both methods and lets the peer choose, PolicyRequire only offers RC4.
+func Initiate(conn net.Conn, skey [20]byte, policy Policy) (*Conn, error) {
+	if policy == PolicyDisable {
+		return &Conn{Conn: conn, r: conn}, nil
+	}
+	provide := MethodRC4
+	if policy == PolicyPrefer {
+		provide |= MethodPlaintext
+	}
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	sent := goWrite(conn, append(keys.public, padA...))
+	r := bufio.NewReader(conn)
+	peerPublic := make([]byte, keyLength)
+	_, err = io.ReadFull(r, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	if err = <-sent; err != nil {
+		return nil, err
+	}
+	s := keys.secret(peerPublic)
+	enc := newCipher("keyA", s, skey)
+	dec := newCipher("keyB", s, skey)
+
+	req1 := hash([]byte("req1"), s)
+	req2 := hash([]byte("req2"), skey[:])
+	req3 := hash([]byte("req3"), s)
+	var msg bytes.Buffer
+	msg.Write(req1[:])
+	for i := range req2 {
+		msg.WriteByte(req2[i] ^ req3[i])
+	}
+	var fields [16]byte
+	copy(fields[:8], vc[:])
+	binary.BigEndian.PutUint32(fields[8:12], uint32(provide))
+	// no PadC and no initial payload, the BitTorrent handshake follows through the connection
+	enc.XORKeyStream(fields[:], fields[:])
+	msg.Write(fields[:])
+	_, err = conn.Write(msg.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// the encrypted VC marks the end of PadB
+	var encVC [8]byte
+	probe := newCipher("keyB", s, skey)
+	probe.XORKeyStream(encVC[:], vc[:])
+	err = syncTo(r, encVC[:], maxPad)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(encVC[:], encVC[:])
+	var answer [6]byte
+	_, err = io.ReadFull(r, answer[:])
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(answer[:], answer[:])
+	selected := Method(binary.BigEndian.Uint32(answer[:4]))
+	padD := make([]byte, binary.BigEndian.Uint16(answer[4:]))
+	_, err = io.ReadFull(r, padD)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	c := &Conn{Conn: conn, r: r, Method: selected}
+	switch selected {
+	case MethodRC4:
+		c.enc, c.dec = enc, dec
+	case MethodPlaintext:
+		if policy == PolicyRequire {
+			return nil, ErrPlaintextRefused
+		}
+	default:
+		return nil, fmt.Errorf("peer selected crypto method %d: %w", selected, ErrNoCommonMethod)
+	}
+	return c, nil
+}
+
+// Accept runs the incoming side of the handshake. Plaintext BitTorrent handshakes are passed through
+// unless the policy requires encryption, encrypted ones must be for one of the skeys.
+// The returned connection starts with the peer's BitTorrent handshake either way.
+func Accept(conn net.Conn, skeys [][20]byte, policy Policy) (*Conn, error) {
+	return accept(conn, skeys, policy, MethodRC4|MethodPlaintext)
+}
+
+// accept is Accept selecting among the supported methods only
+func accept(conn net.Conn, skeys [][20]byte, policy Policy, supported Method) (*Conn, error) {
+	r := bufio.NewReaderSize(conn, keyLength+maxPad)
+	start, err := r.Peek(len(plainHandshake))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(start, plainHandshake) {
+		if policy == PolicyRequire {
+			return nil, ErrPlaintextRefused
+		}
+		return &Conn{Conn: conn, r: r}, nil
+	}
+	if policy == PolicyDisable {
+		return nil, ErrEncryptedRefused
+	}
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	peerPublic := make([]byte, keyLength)
+	_, err = io.ReadFull(r, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	sent := goWrite(conn, append(keys.public, padB...))
+	s := keys.secret(peerPublic)
+	req1 := hash([]byte("req1"), s)
+	err = syncTo(r, req1[:], maxPad)
+	if err != nil {
+		return nil, err
+	}
+
+	var obfuscated [20]byte
+	_, err = io.ReadFull(r, obfuscated[:])
+	if err != nil {
+		return nil, err
+	}
+	req3 := hash([]byte("req3"), s)
+	var skey [20]byte
+	found := false
+	for _, candidate := range skeys {
+		req2 := hash([]byte("req2"), candidate[:])
+		match := true
+		for i := range req2 {
+			if req2[i]^req3[i] != obfuscated[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			skey, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, ErrUnknownSKey
+	}
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+
+	var fields [14]byte
+	_, err = io.ReadFull(r, fields[:])
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(fields[:], fields[:])
+	if !bytes.Equal(fields[:8], vc[:]) {
+		return nil, errors.New("bad verification constant")
+	}
+	provide := Method(binary.BigEndian.Uint32(fields[8:12]))
+	padC := make([]byte, binary.BigEndian.Uint16(fields[12:14]))
+	_, err = io.ReadFull(r, padC)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+	var iaLength [2]byte
+	_, err = io.ReadFull(r, iaLength[:])
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(iaLength[:], iaLength[:])
+	ia := make([]byte, binary.BigEndian.Uint16(iaLength[:]))
+	_, err = io.ReadFull(r, ia)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected Method
+	provide &= supported
+	switch {
+	case provide&MethodRC4 != 0:
+		selected = MethodRC4
+	case provide&MethodPlaintext != 0 && policy != PolicyRequire:
+		selected = MethodPlaintext
+	default:
+		return nil, ErrNoCommonMethod
+	}
+	var answer [14]byte
+	copy(answer[:8], vc[:])
+	binary.BigEndian.PutUint32(answer[8:12], uint32(selected))
+	enc.XORKeyStream(answer[:], answer[:])
+	if err = <-sent; err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(answer[:])
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{Conn: conn, r: r, pending: ia, Method: selected}
+	if selected == MethodRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, nil
+}
@@ -0,0 +1,136 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type result struct {
+	conn *Conn
+	err  error
+}
+
+// handshake runs both ends over a pipe, the initiator for ih and the responder knowing skeys
+func handshake(ih [20]byte, out Policy, skeys [][20]byte, in Policy) (*Conn, error, *Conn, error) {
+	a, b := net.Pipe()
+	accepted := make(chan result, 1)
+	go func() {
+		c, err := Accept(b, skeys, in)
+		if err != nil {
+			b.Close()
+		}
+		accepted <- result{c, err}
+	}()
+	c, err := Initiate(a, ih, out)
+	if err != nil {
+		a.Close()
+	}
+	r := <-accepted
+	return c, err, r.conn, r.err
+}
+
+func exchange(t *testing.T, a, b net.Conn) {
+	go func() {
+		a.Write([]byte("\x13BitTorrent protocol and more"))
+	}()
+	buf := make([]byte, 29)
+	_, err := io.ReadFull(b, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "\x13BitTorrent protocol and more", string(buf))
+
+	go func() {
+		b.Write([]byte("answer"))
+	}()
+	buf = make([]byte, 6)
+	_, err = io.ReadFull(a, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "answer", string(buf))
+}
+
+func TestHandshake(t *testing.T) {
+	ih := [20]byte{1, 2, 3}
+	other := [20]byte{9}
+	tests := map[string]struct {
+		out, in Policy
+		method  Method
+	}{
+		"prefer both":       {PolicyPrefer, PolicyPrefer, MethodRC4},
+		"require initiator": {PolicyRequire, PolicyPrefer, MethodRC4},
+		"require responder": {PolicyPrefer, PolicyRequire, MethodRC4},
+	}
+	for name, test := range tests {
+		a, errA, b, errB := handshake(ih, test.out, [][20]byte{other, ih}, test.in)
+		require.Nil(t, errA, name)
+		require.Nil(t, errB, name)
+		assert.Equal(t, test.method, a.Method, name)
+		assert.Equal(t, test.method, b.Method, name)
+		exchange(t, a, b)
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestPlaintextSelected(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	accepted := make(chan result, 1)
+	go func() {
+		c, err := accept(b, [][20]byte{{1}}, PolicyPrefer, MethodPlaintext)
+		accepted <- result{c, err}
+	}()
+	c, err := Initiate(a, [20]byte{1}, PolicyPrefer)
+	require.Nil(t, err)
+	assert.Equal(t, MethodPlaintext, c.Method)
+	r := <-accepted
+	require.Nil(t, r.err)
+	exchange(t, c, r.conn)
+}
+
+func TestPlainPassthrough(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	accepted := make(chan result, 1)
+	go func() {
+		c, err := Accept(b, nil, PolicyPrefer)
+		accepted <- result{c, err}
+	}()
+	go a.Write([]byte("\x13BitTorrent protocol and more"))
+	r := <-accepted
+	require.Nil(t, r.err)
+	assert.Equal(t, Method(0), r.conn.Method)
+	buf := make([]byte, 29)
+	_, err := io.ReadFull(r.conn, buf)
+	require.Nil(t, err)
+	assert.Equal(t, "\x13BitTorrent protocol and more", string(buf))
+}
+
+func TestRefused(t *testing.T) {
+	ih := [20]byte{1}
+	_, errA, _, errB := handshake(ih, PolicyPrefer, [][20]byte{{2}}, PolicyPrefer)
+	assert.NotNil(t, errA, "unknown skey")
+	assert.ErrorIs(t, errB, ErrUnknownSKey)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	go a.Write([]byte("\x13BitTorrent protocol and more"))
+	_, err := Accept(b, nil, PolicyRequire)
+	assert.ErrorIs(t, err, ErrPlaintextRefused)
+
+	_, errA, _, errB = handshake(ih, PolicyPrefer, [][20]byte{ih}, PolicyDisable)
+	assert.NotNil(t, errA, "encryption disabled")
+	assert.ErrorIs(t, errB, ErrEncryptedRefused)
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{PolicyPrefer, PolicyRequire, PolicyDisable} {
+		parsed, err := ParsePolicy(p.String())
+		require.Nil(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParsePolicy("sometimes")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"bit_torrent_cli/holepunch"
+	"bit_torrent_cli/message"
+	"bit_torrent_cli/peers"
+	"bytes"
+	"fmt"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Version is the client name and version sent in the extension handshake
+const Version = "bit_torrent_cli/0.1.0"
+
+// sendExtHandshake tells the peer our client, the extensions we support and the port we take connections on
+func (pc *peerConn) sendExtHandshake() error {
+	m := map[string]interface{}{}
+	if pc.t.Holepunch {
+		m[holepunch.ExtensionName] = utHolepunchID
+	}
+	d := map[string]interface{}{"m": m, "v": Version}
+	if pc.t.Port != 0 {
+		d["p"] = int(pc.t.Port)
+	}
+	var payload bytes.Buffer
+	err := bencode.Marshal(&payload, d)
+	if err != nil {
+		return err
+	}
+	return pc.c.SendExtended(0, payload.Bytes())
+}
+
+func (pc *peerConn) handleExtended(msg *message.Message) error {
+	id, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+	switch id {
+	case 0:
+		return pc.handleExtHandshake(payload)
+	case utHolepunchID:
+		if !pc.t.Holepunch {
+			return nil
+		}
+		m, err := holepunch.Parse(payload)
+		if err != nil {
+			return err
+		}
+		return pc.handleHolepunch(m)
+	}
+	return nil
+}
+
+// handleExtHandshake learns the peer's client and where it takes connections,
+// and asks it for holes to the peers we could not dial
+func (pc *peerConn) handleExtHandshake(payload []byte) error {
+	v, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("extension handshake is not a dictionary")
+	}
+	var id int64
+	if m, ok := d["m"].(map[string]interface{}); ok {
+		id, _ = m[holepunch.ExtensionName].(int64)
+	}
+	port, _ := d["p"].(int64)
+	version, _ := d["v"].(string)
+
+	t := pc.t
+	t.mu.Lock()
+	if port > 0 && port < 1<<16 {
+		// an inbound peer is reached at its listen port rather than the one it connected from
+		pc.addr.Port = uint16(port)
+	}
+	if version != "" {
+		pc.client = version
+	}
+	var targets []peers.Peer
+	if id > 0 && id < 256 {
+		pc.holepunchID = byte(id)
+		if t.Holepunch {
+			for _, p := range t.unreachable {
+				targets = append(targets, p)
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, p := range targets {
+		err = pc.sendHolepunch(holepunch.Msg{Type: holepunch.Rendezvous, Addr: p})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package p2p
+
+// Priority controls whether and how urgently the pieces of a file are downloaded
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityNormal
+	PriorityHigh
+	PriorityReadahead // a Reader will need the piece soon
+	PriorityNow       // a Reader is blocked on the piece
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityReadahead:
+		return "readahead"
+	case PriorityNow:
+		return "now"
+	default:
+		return "unknown"
+	}
+}
+
+// File is one file of the torrent, laid out at Offset in the concatenated torrent data
+type File struct {
+	Path     string
+	Length   int
+	Offset   int
+	Priority Priority
+}
+
+// pieceRange returns the half-open range of pieces overlapping the file
+func (t *Torrent) pieceRange(f File) (begin, end int) {
+	return PieceRange(f, t.PieceLength)
+}
+
+// PieceRange returns the half-open range of pieces of pieceLength overlapping the file, empty for an empty file
+func PieceRange(f File, pieceLength int) (begin, end int) {
+	if f.Length == 0 {
+		return f.Offset / pieceLength, f.Offset / pieceLength
+	}
+	begin = f.Offset / pieceLength
+	end = (f.Offset+f.Length-1)/pieceLength + 1
+	return begin, end
+}
+
+// piecePriorities returns the priority of each piece: the highest priority of any file it overlaps
+func (t *Torrent) piecePriorities() []Priority {
+	prios := make([]Priority, len(t.PieceHashes))
+	if len(t.Files) == 0 {
+		for i := range prios {
+			prios[i] = PriorityNormal
+		}
+		return prios
+	}
+	for _, f := range t.Files {
+		begin, end := t.pieceRange(f)
+		for i := begin; i < end && i < len(prios); i++ {
+			if f.Priority > prios[i] {
+				prios[i] = f.Priority
+			}
+		}
+	}
+	return prios
+}
+
+// BoundaryPieces returns the wanted pieces that also hold data of skipped files
+func (t *Torrent) BoundaryPieces() []int {
+	prios := t.piecePriorities()
+	skipped := make([]bool, len(prios))
+	for _, f := range t.Files {
+		if f.Priority != PrioritySkip {
+			continue
+		}
+		begin, end := t.pieceRange(f)
+		for i := begin; i < end && i < len(prios); i++ {
+			skipped[i] = true
+		}
+	}
+	var boundary []int
+	for i := range prios {
+		if skipped[i] && prios[i] != PrioritySkip {
+			boundary = append(boundary, i)
+		}
+	}
+	return boundary
+}
+
+// SetFilePriority changes the priority of a file of a started torrent
+func (t *Torrent) SetFilePriority(index int, prio Priority) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Files[index].Priority = prio
+	t.base = t.piecePriorities()
+	t.wanted, t.donePieces = 0, 0
+	for i, base := range t.base {
+		if base != PrioritySkip {
+			t.wanted++
+			if t.have.HasPiece(i) {
+				t.donePieces++
+			}
+		}
+		// pieces readers are waiting for keep their boost
+		prio := base
+		if t.boosted[i] > prio {
+			prio = t.boosted[i]
+		}
+		t.work.setPriority(i, prio)
+	}
+	t.checkCompleteLocked()
+}
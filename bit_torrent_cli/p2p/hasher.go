@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"bit_torrent_cli/metrics"
+	"runtime"
+	"sync"
+)
+
+// DefaultMaxUnverifiedBytes is the budget of a Hasher given none, the default of anacrolix/torrent
+const DefaultMaxUnverifiedBytes = 64 << 20
+
+// hashQueue is how many downloaded pieces per worker may wait for their check before peers wait to submit more
+const hashQueue = 4
+
+var unverifiedBytes = metrics.NewGauge("bittorrent_unverified_bytes",
+	"Bytes of the pieces being downloaded or waiting for their hash check.")
+
+// Hasher checks the hashes of downloaded pieces on a pool of workers, so that no peer connection waits on hashing.
+// It also bounds the bytes of the pieces being downloaded or waiting for their check: no new piece is picked
+// while they are spent, which bounds the memory they take and holds the download back to the hashing.
+type Hasher struct {
+	jobs chan hashJob
+	done chan struct{}
+	stop sync.Once
+
+	mu      sync.Mutex
+	max     int64
+	pending int64
+	// starved is set when bytes were refused, wake being closed and replaced on the next release
+	starved bool
+	wake    chan struct{}
+}
+
+type hashJob struct {
+	pc    *peerConn
+	state *pieceProgress
+}
+
+// NewHasher starts the workers, one per CPU if 0, with a budget of maxUnverified bytes,
+// DefaultMaxUnverifiedBytes if 0. It may be shared by many torrents.
+func NewHasher(workers int, maxUnverified int64) *Hasher {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if maxUnverified <= 0 {
+		maxUnverified = DefaultMaxUnverifiedBytes
+	}
+	h := &Hasher{
+		jobs: make(chan hashJob, workers*hashQueue),
+		done: make(chan struct{}),
+		max:  maxUnverified,
+		wake: make(chan struct{}),
+	}
+	for range workers {
+		go h.work()
+	}
+	return h
+}
+
+func (h *Hasher) work() {
+	for {
+		select {
+		case j := <-h.jobs:
+			j.pc.verify(j.state)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// submit queues a downloaded piece for its check, waiting while the queue is full
+func (h *Hasher) submit(pc *peerConn, state *pieceProgress) {
+	select {
+	case h.jobs <- hashJob{pc, state}:
+	case <-pc.t.closing:
+		state.span.End()
+		h.release(int64(state.pw.length))
+	case <-h.done:
+		state.span.End()
+		h.release(int64(state.pw.length))
+	}
+}
+
+// reserve takes n bytes of the budget if they are left. They are always granted when none are taken,
+// so that pieces larger than the budget still download one at a time.
+func (h *Hasher) reserve(n int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pending > 0 && h.pending+n > h.max {
+		h.starved = true
+		return false
+	}
+	h.pending += n
+	unverifiedBytes.Add(float64(n))
+	return true
+}
+
+// release gives back bytes of the budget, waking the peers refused some
+func (h *Hasher) release(n int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending -= n
+	unverifiedBytes.Add(-float64(n))
+	if h.starved {
+		h.starved = false
+		close(h.wake)
+		h.wake = make(chan struct{})
+	}
+}
+
+// changed returns a channel closed once bytes are released after some were refused
+func (h *Hasher) changed() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.wake
+}
+
+// Unverified returns the bytes of the pieces being downloaded or waiting for their check
+func (h *Hasher) Unverified() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pending
+}
+
+// Close stops the workers, the pieces still queued being dropped
+func (h *Hasher) Close() {
+	h.stop.Do(func() { close(h.done) })
+}
@@ -0,0 +1,116 @@
+package p2p
+
+import (
+	"bit_torrent_cli/holepunch"
+	"bit_torrent_cli/peers"
+	"time"
+)
+
+const (
+	// utHolepunchID is the extended message ID we ask peers to use for ut_holepunch
+	utHolepunchID = 1
+	// punchWindow is how long a holepunch target is not asked for again
+	punchWindow = time.Minute
+)
+
+func (pc *peerConn) sendHolepunch(m holepunch.Msg) error {
+	if pc.holepunchID == 0 {
+		return nil
+	}
+	return pc.c.SendExtended(pc.holepunchID, m.Marshal())
+}
+
+// post queues a holepunch message for the connection's own loop to send, dropping it if the queue is full
+func (pc *peerConn) post(m holepunch.Msg) {
+	select {
+	case pc.outbox <- m:
+	default:
+	}
+}
+
+func (pc *peerConn) handleHolepunch(m holepunch.Msg) error {
+	switch m.Type {
+	case holepunch.Rendezvous:
+		return pc.relay(m.Addr)
+	case holepunch.Connect:
+		pc.t.punch(m.Addr)
+	case holepunch.Error:
+		pc.log.Info("holepunch failed", "target", m.Addr.String(), "code", m.Err)
+	}
+	return nil
+}
+
+// relay tells the peer and the target it asks for to connect to each other, if we are connected to both
+func (pc *peerConn) relay(target peers.Peer) error {
+	t := pc.t
+	t.mu.Lock()
+	from := pc.addr
+	var to *peerConn
+	for q := range t.conns {
+		if q.addr.IP.Equal(target.IP) && q.addr.Port == target.Port {
+			to = q
+			break
+		}
+	}
+	code := holepunch.NoError
+	switch {
+	case target.IP == nil || target.IP.IsUnspecified() || target.Port == 0:
+		code = holepunch.NoSuchPeer
+	case from.IP.Equal(target.IP) && from.Port == target.Port:
+		code = holepunch.NoSelf
+	case to == nil:
+		code = holepunch.NotConnected
+	case to.holepunchID == 0:
+		code = holepunch.NoSupport
+	}
+	t.mu.Unlock()
+	if code != holepunch.NoError {
+		return pc.sendHolepunch(holepunch.Msg{Type: holepunch.Error, Addr: target, Err: code})
+	}
+	to.post(holepunch.Msg{Type: holepunch.Connect, Addr: from})
+	return pc.sendHolepunch(holepunch.Msg{Type: holepunch.Connect, Addr: target})
+}
+
+// punch dials a peer a relay told us to connect to, as the peer dials us at the same time
+func (t *Torrent) punch(p peers.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := p.String()
+	if time.Since(t.punching[key]) < punchWindow {
+		return
+	}
+	for pc := range t.conns {
+		if pc.addr.IP.Equal(p.IP) && pc.addr.Port == p.Port {
+			return
+		}
+	}
+	t.punching[key] = time.Now()
+	delete(t.unreachable, key)
+	t.known[key] = p
+	t.candidates = append([]peers.Peer{p}, t.candidates...)
+	t.connectLocked()
+}
+
+// dialFailed asks the connected peers supporting holepunching to relay us to a peer we could not dial
+func (t *Torrent) dialFailed(p peers.Peer) {
+	if !t.Holepunch {
+		return
+	}
+	t.mu.Lock()
+	key := p.String()
+	if time.Since(t.punching[key]) < punchWindow {
+		t.mu.Unlock()
+		return
+	}
+	t.unreachable[key] = p
+	var relays []*peerConn
+	for pc := range t.conns {
+		if pc.holepunchID != 0 {
+			relays = append(relays, pc)
+		}
+	}
+	t.mu.Unlock()
+	for _, pc := range relays {
+		pc.post(holepunch.Msg{Type: holepunch.Rendezvous, Addr: p})
+	}
+}
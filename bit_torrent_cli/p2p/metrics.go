@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"bit_torrent_cli/metrics"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the byte counts of every peer connection, the overhead being what isn't piece data
+var (
+	wireDown, wireUp atomic.Int64
+	dataDown, dataUp atomic.Int64
+)
+
+var (
+	piecesChecked = metrics.NewCounter("bittorrent_pieces_total",
+		"Pieces downloaded by the native engine, by hash check result.", "result")
+	hashSeconds = metrics.NewHistogram("bittorrent_hash_check_seconds",
+		"Time taken to check the hash of a downloaded piece.", metrics.DefBuckets)
+	requestsQueued = metrics.NewGauge("bittorrent_requests_outstanding",
+		"Block requests sent to peers and not answered yet.")
+)
+
+// live are the started torrents not closed yet, which the peer gauges are computed from
+var live = struct {
+	sync.Mutex
+	torrents map[*Torrent]struct{}
+}{torrents: make(map[*Torrent]struct{})}
+
+func init() {
+	metrics.NewCounterFunc("bittorrent_transferred_bytes_total",
+		"Bytes exchanged with peers by the native engine, split into piece data and protocol overhead.",
+		[]string{"direction", "kind"}, func(emit func(float64, ...string)) {
+			down, up := dataDown.Load(), dataUp.Load()
+			emit(float64(down), "down", "data")
+			emit(float64(wireDown.Load()-down), "down", "overhead")
+			emit(float64(up), "up", "data")
+			emit(float64(wireUp.Load()-up), "up", "overhead")
+		})
+	metrics.NewGaugeFunc("bittorrent_peers",
+		"Peer connections of the native engine: connected, choking us, we are interested in, interested in us.",
+		[]string{"state"}, func(emit func(float64, ...string)) {
+			var connected, choking, interesting, interested int
+			live.Lock()
+			for t := range live.torrents {
+				for _, p := range t.PeerStats() {
+					connected++
+					if p.Choked {
+						choking++
+					}
+					if p.Interested {
+						interesting++
+					}
+					if p.PeerInterested {
+						interested++
+					}
+				}
+			}
+			live.Unlock()
+			emit(float64(connected), "connected")
+			emit(float64(choking), "choking")
+			emit(float64(interesting), "interesting")
+			emit(float64(interested), "interested")
+		})
+	metrics.NewGaugeFunc("bittorrent_torrents", "Torrents started by the native engine and not closed.",
+		nil, func(emit func(float64, ...string)) {
+			live.Lock()
+			n := len(live.torrents)
+			live.Unlock()
+			emit(float64(n))
+		})
+}
+
+// meteredConn counts every byte of a peer connection
+type meteredConn struct {
+	net.Conn
+}
+
+func (c meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	wireDown.Add(int64(n))
+	return n, err
+}
+
+func (c meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	wireUp.Add(int64(n))
+	return n, err
+}
+
+// checkPiece checks the hash of a downloaded piece, counting the result and the time taken
+func checkPiece(pw *pieceWord, buf []byte) error {
+	start := time.Now()
+	err := checkIntegrity(pw, buf)
+	hashSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		piecesChecked.Inc("failed")
+		return err
+	}
+	piecesChecked.Inc("verified")
+	return nil
+}
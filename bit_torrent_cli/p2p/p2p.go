@@ -1,15 +1,33 @@
 package p2p
 
 import (
+	"bit_torrent_cli/bitfield"
 	"bit_torrent_cli/client"
-	"bit_torrent_cli/message"
+	"bit_torrent_cli/handshake"
+	"bit_torrent_cli/logging"
+	"bit_torrent_cli/mse"
+	"bit_torrent_cli/peerid"
 	"bit_torrent_cli/peers"
+	"bit_torrent_cli/ratelimit"
+	"bit_torrent_cli/storage"
+	"bit_torrent_cli/tracing"
+	"bit_torrent_cli/transport"
+	"bit_torrent_cli/wiretrace"
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-	"runtime"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -25,12 +43,94 @@ type Torrent struct {
 	Length      int
 	PeerID      [20]byte
 	InfoHash    [20]byte
+	Files       []File
+	Bandwidth   Bandwidth
+	// MaxConns caps the torrent's connections, 0 meaning no cap
+	MaxConns int
+	// Slots caps the connections of every torrent sharing it, nil meaning no cap
+	Slots *ConnSlots
+	// Encryption is the MSE policy for outgoing connections
+	Encryption mse.Policy
+	// Dialer connects to peers, nil meaning TCP
+	Dialer transport.Dialer
+	// Port is where we take connections, told to peers in the extension handshake, 0 when not listening
+	Port uint16
+	// Holepunch relays peers to each other and asks for a relay to the peers we cannot dial (BEP 55)
+	Holepunch bool
+	// Logger is where the torrent logs, the default logger if nil
+	Logger *slog.Logger
+	// Recorder, if set, captures the handshakes and messages of every connection
+	Recorder *wiretrace.Recorder
+	// Data, if set, is checked at Start for pieces already there, which are not downloaded again
+	Data io.ReaderAt
+	// Storage keeps the data, in memory if nil. Its pieces from an earlier run are checked at Start like Data's.
+	// The torrent closes it.
+	Storage storage.Storage
+	// Hasher checks the downloaded pieces, shared by the torrents given it, nil meaning one of the torrent's own
+	// with the default workers and budget
+	Hasher *Hasher
+
+	log        *slog.Logger
+	mu         sync.Mutex
+	cond       *sync.Cond
+	store      storage.Storage
+	have       bitfield.Bitfield
+	base       []Priority
+	boosted    map[int]Priority
+	readers    map[*Reader]struct{}
+	work       *picker
+	hasher     *Hasher
+	ownHasher  bool
+	results    chan *pieceResult
+	wanted     int
+	donePieces int
+	doneOrder  []int
+	connected  int
+	numConns   int
+	known      map[string]peers.Peer
+	candidates []peers.Peer
+	conns      map[*peerConn]struct{}
+	downloaded int64
+	uploaded   int64
+	complete   chan struct{}
+	completed  bool
+	closing    chan struct{}
+	paused     bool
+	closed     bool
+
+	// unreachable are the peers we could not dial waiting for a holepunch, punching the recent holepunch targets
+	unreachable map[string]peers.Peer
+	punching    map[string]time.Time
+
+	// span lasts from Start to Close, the parent of the spans of the connections
+	ctx  context.Context
+	span trace.Span
 }
 
+// Bandwidth holds the token buckets throttling the torrent's peer connections
+type Bandwidth struct {
+	// Global and Torrent are shared by every connection they apply to, nil meaning unlimited
+	Global  *ratelimit.Bucket
+	Torrent *ratelimit.Bucket
+	// Peer is applied to each connection separately
+	Peer ratelimit.Limits
+}
+
+// ErrClosed is returned when waiting on a torrent that has been closed
+var ErrClosed = errors.New("torrent closed")
+
+// ErrNotAccepting is returned for inbound connections to a paused torrent or one at its connection cap
+var ErrNotAccepting = errors.New("torrent not accepting connections")
+
+// tracer makes the spans of the torrents, their connections and pieces, exported once a tracer provider is set up
+var tracer = otel.Tracer("bit_torrent_cli/p2p")
+
 type pieceWord struct {
-	index  int
-	hash   [20]byte
-	length int
+	index    int
+	hash     [20]byte
+	length   int
+	priority Priority
+	state    pieceState
 }
 
 type pieceResult struct {
@@ -38,170 +138,370 @@ type pieceResult struct {
 	index int
 }
 
-type pieceProgress struct {
-	client     *client.Client
-	buf        []byte
-	index      int
-	downloaded int
-	requested  int
-	backlog    int
+// integrityError is returned for a piece whose hash does not match
+type integrityError struct {
+	index int
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read()
-	if err != nil {
-		return err
+func (e integrityError) Error() string {
+	return fmt.Sprintf("piece #%d failed integrity check", e.index)
+}
+
+func (e integrityError) ErrClass() string {
+	return "integrity"
+}
+
+// checkIntegrity checks the integrity of the downloaded piece
+func checkIntegrity(pw *pieceWord, buf []byte) error {
+	bash := sha1.Sum(buf)
+	if !bytes.Equal(bash[:], pw.hash[:]) {
+		return integrityError{pw.index}
 	}
+	return nil
+}
 
-	if msg == nil {
-		return nil
+// Download starts the download of the torrent
+func (t *Torrent) calculateBoundsForPiece(index int) (begin, end int) {
+	begin = index * t.PieceLength
+	end = begin + t.PieceLength
+	if end > t.Length {
+		end = t.Length
 	}
+	return begin, end
+}
 
-	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
-	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		index, err := message.ParseHave(msg)
-		if err != nil {
-			return err
-		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
-		if err != nil {
-			return err
-		}
-		state.downloaded += n
-		state.backlog--
+// calculatePieceSize calculates the size of a piece
+func (t *Torrent) calculatePieceSize(index int) int {
+	begin, end := t.calculateBoundsForPiece(index)
+	return end - begin
+}
 
+// Start begins downloading the wanted pieces in the background.
+// Pieces of skipped files are only fetched when a Reader asks for them.
+func (t *Torrent) Start() {
+	t.log = logging.For(t.Logger, "p2p").With(logging.KeyInfohash, hex.EncodeToString(t.InfoHash[:]))
+	t.log.Info("starting download", "name", t.Name, "pieces", len(t.PieceHashes))
+	t.ctx, t.span = tracer.Start(context.Background(), "torrent", trace.WithAttributes(
+		attribute.String("torrent.name", t.Name),
+		attribute.String("torrent.info_hash", hex.EncodeToString(t.InfoHash[:])),
+		attribute.Int("torrent.pieces", len(t.PieceHashes)),
+		attribute.Int("torrent.length", t.Length),
+	))
+	t.cond = sync.NewCond(&t.mu)
+	// the priorities of the files may change while downloading
+	t.Files = append([]File(nil), t.Files...)
+	t.store = t.Storage
+	if t.store == nil {
+		t.store, _ = storage.Memory{}.Open(storage.Layout{PieceLength: t.PieceLength, Length: t.Length})
 	}
-	return nil
+	t.have = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	t.base = t.piecePriorities()
+	t.boosted = make(map[int]Priority)
+	t.readers = make(map[*Reader]struct{})
+	t.known = make(map[string]peers.Peer)
+	t.unreachable = make(map[string]peers.Peer)
+	t.punching = make(map[string]time.Time)
+	t.conns = make(map[*peerConn]struct{})
+	t.complete = make(chan struct{})
+	t.closing = make(chan struct{})
+	t.results = make(chan *pieceResult)
+	t.hasher = t.Hasher
+	if t.hasher == nil {
+		t.hasher = NewHasher(0, 0)
+		t.ownHasher = true
+	}
+
+	pieces := make([]*pieceWord, len(t.PieceHashes))
+	for index, hash := range t.PieceHashes {
+		length := t.calculatePieceSize(index)
+		pieces[index] = &pieceWord{index: index, hash: hash, length: length, priority: t.base[index]}
+		if t.base[index] != PrioritySkip {
+			t.wanted++
+		}
+	}
+	if t.Data != nil || t.Storage != nil {
+		t.loadData(pieces)
+	}
+	t.checkCompleteLocked()
+	t.work = newPicker(pieces)
+
+	live.Lock()
+	live.torrents[t] = struct{}{}
+	live.Unlock()
+
+	go t.collect()
+	t.AddPeers(t.Peers)
 }
 
-// attenpDownloadPiece downloads a piece from a peer and returns the buffer
-func attenpDownloadPiece(c *client.Client, pw *pieceWord) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
-	}
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
-
-	for state.downloaded < pw.length {
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
-
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
+// loadData marks done the pieces matching their hash in the storage or else in t.Data, copying those of t.Data
+// to the storage
+func (t *Torrent) loadData(pieces []*pieceWord) {
+	loaded := 0
+	buf := make([]byte, t.PieceLength)
+	for _, pw := range pieces {
+		p := buf[:pw.length]
+		if !t.store.Stored(pw.index) || !t.readPiece(t.store, pw, p) {
+			if t.Data == nil || !t.readPiece(t.Data, pw, p) {
+				continue
 			}
+			err := t.store.WritePiece(pw.index, p)
+			if err != nil {
+				t.log.Error("storing existing piece failed", logging.KeyPiece, pw.index, logging.Err(err))
+				continue
+			}
+		}
+		pw.state = stateDone
+		t.have.SetPiece(pw.index)
+		t.doneOrder = append(t.doneOrder, pw.index)
+		if pw.priority != PrioritySkip {
+			t.donePieces++
 		}
+		loaded++
+	}
+	t.log.Info("checked existing data", "pieces", loaded, "of", len(pieces))
+}
 
-		err := state.readMessage()
+// readPiece reads a piece from r, telling whether it is there and matches its hash
+func (t *Torrent) readPiece(r io.ReaderAt, pw *pieceWord, p []byte) bool {
+	begin, _ := t.calculateBoundsForPiece(pw.index)
+	_, err := r.ReadAt(p, int64(begin))
+	return err == nil && checkIntegrity(pw, p) == nil
+}
+
+// collect stores verified pieces and wakes up the readers waiting for them
+func (t *Torrent) collect() {
+	for {
+		var res *pieceResult
+		select {
+		case res = <-t.results:
+		case <-t.closing:
+			return
+		}
+		err := t.store.WritePiece(res.index, res.buf)
 		if err != nil {
-			return nil, err
+			select {
+			case <-t.closing:
+				// the storage was closed with the torrent
+				return
+			default:
+			}
+			// downloaded again, if the storage recovers
+			t.log.Error("storing piece failed", logging.KeyPiece, res.index, logging.Err(err))
+			t.work.requeue(t.work.pieces[res.index])
+			continue
 		}
+		t.mu.Lock()
+		t.have.SetPiece(res.index)
+		t.doneOrder = append(t.doneOrder, res.index)
+		if t.base[res.index] != PrioritySkip {
+			t.donePieces++
+			t.checkCompleteLocked()
+		}
+		t.cond.Broadcast()
+		t.mu.Unlock()
+		t.work.finish(res.index)
 	}
-	return state.buf, nil
 }
 
-// checkIntegrity checks the integrity of the downloaded piece
-func checkIntegrity(pw *pieceWord, buf []byte) error {
-	bash := sha1.Sum(buf)
-	if !bytes.Equal(bash[:], pw.hash[:]) {
-		return fmt.Errorf("index %d failed integrity check ", pw.index)
+// AddPeers adds peers to connect to, as many at once as the connection caps allow
+func (t *Torrent) AddPeers(ps []peers.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range ps {
+		key := p.String()
+		if _, ok := t.known[key]; ok {
+			continue
+		}
+		t.known[key] = p
+		t.candidates = append(t.candidates, p)
 	}
-	return nil
+	t.connectLocked()
 }
 
-// Download starts the download of the torrent
-func (t *Torrent) startDownLoadWorker(peer peers.Peer, workQueue chan *pieceWord, resultQueue chan *pieceResult) {
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
+// connectLocked dials candidate peers until a connection cap is reached
+func (t *Torrent) connectLocked() {
+	for len(t.candidates) > 0 && !t.paused && !t.closed {
+		if t.MaxConns > 0 && t.numConns >= t.MaxConns {
+			return
+		}
+		if !t.Slots.tryAcquire() {
+			return
+		}
+		peer := t.candidates[0]
+		t.candidates = t.candidates[1:]
+		t.numConns++
+		go t.dial(peer)
+	}
+}
+
+func (t *Torrent) dial(peer peers.Peer) {
+	_, span := tracer.Start(t.ctx, "peer.connect", trace.WithAttributes(attribute.String("peer.addr", peer.String())))
+	c, err := client.Dial(t.Dialer, peer, t.PeerID, t.InfoHash, t.Encryption)
+	tracing.End(span, err)
 	if err != nil {
-		log.Printf("cound not handshake with %s . disconnecting \n", peer.IP)
+		t.log.Debug("could not connect", logging.KeyPeer, peer.String(), logging.Err(err))
+		t.connDone()
+		t.dialFailed(peer)
 		return
 	}
-	defer c.Conn.Close()
+	t.log.Debug("connected", logging.KeyPeer, peer.String(), "client", peerid.Client(c.RemoteID))
+	t.runPeer(c)
+}
 
-	log.Printf(" completed handshake with %s\n", peer.IP)
-	c.Sendunchoke()
-	c.SendInterested()
+// connDone releases the slot of a finished connection and dials the next candidate
+func (t *Torrent) connDone() {
+	t.Slots.release()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.numConns--
+	t.connectLocked()
+}
 
-	// send bitfield
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw
-			continue
-		}
+// AcceptConn takes over an inbound connection whose handshake has already been read
+func (t *Torrent) AcceptConn(conn net.Conn, hs *handshake.Handshake) error {
+	t.mu.Lock()
+	if t.paused || t.closed || (t.MaxConns > 0 && t.numConns >= t.MaxConns) {
+		t.mu.Unlock()
+		return ErrNotAccepting
+	}
+	if !t.Slots.tryAcquire() {
+		t.mu.Unlock()
+		return ErrNotAccepting
+	}
+	t.numConns++
+	t.mu.Unlock()
 
-		buf, err := attenpDownloadPiece(c, pw)
-		if err != nil {
-			log.Println("Exiting", err)
-			workQueue <- pw
-			return
-		}
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Printf("piece #%d failed integrity check \n", pw.index)
-			workQueue <- pw
-			continue
-		}
-		// send have message
-		c.SendHave(pw.index)
-		resultQueue <- &pieceResult{index: pw.index, buf: buf}
+	c, err := client.Accept(conn, hs, t.PeerID, len(t.PieceHashes))
+	if err != nil {
+		t.connDone()
+		return err
 	}
+	t.log.Debug("accepted", logging.KeyPeer, c.Peer().String(), "client", peerid.Client(c.RemoteID))
+	t.mu.Lock()
+	t.known[c.Peer().String()] = c.Peer()
+	t.mu.Unlock()
+	go t.runPeer(c)
+	return nil
 }
 
-// Download starts the download of the torrent
-func (t *Torrent) calculateBoundsForPiece(index int) (begin, end int) {
-	begin = index * t.PieceLength
-	end = begin + t.PieceLength
-	if end > t.Length {
-		end = t.Length
+// Pause drops every connection and makes no new ones until Resume. Downloaded pieces are kept.
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = true
+	for pc := range t.conns {
+		pc.c.Conn.Close()
 	}
-	return begin, end
 }
 
-// calculatePieceSize calculates the size of a piece
-func (t *Torrent) calculatePieceSize(index int) int {
-	begin, end := t.calculateBoundsForPiece(index)
-	return end - begin
+// Resume reconnects to every known peer of a paused torrent
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.paused {
+		return
+	}
+	t.paused = false
+	t.candidates = t.candidates[:0]
+	for _, p := range t.known {
+		t.candidates = append(t.candidates, p)
+	}
+	t.connectLocked()
 }
 
-func (t *Torrent) Download() ([]byte, error) {
-	log.Println("starting dowload for ", t.Name)
-	workqueue := make(chan *pieceWord, len(t.PieceHashes))
-	results := make(chan *pieceResult)
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workqueue <- &pieceWord{index: index, hash: hash, length: length}
+// checkCompleteLocked closes the complete channel once every wanted piece is verified,
+// and replaces it when pieces are wanted again after that
+func (t *Torrent) checkCompleteLocked() {
+	switch {
+	case t.donePieces == t.wanted && !t.completed:
+		t.completed = true
+		close(t.complete)
+		t.span.AddEvent("complete")
+	case t.donePieces < t.wanted && t.completed:
+		t.completed = false
+		t.complete = make(chan struct{})
+	}
+}
+
+// Complete is closed once every wanted piece is verified
+func (t *Torrent) Complete() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.complete
+}
+
+// Wait blocks until every wanted piece is verified
+func (t *Torrent) Wait() error {
+	select {
+	case <-t.Complete():
+		return nil
+	case <-t.closing:
+		return ErrClosed
+	}
+}
+
+// Close stops the download and fails pending reads
+func (t *Torrent) Close() error {
+	live.Lock()
+	delete(live.torrents, t)
+	live.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	close(t.closing)
+	t.span.End()
+	t.work.close()
+	if t.ownHasher {
+		t.hasher.Close()
 	}
+	err := t.store.Close()
+	if err != nil {
+		t.log.Error("closing storage failed", logging.Err(err))
+	}
+	for pc := range t.conns {
+		pc.c.Conn.Close()
+	}
+	t.cond.Broadcast()
+	return nil
+}
 
-	for _, peer := range t.Peers {
-		go t.startDownLoadWorker(peer, workqueue, results)
+// TraceContext holds the torrent's span, for tracing the work done on its behalf
+func (t *Torrent) TraceContext() context.Context {
+	if t.ctx == nil {
+		return context.Background()
 	}
+	return t.ctx
+}
+
+// ReadAt reads the torrent's data from the storage, which may fail on the pieces not verified
+func (t *Torrent) ReadAt(p []byte, off int64) (int, error) {
+	return t.store.ReadAt(p, off)
+}
 
+// Download downloads every piece overlapping a file that isn't skipped.
+// Pieces of skipped files are left zeroed in the returned buffer.
+func (t *Torrent) Download() ([]byte, error) {
+	t.Start()
+	defer t.Close()
+	err := t.Wait()
+	if err != nil {
+		return nil, err
+	}
 	buf := make([]byte, t.Length)
-	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
-		donePieces++
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
-	}
-	close(workqueue)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for index := range t.PieceHashes {
+		if !t.have.HasPiece(index) {
+			continue
+		}
+		begin, end := t.calculateBoundsForPiece(index)
+		_, err = t.store.ReadAt(buf[begin:end], int64(begin))
+		if err != nil {
+			return nil, err
+		}
+	}
 	return buf, nil
 }
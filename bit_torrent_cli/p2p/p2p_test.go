@@ -0,0 +1,371 @@
+package p2p_test
+
+import (
+	"bit_torrent_cli/metrics"
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/peers"
+	"bit_torrent_cli/swarm"
+	"bit_torrent_cli/torrentfile"
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func wait(t *testing.T, pt *p2p.Torrent) {
+	select {
+	case <-pt.Complete():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s did not complete: %+v", pt.Name, pt.Stats())
+	}
+}
+
+func TestLeechersTrade(t *testing.T) {
+	// each leecher reaches a seeder with half of the pieces and gets the other half from the other leecher
+	content := swarm.NewContent("data.bin", 16<<10, 3, 200<<10)
+	var even, odd []int
+	for i := range content.Torrent.PieceHashes {
+		if i%2 == 0 {
+			even = append(even, i)
+		} else {
+			odd = append(odd, i)
+		}
+	}
+	evenSeeder, err := swarm.NewPeer(content, swarm.Behavior{Have: even})
+	require.Nil(t, err)
+	defer evenSeeder.Close()
+	oddSeeder, err := swarm.NewPeer(content, swarm.Behavior{Have: odd, Latency: time.Millisecond})
+	require.Nil(t, err)
+	defer oddSeeder.Close()
+
+	a := content.Torrent.NewTorrent([20]byte{'a'}, []peers.Peer{evenSeeder.Addr()})
+	b := content.Torrent.NewTorrent([20]byte{'b'}, []peers.Peer{oddSeeder.Addr()})
+	la, err := swarm.Listen(a)
+	require.Nil(t, err)
+	defer la.Close()
+	a.Start()
+	defer a.Close()
+	b.Start()
+	defer b.Close()
+	b.AddPeers([]peers.Peer{la.Addr()})
+
+	wait(t, a)
+	wait(t, b)
+	for _, pt := range []*p2p.Torrent{a, b} {
+		buf := make([]byte, len(content.Data))
+		_, err = pt.ReadAt(buf, 0)
+		require.Nil(t, err)
+		assert.Equal(t, content.Data, buf, pt.Name)
+	}
+	total := len(content.Torrent.PieceHashes)
+	assert.Less(t, evenSeeder.Served()+oddSeeder.Served(), 2*total, "leechers traded pieces")
+
+	// the leecher names itself in the extension handshake, the fake seeder only has its peer ID
+	clients := make(map[string]bool)
+	for _, p := range b.PeerStats() {
+		clients[p.Client] = true
+	}
+	assert.Equal(t, map[string]bool{p2p.Version: true, "SW 0.0.0.1": true}, clients)
+}
+
+func TestFileSelection(t *testing.T) {
+	content := swarm.NewContent("dir", 16<<10, 4, 64<<10, 64<<10)
+	seeder, err := swarm.NewPeer(content, swarm.Behavior{})
+	require.Nil(t, err)
+	defer seeder.Close()
+
+	tf := content.Torrent
+	tf.Files = append([]p2p.File(nil), tf.Files...)
+	tf.Files[1].Priority = p2p.PrioritySkip
+	pt := tf.NewTorrent([20]byte{'a'}, []peers.Peer{seeder.Addr()})
+	pt.Start()
+	defer pt.Close()
+	wait(t, pt)
+	assert.Equal(t, 4, seeder.Served(), "only the pieces of the first file")
+	assert.Equal(t, 4, pt.Stats().WantedDone)
+}
+
+func TestHasherBudget(t *testing.T) {
+	// a budget below a piece lets the torrents sharing the hasher download one piece at a time
+	content := swarm.NewContent("data.bin", 16<<10, 6, 96<<10)
+	h := p2p.NewHasher(1, 1)
+	defer h.Close()
+	var torrents []*p2p.Torrent
+	for _, id := range []byte{'a', 'b'} {
+		var addrs []peers.Peer
+		for range 3 {
+			seeder, err := swarm.NewPeer(content, swarm.Behavior{})
+			require.Nil(t, err)
+			defer seeder.Close()
+			addrs = append(addrs, seeder.Addr())
+		}
+		pt := content.Torrent.NewTorrent([20]byte{id}, addrs)
+		pt.Hasher = h
+		torrents = append(torrents, pt)
+	}
+
+	var most int64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			most = max(most, h.Unverified())
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+		}
+	}()
+	for _, pt := range torrents {
+		pt.Start()
+		defer pt.Close()
+	}
+	for _, pt := range torrents {
+		wait(t, pt)
+		buf := make([]byte, len(content.Data))
+		_, err := pt.ReadAt(buf, 0)
+		require.Nil(t, err)
+		assert.Equal(t, content.Data, buf)
+	}
+	close(stop)
+	<-sampled
+	assert.Greater(t, most, int64(0))
+	assert.LessOrEqual(t, most, int64(content.Torrent.PieceLength))
+	assert.Equal(t, int64(0), h.Unverified())
+}
+
+// scrape reads a series of the default metrics registry, 0 if it is missing
+func scrape(t *testing.T, series string) float64 {
+	var buf bytes.Buffer
+	_, err := metrics.Default.WriteTo(&buf)
+	require.Nil(t, err)
+	m := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(series) + ` (\S+)$`).FindSubmatch(buf.Bytes())
+	if m == nil {
+		return 0
+	}
+	v, err := strconv.ParseFloat(string(m[1]), 64)
+	require.Nil(t, err)
+	return v
+}
+
+func TestMetrics(t *testing.T) {
+	content := swarm.NewContent("data.bin", 16<<10, 4, 64<<10)
+	liar, err := swarm.NewPeer(content, swarm.Behavior{Corrupt: []int{0, 1, 2, 3}})
+	require.Nil(t, err)
+	defer liar.Close()
+	seeder, err := swarm.NewPeer(content, swarm.Behavior{Latency: 20 * time.Millisecond})
+	require.Nil(t, err)
+	defer seeder.Close()
+
+	verified := scrape(t, `bittorrent_pieces_total{result="verified"}`)
+	failed := scrape(t, `bittorrent_pieces_total{result="failed"}`)
+	data := scrape(t, `bittorrent_transferred_bytes_total{direction="down",kind="data"}`)
+	overhead := scrape(t, `bittorrent_transferred_bytes_total{direction="down",kind="overhead"}`)
+	checks := scrape(t, `bittorrent_hash_check_seconds_count`)
+
+	pt := content.Torrent.NewTorrent([20]byte{'a'}, []peers.Peer{liar.Addr(), seeder.Addr()})
+	pt.Start()
+	defer pt.Close()
+	wait(t, pt)
+	assert.Equal(t, 1.0, scrape(t, `bittorrent_peers{state="connected"}`), "the liar is dropped")
+
+	assert.Equal(t, 4.0, scrape(t, `bittorrent_pieces_total{result="verified"}`)-verified)
+	assert.Equal(t, 1.0, scrape(t, `bittorrent_pieces_total{result="failed"}`)-failed)
+	assert.Equal(t, 5.0, scrape(t, `bittorrent_hash_check_seconds_count`)-checks)
+	assert.GreaterOrEqual(t, scrape(t, `bittorrent_transferred_bytes_total{direction="down",kind="data"}`)-data, float64(len(content.Data)))
+	assert.Greater(t, scrape(t, `bittorrent_transferred_bytes_total{direction="down",kind="overhead"}`)-overhead, 0.0)
+}
+
+// spans records the spans of every test, the tracers of the packages sticking to the first provider set
+var spans = sync.OnceValue(func() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	return exporter
+})
+
+func TestTracing(t *testing.T) {
+	exporter := spans()
+	exporter.Reset()
+
+	content := swarm.NewContent("data.bin", 16<<10, 2, 32<<10)
+	seeder, err := swarm.NewPeer(content, swarm.Behavior{})
+	require.Nil(t, err)
+	defer seeder.Close()
+	pt := content.Torrent.NewTorrent([20]byte{'a'}, []peers.Peer{seeder.Addr()})
+	pt.Start()
+	wait(t, pt)
+	pt.Close()
+	require.Eventually(t, func() bool {
+		for _, s := range exporter.GetSpans() {
+			if s.Name == "peer" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond, "the connection ends after the torrent is closed")
+
+	// every span but the torrent's own descends from it
+	byID := make(map[string]tracetest.SpanStub)
+	names := make(map[string]int)
+	for _, s := range exporter.GetSpans() {
+		byID[s.SpanContext.SpanID().String()] = s
+		names[s.Name]++
+	}
+	assert.Equal(t, map[string]int{"torrent": 1, "peer.connect": 1, "peer": 1, "piece.download": 2, "piece.verify": 2}, names)
+	for _, s := range exporter.GetSpans() {
+		chain := []string{s.Name}
+		for p := s.Parent; p.IsValid(); p = byID[p.SpanID().String()].Parent {
+			chain = append(chain, byID[p.SpanID().String()].Name)
+		}
+		assert.Equal(t, "torrent", chain[len(chain)-1], chain)
+	}
+}
+
+func TestHolepunch(t *testing.T) {
+	// a and c are behind NATs and only meet through b, which wants none of the pieces
+	content := swarm.NewContent("data.bin", 16<<10, 5, 128<<10)
+	seeder, err := swarm.NewPeer(content, swarm.Behavior{})
+	require.Nil(t, err)
+	nat := swarm.NewNAT()
+	start := func(id byte, tf torrentfile.Torrentfile, ps ...peers.Peer) (*p2p.Torrent, peers.Peer) {
+		pt := tf.NewTorrent([20]byte{id}, ps)
+		pt.Holepunch = true
+		l, err := swarm.Listen(pt)
+		require.Nil(t, err)
+		t.Cleanup(func() { l.Close() })
+		pt.Port = l.Addr().Port
+		if id != 'b' {
+			pt.Dialer = nat.Hide(l.Addr())
+		}
+		pt.Start()
+		t.Cleanup(func() { pt.Close() })
+		return pt, l.Addr()
+	}
+
+	c, caddr := start('c', content.Torrent, seeder.Addr())
+	wait(t, c)
+	seeder.Close()
+	relay := content.Torrent
+	relay.Files = []p2p.File{relay.Files[0]}
+	relay.Files[0].Priority = p2p.PrioritySkip
+	b, baddr := start('b', relay)
+	c.AddPeers([]peers.Peer{baddr})
+	require.Eventually(t, func() bool { return b.Stats().Peers == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	a, _ := start('a', content.Torrent, caddr, baddr)
+	wait(t, a)
+	buf := make([]byte, len(content.Data))
+	_, err = a.ReadAt(buf, 0)
+	require.Nil(t, err)
+	assert.Equal(t, content.Data, buf)
+	assert.Equal(t, 0, b.Stats().PiecesDone)
+}
+
+func priorities(pt *p2p.Torrent) []p2p.Priority {
+	var prios []p2p.Priority
+	for _, st := range pt.PieceStats() {
+		prios = append(prios, st.Priority)
+	}
+	return prios
+}
+
+func TestReaderBlocks(t *testing.T) {
+	content := swarm.NewContent("dir", 16<<10, 7, 40<<10, 24<<10)
+	seeder, err := swarm.NewPeer(content, swarm.Behavior{})
+	require.Nil(t, err)
+	defer seeder.Close()
+	pt := content.Torrent.NewTorrent([20]byte{'a'}, nil)
+	pt.Start()
+	defer pt.Close()
+
+	r := pt.NewFileReader(content.Torrent.Files[1])
+	defer r.Close()
+	read := make(chan []byte)
+	go func() {
+		got, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		read <- got
+	}()
+	select {
+	case <-read:
+		t.Fatal("read before any piece was downloaded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pt.AddPeers([]peers.Peer{seeder.Addr()})
+	select {
+	case got := <-read:
+		assert.Equal(t, content.Data[40<<10:], got)
+	case <-time.After(10 * time.Second):
+		t.Fatal("read did not end once the pieces were verified")
+	}
+}
+
+func TestReaderPriorities(t *testing.T) {
+	content := swarm.NewContent("data.bin", 16<<10, 8, 128<<10)
+	// no peers, so that no piece is done and the priorities stay
+	pt := content.Torrent.NewTorrent([20]byte{'a'}, nil)
+	pt.Start()
+	defer pt.Close()
+	// W is the piece under the read position, R those of the readahead after it
+	const (
+		N = p2p.PriorityNormal
+		R = p2p.PriorityReadahead
+		W = p2p.PriorityNow
+	)
+
+	r := pt.NewReader()
+	r.SetReadahead(32 << 10)
+	assert.Equal(t, []p2p.Priority{W, R, N, N, N, N, N, N}, priorities(pt))
+
+	tests := []struct {
+		offset int64
+		whence int
+		pos    int64
+		prios  []p2p.Priority
+	}{
+		{48 << 10, io.SeekStart, 48 << 10, []p2p.Priority{N, N, N, W, R, N, N, N}},
+		// within piece 4, the readahead reaching into piece 6
+		{20 << 10, io.SeekCurrent, 68 << 10, []p2p.Priority{N, N, N, N, W, R, R, N}},
+		{-16 << 10, io.SeekEnd, 112 << 10, []p2p.Priority{N, N, N, N, N, N, N, W}},
+		// past the end nothing is left to read
+		{10, io.SeekEnd, 128<<10 + 10, []p2p.Priority{N, N, N, N, N, N, N, N}},
+	}
+	for _, test := range tests {
+		pos, err := r.Seek(test.offset, test.whence)
+		require.Nil(t, err)
+		assert.Equal(t, test.pos, pos)
+		assert.Equal(t, test.prios, priorities(pt), "at %d", pos)
+	}
+	n, err := r.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = r.Seek(-1, io.SeekStart)
+	assert.NotNil(t, err)
+	_, err = r.Seek(0, 42)
+	assert.NotNil(t, err)
+
+	// the pieces another reader wants stay raised once the first is closed
+	_, err = r.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+	other := pt.NewReader()
+	other.SetReadahead(16 << 10)
+	_, err = other.Seek(96<<10, io.SeekStart)
+	require.Nil(t, err)
+	assert.Equal(t, []p2p.Priority{W, R, N, N, N, N, W, N}, priorities(pt))
+	require.Nil(t, r.Close())
+	assert.Equal(t, []p2p.Priority{N, N, N, N, N, N, W, N}, priorities(pt))
+	require.Nil(t, other.Close())
+	assert.Equal(t, []p2p.Priority{N, N, N, N, N, N, N, N}, priorities(pt))
+}
@@ -0,0 +1,508 @@
+package p2p
+
+import (
+	"bit_torrent_cli/bitfield"
+	"bit_torrent_cli/client"
+	"bit_torrent_cli/holepunch"
+	"bit_torrent_cli/logging"
+	"bit_torrent_cli/message"
+	"bit_torrent_cli/peerid"
+	"bit_torrent_cli/peers"
+	"bit_torrent_cli/ratelimit"
+	"bit_torrent_cli/tracing"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// MaxRequestLength is the largest block a peer may request from us
+	MaxRequestLength = 128 << 10
+	// pieceTimeout is how long a peer has to deliver a whole piece
+	pieceTimeout = 30 * time.Second
+)
+
+// errPieceTimeout ends the span of a piece the peer did not deliver in time
+var errPieceTimeout = errors.New("piece timed out")
+
+// ConnSlots caps the number of connections of every torrent sharing it
+type ConnSlots struct {
+	slots chan struct{}
+}
+
+func NewConnSlots(n int) *ConnSlots {
+	return &ConnSlots{slots: make(chan struct{}, n)}
+}
+
+func (s *ConnSlots) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *ConnSlots) release() {
+	if s == nil {
+		return
+	}
+	<-s.slots
+}
+
+// InUse returns how many connections hold a slot
+func (s *ConnSlots) InUse() int {
+	return len(s.slots)
+}
+
+type pieceProgress struct {
+	pw         *pieceWord
+	buf        []byte
+	downloaded int
+	requested  int
+	backlog    int
+	deadline   *time.Timer
+	// span lasts until the piece is verified or dropped
+	ctx  context.Context
+	span trace.Span
+}
+
+// peerConn downloads wanted pieces from one peer and answers its requests
+type peerConn struct {
+	t    *Torrent
+	c    *client.Client
+	log  *slog.Logger
+	msgs chan *message.Message
+	errs chan error
+	done chan struct{}
+	// failed takes the hash check failure of a piece the peer delivered
+	failed chan error
+	state  *pieceProgress
+	haves  int // how many of t.doneOrder the peer was told about
+	// outbox holds the holepunch messages other connections ask this one to send
+	outbox chan holepunch.Msg
+
+	// guarded by t.mu, for PeerStats
+	downloaded int64
+	uploaded   int64
+	choked     bool
+	has        int
+	piece      int
+	// interested is whether we told the peer we want its pieces, peerInterested whether it told us it wants ours
+	interested     bool
+	peerInterested bool
+	// addr is where the peer takes connections and holepunchID its ID for ut_holepunch, 0 without support
+	addr        peers.Peer
+	holepunchID byte
+	// client names the peer's software, from its extension handshake or else its peer ID
+	client string
+	// checking is how many of the peer's pieces wait for their hash check, trusted whether one passed it
+	checking int
+	trusted  bool
+
+	// span lasts as long as the connection, the parent of the spans of its pieces
+	ctx  context.Context
+	span trace.Span
+}
+
+// runPeer drives the connection until it fails or the torrent is paused or closed
+func (t *Torrent) runPeer(c *client.Client) {
+	defer t.connDone()
+	defer c.Conn.Close()
+	c.Conn = meteredConn{ratelimit.NewConn(c.Conn, t.Bandwidth.Global, t.Bandwidth.Torrent, ratelimit.NewBucket(t.Bandwidth.Peer))}
+	pc := &peerConn{
+		t:      t,
+		c:      c,
+		msgs:   make(chan *message.Message),
+		errs:   make(chan error, 1),
+		done:   make(chan struct{}),
+		failed: make(chan error, 1),
+		outbox: make(chan holepunch.Msg, 8),
+		choked: true,
+		piece:  -1,
+		has:    c.Bitfield.Count(),
+		addr:   c.Peer(),
+		client: peerid.Client(c.RemoteID),
+	}
+	pc.log = t.log.With(logging.KeyPeer, c.Peer().String())
+	c.Logger = logging.For(pc.log, "client")
+	if t.Recorder != nil {
+		c.Record(t.Recorder)
+	}
+
+	pc.ctx, pc.span = tracer.Start(t.ctx, "peer", trace.WithAttributes(attribute.String("peer.addr", c.Peer().String())))
+	defer func() {
+		t.mu.Lock()
+		pc.span.SetAttributes(
+			attribute.String("peer.client", pc.client),
+			attribute.Int64("peer.downloaded", pc.downloaded),
+			attribute.Int64("peer.uploaded", pc.uploaded),
+		)
+		t.mu.Unlock()
+		pc.span.End()
+	}()
+
+	t.mu.Lock()
+	if t.paused || t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.conns[pc] = struct{}{}
+	t.connected++
+	delete(t.unreachable, c.Peer().String())
+	pc.haves = len(t.doneOrder)
+	bf := append(bitfield.Bitfield(nil), t.have...)
+	t.mu.Unlock()
+	defer func() {
+		close(pc.done)
+		pc.dropPiece()
+		t.mu.Lock()
+		delete(t.conns, pc)
+		t.connected--
+		t.mu.Unlock()
+	}()
+
+	go pc.readLoop()
+	c.SendBitfield(bf)
+	c.Sendunchoke()
+	if c.Extensions {
+		err := pc.sendExtHandshake()
+		if err != nil {
+			return
+		}
+	}
+
+	for {
+		changed := t.work.changed()
+		hashed := t.hasher.changed()
+		err := pc.sendHaves()
+		if err != nil {
+			return
+		}
+		err = pc.sendInterest()
+		if err != nil {
+			return
+		}
+		// pieces wait for peers that unchoke us rather than for one that may never do
+		if pc.state == nil && !pc.c.Choked {
+			pc.pickPiece()
+		}
+		err = pc.sendRequests()
+		if err != nil {
+			return
+		}
+		var timeout <-chan time.Time
+		if pc.state != nil {
+			timeout = pc.state.deadline.C
+		}
+
+		select {
+		case msg := <-pc.msgs:
+			err = pc.handle(msg)
+			if err != nil {
+				pc.log.Info("disconnecting", logging.Err(err))
+				pc.span.RecordError(err)
+				return
+			}
+		case m := <-pc.outbox:
+			err = pc.sendHolepunch(m)
+			if err != nil {
+				return
+			}
+		case err = <-pc.failed:
+			pc.log.Info("disconnecting", logging.Err(err))
+			pc.span.RecordError(err)
+			return
+		case err = <-pc.errs:
+			pc.log.Debug("disconnected", logging.Err(err))
+			pc.span.RecordError(err)
+			return
+		case <-timeout:
+			pc.log.Info("piece timed out, disconnecting", logging.KeyPiece, pc.state.pw.index)
+			tracing.End(pc.state.span, errPieceTimeout)
+			pc.state.span = nil
+			return
+		case <-changed:
+		case <-hashed:
+		case <-t.closing:
+			return
+		}
+	}
+}
+
+// readLoop reads the peer's messages until the connection fails
+func (pc *peerConn) readLoop() {
+	for {
+		msg, err := pc.c.Read()
+		if err != nil {
+			pc.errs <- err
+			return
+		}
+		select {
+		case pc.msgs <- msg:
+		case <-pc.done:
+			return
+		}
+	}
+}
+
+// sendHaves tells the peer about the pieces verified since the last call
+func (pc *peerConn) sendHaves() error {
+	pc.t.mu.Lock()
+	fresh := pc.t.doneOrder[pc.haves:]
+	pc.haves = len(pc.t.doneOrder)
+	pc.t.mu.Unlock()
+	for _, index := range fresh {
+		err := pc.c.SendHave(index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendInterest tells the peer whether we still want pieces, as the wanted files change
+func (pc *peerConn) sendInterest() error {
+	pc.t.mu.Lock()
+	want := pc.t.donePieces < pc.t.wanted
+	changed := want != pc.interested
+	pc.interested = want
+	pc.t.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	if want {
+		return pc.c.SendInterested()
+	}
+	return pc.c.SendNotInterested()
+}
+
+// pickPiece takes the next piece to download from the peer, if the hasher's budget leaves room for it.
+// A peer only gets another piece while one waits for its check once a piece of it passed, so that a peer
+// sending bad data is dropped before it wastes more.
+func (pc *peerConn) pickPiece() {
+	pc.t.mu.Lock()
+	untrusted := pc.checking > 0 && !pc.trusted
+	pc.t.mu.Unlock()
+	if untrusted {
+		return
+	}
+	// the budget is taken for a whole piece before picking one, so that no piece goes back for the lack of it
+	h := pc.t.hasher
+	if !h.reserve(int64(pc.t.PieceLength)) {
+		return
+	}
+	pw, ok := pc.t.work.tryNext(pc.c.Bitfield)
+	if !ok {
+		h.release(int64(pc.t.PieceLength))
+		return
+	}
+	if pw.length < pc.t.PieceLength {
+		h.release(int64(pc.t.PieceLength - pw.length))
+	}
+	pc.state = &pieceProgress{
+		pw:       pw,
+		buf:      make([]byte, pw.length),
+		deadline: time.NewTimer(pieceTimeout),
+	}
+	pc.state.ctx, pc.state.span = tracer.Start(pc.ctx, "piece.download", trace.WithAttributes(
+		attribute.Int("piece.index", pw.index),
+		attribute.Int("piece.length", pw.length),
+	))
+	pc.updateStats()
+}
+
+// dropPiece gives the piece being downloaded back to the picker
+func (pc *peerConn) dropPiece() {
+	if pc.state == nil {
+		return
+	}
+	pc.state.deadline.Stop()
+	if pc.state.span != nil {
+		pc.state.span.AddEvent("dropped")
+		pc.state.span.End()
+	}
+	requestsQueued.Add(-float64(pc.state.backlog))
+	pc.t.hasher.release(int64(pc.state.pw.length))
+	pc.t.work.requeue(pc.state.pw)
+	pc.state = nil
+	pc.updateStats()
+}
+
+func (pc *peerConn) sendRequests() error {
+	state := pc.state
+	if state == nil || pc.c.Choked {
+		return nil
+	}
+	for state.backlog < MaxBacklog && state.requested < state.pw.length {
+		blockSize := MaxBlockSize
+		if state.pw.length-state.requested < blockSize {
+			blockSize = state.pw.length - state.requested
+		}
+
+		err := pc.c.SendRequest(state.pw.index, state.requested, blockSize)
+		if err != nil {
+			return err
+		}
+		state.backlog++
+		state.requested += blockSize
+		requestsQueued.Add(1)
+	}
+	return nil
+}
+
+func (pc *peerConn) handle(msg *message.Message) error {
+	if msg == nil {
+		return nil
+	}
+	c := pc.c
+	switch msg.ID {
+	case message.MsgUnchoke:
+		c.Choked = false
+		pc.updateStats()
+	case message.MsgChoke:
+		c.Choked = true
+		pc.updateStats()
+		// the peer discards our outstanding requests
+		pc.dropPiece()
+	case message.MsgInterested, message.MsgNotInterested:
+		pc.t.mu.Lock()
+		pc.peerInterested = msg.ID == message.MsgInterested
+		pc.t.mu.Unlock()
+	case message.MsgHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		c.Bitfield.SetPiece(index)
+		pc.updateStats()
+	case message.MsgBitfield:
+		c.Bitfield = append(bitfield.Bitfield(nil), msg.Payload...)
+		pc.updateStats()
+	case message.MsgRequest:
+		return pc.serveRequest(msg)
+	case message.MsgPiece:
+		return pc.receiveBlock(msg)
+	case message.MsgExtended:
+		return pc.handleExtended(msg)
+	}
+	return nil
+}
+
+// updateStats publishes the peer's state for PeerStats
+func (pc *peerConn) updateStats() {
+	pc.t.mu.Lock()
+	defer pc.t.mu.Unlock()
+	pc.choked = pc.c.Choked
+	pc.has = pc.c.Bitfield.Count()
+	pc.piece = -1
+	if pc.state != nil {
+		pc.piece = pc.state.pw.index
+	}
+}
+
+// receiveBlock stores a block of the piece being downloaded and hands the piece to the hasher once it is complete
+func (pc *peerConn) receiveBlock(msg *message.Message) error {
+	index, err := message.PieceIndex(msg)
+	if err != nil {
+		return err
+	}
+	state := pc.state
+	if state == nil || index != state.pw.index {
+		// a late block of a piece dropped on choke
+		return nil
+	}
+	n, err := message.ParsePiece(index, state.buf, msg)
+	if err != nil {
+		return err
+	}
+	state.downloaded += n
+	state.backlog--
+	requestsQueued.Add(-1)
+	dataDown.Add(int64(n))
+	pc.t.mu.Lock()
+	pc.t.downloaded += int64(n)
+	pc.downloaded += int64(n)
+	pc.t.mu.Unlock()
+	if state.downloaded < state.pw.length {
+		return nil
+	}
+
+	state.deadline.Stop()
+	pc.state = nil
+	pc.updateStats()
+	pc.t.mu.Lock()
+	pc.checking++
+	pc.t.mu.Unlock()
+	pc.t.hasher.submit(pc, state)
+	return nil
+}
+
+// verify checks the hash of a piece the peer delivered on a worker of the hasher, handing it to collect
+// or, if it is corrupt, back to the picker while the peer is dropped
+func (pc *peerConn) verify(state *pieceProgress) {
+	t := pc.t
+	_, span := tracer.Start(state.ctx, "piece.verify")
+	err := checkPiece(state.pw, state.buf)
+	tracing.End(span, err)
+	tracing.End(state.span, err)
+	t.hasher.release(int64(state.pw.length))
+	t.mu.Lock()
+	pc.checking--
+	pc.trusted = pc.trusted || err == nil
+	t.mu.Unlock()
+	if err != nil {
+		// another peer gets the piece, this one is not trusted with more
+		t.work.requeue(state.pw)
+		select {
+		case pc.failed <- err:
+		default:
+		}
+		return
+	}
+	select {
+	case t.results <- &pieceResult{index: state.pw.index, buf: state.buf}:
+	case <-t.closing:
+	}
+}
+
+// serveRequest sends the requested block if we have its piece
+func (pc *peerConn) serveRequest(msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	t := pc.t
+	if index < 0 || index >= len(t.PieceHashes) || length <= 0 || length > MaxRequestLength {
+		return nil
+	}
+	pieceBegin, pieceEnd := t.calculateBoundsForPiece(index)
+	if begin < 0 || pieceBegin+begin+length > pieceEnd {
+		return nil
+	}
+	t.mu.Lock()
+	if !t.have.HasPiece(index) {
+		t.mu.Unlock()
+		return nil
+	}
+	t.mu.Unlock()
+	block := make([]byte, length)
+	_, err = t.store.ReadAt(block, int64(pieceBegin+begin))
+	if err != nil {
+		return fmt.Errorf("reading piece #%d: %w", index, err)
+	}
+	t.mu.Lock()
+	t.uploaded += int64(length)
+	pc.uploaded += int64(length)
+	t.mu.Unlock()
+	dataUp.Add(int64(length))
+	return pc.c.SendPiece(index, begin, block)
+}
@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"bit_torrent_cli/bitfield"
+	"sort"
+	"sync"
+)
+
+type pieceState int
+
+const (
+	stateIdle pieceState = iota // not wanted
+	statePending
+	stateInFlight
+	stateDone
+)
+
+func (s pieceState) String() string {
+	switch s {
+	case stateIdle:
+		return "idle"
+	case statePending:
+		return "pending"
+	case stateInFlight:
+		return "downloading"
+	case stateDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+// picker hands out pending pieces to workers, highest priority first
+type picker struct {
+	mu      sync.Mutex
+	pieces  []*pieceWord
+	pending []*pieceWord
+	// wake is closed and replaced whenever pieces are requeued, reprioritized or finished
+	wake   chan struct{}
+	closed bool
+}
+
+func newPicker(pieces []*pieceWord) *picker {
+	p := &picker{pieces: pieces, wake: make(chan struct{})}
+	for _, pw := range pieces {
+		if pw.priority != PrioritySkip && pw.state != stateDone {
+			pw.state = statePending
+			p.pending = append(p.pending, pw)
+		}
+	}
+	p.sortLocked()
+	return p
+}
+
+func (p *picker) sortLocked() {
+	sort.SliceStable(p.pending, func(i, j int) bool {
+		if p.pending[i].priority != p.pending[j].priority {
+			return p.pending[i].priority > p.pending[j].priority
+		}
+		return p.pending[i].index < p.pending[j].index
+	})
+}
+
+// changed returns a channel closed on the next change to the pieces
+func (p *picker) changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wake
+}
+
+func (p *picker) notifyLocked() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// tryNext takes the highest priority pending piece the peer has, if any
+func (p *picker) tryNext(bf bitfield.Bitfield) (*pieceWord, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, false
+	}
+	for i, pw := range p.pending {
+		if !bf.HasPiece(pw.index) {
+			continue
+		}
+		if i == 0 {
+			p.pending = p.pending[1:]
+		} else {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+		}
+		pw.state = stateInFlight
+		return pw, true
+	}
+	return nil, false
+}
+
+// requeue puts back a piece that failed to download
+func (p *picker) requeue(pw *pieceWord) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pw.priority == PrioritySkip {
+		pw.state = stateIdle
+		return
+	}
+	pw.state = statePending
+	p.pending = append(p.pending, pw)
+	p.sortLocked()
+	p.notifyLocked()
+}
+
+// finish marks a verified piece as done
+func (p *picker) finish(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pieces[index].state = stateDone
+	p.notifyLocked()
+}
+
+// setPriority changes the priority of a piece, scheduling or unscheduling it as needed
+func (p *picker) setPriority(index int, prio Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pw := p.pieces[index]
+	if pw.priority == prio {
+		return
+	}
+	pw.priority = prio
+	switch pw.state {
+	case stateIdle:
+		if prio == PrioritySkip {
+			return
+		}
+		pw.state = statePending
+		p.pending = append(p.pending, pw)
+	case statePending:
+		if prio == PrioritySkip {
+			pw.state = stateIdle
+			for i, other := range p.pending {
+				if other == pw {
+					p.pending = append(p.pending[:i], p.pending[i+1:]...)
+					break
+				}
+			}
+			return
+		}
+	default:
+		return
+	}
+	p.sortLocked()
+	p.notifyLocked()
+}
+
+func (p *picker) stats() []PieceStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]PieceStats, len(p.pieces))
+	for i, pw := range p.pieces {
+		stats[i] = PieceStats{Priority: pw.priority, State: pw.state.String()}
+	}
+	return stats
+}
+
+// close wakes every waiting worker and stops handing out pieces
+func (p *picker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.notifyLocked()
+}
@@ -0,0 +1,161 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+)
+
+// DefaultReadahead is how many bytes past the read position a new Reader asks for
+const DefaultReadahead = 4 << 20
+
+// Reader reads a span of the torrent in order, blocking until the pieces it needs are verified.
+// The piece under the read position and the readahead after it are downloaded before anything else.
+type Reader struct {
+	t         *Torrent
+	offset    int
+	length    int
+	pos       int
+	readahead int
+	// window is the half-open range of pieces the reader asked for
+	windowBegin int
+	windowEnd   int
+}
+
+// NewReader returns a reader over the whole torrent. The torrent must be started.
+func (t *Torrent) NewReader() *Reader {
+	return t.newReader(0, t.Length)
+}
+
+// NewFileReader returns a reader over one file of the torrent
+func (t *Torrent) NewFileReader(f File) *Reader {
+	return t.newReader(f.Offset, f.Length)
+}
+
+func (t *Torrent) newReader(offset, length int) *Reader {
+	r := &Reader{t: t, offset: offset, length: length, readahead: DefaultReadahead}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.readers[r] = struct{}{}
+	r.updateWindowLocked()
+	return r
+}
+
+// SetReadahead sets how many bytes past the read position are prioritized
+func (r *Reader) SetReadahead(n int) {
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	r.readahead = n
+	r.updateWindowLocked()
+}
+
+// updateWindowLocked moves the reader's window to the read position and reprioritizes pieces if it changed
+func (r *Reader) updateWindowLocked() {
+	t := r.t
+	begin, end := 0, 0
+	if r.pos < r.length {
+		begin = (r.offset + r.pos) / t.PieceLength
+		last := r.offset + r.pos + r.readahead
+		if last > r.offset+r.length {
+			last = r.offset + r.length
+		}
+		end = (last-1)/t.PieceLength + 1
+		if end <= begin {
+			end = begin + 1
+		}
+	}
+	if begin == r.windowBegin && end == r.windowEnd {
+		return
+	}
+	r.windowBegin, r.windowEnd = begin, end
+	t.updatePrioritiesLocked()
+}
+
+// updatePrioritiesLocked recomputes the priorities readers give to pieces on top of the file priorities
+func (t *Torrent) updatePrioritiesLocked() {
+	boosted := make(map[int]Priority)
+	for r := range t.readers {
+		for i := r.windowBegin; i < r.windowEnd; i++ {
+			prio := PriorityReadahead
+			if i == r.windowBegin {
+				prio = PriorityNow
+			}
+			if prio > boosted[i] {
+				boosted[i] = prio
+			}
+		}
+	}
+	for i := range t.boosted {
+		if _, ok := boosted[i]; !ok {
+			t.work.setPriority(i, t.base[i])
+		}
+	}
+	for i, prio := range boosted {
+		if t.base[i] > prio {
+			prio = t.base[i]
+		}
+		t.work.setPriority(i, prio)
+	}
+	t.boosted = boosted
+}
+
+// Read reads from the read position, waiting for the piece under it to be verified
+func (r *Reader) Read(p []byte) (int, error) {
+	t := r.t
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	t.mu.Lock()
+	r.updateWindowLocked()
+	abs := r.offset + r.pos
+	index := abs / t.PieceLength
+	for !t.have.HasPiece(index) {
+		if t.closed {
+			t.mu.Unlock()
+			return 0, ErrClosed
+		}
+		t.cond.Wait()
+	}
+	t.mu.Unlock()
+	_, end := t.calculateBoundsForPiece(index)
+	if end > r.offset+r.length {
+		end = r.offset + r.length
+	}
+	n, err := t.store.ReadAt(p[:min(len(p), end-abs)], int64(abs))
+	t.mu.Lock()
+	r.pos += n
+	t.mu.Unlock()
+	return n, err
+}
+
+// Seek sets the read position, relative to the start of the reader's span
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = int64(r.pos) + offset
+	case io.SeekEnd:
+		pos = int64(r.length) + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = int(pos)
+	r.updateWindowLocked()
+	return pos, nil
+}
+
+// Close releases the pieces the reader prioritized
+func (r *Reader) Close() error {
+	t := r.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.readers, r)
+	t.updatePrioritiesLocked()
+	return nil
+}
@@ -0,0 +1,104 @@
+package p2p
+
+import "sort"
+
+// Stats is a snapshot of a started torrent's progress
+type Stats struct {
+	Pieces     int
+	PiecesDone int
+	Wanted     int
+	WantedDone int
+	Completed  int
+	Peers      int
+	Downloaded int64
+	Uploaded   int64
+}
+
+// Stats returns the torrent's progress so far
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Stats{Pieces: len(t.PieceHashes), Wanted: t.wanted, WantedDone: t.donePieces, Peers: t.connected}
+	s.Downloaded, s.Uploaded = t.downloaded, t.uploaded
+	for i := range t.PieceHashes {
+		if t.have.HasPiece(i) {
+			s.PiecesDone++
+			s.Completed += t.calculatePieceSize(i)
+		}
+	}
+	return s
+}
+
+// BytesCompleted returns how many bytes of the file have been verified
+func (t *Torrent) BytesCompleted(f File) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	begin, end := t.pieceRange(f)
+	for i := begin; i < end; i++ {
+		if !t.have.HasPiece(i) {
+			continue
+		}
+		pieceBegin, pieceEnd := t.calculateBoundsForPiece(i)
+		if pieceBegin < f.Offset {
+			pieceBegin = f.Offset
+		}
+		if pieceEnd > f.Offset+f.Length {
+			pieceEnd = f.Offset + f.Length
+		}
+		n += pieceEnd - pieceBegin
+	}
+	return n
+}
+
+// PeerStats is a snapshot of one connection of a torrent
+type PeerStats struct {
+	Addr string
+	// Client names the peer's software, empty if unknown
+	Client     string
+	Downloaded int64
+	Uploaded   int64
+	// Choked is whether the peer refuses our requests
+	Choked bool
+	// Interested is whether we want the peer's pieces, PeerInterested whether it wants ours
+	Interested     bool
+	PeerInterested bool
+	// Pieces is how many pieces the peer has
+	Pieces int
+	// Piece is the piece being downloaded from the peer, -1 for none
+	Piece int
+}
+
+// PeerStats returns a snapshot of every connection
+func (t *Torrent) PeerStats() []PeerStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]PeerStats, 0, len(t.conns))
+	for pc := range t.conns {
+		stats = append(stats, PeerStats{
+			Addr:           pc.c.Peer().String(),
+			Client:         pc.client,
+			Downloaded:     pc.downloaded,
+			Uploaded:       pc.uploaded,
+			Choked:         pc.choked,
+			Interested:     pc.interested,
+			PeerInterested: pc.peerInterested,
+			Pieces:         pc.has,
+			Piece:          pc.piece,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
+
+// PieceStats is the state of one piece
+type PieceStats struct {
+	Priority Priority
+	// State is one of "idle", "pending", "downloading" or "done"
+	State string
+}
+
+// PieceStats returns the state of every piece
+func (t *Torrent) PieceStats() []PieceStats {
+	return t.work.stats()
+}
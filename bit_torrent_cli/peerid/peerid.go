@@ -0,0 +1,138 @@
+package peerid
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultPrefix identifies this client Azureus-style: dash, client code, version 0.1.0.0, dash
+const DefaultPrefix = "-GB0100-"
+
+// MaxPrefix leaves at least 8 random bytes in an ID
+const MaxPrefix = 12
+
+// alphabet is what the random part of an ID is made of, printable for trackers that log IDs
+const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// New generates a peer ID starting with prefix, DefaultPrefix if empty
+func New(prefix string) ([20]byte, error) {
+	var id [20]byte
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	if len(prefix) > MaxPrefix {
+		return id, fmt.Errorf("peer ID prefix %q is longer than %d bytes", prefix, MaxPrefix)
+	}
+	n := copy(id[:], prefix)
+	_, err := rand.Read(id[n:])
+	if err != nil {
+		return id, err
+	}
+	for i := n; i < len(id); i++ {
+		id[i] = alphabet[int(id[i])%len(alphabet)]
+	}
+	return id, nil
+}
+
+// azureus are the client codes of -XX1234- style IDs
+var azureus = map[string]string{
+	"AG": "Ares",
+	"AZ": "Azureus",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GB": "bit_torrent_cli",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UM": "µTorrent Mac",
+	"WW": "WebTorrent",
+}
+
+// shadow are the client codes of Shad0w style IDs, one letter and five version characters
+var shadow = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowDigit decodes a version character of a Shad0w style ID
+func shadowDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36, true
+	case c == '.':
+		return 62, true
+	case c == '-':
+		return 63, true
+	}
+	return 0, false
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// Client names the client and version a peer ID comes from, empty if it follows no known convention
+func Client(id [20]byte) string {
+	// Azureus style: -XX1234-
+	if id[0] == '-' && id[7] == '-' && isAlnum(id[1]) && isAlnum(id[2]) {
+		code := string(id[1:3])
+		name, ok := azureus[code]
+		if !ok {
+			name = code
+		}
+		v := id[3:7]
+		for _, c := range v {
+			if !isAlnum(c) {
+				return name
+			}
+		}
+		parts := []string{string(v[0]), string(v[1]), string(v[2])}
+		if v[3] != '0' {
+			parts = append(parts, string(v[3]))
+		}
+		return name + " " + strings.Join(parts, ".")
+	}
+	// Shad0w style: T03I-----, five version characters padded with dashes, then three dashes
+	if name, ok := shadow[id[0]]; ok && string(id[6:9]) == "---" {
+		var parts []string
+		for _, c := range id[1:6] {
+			if c == '-' {
+				break
+			}
+			d, ok := shadowDigit(c)
+			if !ok {
+				return ""
+			}
+			parts = append(parts, strconv.Itoa(d))
+		}
+		if len(parts) == 0 {
+			return name
+		}
+		return name + " " + strings.Join(parts, ".")
+	}
+	// Mainline style: M4-3-6--
+	if id[0] == 'M' && id[2] == '-' {
+		end := strings.Index(string(id[1:]), "--")
+		if end > 0 {
+			return "BitTorrent " + strings.ReplaceAll(string(id[1:1+end]), "-", ".")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package peerid
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	id, err := New("")
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(id[:]), DefaultPrefix))
+	for _, c := range id[len(DefaultPrefix):] {
+		assert.Contains(t, alphabet, string(c))
+	}
+	other, err := New("")
+	require.Nil(t, err)
+	assert.NotEqual(t, id, other)
+
+	id, err = New("-XX0100-")
+	require.Nil(t, err)
+	assert.Equal(t, "-XX0100-", string(id[:8]))
+
+	_, err = New("-much-too-long-prefix-")
+	assert.NotNil(t, err)
+}
+
+func TestClient(t *testing.T) {
+	tests := map[string]string{
+		"-GB0100-abcdefghijkl":       "bit_torrent_cli 0.1.0",
+		"-qB4520-abcdefghijkl":       "qBittorrent 4.5.2",
+		"-UT355S-abcdefghijkl":       "µTorrent 3.5.5.S",
+		"-ZZ1000-abcdefghijkl":       "ZZ 1.0.0",
+		"-TR30\x00\x00-abcdefghijkl": "Transmission",
+		"T03I--------abcdefgh":       "BitTornado 0.3.18",
+		"S58B-----abcdefghijk":       "Shadow's client 5.8.11",
+		"M4-3-6--abcdefghijkl":       "BitTorrent 4.3.6",
+		"\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13\x14": "",
+	}
+	for input, output := range tests {
+		var id [20]byte
+		copy(id[:], input)
+		assert.Equal(t, output, Client(id), input)
+	}
+}
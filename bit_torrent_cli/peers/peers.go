@@ -27,6 +27,20 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	return peers, nil
 }
 
+// Marshal encodes peers in the compact format Unmarshal reads, skipping those without an IPv4 address
+func Marshal(ps []Peer) []byte {
+	buf := make([]byte, 0, len(ps)*6)
+	for _, p := range ps {
+		ip := p.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, p.Port)
+	}
+	return buf
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
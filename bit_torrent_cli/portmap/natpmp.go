@@ -0,0 +1,228 @@
+package portmap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pmpVersion = 0
+	pcpVersion = 2
+
+	pmpOpExternalAddr = 0
+	pmpOpMapUDP       = 1
+	pmpOpMapTCP       = 2
+
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+	pcpResponse   = 0x80
+)
+
+// exchange sends a request to the gateway until it answers, waiting twice as long each time (RFC 6886)
+func exchange(ctx context.Context, gateway string, req []byte, ok func([]byte) bool) ([]byte, error) {
+	conn, err := net.Dial("udp", gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1100)
+	wait := 250 * time.Millisecond
+	for try := 0; try < 4; try++ {
+		_, err = conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(wait)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if ok(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+	return nil, fmt.Errorf("no answer from %s", gateway)
+}
+
+// NATPMP maps ports with NAT-PMP (RFC 6886)
+type NATPMP struct {
+	// Gateway is the host:port of the gateway, port 5351
+	Gateway string
+}
+
+func (g *NATPMP) String() string {
+	return "NAT-PMP"
+}
+
+func pmpResult(resp []byte) error {
+	code := binary.BigEndian.Uint16(resp[2:4])
+	if code != 0 {
+		return fmt.Errorf("NAT-PMP result code %d", code)
+	}
+	return nil
+}
+
+// probe asks for the external address, which every NAT-PMP gateway answers
+func (g *NATPMP) probe(ctx context.Context) error {
+	resp, err := exchange(ctx, g.Gateway, []byte{pmpVersion, pmpOpExternalAddr}, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == pmpVersion && b[1] == pcpResponse|pmpOpExternalAddr
+	})
+	if err != nil {
+		return err
+	}
+	return pmpResult(resp)
+}
+
+func (g *NATPMP) AddMapping(ctx context.Context, protocol string, internal, external uint16, lifetime time.Duration) (uint16, error) {
+	op := byte(pmpOpMapTCP)
+	if protocol == UDP {
+		op = pmpOpMapUDP
+	}
+	req := make([]byte, 12)
+	req[0] = pmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], internal)
+	binary.BigEndian.PutUint16(req[6:], external)
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	resp, err := exchange(ctx, g.Gateway, req, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == pmpVersion && b[1] == pcpResponse|op && binary.BigEndian.Uint16(b[8:]) == internal
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = pmpResult(resp)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(resp[10:]), nil
+}
+
+// DeleteMapping asks for a lifetime of 0, which removes the mapping
+func (g *NATPMP) DeleteMapping(ctx context.Context, protocol string, internal, external uint16) error {
+	_, err := g.AddMapping(ctx, protocol, internal, 0, 0)
+	return err
+}
+
+// PCP maps ports with the Port Control Protocol (RFC 6887), the successor of NAT-PMP
+type PCP struct {
+	// Gateway is the host:port of the gateway, port 5351
+	Gateway string
+
+	mu sync.Mutex
+	// nonces identify our mappings to the gateway, a renewal or deletion having to repeat them
+	nonces map[mapping][12]byte
+}
+
+func (g *PCP) String() string {
+	return "PCP"
+}
+
+// pcpHeader is the common request header, the client address being the one the gateway sees
+func pcpHeader(op byte, lifetime time.Duration, client net.IP) []byte {
+	req := make([]byte, 24)
+	req[0] = pcpVersion
+	req[1] = op
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	copy(req[8:], client.To16())
+	return req
+}
+
+func pcpResult(resp []byte) error {
+	if resp[3] != 0 {
+		return fmt.Errorf("PCP result code %d", resp[3])
+	}
+	return nil
+}
+
+// probe sends an ANNOUNCE, answered by every PCP server
+func (g *PCP) probe(ctx context.Context) error {
+	client, err := localIP(g.Gateway)
+	if err != nil {
+		return err
+	}
+	resp, err := exchange(ctx, g.Gateway, pcpHeader(pcpOpAnnounce, 0, client), func(b []byte) bool {
+		// a NAT-PMP gateway answers with its version and an unsupported version error
+		return len(b) >= 24 && b[0] == pcpVersion && b[1] == pcpResponse|pcpOpAnnounce || len(b) >= 4 && b[0] == pmpVersion
+	})
+	if err != nil {
+		return err
+	}
+	if resp[0] != pcpVersion {
+		return fmt.Errorf("gateway only speaks NAT-PMP")
+	}
+	return pcpResult(resp)
+}
+
+func (g *PCP) nonce(m mapping) ([12]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.nonces == nil {
+		g.nonces = make(map[mapping][12]byte)
+	}
+	nonce, ok := g.nonces[m]
+	if ok {
+		return nonce, nil
+	}
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nonce, err
+	}
+	g.nonces[m] = nonce
+	return nonce, nil
+}
+
+func (g *PCP) AddMapping(ctx context.Context, protocol string, internal, external uint16, lifetime time.Duration) (uint16, error) {
+	nonce, err := g.nonce(mapping{protocol: protocol, internal: internal})
+	if err != nil {
+		return 0, err
+	}
+	client, err := localIP(g.Gateway)
+	if err != nil {
+		return 0, err
+	}
+	proto := byte(6)
+	if protocol == UDP {
+		proto = 17
+	}
+	req := pcpHeader(pcpOpMap, lifetime, client)
+	req = append(req, nonce[:]...)
+	req = append(req, proto, 0, 0, 0)
+	req = binary.BigEndian.AppendUint16(req, internal)
+	req = binary.BigEndian.AppendUint16(req, external)
+	req = append(req, net.IPv4zero.To16()...)
+	resp, err := exchange(ctx, g.Gateway, req, func(b []byte) bool {
+		return len(b) >= 60 && b[0] == pcpVersion && b[1] == pcpResponse|pcpOpMap && [12]byte(b[24:36]) == nonce
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = pcpResult(resp)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(resp[42:]), nil
+}
+
+// DeleteMapping asks for a lifetime of 0 with the nonce of the mapping
+func (g *PCP) DeleteMapping(ctx context.Context, protocol string, internal, external uint16) error {
+	_, err := g.AddMapping(ctx, protocol, internal, 0, 0)
+	g.mu.Lock()
+	delete(g.nonces, mapping{protocol: protocol, internal: internal})
+	g.mu.Unlock()
+	return err
+}
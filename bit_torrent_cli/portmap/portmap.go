@@ -0,0 +1,204 @@
+package portmap
+
+import (
+	"bit_torrent_cli/logging"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TCP = "TCP"
+	UDP = "UDP"
+	// DefaultLifetime is how long mappings are asked for, renewed at half of it
+	DefaultLifetime = time.Hour
+	// DiscoverTimeout bounds how long Discover looks for a gateway
+	DiscoverTimeout = 3 * time.Second
+	description     = "bit_torrent_cli"
+)
+
+// ErrNoGateway is returned when no gateway answers any of the protocols
+var ErrNoGateway = errors.New("no gateway supporting UPnP, NAT-PMP or PCP")
+
+// Mapper asks a gateway to forward an external port to a port of this host
+type Mapper interface {
+	// AddMapping asks for external to be forwarded to internal, returning the external port the gateway chose
+	AddMapping(ctx context.Context, protocol string, internal, external uint16, lifetime time.Duration) (uint16, error)
+	DeleteMapping(ctx context.Context, protocol string, internal, external uint16) error
+	String() string
+}
+
+// Discover finds the gateway of the default route, trying PCP, NAT-PMP and then UPnP
+func Discover(ctx context.Context) (Mapper, error) {
+	ctx, cancel := context.WithTimeout(ctx, DiscoverTimeout)
+	defer cancel()
+	var errs []error
+	gw, err := defaultGateway()
+	if err == nil {
+		addr := net.JoinHostPort(gw.String(), "5351")
+		pcp := &PCP{Gateway: addr}
+		err = pcp.probe(ctx)
+		if err == nil {
+			return pcp, nil
+		}
+		errs = append(errs, fmt.Errorf("PCP: %w", err))
+		pmp := &NATPMP{Gateway: addr}
+		err = pmp.probe(ctx)
+		if err == nil {
+			return pmp, nil
+		}
+		errs = append(errs, fmt.Errorf("NAT-PMP: %w", err))
+	} else {
+		errs = append(errs, err)
+	}
+	igd, err := DiscoverUPnP(ctx)
+	if err == nil {
+		return igd, nil
+	}
+	errs = append(errs, fmt.Errorf("UPnP: %w", err))
+	return nil, fmt.Errorf("%w: %w", ErrNoGateway, errors.Join(errs...))
+}
+
+// defaultGateway reads the gateway of the default route, guessing the .1 of our subnet where there is no /proc
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 3 || fields[1] != "00000000" {
+				continue
+			}
+			var gw uint32
+			_, err := fmt.Sscanf(fields[2], "%x", &gw)
+			if err != nil || gw == 0 {
+				continue
+			}
+			ip := make(net.IP, 4)
+			binary.LittleEndian.PutUint32(ip, gw)
+			return ip, nil
+		}
+	}
+	local, err := localIP("8.8.8.8:53")
+	if err != nil {
+		return nil, fmt.Errorf("finding the gateway: %w", err)
+	}
+	ip4 := local.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("finding the gateway: no IPv4 address")
+	}
+	return net.IPv4(ip4[0], ip4[1], ip4[2], 1), nil
+}
+
+// localIP is the address of this host that packets to addr leave from
+func localIP(addr string) (net.IP, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+type mapping struct {
+	protocol           string
+	internal, external uint16
+}
+
+// Lease keeps ports mapped until closed
+type Lease struct {
+	m        Mapper
+	lifetime time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+
+	mu       sync.Mutex
+	mappings []mapping
+}
+
+// Map forwards port for each protocol, asking for the same port outside, and renews the mappings until Close
+func Map(ctx context.Context, m Mapper, port uint16, protocols []string, lifetime time.Duration) (*Lease, error) {
+	if lifetime == 0 {
+		lifetime = DefaultLifetime
+	}
+	l := &Lease{m: m, lifetime: lifetime, stop: make(chan struct{})}
+	for _, proto := range protocols {
+		external, err := m.AddMapping(ctx, proto, port, port, lifetime)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("mapping %s port %d with %s: %w", proto, port, m, err)
+		}
+		l.mappings = append(l.mappings, mapping{protocol: proto, internal: port, external: external})
+	}
+	l.wg.Add(1)
+	go l.renewLoop()
+	return l, nil
+}
+
+// External returns the port the gateway forwards for the protocol, 0 if not mapped
+func (l *Lease) External(protocol string) uint16 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.mappings {
+		if m.protocol == protocol {
+			return m.external
+		}
+	}
+	return 0
+}
+
+func (l *Lease) renewLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.lifetime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		mappings := append([]mapping(nil), l.mappings...)
+		l.mu.Unlock()
+		for i, m := range mappings {
+			ctx, cancel := context.WithTimeout(context.Background(), DiscoverTimeout)
+			external, err := l.m.AddMapping(ctx, m.protocol, m.internal, m.external, l.lifetime)
+			cancel()
+			if err != nil {
+				logging.For(nil, "portmap").Warn("renewing port mapping failed", "gateway", l.m.String(),
+					"protocol", m.protocol, "port", m.internal, logging.Err(err))
+				continue
+			}
+			l.mu.Lock()
+			l.mappings[i].external = external
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Close stops the renewals and removes the mappings
+func (l *Lease) Close() error {
+	var errs []error
+	l.once.Do(func() {
+		close(l.stop)
+		l.wg.Wait()
+		for _, m := range l.mappings {
+			ctx, cancel := context.WithTimeout(context.Background(), DiscoverTimeout)
+			err := l.m.DeleteMapping(ctx, m.protocol, m.internal, m.external)
+			cancel()
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,290 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGateway answers NAT-PMP, and PCP if pcp is set, on localhost
+type fakeGateway struct {
+	conn *net.UDPConn
+	pcp  bool
+
+	mu       sync.Mutex
+	mappings map[string]uint32
+	adds     int
+}
+
+func newFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	g := &fakeGateway{conn: conn, pcp: pcp, mappings: make(map[string]uint32)}
+	t.Cleanup(func() { conn.Close() })
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) addr() string {
+	return g.conn.LocalAddr().String()
+}
+
+// record stores or deletes a mapping, returning the external port given
+func (g *fakeGateway) record(proto string, internal, external uint16, lifetime uint32) uint16 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := fmt.Sprintf("%s:%d", proto, internal)
+	if lifetime == 0 {
+		delete(g.mappings, key)
+		return 0
+	}
+	g.adds++
+	g.mappings[key] = lifetime
+	if external == 0 {
+		external = internal
+	}
+	return external
+}
+
+func (g *fakeGateway) state() (map[string]uint32, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := make(map[string]uint32)
+	for k, v := range g.mappings {
+		m[k] = v
+	}
+	return m, g.adds
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		var resp []byte
+		switch {
+		case req[0] == pcpVersion && !g.pcp:
+			resp = []byte{pmpVersion, pcpResponse | req[1], 0, 1, 0, 0, 0, 0}
+		case req[0] == pcpVersion && req[1] == pcpOpAnnounce:
+			resp = make([]byte, 24)
+			resp[0], resp[1] = pcpVersion, pcpResponse|pcpOpAnnounce
+		case req[0] == pcpVersion && req[1] == pcpOpMap:
+			proto := TCP
+			if req[36] == 17 {
+				proto = UDP
+			}
+			lifetime := binary.BigEndian.Uint32(req[4:])
+			external := g.record(proto, binary.BigEndian.Uint16(req[40:]), binary.BigEndian.Uint16(req[42:]), lifetime)
+			resp = append([]byte(nil), req[:60]...)
+			resp[1], resp[2], resp[3] = pcpResponse|pcpOpMap, 0, 0
+			binary.BigEndian.PutUint16(resp[42:], external)
+		case req[0] == pmpVersion && req[1] == pmpOpExternalAddr:
+			resp = []byte{pmpVersion, pcpResponse, 0, 0, 0, 0, 0, 1, 203, 0, 113, 1}
+		case req[0] == pmpVersion:
+			proto := TCP
+			if req[1] == pmpOpMapUDP {
+				proto = UDP
+			}
+			internal := binary.BigEndian.Uint16(req[4:])
+			lifetime := binary.BigEndian.Uint32(req[8:])
+			external := g.record(proto, internal, binary.BigEndian.Uint16(req[6:]), lifetime)
+			resp = make([]byte, 16)
+			resp[0], resp[1] = pmpVersion, pcpResponse|req[1]
+			binary.BigEndian.PutUint16(resp[8:], internal)
+			binary.BigEndian.PutUint16(resp[10:], external)
+			binary.BigEndian.PutUint32(resp[12:], lifetime)
+		default:
+			continue
+		}
+		g.conn.WriteToUDP(resp, from)
+	}
+}
+
+func TestMap(t *testing.T) {
+	tests := map[string]func(gateway string) Mapper{
+		"NAT-PMP": func(gateway string) Mapper { return &NATPMP{Gateway: gateway} },
+		"PCP":     func(gateway string) Mapper { return &PCP{Gateway: gateway} },
+	}
+	for name, mapper := range tests {
+		g := newFakeGateway(t, true)
+		l, err := Map(context.Background(), mapper(g.addr()), 6881, []string{TCP, UDP}, 2*time.Second)
+		require.Nil(t, err, name)
+		assert.Equal(t, uint16(6881), l.External(TCP), name)
+		assert.Equal(t, uint16(6881), l.External(UDP), name)
+		mappings, adds := g.state()
+		assert.Equal(t, map[string]uint32{"TCP:6881": 2, "UDP:6881": 2}, mappings, name)
+		assert.Equal(t, 2, adds, name)
+
+		// renewed at half the lifetime
+		time.Sleep(1200 * time.Millisecond)
+		_, adds = g.state()
+		assert.Equal(t, 4, adds, name)
+
+		require.Nil(t, l.Close(), name)
+		mappings, _ = g.state()
+		assert.Empty(t, mappings, name)
+	}
+}
+
+func TestPCPProbe(t *testing.T) {
+	ctx := context.Background()
+	pcp := newFakeGateway(t, true)
+	assert.Nil(t, (&PCP{Gateway: pcp.addr()}).probe(ctx))
+	assert.Nil(t, (&NATPMP{Gateway: pcp.addr()}).probe(ctx))
+
+	pmp := newFakeGateway(t, false)
+	assert.NotNil(t, (&PCP{Gateway: pmp.addr()}).probe(ctx), "NAT-PMP only gateway")
+	assert.Nil(t, (&NATPMP{Gateway: pmp.addr()}).probe(ctx))
+}
+
+const igdDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+const upnpFault = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail>
+</s:Fault></s:Body></s:Envelope>`
+
+var soapArg = regexp.MustCompile(`<(New\w+)>([^<]*)</New\w+>`)
+
+// fakeIGD is an Internet Gateway Device answering SSDP searches on localhost
+type fakeIGD struct {
+	ssdp          *net.UDPConn
+	permanentOnly bool
+
+	mu       sync.Mutex
+	mappings map[string]string
+}
+
+func newFakeIGD(t *testing.T, permanentOnly bool) *fakeIGD {
+	g := &fakeIGD{permanentOnly: permanentOnly, mappings: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, igdDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", g.control)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	var err error
+	g.ssdp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	t.Cleanup(func() { g.ssdp.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := g.ssdp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+				continue
+			}
+			resp := "HTTP/1.1 200 OK\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+				"LOCATION: " + srv.URL + "/rootDesc.xml\r\n\r\n"
+			g.ssdp.WriteToUDP([]byte(resp), from)
+		}
+	}()
+	return g
+}
+
+func (g *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	args := make(map[string]string)
+	for _, m := range soapArg.FindAllStringSubmatch(string(body), -1) {
+		args[m[1]] = m[2]
+	}
+	key := args["NewProtocol"] + ":" + args["NewExternalPort"]
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case strings.HasSuffix(r.Header.Get("SOAPAction"), `#AddPortMapping"`):
+		if g.permanentOnly && args["NewLeaseDuration"] != "0" {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, upnpFault)
+			return
+		}
+		g.mappings[key] = args["NewInternalClient"] + ":" + args["NewInternalPort"] + " " + args["NewLeaseDuration"]
+	case strings.HasSuffix(r.Header.Get("SOAPAction"), `#DeletePortMapping"`):
+		delete(g.mappings, key)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body/></s:Envelope>`)
+}
+
+func (g *fakeIGD) state() map[string]string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := make(map[string]string)
+	for k, v := range g.mappings {
+		m[k] = v
+	}
+	return m
+}
+
+func TestUPnP(t *testing.T) {
+	tests := map[string]struct {
+		permanentOnly bool
+		output        map[string]string
+	}{
+		"lease": {
+			output: map[string]string{"TCP:6881": "127.0.0.1:6881 3600", "UDP:6881": "127.0.0.1:6881 3600"},
+		},
+		"only permanent leases": {
+			permanentOnly: true,
+			output:        map[string]string{"TCP:6881": "127.0.0.1:6881 0", "UDP:6881": "127.0.0.1:6881 0"},
+		},
+	}
+	for name, test := range tests {
+		igd := newFakeIGD(t, test.permanentOnly)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		g, err := discoverUPnP(ctx, igd.ssdp.LocalAddr().String())
+		cancel()
+		require.Nil(t, err, name)
+		assert.Equal(t, "urn:schemas-upnp-org:service:WANIPConnection:1", g.ServiceType, name)
+
+		l, err := Map(context.Background(), g, 6881, []string{TCP, UDP}, time.Hour)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.output, igd.state(), name)
+		require.Nil(t, l.Close(), name)
+		assert.Empty(t, igd.state(), name)
+	}
+}
@@ -0,0 +1,248 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ssdpAddr is where SSDP searches are multicast
+const ssdpAddr = "239.255.255.250:1900"
+
+// errOnlyPermanentLeases is the UPnP error of gateways refusing mappings that expire
+const errOnlyPermanentLeases = 725
+
+// UPnP maps ports through the WANIPConnection or WANPPPConnection service of an Internet Gateway Device
+type UPnP struct {
+	ControlURL  string
+	ServiceType string
+	// LocalIP is our address on the gateway's network, where the ports are forwarded to
+	LocalIP net.IP
+}
+
+func (g *UPnP) String() string {
+	return "UPnP"
+}
+
+// DiscoverUPnP searches the local network for an Internet Gateway Device
+func DiscoverUPnP(ctx context.Context) (*UPnP, error) {
+	return discoverUPnP(ctx, ssdpAddr)
+}
+
+func discoverUPnP(ctx context.Context, ssdp string) (*UPnP, error) {
+	dst, err := net.ResolveUDPAddr("udp4", ssdp)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	_, err = conn.WriteToUDP([]byte(search), dst)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DiscoverTimeout)
+	}
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	var lastErr error
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, errors.New("no Internet Gateway Device answered")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		g, err := describe(ctx, location)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return g, nil
+	}
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+// service finds the connection service in the device tree
+func (d upnpDevice) service() (upnpService, bool) {
+	for _, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return s, true
+		}
+	}
+	for _, child := range d.Devices {
+		s, ok := child.service()
+		if ok {
+			return s, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// describe reads the device description at location for the control URL of the connection service
+func describe(ctx context.Context, location string) (*UPnP, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&root)
+	if err != nil {
+		return nil, fmt.Errorf("reading device description: %w", err)
+	}
+	s, ok := root.Device.service()
+	if !ok {
+		return nil, fmt.Errorf("%s has no WAN connection service", location)
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.URLBase != "" {
+		base, err = url.Parse(root.URLBase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	control, err := base.Parse(s.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	host := control.Host
+	if control.Port() == "" {
+		host = net.JoinHostPort(control.Hostname(), "80")
+	}
+	local, err := localIP(host)
+	if err != nil {
+		return nil, err
+	}
+	return &UPnP{ControlURL: control.String(), ServiceType: s.ServiceType, LocalIP: local}, nil
+}
+
+// soapError is the UPnP error of a failed action
+type soapError struct {
+	Code        int
+	Description string
+}
+
+func (e *soapError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// call runs a SOAP action of the connection service with the arguments in order
+func (g *UPnP) call(ctx context.Context, action string, args [][2]string) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, g.ServiceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.ControlURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, g.ServiceType, action))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	var fault struct {
+		Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+		Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&fault)
+	if err != nil || fault.Code == 0 {
+		return fmt.Errorf("%s: %s", action, resp.Status)
+	}
+	return &soapError{Code: fault.Code, Description: fault.Description}
+}
+
+func (g *UPnP) AddMapping(ctx context.Context, protocol string, internal, external uint16, lifetime time.Duration) (uint16, error) {
+	add := func(lease time.Duration) error {
+		return g.call(ctx, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(external))},
+			{"NewProtocol", protocol},
+			{"NewInternalPort", strconv.Itoa(int(internal))},
+			{"NewInternalClient", g.LocalIP.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", description},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		})
+	}
+	err := add(lifetime)
+	var se *soapError
+	if errors.As(err, &se) && se.Code == errOnlyPermanentLeases {
+		// the mapping lasts until deleted, renewing it does no harm
+		err = add(0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return external, nil
+}
+
+func (g *UPnP) DeleteMapping(ctx context.Context, protocol string, internal, external uint16) error {
+	return g.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(external))},
+		{"NewProtocol", protocol},
+	})
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// MinBurst is the smallest burst a limited bucket gets, enough for a whole block message
+const MinBurst = 16<<10 + 13
+
+// Limit is a rate in bytes per second and the burst allowed above it.
+// A zero Rate is unlimited, a zero Burst is derived from the rate.
+type Limit struct {
+	Rate  int64
+	Burst int
+}
+
+func (l Limit) burst() int {
+	burst := l.Burst
+	if burst == 0 {
+		burst = int(l.Rate)
+	}
+	if burst < MinBurst {
+		burst = MinBurst
+	}
+	return burst
+}
+
+func (l Limit) newLimiter() *rate.Limiter {
+	if l.Rate <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(l.Rate), l.burst())
+}
+
+// Limits is a pair of download and upload limits
+type Limits struct {
+	Down Limit
+	Up   Limit
+}
+
+// Bucket is a pair of token buckets shared by every connection it is applied to
+type Bucket struct {
+	down *rate.Limiter
+	up   *rate.Limiter
+}
+
+func NewBucket(l Limits) *Bucket {
+	return &Bucket{down: l.Down.newLimiter(), up: l.Up.newLimiter()}
+}
+
+// Set changes the bucket's limits, affecting connections already using it
+func (b *Bucket) Set(l Limits) {
+	set(b.down, l.Down)
+	set(b.up, l.Up)
+}
+
+func set(lim *rate.Limiter, l Limit) {
+	if l.Rate <= 0 {
+		lim.SetLimit(rate.Inf)
+		return
+	}
+	lim.SetBurst(l.burst())
+	lim.SetLimit(rate.Limit(l.Rate))
+}
+
+// Conn is a connection whose reads and writes wait on every bucket it was given
+type Conn struct {
+	net.Conn
+	down []*rate.Limiter
+	up   []*rate.Limiter
+}
+
+// NewConn wraps conn with the buckets, nil buckets being ignored
+func NewConn(conn net.Conn, buckets ...*Bucket) *Conn {
+	c := &Conn{Conn: conn}
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		c.down = append(c.down, b.down)
+		c.up = append(c.up, b.up)
+	}
+	return c
+}
+
+// chunk returns the largest amount every limiter can grant at once, or n when unlimited
+func chunk(limiters []*rate.Limiter, n int) int {
+	for _, lim := range limiters {
+		if lim.Limit() == rate.Inf {
+			continue
+		}
+		if b := lim.Burst(); b < n {
+			n = b
+		}
+	}
+	return n
+}
+
+// wait takes n tokens from every limiter, a burst at a time in case a schedule shrank it
+func wait(limiters []*rate.Limiter, n int) error {
+	for _, lim := range limiters {
+		for left := n; left > 0; {
+			k := chunk([]*rate.Limiter{lim}, left)
+			err := lim.WaitN(context.Background(), k)
+			if err != nil {
+				return err
+			}
+			left -= k
+		}
+	}
+	return nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p[:chunk(c.down, len(p))])
+	if n > 0 {
+		werr := wait(c.down, n)
+		if err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := chunk(c.up, len(p)-written)
+		err := wait(c.up, n)
+		if err != nil {
+			return written, err
+		}
+		n, err = c.Conn.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		fails bool
+	}{
+		"business hours":   {input: "mon-fri 09:00-18:00 1MiB/256KiB"},
+		"weekend list":     {input: "sat,sun 00:00-23:59 0/0"},
+		"every night":      {input: "* 22:00-06:00 10MB/1MB"},
+		"missing rates":    {input: "mon-fri 09:00-18:00", fails: true},
+		"bad day":          {input: "monday 09:00-18:00 1MiB/1MiB", fails: true},
+		"bad time":         {input: "mon 9-18 1MiB/1MiB", fails: true},
+		"bad rate":         {input: "mon 09:00-18:00 fast/1MiB", fails: true},
+		"missing up limit": {input: "mon 09:00-18:00 1MiB", fails: true},
+	}
+	for name, test := range tests {
+		_, err := ParseRule(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+	}
+}
+
+func TestScheduleLimits(t *testing.T) {
+	business, err := ParseRule("mon-fri 09:00-18:00 1MiB/256KiB")
+	require.Nil(t, err)
+	night, err := ParseRule("fri 22:00-06:00 0/0")
+	require.Nil(t, err)
+	s := Schedule{Default: Limits{Down: Limit{Rate: 100}}, Rules: []Rule{business, night}}
+
+	// 2024-09-02 is a Monday
+	monday := time.Date(2024, 9, 2, 10, 30, 0, 0, time.Local)
+	assert.Equal(t, int64(1<<20), s.Limits(monday).Down.Rate)
+	assert.Equal(t, int64(256<<10), s.Limits(monday).Up.Rate)
+	assert.Equal(t, int64(100), s.Limits(monday.Add(8*time.Hour)).Down.Rate)
+
+	saturdayMorning := time.Date(2024, 9, 7, 3, 0, 0, 0, time.Local)
+	assert.True(t, night.Active(saturdayMorning))
+	assert.False(t, night.Active(saturdayMorning.Add(24*time.Hour)))
+	assert.Equal(t, int64(0), s.Limits(saturdayMorning).Down.Rate)
+}
+
+func TestConnThrottlesWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	bucket := NewBucket(Limits{Up: Limit{Rate: 100000}})
+	conn := NewConn(client, bucket, nil)
+
+	size := 100000 + 50000
+	go io.Copy(io.Discard, server)
+	started := time.Now()
+	n, err := conn.Write(make([]byte, size))
+	require.Nil(t, err)
+	assert.Equal(t, size, n)
+	// a second worth of burst goes through at once, the rest at 100000 bytes per second
+	assert.GreaterOrEqual(t, time.Since(started), 400*time.Millisecond)
+}
+
+func TestConnUnlimited(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := NewConn(server, NewBucket(Limits{}))
+
+	go client.Write(make([]byte, 1<<20))
+	started := time.Now()
+	n, err := io.ReadFull(conn, make([]byte, 1<<20))
+	require.Nil(t, err)
+	assert.Equal(t, 1<<20, n)
+	assert.Less(t, time.Since(started), time.Second)
+}
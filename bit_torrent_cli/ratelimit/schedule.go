@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Rule replaces the default limits during a daily time window on some days of the week
+type Rule struct {
+	Days   [7]bool
+	Start  time.Duration // since midnight
+	End    time.Duration // since midnight, before Start for windows crossing midnight
+	Limits Limits
+}
+
+// ParseRule parses a rule like "mon-fri 09:00-18:00 1MiB/256KiB" (download/upload per second, 0 for unlimited).
+// The days may be "*", a range or a comma separated list.
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return Rule{}, fmt.Errorf("rate rule %q: expected <days> <HH:MM-HH:MM> <down>/<up>", s)
+	}
+	var r Rule
+	err := r.parseDays(strings.ToLower(fields[0]))
+	if err != nil {
+		return Rule{}, fmt.Errorf("rate rule %q: %w", s, err)
+	}
+	start, end, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return Rule{}, fmt.Errorf("rate rule %q: bad time window %q", s, fields[1])
+	}
+	if r.Start, err = parseClock(start); err != nil {
+		return Rule{}, fmt.Errorf("rate rule %q: %w", s, err)
+	}
+	if r.End, err = parseClock(end); err != nil {
+		return Rule{}, fmt.Errorf("rate rule %q: %w", s, err)
+	}
+	down, up, ok := strings.Cut(fields[2], "/")
+	if !ok {
+		return Rule{}, fmt.Errorf("rate rule %q: expected <down>/<up> rates", s)
+	}
+	if r.Limits.Down.Rate, err = ParseRate(down); err != nil {
+		return Rule{}, fmt.Errorf("rate rule %q: %w", s, err)
+	}
+	if r.Limits.Up.Rate, err = ParseRate(up); err != nil {
+		return Rule{}, fmt.Errorf("rate rule %q: %w", s, err)
+	}
+	return r, nil
+}
+
+// ParseRate parses a byte rate like "512KiB" or "2MB", "0" meaning unlimited
+func ParseRate(s string) (int64, error) {
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+func (r *Rule) parseDays(s string) error {
+	if s == "*" {
+		for i := range r.Days {
+			r.Days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return fmt.Errorf("bad day %q", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[last]; !ok {
+				return fmt.Errorf("bad day %q", last)
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			r.Days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active reports whether the rule applies at the given time
+func (r Rule) Active(now time.Time) bool {
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if r.Start <= r.End {
+		return r.Days[now.Weekday()] && clock >= r.Start && clock < r.End
+	}
+	// the window crosses midnight, after midnight it belongs to the previous day
+	if clock >= r.Start {
+		return r.Days[now.Weekday()]
+	}
+	return clock < r.End && r.Days[(now.Weekday()+6)%7]
+}
+
+// Schedule picks the limits of a bucket from the time of day
+type Schedule struct {
+	Default Limits
+	Rules   []Rule
+}
+
+// Limits returns the limits of the first active rule, or the default ones
+func (s *Schedule) Limits(now time.Time) Limits {
+	for _, r := range s.Rules {
+		if r.Active(now) {
+			limits := r.Limits
+			limits.Down.Burst = s.Default.Down.Burst
+			limits.Up.Burst = s.Default.Up.Burst
+			return limits
+		}
+	}
+	return s.Default
+}
+
+// Run applies the schedule to the bucket every minute until ctx is done
+func (s *Schedule) Run(ctx context.Context, b *Bucket) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		b.Set(s.Limits(time.Now()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
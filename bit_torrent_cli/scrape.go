@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bit_torrent_cli/torrentfile"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// scrapeCmd prints the seeders, leechers and completed downloads the trackers know of each torrent
+func scrapeCmd(args []string) error {
+	fs := newFlagSet("scrape", "<torrent>...")
+	err := parseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "NAME\tSEEDERS\tLEECHERS\tCOMPLETED")
+	var errs []error
+	for _, path := range fs.Args() {
+		tf, err := torrentfile.Open(path)
+		if err == nil {
+			var sw torrentfile.Swarm
+			sw, err = tf.Scrape()
+			if err == nil {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", tf.Name, sw.Seeders, sw.Leechers, sw.Completed)
+				continue
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,991 @@
+package session
+
+import (
+	"bit_torrent_cli/handshake"
+	"bit_torrent_cli/logging"
+	"bit_torrent_cli/lsd"
+	"bit_torrent_cli/metadata"
+	"bit_torrent_cli/mse"
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/peerid"
+	"bit_torrent_cli/peers"
+	"bit_torrent_cli/portmap"
+	"bit_torrent_cli/ratelimit"
+	"bit_torrent_cli/storage"
+	"bit_torrent_cli/torrentfile"
+	"bit_torrent_cli/transport"
+	"bit_torrent_cli/utp"
+	"bit_torrent_cli/wiretrace"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+)
+
+// State is where a torrent is in the session's queue
+type State int
+
+const (
+	Queued State = iota
+	Downloading
+	Seeding
+	Paused
+)
+
+func (s State) String() string {
+	switch s {
+	case Queued:
+		return "queued"
+	case Downloading:
+		return "downloading"
+	case Seeding:
+		return "seeding"
+	case Paused:
+		return "paused"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultAnnounceInterval is how often trackers and the DHT are asked for peers when not configured
+const DefaultAnnounceInterval = 30 * time.Minute
+
+type Config struct {
+	// DataDir is where completed torrents are written
+	DataDir string
+	// Storage keeps the data of the torrents while they download, memory if nil. The files are not written
+	// to DataDir once downloaded when it stores them in place. The session closes it.
+	Storage storage.Backend
+	// ListenAddr accepts inbound peer connections for every torrent, empty disables listening.
+	// Its port may be a range like 6881-6889, the first free one being used.
+	ListenAddr string
+	// PortMapping forwards the listen port on the gateway with PCP, NAT-PMP or UPnP and announces the external port
+	PortMapping bool
+	// PortMapper is the gateway PortMapping uses, nil meaning the one discovered
+	PortMapper portmap.Mapper
+	// DHT finds peers on the mainline DHT in addition to the trackers
+	DHT bool
+	// LSD finds peers on the local network by multicast announces (BEP 14)
+	LSD bool
+	// Holepunch relays peers behind NATs to each other and asks for relays to the peers we cannot dial (BEP 55).
+	// The holes are punched over uTP when UTP is set, as both ends dial from their listening port.
+	Holepunch bool
+	// MaxActiveDownloads and MaxActiveSeeds queue the torrents beyond them, 0 meaning no limit
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// MaxConns caps the connections of the whole session and MaxConnsPerTorrent those of each torrent, 0 meaning no cap
+	MaxConns           int
+	MaxConnsPerTorrent int
+	// HashWorkers check the downloaded pieces of every torrent, one per CPU if 0. MaxUnverifiedBytes bounds
+	// the bytes of the pieces being downloaded or waiting for their check, p2p.DefaultMaxUnverifiedBytes if 0.
+	HashWorkers        int
+	MaxUnverifiedBytes int64
+	// Global throttles every connection of the session, nil meaning unlimited until SetLimits
+	Global        *ratelimit.Bucket
+	TorrentLimits ratelimit.Limits
+	PeerLimits    ratelimit.Limits
+	// AnnounceInterval is how often trackers and the DHT are asked for peers
+	AnnounceInterval time.Duration
+	// Encryption is the MSE policy for outgoing and inbound peer connections
+	Encryption mse.Policy
+	// UTP also dials peers over uTP, trying it before the Dialer, and accepts uTP on the listen port.
+	// uTP goes around proxies.
+	UTP bool
+	// Dialer connects to peers, nil meaning TCP
+	Dialer transport.Dialer
+	// Listener, if set, accepts peers instead of a TCP listener on ListenAddr. The session closes it.
+	Listener transport.Listener
+	// PeerIDPrefix starts the peer ID every torrent of the session uses, peerid.DefaultPrefix if empty
+	PeerIDPrefix string
+	// Logger is where the session and its torrents log, the default logger if nil
+	Logger *slog.Logger
+	// Recorder, if set, captures the peer connections of every torrent
+	Recorder *wiretrace.Recorder
+}
+
+// Torrent is a torrent managed by the session
+type Torrent struct {
+	Meta    torrentfile.Torrentfile
+	AddedAt time.Time
+
+	state    State
+	p2p      *p2p.Torrent
+	store    storage.Storage
+	bucket   *ratelimit.Bucket
+	limits   ratelimit.Limits
+	stop     chan struct{}
+	watching bool
+	written  bool
+	err      error
+	// starting is set while the engine torrent starts, which is done outside of the session's lock
+	starting bool
+}
+
+// Status is a snapshot of a torrent of the session
+type Status struct {
+	InfoHash [20]byte
+	Name     string
+	State    State
+	AddedAt  time.Time
+	Announce string
+	// PieceLength and Files describe the torrent's layout
+	PieceLength int
+	Files       []p2p.File
+	Limits      ratelimit.Limits
+	Stats       p2p.Stats
+	// Complete is set once the wanted files are written to the data directory
+	Complete bool
+	Err      error
+}
+
+// Session runs many torrents with a shared peer ID, listener, DHT node, bandwidth and connection caps
+type Session struct {
+	cfg    Config
+	log    *slog.Logger
+	peerID [20]byte
+	port   uint16
+	slots  *p2p.ConnSlots
+	hasher *p2p.Hasher
+
+	listener net.Listener
+	utp      *utp.Socket
+	dialer   transport.Dialer
+	dht      *dht.Server
+	lsd      *lsd.Service
+	lsdStop  chan struct{}
+	lease    *portmap.Lease
+
+	mu       sync.Mutex
+	limits   ratelimit.Limits
+	torrents map[[20]byte]*Torrent
+	order    [][20]byte
+	// starts are the torrents scheduled to start, which unlock does
+	starts []start
+	closed bool
+}
+
+// start is an engine torrent to start for a torrent of the session
+type start struct {
+	t  *Torrent
+	pt *p2p.Torrent
+	// files are those pt starts with, the priorities changed meanwhile being set once started
+	files []p2p.File
+}
+
+var (
+	ErrExists   = errors.New("torrent already in session")
+	ErrNotFound = errors.New("torrent not in session")
+	ErrNoFile   = errors.New("no such file in torrent")
+)
+
+// MetadataPeerWait is how long AddMagnet looks for peers on the DHT before asking them for the metadata
+const MetadataPeerWait = 15 * time.Second
+
+// New starts a session: its listener and DHT node if configured
+func New(cfg Config) (*Session, error) {
+	if cfg.AnnounceInterval == 0 {
+		cfg.AnnounceInterval = DefaultAnnounceInterval
+	}
+	if cfg.Global == nil {
+		cfg.Global = ratelimit.NewBucket(ratelimit.Limits{})
+	}
+	s := &Session{cfg: cfg, log: logging.For(cfg.Logger, "session"), torrents: make(map[[20]byte]*Torrent)}
+	var err error
+	s.peerID, err = peerid.New(cfg.PeerIDPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConns > 0 {
+		s.slots = p2p.NewConnSlots(cfg.MaxConns)
+	}
+	s.hasher = p2p.NewHasher(cfg.HashWorkers, cfg.MaxUnverifiedBytes)
+	s.dialer = cfg.Dialer
+	if s.dialer == nil {
+		s.dialer = transport.TCP
+	}
+	s.listener = cfg.Listener
+	if s.listener == nil && cfg.ListenAddr != "" {
+		s.listener, err = transport.ListenTCP(cfg.ListenAddr)
+		if err != nil {
+			s.hasher.Close()
+			return nil, fmt.Errorf("listening: %w", err)
+		}
+	}
+	if s.listener != nil {
+		_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+		p, _ := strconv.ParseUint(port, 10, 16)
+		s.port = uint16(p)
+		go s.acceptLoop(s.listener)
+	}
+	if cfg.UTP {
+		// uTP shares the TCP port so peers reach both at the announced one
+		addr := ":0"
+		if s.listener != nil {
+			host, _, _ := net.SplitHostPort(cfg.ListenAddr)
+			addr = net.JoinHostPort(host, strconv.Itoa(int(s.port)))
+		}
+		s.utp, err = utp.Listen(addr)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("listening for uTP: %w", err)
+		}
+		if s.listener != nil {
+			go s.acceptLoop(s.utp)
+		}
+		s.dialer = transport.Fallback{s.utp, s.dialer}
+	}
+	if cfg.DHT {
+		s.dht, err = dht.NewServer(nil)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("starting dht: %w", err)
+		}
+	}
+	if cfg.LSD {
+		s.lsd, err = lsd.New(s.port, s.foundLocal)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("starting local service discovery: %w", err)
+		}
+		if s.listener != nil {
+			s.lsdStop = make(chan struct{})
+			go s.lsdLoop(s.lsdStop)
+		}
+	}
+	if cfg.PortMapping && s.listener != nil {
+		s.mapPort()
+	}
+	return s, nil
+}
+
+// mapPort forwards the listen port on the gateway, going on without it as most hosts have none
+func (s *Session) mapPort() {
+	m := s.cfg.PortMapper
+	if m == nil {
+		var err error
+		m, err = portmap.Discover(context.Background())
+		if err != nil {
+			s.log.Info("no port mapping", logging.Err(err))
+			return
+		}
+	}
+	protocols := []string{portmap.TCP}
+	if s.utp != nil {
+		protocols = append(protocols, portmap.UDP)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), portmap.DiscoverTimeout)
+	defer cancel()
+	lease, err := portmap.Map(ctx, m, s.port, protocols, portmap.DefaultLifetime)
+	if err != nil {
+		s.log.Warn("port mapping failed", "gateway", m.String(), logging.Err(err))
+		return
+	}
+	s.lease = lease
+	s.port = lease.External(portmap.TCP)
+	s.log.Info("port forwarded", "gateway", m.String(), "port", s.port)
+}
+
+// PeerID returns the peer ID every torrent of the session uses
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// Config returns the configuration the session was started with
+func (s *Session) Config() Config {
+	return s.cfg
+}
+
+// Port returns the port announced to trackers and the DHT, 0 when not listening
+func (s *Session) Port() uint16 {
+	return s.port
+}
+
+// Add queues a torrent, starting it right away if the queue allows
+func (s *Session) Add(tf torrentfile.Torrentfile) ([20]byte, error) {
+	return s.add(tf, Queued)
+}
+
+// AddPaused adds a torrent that waits for Resume
+func (s *Session) AddPaused(tf torrentfile.Torrentfile) ([20]byte, error) {
+	return s.add(tf, Paused)
+}
+
+// add checks the torrent and opens its storage before taking the lock, under which nothing may fail
+func (s *Session) add(tf torrentfile.Torrentfile, state State) ([20]byte, error) {
+	err := tf.Validate()
+	if err != nil {
+		return tf.Infohash, err
+	}
+	if _, ok := s.Get(tf.Infohash); ok {
+		return tf.Infohash, ErrExists
+	}
+	var store storage.Storage
+	if s.cfg.Storage != nil {
+		store, err = s.cfg.Storage.Open(tf.Layout())
+		if err != nil {
+			return tf.Infohash, fmt.Errorf("opening storage: %w", err)
+		}
+	}
+	s.mu.Lock()
+	_, exists := s.torrents[tf.Infohash]
+	if s.closed || exists {
+		s.mu.Unlock()
+		if store != nil {
+			store.Close()
+		}
+		if exists {
+			return tf.Infohash, ErrExists
+		}
+		return [20]byte{}, p2p.ErrClosed
+	}
+	s.torrents[tf.Infohash] = &Torrent{
+		Meta:    tf,
+		AddedAt: time.Now(),
+		state:   state,
+		store:   store,
+		bucket:  ratelimit.NewBucket(s.cfg.TorrentLimits),
+		limits:  s.cfg.TorrentLimits,
+	}
+	s.order = append(s.order, tf.Infohash)
+	s.scheduleLocked()
+	s.unlock()
+	return tf.Infohash, nil
+}
+
+// AddFile opens a .torrent file and adds it
+func (s *Session) AddFile(path string) ([20]byte, error) {
+	tf, err := torrentfile.Open(path)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return s.Add(tf)
+}
+
+// AddMagnet fetches the metadata of a magnet link from its peers and adds the torrent.
+// It blocks until the metadata arrives or ctx is done.
+func (s *Session) AddMagnet(ctx context.Context, uri string) ([20]byte, error) {
+	m, err := torrentfile.ParseMagnet(uri)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	if _, ok := s.Get(m.InfoHash); ok {
+		return m.InfoHash, ErrExists
+	}
+	m.Logger = s.cfg.Logger
+	// the failed announces are logged by the tracker
+	ps, _ := m.RequestPeers(s.peerID, s.port)
+	if s.dht != nil {
+		ps = append(ps, s.lookupDHT(ctx, m.InfoHash)...)
+	}
+	if len(ps) == 0 {
+		return [20]byte{}, fmt.Errorf("no peers found for %x", m.InfoHash)
+	}
+	info, err := metadata.Fetch(ctx, s.dialer, m.InfoHash, s.peerID, ps)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	announce := ""
+	if len(m.Trackers) > 0 {
+		announce = m.Trackers[0]
+	}
+	tf, err := torrentfile.FromMetadata(info, m.InfoHash, announce)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	ih, err := s.Add(tf)
+	if err != nil {
+		return ih, err
+	}
+	if pt := s.Torrent(ih); pt != nil {
+		pt.AddPeers(ps)
+	}
+	return ih, nil
+}
+
+// lookupDHT collects the peers the DHT knows for a while
+func (s *Session) lookupDHT(ctx context.Context, infoHash [20]byte) []peers.Peer {
+	a, err := s.dht.AnnounceTraversal(infoHash)
+	if err != nil {
+		s.log.Warn("dht lookup failed", logging.KeyInfohash, hex.EncodeToString(infoHash[:]), logging.Err(err))
+		return nil
+	}
+	defer a.Close()
+	timeout := time.NewTimer(MetadataPeerWait)
+	defer timeout.Stop()
+	var ps []peers.Peer
+	for {
+		select {
+		case pv, ok := <-a.Peers:
+			if !ok {
+				return ps
+			}
+			for _, p := range pv.Peers {
+				ps = append(ps, peers.Peer{IP: p.IP, Port: uint16(p.Port)})
+			}
+		case <-timeout.C:
+			return ps
+		case <-ctx.Done():
+			return ps
+		}
+	}
+}
+
+// Remove stops a torrent and forgets it, deleting its files from the data directory and its data from the storage
+// if asked to. Only the torrent's own files are deleted, whatever else shares their directory staying.
+func (s *Session) Remove(infoHash [20]byte, deleteData bool) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	s.deactivateLocked(t)
+	t.close()
+	delete(s.torrents, infoHash)
+	for i, ih := range s.order {
+		if ih == infoHash {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	s.scheduleLocked()
+	s.unlock()
+	if !deleteData {
+		return nil
+	}
+	err := t.Meta.RemoveFiles(filepath.Join(s.cfg.DataDir, t.Meta.Name))
+	if s.cfg.Storage != nil {
+		err = errors.Join(err, s.cfg.Storage.Remove(t.Meta.Layout()))
+	}
+	return err
+}
+
+// Pause stops a torrent until Resume, keeping what it downloaded
+func (s *Session) Pause(infoHash [20]byte) error {
+	s.mu.Lock()
+	defer s.unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return ErrNotFound
+	}
+	s.deactivateLocked(t)
+	t.state = Paused
+	s.scheduleLocked()
+	return nil
+}
+
+// Resume puts a paused torrent back in the queue
+func (s *Session) Resume(infoHash [20]byte) error {
+	s.mu.Lock()
+	defer s.unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return ErrNotFound
+	}
+	if t.state == Paused {
+		t.state = Queued
+		s.scheduleLocked()
+	}
+	return nil
+}
+
+// SetFilePriority changes the priority of a file, downloading it again if it was skipped
+func (s *Session) SetFilePriority(infoHash [20]byte, file int, prio p2p.Priority) error {
+	s.mu.Lock()
+	defer s.unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return ErrNotFound
+	}
+	if file < 0 || file >= len(t.Meta.Files) {
+		return ErrNoFile
+	}
+	t.Meta.Files[file].Priority = prio
+	if t.p2p == nil {
+		return nil
+	}
+	t.p2p.SetFilePriority(file, prio)
+	if !t.downloaded() {
+		t.written = false
+		if !t.watching {
+			t.watching = true
+			go s.watchComplete(t, t.p2p)
+		}
+	}
+	s.scheduleLocked()
+	return nil
+}
+
+// Limits returns the global limits set with SetLimits
+func (s *Session) Limits() ratelimit.Limits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limits
+}
+
+// SetLimits changes the global limits of the session
+func (s *Session) SetLimits(l ratelimit.Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = l
+	s.cfg.Global.Set(l)
+}
+
+// SetTorrentLimits changes the limits of one torrent
+func (s *Session) SetTorrentLimits(infoHash [20]byte, l ratelimit.Limits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return ErrNotFound
+	}
+	t.limits = l
+	t.bucket.Set(l)
+	return nil
+}
+
+// List returns the status of every torrent in the order they were added
+func (s *Session) List() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]Status, 0, len(s.order))
+	for _, ih := range s.order {
+		statuses = append(statuses, s.torrents[ih].status())
+	}
+	return statuses
+}
+
+// Get returns the status of a torrent
+func (s *Session) Get(infoHash [20]byte) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return Status{}, false
+	}
+	return t.status(), true
+}
+
+// Torrent returns the engine torrent, nil until it was first started
+func (s *Session) Torrent(infoHash [20]byte) *p2p.Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return nil
+	}
+	return t.p2p
+}
+
+func (t *Torrent) status() Status {
+	st := Status{
+		InfoHash:    t.Meta.Infohash,
+		Name:        t.Meta.Name,
+		State:       t.state,
+		AddedAt:     t.AddedAt,
+		Announce:    t.Meta.Announce,
+		PieceLength: t.Meta.PieceLength,
+		Files:       append([]p2p.File(nil), t.Meta.Files...),
+		Limits:      t.limits,
+		Complete:    t.written,
+		Err:         t.err,
+	}
+	if t.p2p != nil {
+		st.Stats = t.p2p.Stats()
+	}
+	return st
+}
+
+// close closes the p2p torrent, or the storage when it never started. A torrent starting is closed once started.
+func (t *Torrent) close() {
+	switch {
+	case t.starting:
+	case t.p2p != nil:
+		t.p2p.Close()
+	case t.store != nil:
+		t.store.Close()
+	}
+}
+
+// inPlace tells whether the storage writes the files where they go, nothing being left to write once downloaded
+func (s *Session) inPlace() bool {
+	return s.cfg.Storage != nil && s.cfg.Storage.InPlace()
+}
+
+func (t *Torrent) downloaded() bool {
+	if t.p2p == nil {
+		return false
+	}
+	select {
+	case <-t.p2p.Complete():
+		return true
+	default:
+		return false
+	}
+}
+
+// scheduleLocked activates torrents in the order they were added, as the download and seed limits allow
+func (s *Session) scheduleLocked() {
+	if s.closed {
+		return
+	}
+	downloads, seeds := 0, 0
+	for _, ih := range s.order {
+		t := s.torrents[ih]
+		if t.state == Paused {
+			continue
+		}
+		want := Queued
+		if !t.downloaded() {
+			if s.cfg.MaxActiveDownloads == 0 || downloads < s.cfg.MaxActiveDownloads {
+				want = Downloading
+				downloads++
+			}
+		} else if s.cfg.MaxActiveSeeds == 0 || seeds < s.cfg.MaxActiveSeeds {
+			want = Seeding
+			seeds++
+		}
+		if want == Queued {
+			s.deactivateLocked(t)
+		} else {
+			s.activateLocked(t)
+		}
+		// a torrent whose data was all there is done as soon as it starts
+		if want == Downloading && t.downloaded() {
+			want = Seeding
+			downloads--
+			seeds++
+		}
+		t.state = want
+	}
+}
+
+// activateLocked resumes a torrent and its announces, or schedules its start
+func (s *Session) activateLocked(t *Torrent) {
+	if t.stop != nil {
+		return
+	}
+	t.stop = make(chan struct{})
+	if t.p2p == nil {
+		if !t.starting {
+			t.starting = true
+			s.starts = append(s.starts, s.prepareLocked(t))
+		}
+		// the announces begin once started
+		return
+	}
+	t.p2p.Resume()
+	s.announceLocked(t)
+}
+
+// prepareLocked builds the engine torrent of a torrent for unlock to start
+func (s *Session) prepareLocked(t *Torrent) start {
+	t.Meta.Logger = s.cfg.Logger
+	t.Meta.Recorder = s.cfg.Recorder
+	pt := t.Meta.NewTorrent(s.peerID, nil)
+	// SetFilePriority changes those of t.Meta while starting
+	pt.Files = append([]p2p.File(nil), t.Meta.Files...)
+	pt.Bandwidth = p2p.Bandwidth{
+		Global:  s.cfg.Global,
+		Torrent: t.bucket,
+		Peer:    s.cfg.PeerLimits,
+	}
+	pt.MaxConns = s.cfg.MaxConnsPerTorrent
+	pt.Slots = s.slots
+	pt.Hasher = s.hasher
+	pt.Storage = t.store
+	pt.Encryption = s.cfg.Encryption
+	pt.Dialer = s.dialer
+	pt.Holepunch = s.cfg.Holepunch
+	if s.listener != nil {
+		pt.Port = s.port
+	}
+	return start{t: t, pt: pt, files: pt.Files}
+}
+
+// unlock releases the lock, starting the torrents scheduled to first. They are started without holding it,
+// as checking the data already there takes a while, and scheduled again once started.
+func (s *Session) unlock() {
+	for len(s.starts) > 0 {
+		starts := s.starts
+		s.starts = nil
+		s.mu.Unlock()
+		for _, st := range starts {
+			st.pt.Start()
+		}
+		s.mu.Lock()
+		for _, st := range starts {
+			s.startedLocked(st)
+		}
+		s.scheduleLocked()
+	}
+	s.mu.Unlock()
+}
+
+// startedLocked hands a started engine torrent to its torrent, closing it if the torrent went meanwhile
+func (s *Session) startedLocked(st start) {
+	t, pt := st.t, st.pt
+	t.starting = false
+	if s.closed || s.torrents[t.Meta.Infohash] != t {
+		pt.Close()
+		return
+	}
+	t.p2p = pt
+	for i, f := range t.Meta.Files {
+		if f.Priority != st.files[i].Priority {
+			pt.SetFilePriority(i, f.Priority)
+		}
+	}
+	select {
+	case <-pt.Complete():
+		// the data was already all there, nothing to write
+		t.written = t.Meta.Data != nil || s.inPlace()
+	default:
+	}
+	if !t.written {
+		t.watching = true
+		go s.watchComplete(t, pt)
+	}
+	if t.stop == nil {
+		// paused or queued while starting
+		pt.Pause()
+		return
+	}
+	s.announceLocked(t)
+}
+
+// announceLocked starts the announces of an active torrent
+func (s *Session) announceLocked(t *Torrent) {
+	go s.announceLoop(t.Meta, t.p2p, t.stop)
+	if s.lsdStop != nil {
+		go s.lsd.Announce(t.Meta.Infohash)
+	}
+}
+
+// deactivateLocked drops the connections of an active torrent
+func (s *Session) deactivateLocked(t *Torrent) {
+	if t.stop == nil {
+		return
+	}
+	close(t.stop)
+	t.stop = nil
+	if t.p2p != nil {
+		t.p2p.Pause()
+	}
+}
+
+// watchComplete writes the torrent's files once downloaded and lets it move on to seeding.
+// It keeps going while files are selected again during the write.
+func (s *Session) watchComplete(t *Torrent, pt *p2p.Torrent) {
+	for {
+		err := pt.Wait()
+		if err != nil {
+			s.mu.Lock()
+			t.watching = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Lock()
+		meta := t.Meta
+		meta.Files = append([]p2p.File(nil), t.Meta.Files...)
+		s.mu.Unlock()
+		if !s.inPlace() {
+			err = meta.WriteFiles(pt, filepath.Join(s.cfg.DataDir, meta.Name))
+		}
+		if err != nil {
+			s.log.Error("writing files failed", logging.KeyInfohash, hex.EncodeToString(meta.Infohash[:]),
+				"name", meta.Name, logging.Err(err))
+		}
+		s.mu.Lock()
+		if err == nil && !t.downloaded() {
+			s.mu.Unlock()
+			continue
+		}
+		t.watching = false
+		t.written = err == nil
+		t.err = err
+		s.scheduleLocked()
+		s.unlock()
+		return
+	}
+}
+
+// announceLoop asks the tracker and the DHT for peers until stopped
+func (s *Session) announceLoop(tf torrentfile.Torrentfile, pt *p2p.Torrent, stop chan struct{}) {
+	ticker := time.NewTicker(s.cfg.AnnounceInterval)
+	defer ticker.Stop()
+	for {
+		if tf.Announce != "" {
+			ps, err := tf.RequestPeers(s.peerID, s.port)
+			if err == nil {
+				pt.AddPeers(ps)
+			}
+		}
+		if s.dht != nil {
+			s.announceDHT(tf.Infohash, pt, stop)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// announceDHT collects the peers of the DHT traversal, announcing ourselves only when accepting connections
+func (s *Session) announceDHT(infoHash [20]byte, pt *p2p.Torrent, stop chan struct{}) {
+	var a *dht.Announce
+	var err error
+	if s.listener != nil {
+		a, err = s.dht.Announce(infoHash, int(s.port), false)
+	} else {
+		a, err = s.dht.AnnounceTraversal(infoHash)
+	}
+	if err != nil {
+		s.log.Warn("dht announce failed", logging.KeyInfohash, hex.EncodeToString(infoHash[:]), logging.Err(err))
+		return
+	}
+	defer a.Close()
+	for {
+		select {
+		case pv, ok := <-a.Peers:
+			if !ok {
+				return
+			}
+			ps := make([]peers.Peer, 0, len(pv.Peers))
+			for _, p := range pv.Peers {
+				ps = append(ps, peers.Peer{IP: p.IP, Port: uint16(p.Port)})
+			}
+			pt.AddPeers(ps)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// lsdLoop announces the active torrents on the local network, only done when accepting connections
+func (s *Session) lsdLoop(stop chan struct{}) {
+	ticker := time.NewTicker(lsd.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		var active [][20]byte
+		for ih, t := range s.torrents {
+			if t.stop != nil {
+				active = append(active, ih)
+			}
+		}
+		s.mu.Unlock()
+		s.lsd.Announce(active...)
+	}
+}
+
+// foundLocal hands a peer announced on the local network to its torrent if active
+func (s *Session) foundLocal(infoHash [20]byte, p peers.Peer) {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	var pt *p2p.Torrent
+	if ok && t.stop != nil {
+		pt = t.p2p
+	}
+	s.mu.Unlock()
+	if pt != nil {
+		pt.AddPeers([]peers.Peer{p})
+	}
+}
+
+func (s *Session) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn reads an inbound handshake and hands the connection to the torrent it asks for
+func (s *Session) handleConn(raw net.Conn) {
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	s.mu.Lock()
+	skeys := make([][20]byte, 0, len(s.torrents))
+	for ih, t := range s.torrents {
+		if t.stop != nil {
+			skeys = append(skeys, ih)
+		}
+	}
+	s.mu.Unlock()
+	conn, err := mse.Accept(raw, skeys, s.cfg.Encryption)
+	if err != nil {
+		raw.Close()
+		return
+	}
+	hs, err := handshake.Read(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.mu.Lock()
+	t, ok := s.torrents[hs.InfoHash]
+	var pt *p2p.Torrent
+	if ok && t.stop != nil {
+		pt = t.p2p
+	}
+	s.mu.Unlock()
+	if pt == nil {
+		conn.Close()
+		return
+	}
+	err = pt.AcceptConn(conn, hs)
+	if err != nil {
+		conn.Close()
+	}
+}
+
+// Close stops every torrent, the listener, the DHT node and local service discovery, and removes the port mappings
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for _, t := range s.torrents {
+		s.deactivateLocked(t)
+		t.close()
+	}
+	s.mu.Unlock()
+	s.hasher.Close()
+	if s.cfg.Storage != nil {
+		s.cfg.Storage.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.utp != nil {
+		s.utp.Close()
+	}
+	if s.dht != nil {
+		s.dht.Close()
+	}
+	if s.lsdStop != nil {
+		close(s.lsdStop)
+	}
+	if s.lsd != nil {
+		s.lsd.Close()
+	}
+	if s.lease != nil {
+		s.lease.Close()
+	}
+	return nil
+}
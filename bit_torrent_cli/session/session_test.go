@@ -0,0 +1,220 @@
+package session
+
+import (
+	"bit_torrent_cli/client"
+	"bit_torrent_cli/mse"
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/peers"
+	"bit_torrent_cli/storage"
+	"bit_torrent_cli/torrentfile"
+	"bit_torrent_cli/utp"
+	"context"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTorrent(name string, id byte) torrentfile.Torrentfile {
+	return torrentfile.Torrentfile{
+		Name:        name,
+		PieceHashes: [][20]byte{{id}},
+		PieceLength: 16,
+		Length:      16,
+		Infohash:    [20]byte{id},
+		Files:       []p2p.File{{Path: name, Length: 16, Priority: p2p.PriorityNormal}},
+	}
+}
+
+func states(s *Session) []State {
+	var st []State
+	for _, status := range s.List() {
+		st = append(st, status.State)
+	}
+	return st
+}
+
+func TestQueue(t *testing.T) {
+	s, err := New(Config{DataDir: t.TempDir(), MaxActiveDownloads: 1})
+	require.Nil(t, err)
+	defer s.Close()
+
+	first, err := s.Add(testTorrent("first", 1))
+	require.Nil(t, err)
+	second, err := s.Add(testTorrent("second", 2))
+	require.Nil(t, err)
+	_, err = s.Add(testTorrent("first", 1))
+	assert.Equal(t, ErrExists, err)
+	assert.Equal(t, []State{Downloading, Queued}, states(s))
+	assert.Nil(t, s.Torrent(second))
+
+	require.Nil(t, s.Pause(first))
+	assert.Equal(t, []State{Paused, Downloading}, states(s))
+
+	// resumed torrents take their slot back in the order they were added
+	require.Nil(t, s.Resume(first))
+	assert.Equal(t, []State{Downloading, Queued}, states(s))
+
+	require.Nil(t, s.Remove(first, true))
+	assert.Equal(t, []State{Downloading}, states(s))
+	_, ok := s.Get(first)
+	assert.False(t, ok)
+	assert.Equal(t, ErrNotFound, s.Pause(first))
+}
+
+func TestAddInvalid(t *testing.T) {
+	s, err := New(Config{DataDir: t.TempDir()})
+	require.Nil(t, err)
+	defer s.Close()
+	tf := testTorrent("first", 1)
+	tf.PieceLength = 0
+	_, err = s.Add(tf)
+	assert.ErrorContains(t, err, "invalid piece length")
+	_, err = s.Add(testTorrent("..", 2))
+	assert.ErrorContains(t, err, "invalid path element")
+	assert.Empty(t, s.List())
+
+	// the session is still usable
+	_, err = s.Add(testTorrent("first", 1))
+	require.Nil(t, err)
+	assert.Equal(t, []State{Downloading}, states(s))
+}
+
+func TestRemoveData(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(Config{DataDir: dir})
+	require.Nil(t, err)
+	defer s.Close()
+	tf := testTorrent("dir", 1)
+	tf.Files = []p2p.File{{Path: "a", Length: 8, Priority: p2p.PriorityNormal}, {Path: "sub/b", Length: 8, Offset: 8, Priority: p2p.PriorityNormal}}
+	ih, err := s.AddPaused(tf)
+	require.Nil(t, err)
+	for _, name := range []string{"dir/a", "dir/sub/b", "dir/other", "single"} {
+		require.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644))
+	}
+
+	require.Nil(t, s.Remove(ih, true))
+	assert.NoFileExists(t, filepath.Join(dir, "dir", "a"))
+	assert.NoDirExists(t, filepath.Join(dir, "dir", "sub"))
+	assert.FileExists(t, filepath.Join(dir, "dir", "other"), "not a file of the torrent")
+	assert.FileExists(t, filepath.Join(dir, "single"))
+}
+
+func TestUnlimitedQueue(t *testing.T) {
+	s, err := New(Config{DataDir: t.TempDir()})
+	require.Nil(t, err)
+	defer s.Close()
+
+	for i := byte(1); i <= 3; i++ {
+		_, err = s.Add(testTorrent(string('a'+rune(i)), i))
+		require.Nil(t, err)
+	}
+	assert.Equal(t, []State{Downloading, Downloading, Downloading}, states(s))
+}
+
+func TestStorageInPlace(t *testing.T) {
+	// the files stored by an earlier run are seeded from where they are
+	dir := t.TempDir()
+	data := []byte("sixteen bytes!!!")
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "kept"), data, 0644))
+	kept := testTorrent("kept", 1)
+	kept.PieceHashes = [][20]byte{sha1.Sum(data)}
+	s, err := New(Config{DataDir: dir, Storage: storage.Files{Dir: dir}})
+	require.Nil(t, err)
+	defer s.Close()
+
+	ih, err := s.Add(kept)
+	require.Nil(t, err)
+	fresh, err := s.Add(testTorrent("fresh", 2))
+	require.Nil(t, err)
+	assert.Equal(t, []State{Seeding, Downloading}, states(s))
+	st, _ := s.Get(ih)
+	assert.True(t, st.Complete)
+	st, _ = s.Get(fresh)
+	assert.False(t, st.Complete)
+	got, err := os.ReadFile(filepath.Join(dir, "kept"))
+	require.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestRemoveStorage(t *testing.T) {
+	for _, kind := range []string{"piece", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			b, err := storage.New(kind, t.TempDir())
+			require.Nil(t, err)
+			tf := testTorrent("first", 1)
+			st, err := b.Open(tf.Layout())
+			require.Nil(t, err)
+			require.Nil(t, st.WritePiece(0, make([]byte, 16)))
+			require.Nil(t, st.Close())
+			s, err := New(Config{DataDir: t.TempDir(), Storage: b})
+			require.Nil(t, err)
+			defer s.Close()
+
+			ih, err := s.AddPaused(tf)
+			require.Nil(t, err)
+			require.Nil(t, s.Remove(ih, true))
+			st, err = b.Open(tf.Layout())
+			require.Nil(t, err)
+			defer st.Close()
+			assert.False(t, st.Stored(0))
+		})
+	}
+}
+
+func TestUTP(t *testing.T) {
+	s, err := New(Config{DataDir: t.TempDir(), ListenAddr: "127.0.0.1:0", UTP: true, Encryption: mse.PolicyRequire})
+	require.Nil(t, err)
+	defer s.Close()
+	ih, err := s.Add(testTorrent("first", 1))
+	require.Nil(t, err)
+
+	socket, err := utp.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer socket.Close()
+	peer := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: s.Port()}
+	c, err := client.Dial(socket, peer, [20]byte{9}, ih, mse.PolicyRequire)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+	assert.Len(t, c.Bitfield, 1)
+
+	_, err = client.Dial(socket, peer, [20]byte{9}, [20]byte{2}, mse.PolicyRequire)
+	assert.NotNil(t, err, "unknown torrent")
+}
+
+// fakeMapper forwards every port to external
+type fakeMapper struct {
+	external uint16
+	mapped   map[string]uint16
+}
+
+func (m *fakeMapper) AddMapping(ctx context.Context, protocol string, internal, external uint16, lifetime time.Duration) (uint16, error) {
+	m.mapped[protocol] = internal
+	return m.external, nil
+}
+
+func (m *fakeMapper) DeleteMapping(ctx context.Context, protocol string, internal, external uint16) error {
+	delete(m.mapped, protocol)
+	return nil
+}
+
+func (m *fakeMapper) String() string {
+	return "fake"
+}
+
+func TestPortMapping(t *testing.T) {
+	m := &fakeMapper{external: 40000, mapped: make(map[string]uint16)}
+	s, err := New(Config{DataDir: t.TempDir(), ListenAddr: "127.0.0.1:0", UTP: true, PortMapping: true, PortMapper: m})
+	require.Nil(t, err)
+	local := uint16(s.listener.Addr().(*net.TCPAddr).Port)
+	assert.Equal(t, map[string]uint16{"TCP": local, "UDP": local}, m.mapped)
+	assert.Equal(t, uint16(40000), s.Port(), "the external port is announced")
+	s.Close()
+	assert.Empty(t, m.mapped)
+}
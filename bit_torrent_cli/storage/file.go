@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Files writes each torrent as its files under Dir while downloading, as they are once done.
+// The pieces shared with skipped files write those files in part.
+type Files struct {
+	Dir string
+}
+
+func (b Files) Open(l Layout) (Storage, error) {
+	s := &files{l: l, handles: make([]*os.File, len(l.Files))}
+	var err error
+	s.paths, s.sizes, err = paths(b.Dir, l)
+	if err != nil {
+		return nil, err
+	}
+	// empty files get no piece written to them
+	for i, f := range l.Files {
+		if f.Length == 0 {
+			err := createEmpty(s.paths[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func (Files) InPlace() bool {
+	return true
+}
+
+func (b Files) Remove(l Layout) error {
+	return removeFiles(b.Dir, l)
+}
+
+func (Files) Close() error {
+	return nil
+}
+
+// paths returns where the files of l go under dir and how much of each was there beforehand,
+// failing on the paths that leave dir
+func paths(dir string, l Layout) (paths []string, sizes []int64, err error) {
+	paths = make([]string, len(l.Files))
+	sizes = make([]int64, len(l.Files))
+	for i, f := range l.Files {
+		local := filepath.FromSlash(f.Path)
+		if !filepath.IsLocal(local) {
+			return nil, nil, fmt.Errorf("file %s is not under %s", f.Path, dir)
+		}
+		paths[i] = filepath.Join(dir, local)
+		if fi, err := os.Stat(paths[i]); err == nil {
+			sizes[i] = fi.Size()
+		}
+	}
+	return paths, sizes, nil
+}
+
+// removeFiles deletes the files of l under dir and the directories they leave empty
+func removeFiles(dir string, l Layout) error {
+	names, _, err := paths(dir, l)
+	if err != nil {
+		return err
+	}
+	root := filepath.Clean(dir)
+	var dirs []string
+	for _, name := range names {
+		rm := os.Remove(name)
+		if !errors.Is(rm, fs.ErrNotExist) {
+			err = errors.Join(err, rm)
+		}
+		for d := filepath.Dir(name); d != root && !slices.Contains(dirs, d); d = filepath.Dir(d) {
+			dirs = append(dirs, d)
+		}
+	}
+	// the deepest first, a directory holding other files staying
+	slices.SortFunc(dirs, func(a, b string) int { return len(b) - len(a) })
+	for _, d := range dirs {
+		os.Remove(d)
+	}
+	return err
+}
+
+func createEmpty(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// storedIn tells whether the files were long enough when opened to hold the piece
+func storedIn(l Layout, sizes []int64, index int) bool {
+	begin, end := l.pieceBounds(index)
+	stored := true
+	l.each(int64(begin), end-begin, func(i int, fileOff int64, begin, end int) error {
+		stored = stored && sizes[i] >= fileOff+int64(end-begin)
+		return nil
+	})
+	return stored
+}
+
+type files struct {
+	l     Layout
+	paths []string
+	// sizes are those of the files when opened
+	sizes []int64
+
+	mu      sync.Mutex
+	handles []*os.File
+}
+
+// file opens the file i once, creating it for writes
+func (s *files) file(i int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handles[i] != nil {
+		return s.handles[i], nil
+	}
+	if create {
+		err := os.MkdirAll(filepath.Dir(s.paths[i]), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(s.paths[i], flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.handles[i] = f
+	return f, nil
+}
+
+// ReadAt reads from the files overlapping the range, failing on the first missing or short one
+func (s *files) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	err := s.l.each(off, len(p), func(i int, fileOff int64, begin, end int) error {
+		f, err := s.file(i, false)
+		if err != nil {
+			return err
+		}
+		read, err := f.ReadAt(p[begin:end], fileOff)
+		n += read
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", s.l.Files[i].Path, io.ErrUnexpectedEOF)
+		}
+		return err
+	})
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (s *files) WritePiece(index int, p []byte) error {
+	begin, _ := s.l.pieceBounds(index)
+	return s.l.each(int64(begin), len(p), func(i int, fileOff int64, begin, end int) error {
+		f, err := s.file(i, true)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(p[begin:end], fileOff)
+		return err
+	})
+}
+
+func (s *files) Stored(index int) bool {
+	return storedIn(s.l, s.sizes, index)
+}
+
+func (s *files) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for i, f := range s.handles {
+		if f != nil {
+			err = errors.Join(err, f.Close())
+			s.handles[i] = nil
+		}
+	}
+	return err
+}
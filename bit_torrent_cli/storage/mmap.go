@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// Mmap writes each torrent as its files under Dir like Files, through memory maps of them.
+// The files are created at their full length when the torrent is opened.
+type Mmap struct {
+	Dir string
+}
+
+func (b Mmap) Open(l Layout) (Storage, error) {
+	s := &mmapped{l: l, maps: make([]mmap.MMap, len(l.Files))}
+	var names []string
+	var err error
+	names, s.sizes, err = paths(b.Dir, l)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range l.Files {
+		err = s.mapFile(i, names[i], f.Length)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (Mmap) InPlace() bool {
+	return true
+}
+
+func (b Mmap) Remove(l Layout) error {
+	return removeFiles(b.Dir, l)
+}
+
+func (Mmap) Close() error {
+	return nil
+}
+
+type mmapped struct {
+	l     Layout
+	sizes []int64
+
+	mu    sync.RWMutex
+	files []*os.File
+	maps  []mmap.MMap
+}
+
+// mapFile sizes the file and maps it, empty files having nothing to map
+func (s *mmapped) mapFile(i int, path string, length int) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, f)
+	if s.sizes[i] < int64(length) {
+		err = f.Truncate(int64(length))
+		if err != nil {
+			return err
+		}
+	}
+	if length == 0 {
+		return nil
+	}
+	s.maps[i], err = mmap.MapRegion(f, length, mmap.RDWR, 0, 0)
+	return err
+}
+
+func (s *mmapped) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	err := s.l.each(off, len(p), func(i int, fileOff int64, begin, end int) error {
+		if s.maps[i] == nil {
+			return ErrClosed
+		}
+		n += copy(p[begin:end], s.maps[i][fileOff:])
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *mmapped) WritePiece(index int, p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	begin, _ := s.l.pieceBounds(index)
+	return s.l.each(int64(begin), len(p), func(i int, fileOff int64, begin, end int) error {
+		if s.maps[i] == nil {
+			return ErrClosed
+		}
+		copy(s.maps[i][fileOff:], p[begin:end])
+		return nil
+	})
+}
+
+func (s *mmapped) Stored(index int) bool {
+	return storedIn(s.l, s.sizes, index)
+}
+
+// Close flushes the maps to the files
+func (s *mmapped) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for i, m := range s.maps {
+		if m != nil {
+			err = errors.Join(err, m.Unmap())
+			s.maps[i] = nil
+		}
+	}
+	for _, f := range s.files {
+		err = errors.Join(err, f.Close())
+	}
+	s.files = nil
+	return err
+}
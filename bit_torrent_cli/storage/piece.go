@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// PieceFiles writes each piece of a torrent to its own file under Dir/<infohash>, so that a partial download
+// takes the space of the pieces downloaded alone and sparse files are not needed
+type PieceFiles struct {
+	Dir string
+}
+
+func (b PieceFiles) Open(l Layout) (Storage, error) {
+	dir := b.dir(l)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &pieceFiles{l: l, dir: dir}, nil
+}
+
+func (PieceFiles) InPlace() bool {
+	return false
+}
+
+func (b PieceFiles) Remove(l Layout) error {
+	return os.RemoveAll(b.dir(l))
+}
+
+func (b PieceFiles) dir(l Layout) string {
+	return filepath.Join(b.Dir, hex.EncodeToString(l.InfoHash[:]))
+}
+
+func (PieceFiles) Close() error {
+	return nil
+}
+
+type pieceFiles struct {
+	l   Layout
+	dir string
+}
+
+func (s *pieceFiles) path(index int) string {
+	return filepath.Join(s.dir, strconv.Itoa(index))
+}
+
+// ReadAt reads from the files of the pieces overlapping the range, failing on the first missing one
+func (s *pieceFiles) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off+int64(n) < int64(s.l.Length) {
+		pos := off + int64(n)
+		index := int(pos / int64(s.l.PieceLength))
+		begin, end := s.l.pieceBounds(index)
+		read, err := s.readPiece(index, p[n:min(len(p), n+end-int(pos))], pos-int64(begin))
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *pieceFiles) readPiece(index int, p []byte, off int64) (int, error) {
+	f, err := os.Open(s.path(index))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("piece %d not stored", index)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(p, off)
+	if errors.Is(err, io.EOF) {
+		return n, fmt.Errorf("piece %d: %w", index, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// WritePiece writes the piece to a temporary file renamed into place, so that no piece is ever partly there
+func (s *pieceFiles) WritePiece(index int, p []byte) error {
+	f, err := os.CreateTemp(s.dir, strconv.Itoa(index)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(p)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(index))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *pieceFiles) Stored(index int) bool {
+	_, err := os.Stat(s.path(index))
+	return err == nil
+}
+
+func (s *pieceFiles) Close() error {
+	return nil
+}
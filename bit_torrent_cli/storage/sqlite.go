@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLite keeps the pieces of every torrent as blobs of one database, a single file to move or back up
+type SQLite struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens the database at path, creating it if needed
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// one connection serializes the writes, which SQLite does anyway
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`pragma journal_mode = wal;
+		create table if not exists pieces (
+			infohash blob not null,
+			piece integer not null,
+			data blob not null,
+			primary key (infohash, piece)
+		) without rowid`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+func (b *SQLite) Open(l Layout) (Storage, error) {
+	return &sqlitePieces{db: b.db, l: l}, nil
+}
+
+func (*SQLite) InPlace() bool {
+	return false
+}
+
+func (b *SQLite) Remove(l Layout) error {
+	_, err := b.db.Exec(`delete from pieces where infohash = ?`, l.InfoHash[:])
+	return err
+}
+
+func (b *SQLite) Close() error {
+	return b.db.Close()
+}
+
+type sqlitePieces struct {
+	db *sql.DB
+	l  Layout
+}
+
+// ReadAt reads the parts of the pieces overlapping the range, failing on the first missing one
+func (s *sqlitePieces) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off+int64(n) < int64(s.l.Length) {
+		pos := off + int64(n)
+		index := int(pos / int64(s.l.PieceLength))
+		begin, end := s.l.pieceBounds(index)
+		want := min(len(p)-n, end-int(pos))
+		var data []byte
+		// substr counts bytes of blobs from 1
+		err := s.db.QueryRow(`select substr(data, ?, ?) from pieces where infohash = ? and piece = ?`,
+			pos-int64(begin)+1, want, s.l.InfoHash[:], index).Scan(&data)
+		if errors.Is(err, sql.ErrNoRows) {
+			return n, fmt.Errorf("piece %d not stored", index)
+		}
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data)
+		if len(data) < want {
+			return n, fmt.Errorf("piece %d: %w", index, io.ErrUnexpectedEOF)
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *sqlitePieces) WritePiece(index int, p []byte) error {
+	_, err := s.db.Exec(`insert or replace into pieces (infohash, piece, data) values (?, ?, ?)`, s.l.InfoHash[:], index, p)
+	return err
+}
+
+func (s *sqlitePieces) Stored(index int) bool {
+	var one int
+	err := s.db.QueryRow(`select 1 from pieces where infohash = ? and piece = ?`, s.l.InfoHash[:], index).Scan(&one)
+	return err == nil
+}
+
+// Close leaves the database to the backend, shared by the torrents
+func (s *sqlitePieces) Close() error {
+	return nil
+}
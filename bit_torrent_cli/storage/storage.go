@@ -0,0 +1,151 @@
+// Package storage keeps the data of the native engine's torrents, in memory or on disk
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+// Storage holds the data of a torrent, written a verified piece at a time. It is safe for concurrent use.
+type Storage interface {
+	// ReadAt reads the data of the torrent, failing on the pieces not stored
+	io.ReaderAt
+	// WritePiece stores a verified piece
+	WritePiece(index int, p []byte) error
+	// Stored tells whether a piece may be there from an earlier run, to be checked before downloading it
+	Stored(index int) bool
+	io.Closer
+}
+
+// ErrClosed is returned for reads and writes of a closed storage
+var ErrClosed = errors.New("storage closed")
+
+// Backend opens the storage of torrents
+type Backend interface {
+	Open(l Layout) (Storage, error)
+	// InPlace is set for the backends writing the torrents' files themselves, leaving nothing to write once downloaded
+	InPlace() bool
+	// Remove deletes the data of a torrent, its storage being closed
+	Remove(l Layout) error
+	Close() error
+}
+
+// Layout is what a backend knows of a torrent
+type Layout struct {
+	InfoHash    [20]byte
+	PieceLength int
+	Length      int
+	// Files are where the data goes, their slash separated paths relative to the backend's directory
+	Files []File
+}
+
+// File is a file of a torrent at its offset in the torrent's data
+type File struct {
+	Path   string
+	Offset int
+	Length int
+}
+
+// pieceBounds returns where a piece starts and ends in the torrent's data
+func (l Layout) pieceBounds(index int) (begin, end int) {
+	begin = index * l.PieceLength
+	return begin, min(begin+l.PieceLength, l.Length)
+}
+
+// each calls f for every file overlapping the n bytes at off, with where the overlap starts in the file and in those bytes
+func (l Layout) each(off int64, n int, f func(i int, fileOff int64, begin, end int) error) error {
+	for i, file := range l.Files {
+		lo := max(off, int64(file.Offset))
+		hi := min(off+int64(n), int64(file.Offset+file.Length))
+		if lo >= hi {
+			continue
+		}
+		err := f(i, lo-int64(file.Offset), int(lo-off), int(hi-off))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Kinds are the backends New makes, for the usage of flags
+const Kinds = "memory, file, mmap, piece or sqlite"
+
+// New makes the backend kind keeping its data under dir: the torrents' files themselves for file and mmap,
+// a file per piece under dir/.pieces for piece and the database dir/.torrents.db for sqlite.
+// An empty kind is memory.
+func New(kind, dir string) (Backend, error) {
+	switch kind {
+	case "", "memory":
+		return Memory{}, nil
+	case "file":
+		return Files{Dir: dir}, nil
+	case "mmap":
+		return Mmap{Dir: dir}, nil
+	case "piece":
+		return PieceFiles{Dir: filepath.Join(dir, ".pieces")}, nil
+	case "sqlite":
+		return OpenSQLite(filepath.Join(dir, ".torrents.db"))
+	}
+	return nil, fmt.Errorf("unknown storage %q, want %s", kind, Kinds)
+}
+
+// Memory keeps every torrent in a buffer of its length, lost at exit
+type Memory struct{}
+
+func (Memory) Open(l Layout) (Storage, error) {
+	return &memory{buf: make([]byte, l.Length), l: l}, nil
+}
+
+func (Memory) InPlace() bool {
+	return false
+}
+
+// Remove has nothing to do, the buffer going with its storage
+func (Memory) Remove(Layout) error {
+	return nil
+}
+
+func (Memory) Close() error {
+	return nil
+}
+
+type memory struct {
+	mu  sync.RWMutex
+	buf []byte
+	l   Layout
+}
+
+// ReadAt reads the buffer, the pieces not written yet being zeroed
+func (m *memory) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if off >= int64(len(m.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memory) WritePiece(index int, p []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	begin, _ := m.l.pieceBounds(index)
+	copy(m.buf[begin:], p)
+	return nil
+}
+
+func (m *memory) Stored(int) bool {
+	return false
+}
+
+// Close keeps the buffer, which stays readable
+func (m *memory) Close() error {
+	return nil
+}
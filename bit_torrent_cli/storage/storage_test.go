@@ -0,0 +1,142 @@
+package storage_test
+
+import (
+	"bit_torrent_cli/storage"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackends(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxy")
+	l := storage.Layout{
+		InfoHash:    [20]byte{1},
+		PieceLength: 16,
+		Length:      len(data),
+		Files: []storage.File{
+			{Path: "t/a", Offset: 0, Length: 10},
+			{Path: "t/empty", Offset: 10, Length: 0},
+			{Path: "t/dir/c", Offset: 10, Length: 25},
+		},
+	}
+	piece := func(index int) []byte {
+		return data[index*16 : min(index*16+16, len(data))]
+	}
+	tests := map[string]struct {
+		// partial is whether the pieces not written yet fail to read rather than read zeroed
+		partial    bool
+		persistent bool
+	}{
+		"memory": {},
+		"file":   {persistent: true},
+		"mmap":   {persistent: true},
+		"piece":  {partial: true, persistent: true},
+		"sqlite": {partial: true, persistent: true},
+	}
+	for kind, test := range tests {
+		t.Run(kind, func(t *testing.T) {
+			dir := t.TempDir()
+			b, err := storage.New(kind, dir)
+			require.Nil(t, err)
+			defer b.Close()
+			s, err := b.Open(l)
+			require.Nil(t, err)
+			for i := range 3 {
+				assert.False(t, s.Stored(i), "piece %d", i)
+			}
+			require.Nil(t, s.WritePiece(0, piece(0)))
+			require.Nil(t, s.WritePiece(2, piece(2)))
+
+			p := make([]byte, 6)
+			n, err := s.ReadAt(p, 7)
+			require.Nil(t, err)
+			assert.Equal(t, "789abc", string(p[:n]))
+			_, err = s.ReadAt(p, 14)
+			if test.partial {
+				assert.NotNil(t, err, "piece 1 is missing")
+			}
+			require.Nil(t, s.WritePiece(1, piece(1)))
+			got := make([]byte, len(data))
+			_, err = s.ReadAt(got, 0)
+			require.Nil(t, err)
+			assert.Equal(t, data, got)
+			n, err = s.ReadAt(p, 32)
+			assert.Equal(t, io.EOF, err)
+			assert.Equal(t, "wxy", string(p[:n]))
+			require.Nil(t, s.Close())
+
+			if b.InPlace() {
+				for _, f := range l.Files {
+					content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f.Path)))
+					require.Nil(t, err)
+					assert.Equal(t, data[f.Offset:f.Offset+f.Length], content, f.Path)
+				}
+			}
+			if !test.persistent {
+				return
+			}
+			s, err = b.Open(l)
+			require.Nil(t, err)
+			for i := range 3 {
+				assert.True(t, s.Stored(i), "piece %d", i)
+			}
+			got = make([]byte, len(data))
+			_, err = s.ReadAt(got, 0)
+			require.Nil(t, err)
+			assert.Equal(t, data, got)
+			require.Nil(t, s.Close())
+
+			require.Nil(t, os.WriteFile(filepath.Join(dir, "other"), nil, 0644))
+			require.Nil(t, b.Remove(l))
+			entries, err := os.ReadDir(dir)
+			require.Nil(t, err)
+			names := []string{}
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			assert.NotContains(t, names, "t", "the files and their directories are gone")
+			assert.Contains(t, names, "other")
+			s, err = b.Open(l)
+			require.Nil(t, err)
+			defer s.Close()
+			for i := range 3 {
+				assert.False(t, s.Stored(i), "piece %d", i)
+			}
+		})
+	}
+}
+
+func TestOutsideDir(t *testing.T) {
+	l := storage.Layout{PieceLength: 4, Length: 4, Files: []storage.File{{Path: "../escaped", Length: 4}}}
+	dir := filepath.Join(t.TempDir(), "data")
+	for _, b := range []storage.Backend{storage.Files{Dir: dir}, storage.Mmap{Dir: dir}} {
+		_, err := b.Open(l)
+		assert.ErrorContains(t, err, "not under")
+		assert.ErrorContains(t, b.Remove(l), "not under")
+	}
+	assert.NoFileExists(t, filepath.Join(dir, "..", "escaped"))
+}
+
+func TestFilesPartlyThere(t *testing.T) {
+	l := storage.Layout{PieceLength: 4, Length: 12, Files: []storage.File{{Path: "f", Length: 12}}}
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "f"), bytes.Repeat([]byte{'x'}, 6), 0644))
+	s, err := storage.Files{Dir: dir}.Open(l)
+	require.Nil(t, err)
+	defer s.Close()
+	assert.True(t, s.Stored(0))
+	assert.False(t, s.Stored(1), "the file ends within the piece")
+	assert.False(t, s.Stored(2))
+	_, err = s.ReadAt(make([]byte, 4), 4)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestNew(t *testing.T) {
+	_, err := storage.New("tape", t.TempDir())
+	assert.ErrorContains(t, err, "unknown storage")
+}
@@ -0,0 +1,63 @@
+package swarm
+
+import (
+	"bit_torrent_cli/handshake"
+	"bit_torrent_cli/mse"
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/peers"
+	"net"
+	"time"
+)
+
+// Listener takes inbound connections on localhost for a torrent of the engine, as a session does
+type Listener struct {
+	l net.Listener
+	t *p2p.Torrent
+}
+
+// Listen starts accepting peers for t
+func Listen(t *p2p.Torrent) (*Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	sl := &Listener{l: l, t: t}
+	go sl.acceptLoop()
+	return sl, nil
+}
+
+// Addr is where the torrent takes peers
+func (l *Listener) Addr() peers.Peer {
+	addr := l.l.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (l *Listener) Close() error {
+	return l.l.Close()
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		raw, err := l.l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			raw.SetDeadline(time.Now().Add(5 * time.Second))
+			conn, err := mse.Accept(raw, [][20]byte{l.t.InfoHash}, mse.PolicyPrefer)
+			if err != nil {
+				raw.Close()
+				return
+			}
+			hs, err := handshake.Read(conn)
+			if err != nil || hs.InfoHash != l.t.InfoHash {
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			if l.t.AcceptConn(conn, hs) != nil {
+				conn.Close()
+			}
+		}()
+	}
+}
@@ -0,0 +1,46 @@
+package swarm
+
+import (
+	"bit_torrent_cli/peers"
+	"bit_torrent_cli/transport"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// NAT puts peers behind port-restricted NATs: a peer behind one is only reached by the peers it tried to reach first
+type NAT struct {
+	mu     sync.Mutex
+	behind map[string]bool
+	tried  map[[2]string]bool
+}
+
+func NewNAT() *NAT {
+	return &NAT{behind: make(map[string]bool), tried: make(map[[2]string]bool)}
+}
+
+// Hide puts the peer taking connections at addr behind the NAT and returns the dialer it has to use
+func (n *NAT) Hide(addr peers.Peer) transport.Dialer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.behind[addr.String()] = true
+	return natDialer{n: n, from: addr.String()}
+}
+
+type natDialer struct {
+	n    *NAT
+	from string
+}
+
+func (d natDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.n.mu.Lock()
+	// the attempt opens our side even when it does not get through
+	d.n.tried[[2]string{d.from, addr}] = true
+	refused := d.n.behind[addr] && !d.n.tried[[2]string{addr, d.from}]
+	d.n.mu.Unlock()
+	if refused {
+		return nil, fmt.Errorf("dial %s: behind NAT", addr)
+	}
+	return transport.TCP.DialContext(ctx, network, addr)
+}
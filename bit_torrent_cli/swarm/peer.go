@@ -0,0 +1,251 @@
+package swarm
+
+import (
+	"bit_torrent_cli/bitfield"
+	"bit_torrent_cli/handshake"
+	"bit_torrent_cli/message"
+	"bit_torrent_cli/mse"
+	"bit_torrent_cli/peers"
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// DefaultDropDelay is how long a dropped message takes to arrive, like a TCP retransmission
+const DefaultDropDelay = 200 * time.Millisecond
+
+// Behavior sets how a fake peer serves, and misbehaves
+type Behavior struct {
+	// Have lists the pieces the peer has, nil meaning all of them
+	Have []int
+	// Latency delays every message the peer sends
+	Latency time.Duration
+	// Bandwidth caps what the peer sends in bytes per second, 0 meaning no cap
+	Bandwidth int
+	// DropRate is the share of messages lost on the way and sent again after DropDelay
+	DropRate  float64
+	DropDelay time.Duration
+	// Seed makes the drops the same from run to run
+	Seed uint64
+	// Corrupt lists pieces served with wrong data
+	Corrupt []int
+	// Choke never unchokes the downloader
+	Choke bool
+	// WrongInfoHash answers the handshake for another torrent
+	WrongInfoHash bool
+	// Garbage answers requests with a message longer than any real one
+	Garbage bool
+	// Disconnect hangs up after serving that many blocks, 0 meaning never
+	Disconnect int
+	// Encryption is how the peer takes encrypted connections
+	Encryption mse.Policy
+}
+
+// Peer is a fake peer serving a torrent's content on localhost
+type Peer struct {
+	content  Content
+	behavior Behavior
+	have     bitfield.Bitfield
+	l        net.Listener
+	limiter  *rate.Limiter
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	conns map[net.Conn]struct{}
+
+	served    atomic.Int64
+	connected atomic.Int64
+	wg        sync.WaitGroup
+}
+
+// NewPeer starts a peer listening on 127.0.0.1
+func NewPeer(c Content, b Behavior) (*Peer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	if b.DropDelay == 0 {
+		b.DropDelay = DefaultDropDelay
+	}
+	p := &Peer{
+		content:  c,
+		behavior: b,
+		have:     make(bitfield.Bitfield, (len(c.Torrent.PieceHashes)+7)/8),
+		l:        l,
+		limiter:  rate.NewLimiter(rate.Inf, 0),
+		rand:     rand.New(rand.NewPCG(b.Seed, 1)),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	if b.Bandwidth > 0 {
+		p.limiter = rate.NewLimiter(rate.Limit(b.Bandwidth), b.Bandwidth)
+	}
+	for i := range c.Torrent.PieceHashes {
+		if b.Have == nil || slices.Contains(b.Have, i) {
+			p.have.SetPiece(i)
+		}
+	}
+	p.wg.Add(1)
+	go p.acceptLoop()
+	return p, nil
+}
+
+// Addr is where the peer listens
+func (p *Peer) Addr() peers.Peer {
+	addr := p.l.Addr().(*net.TCPAddr)
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+// Served counts the blocks the peer sent
+func (p *Peer) Served() int {
+	return int(p.served.Load())
+}
+
+// Connected counts the connections that got past the handshake
+func (p *Peer) Connected() int {
+	return int(p.connected.Load())
+}
+
+// Close stops listening and hangs up on every connection
+func (p *Peer) Close() {
+	p.l.Close()
+	p.mu.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *Peer) acceptLoop() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.conns[conn] = struct{}{}
+		p.mu.Unlock()
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.serve(conn)
+			conn.Close()
+			p.mu.Lock()
+			delete(p.conns, conn)
+			p.mu.Unlock()
+		}()
+	}
+}
+
+func (p *Peer) serve(raw net.Conn) {
+	t := p.content.Torrent
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := mse.Accept(raw, [][20]byte{t.Infohash}, p.behavior.Encryption)
+	if err != nil {
+		return
+	}
+	hs, err := handshake.Read(conn)
+	if err != nil || hs.InfoHash != t.Infohash {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	infoHash := t.Infohash
+	if p.behavior.WrongInfoHash {
+		infoHash[0]++
+	}
+	var peerID [20]byte
+	copy(peerID[:], "-SW0001-fakepeer0000")
+	_, err = conn.Write(handshake.New(infoHash, peerID).Serialize())
+	if err != nil {
+		return
+	}
+	p.connected.Add(1)
+	err = p.send(conn, &message.Message{ID: message.MsgBitfield, Payload: p.have})
+	if err != nil {
+		return
+	}
+
+	blocks := 0
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgInterested:
+			if !p.behavior.Choke {
+				err = p.send(conn, &message.Message{ID: message.MsgUnchoke})
+			}
+		case message.MsgRequest:
+			if p.behavior.Garbage {
+				var header [4]byte
+				binary.BigEndian.PutUint32(header[:], message.MaxLength+1)
+				conn.Write(header[:])
+				return
+			}
+			index, begin, length, perr := message.ParseRequest(msg)
+			if perr != nil || p.behavior.Choke || !p.have.HasPiece(index) {
+				return
+			}
+			piece := p.content.Piece(index)
+			if begin+length > len(piece) {
+				return
+			}
+			block := append([]byte(nil), piece[begin:begin+length]...)
+			if slices.Contains(p.behavior.Corrupt, index) {
+				block[0] ^= 0xff
+			}
+			err = p.send(conn, message.FormatPiece(index, begin, block))
+			p.served.Add(1)
+			blocks++
+			if p.behavior.Disconnect > 0 && blocks >= p.behavior.Disconnect {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// send writes a message after the latency, bandwidth and drops of the peer
+func (p *Peer) send(conn net.Conn, msg *message.Message) error {
+	delay := p.behavior.Latency
+	if p.behavior.DropRate > 0 {
+		p.mu.Lock()
+		dropped := p.rand.Float64() < p.behavior.DropRate
+		p.mu.Unlock()
+		if dropped {
+			delay += p.behavior.DropDelay
+		}
+	}
+	time.Sleep(delay)
+	buf := msg.Setialize()
+	for len(buf) > 0 {
+		n := len(buf)
+		if p.behavior.Bandwidth > 0 {
+			n = min(n, p.behavior.Bandwidth)
+		}
+		err := p.limiter.WaitN(context.Background(), n)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
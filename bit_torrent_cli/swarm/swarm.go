@@ -0,0 +1,62 @@
+// Package swarm runs a tracker and peers in process on localhost, for end to end tests of the download flow
+package swarm
+
+import (
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/torrentfile"
+	"crypto/sha1"
+	"fmt"
+	"math/rand/v2"
+)
+
+// Content is a torrent together with the data it describes
+type Content struct {
+	Torrent torrentfile.Torrentfile
+	Data    []byte
+}
+
+// NewContent makes a torrent of random data, the same for the same seed.
+// One length makes a single file torrent named name, more make files name/0, name/1 and so on.
+func NewContent(name string, pieceLength int, seed uint64, lengths ...int) Content {
+	r := rand.New(rand.NewPCG(seed, 0))
+	var files []p2p.File
+	total := 0
+	for i, l := range lengths {
+		path := name
+		if len(lengths) > 1 {
+			path = fmt.Sprintf("%s/%d", name, i)
+		}
+		files = append(files, p2p.File{Path: path, Length: l, Offset: total, Priority: p2p.PriorityNormal})
+		total += l
+	}
+	data := make([]byte, total)
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+
+	var hashes [][20]byte
+	for begin := 0; begin < total; begin += pieceLength {
+		hashes = append(hashes, sha1.Sum(data[begin:min(begin+pieceLength, total)]))
+	}
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = byte(r.Uint32())
+	}
+	return Content{
+		Torrent: torrentfile.Torrentfile{
+			Name:        name,
+			PieceHashes: hashes,
+			PieceLength: pieceLength,
+			Length:      total,
+			Infohash:    infoHash,
+			Files:       files,
+		},
+		Data: data,
+	}
+}
+
+// Piece returns the data of a piece
+func (c Content) Piece(index int) []byte {
+	begin := index * c.Torrent.PieceLength
+	return c.Data[begin:min(begin+c.Torrent.PieceLength, len(c.Data))]
+}
@@ -0,0 +1,79 @@
+package swarm
+
+import (
+	"bit_torrent_cli/peers"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Tracker is a fake HTTP tracker. It hands out the peers added for an info hash, not the ones announcing,
+// and scrapes count them as seeders.
+type Tracker struct {
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	peers     map[[20]byte][]peers.Peer
+	announces int
+}
+
+func NewTracker() *Tracker {
+	tr := &Tracker{peers: make(map[[20]byte][]peers.Peer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", tr.announce)
+	mux.HandleFunc("/scrape", tr.scrape)
+	tr.srv = httptest.NewServer(mux)
+	return tr
+}
+
+// URL is the announce URL to put in torrents
+func (tr *Tracker) URL() string {
+	return tr.srv.URL + "/announce"
+}
+
+// Add lists a peer for the info hash
+func (tr *Tracker) Add(infoHash [20]byte, p peers.Peer) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.peers[infoHash] = append(tr.peers[infoHash], p)
+}
+
+// Announces counts the announces received
+func (tr *Tracker) Announces() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.announces
+}
+
+func (tr *Tracker) Close() {
+	tr.srv.Close()
+}
+
+func (tr *Tracker) announce(w http.ResponseWriter, r *http.Request) {
+	var infoHash [20]byte
+	ih := r.URL.Query().Get("info_hash")
+	if len(ih) != len(infoHash) {
+		bencode.Marshal(w, map[string]any{"failure reason": "bad info_hash"})
+		return
+	}
+	copy(infoHash[:], ih)
+	tr.mu.Lock()
+	tr.announces++
+	ps := peers.Marshal(tr.peers[infoHash])
+	tr.mu.Unlock()
+	bencode.Marshal(w, map[string]any{"interval": 1800, "peers": string(ps)})
+}
+
+func (tr *Tracker) scrape(w http.ResponseWriter, r *http.Request) {
+	files := make(map[string]any)
+	tr.mu.Lock()
+	for _, ih := range r.URL.Query()["info_hash"] {
+		var infoHash [20]byte
+		copy(infoHash[:], ih)
+		files[ih] = map[string]any{"complete": len(tr.peers[infoHash]), "downloaded": tr.announces, "incomplete": 0}
+	}
+	tr.mu.Unlock()
+	bencode.Marshal(w, map[string]any{"files": files})
+}
@@ -0,0 +1,158 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// CreateOptions are the parts of a new torrent that are not its data
+type CreateOptions struct {
+	Announce string
+	Comment  string
+	WebSeeds []string
+	// PieceLength is picked from the size of the data when 0
+	PieceLength int
+	// CreatedBy names the program making the torrent
+	CreatedBy string
+}
+
+// PieceLengthFor picks a power of two piece length giving about 1500 pieces, between 16KiB and 16MiB
+func PieceLengthFor(size int64) int {
+	length := 16 << 10
+	for length < 16<<20 && size/int64(length) > 1500 {
+		length *= 2
+	}
+	return length
+}
+
+// Create makes the metainfo of a file, or of the files under a directory in lexical order
+func Create(root string, opts CreateOptions) (Torrent, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return Torrent{}, err
+	}
+	var paths []string
+	var files []File
+	var size int64
+	if info.IsDir() {
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, p)
+			files = append(files, File{Length: int(fi.Size()), Path: strings.Split(filepath.ToSlash(rel), "/")})
+			size += fi.Size()
+			return nil
+		})
+		if err != nil {
+			return Torrent{}, err
+		}
+		if len(files) == 0 {
+			return Torrent{}, fmt.Errorf("no files under %s", root)
+		}
+		sort.Sort(byPath{paths, files})
+	} else {
+		paths = []string{root}
+		size = info.Size()
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = PieceLengthFor(size)
+	}
+	pieces, err := hashFiles(paths, pieceLength)
+	if err != nil {
+		return Torrent{}, err
+	}
+	t := Torrent{
+		Announce:     opts.Announce,
+		CreationDate: time.Now().Unix(),
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		URLList:      opts.WebSeeds,
+		Info: Info{
+			PieceLength: pieceLength,
+			Pieces:      string(pieces),
+			Name:        filepath.Base(filepath.Clean(root)),
+		},
+	}
+	if info.IsDir() {
+		t.Info.Files = files
+	} else {
+		t.Info.Length = int(size)
+	}
+	return t, nil
+}
+
+// byPath sorts the walked files by their path in the torrent
+type byPath struct {
+	paths []string
+	files []File
+}
+
+func (b byPath) Len() int { return len(b.files) }
+func (b byPath) Less(i, j int) bool {
+	return strings.Join(b.files[i].Path, "/") < strings.Join(b.files[j].Path, "/")
+}
+func (b byPath) Swap(i, j int) {
+	b.paths[i], b.paths[j] = b.paths[j], b.paths[i]
+	b.files[i], b.files[j] = b.files[j], b.files[i]
+}
+
+// hashFiles hashes the files as if they were one, returning the concatenated piece hashes
+func hashFiles(paths []string, pieceLength int) ([]byte, error) {
+	var pieces []byte
+	buf := make([]byte, pieceLength)
+	n := 0
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			read, err := io.ReadFull(f, buf[n:])
+			n += read
+			if n == pieceLength {
+				h := sha1.Sum(buf)
+				pieces = append(pieces, h[:]...)
+				n = 0
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		f.Close()
+	}
+	if n > 0 {
+		h := sha1.Sum(buf[:n])
+		pieces = append(pieces, h[:]...)
+	}
+	return pieces, nil
+}
+
+// Write writes the metainfo as a .torrent file
+func (bto *Torrent) Write(w io.Writer) error {
+	return bencode.Marshal(w, *bto)
+}
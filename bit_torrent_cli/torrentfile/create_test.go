@@ -0,0 +1,126 @@
+package torrentfile_test
+
+import (
+	"bit_torrent_cli/torrentfile"
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreate(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "album")
+	files := map[string][]byte{
+		"b.txt":          bytes.Repeat([]byte("b"), 40<<10),
+		"a/1.flac":       bytes.Repeat([]byte("1"), 20<<10),
+		"a/2.flac":       bytes.Repeat([]byte("2"), 5<<10+3),
+		"cover/empty.md": nil,
+	}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, os.WriteFile(path, data, 0644))
+	}
+	tests := map[string]struct {
+		root  string
+		opts  torrentfile.CreateOptions
+		files []string
+	}{
+		"directory": {
+			root:  root,
+			opts:  torrentfile.CreateOptions{Announce: "http://tracker/announce", Comment: "test", PieceLength: 16 << 10},
+			files: []string{"a/1.flac", "a/2.flac", "b.txt", "cover/empty.md"},
+		},
+		"single file": {
+			root:  filepath.Join(root, "b.txt"),
+			files: []string{"b.txt"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			created, err := torrentfile.Create(test.root, test.opts)
+			require.Nil(t, err)
+			var buf bytes.Buffer
+			require.Nil(t, created.Write(&buf))
+
+			tf, err := torrentfile.Parse(bytes.NewReader(buf.Bytes()))
+			require.Nil(t, err)
+			mi, err := metainfo.Load(bytes.NewReader(buf.Bytes()))
+			require.Nil(t, err)
+			assert.Equal(t, [20]byte(mi.HashInfoBytes()), tf.Infohash)
+			assert.Equal(t, test.opts.Announce, tf.Announce)
+
+			var paths []string
+			var data []byte
+			for _, f := range tf.Files {
+				paths = append(paths, f.Path)
+			}
+			for _, p := range test.files {
+				data = append(data, files[p]...)
+			}
+			if len(test.files) > 1 {
+				assert.Equal(t, test.files, paths)
+			}
+			assert.Equal(t, len(data), tf.Length)
+			require.Len(t, tf.PieceHashes, (len(data)+tf.PieceLength-1)/tf.PieceLength)
+			for i, h := range tf.PieceHashes {
+				begin := i * tf.PieceLength
+				assert.Equal(t, sha1.Sum(data[begin:min(begin+tf.PieceLength, len(data))]), h, "piece %d", i)
+			}
+
+			// the data reads back from where it was created
+			d := tf.OpenData(test.root)
+			defer d.Close()
+			got, err := io.ReadAll(io.NewSectionReader(d, 0, int64(tf.Length)))
+			require.Nil(t, err)
+			assert.Equal(t, data, got)
+		})
+	}
+}
+
+func TestPieceLengthFor(t *testing.T) {
+	assert.Equal(t, 16<<10, torrentfile.PieceLengthFor(1<<20))
+	assert.Equal(t, 1<<20, torrentfile.PieceLengthFor(1<<30))
+	assert.Equal(t, 16<<20, torrentfile.PieceLengthFor(1<<40))
+}
+
+func TestOpenData(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "dir")
+	created := func() torrentfile.Torrentfile {
+		require.Nil(t, os.MkdirAll(root, 0755))
+		require.Nil(t, os.WriteFile(filepath.Join(root, "a"), []byte("hello "), 0644))
+		require.Nil(t, os.WriteFile(filepath.Join(root, "b"), []byte("world"), 0644))
+		mi, err := torrentfile.Create(root, torrentfile.CreateOptions{})
+		require.Nil(t, err)
+		var buf bytes.Buffer
+		require.Nil(t, mi.Write(&buf))
+		tf, err := torrentfile.Parse(&buf)
+		require.Nil(t, err)
+		return tf
+	}()
+
+	d := created.OpenData(root)
+	p := make([]byte, 7)
+	n, err := d.ReadAt(p, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "llo wor", string(p[:n]))
+	n, err = d.ReadAt(p, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "rld", string(p[:n]))
+	require.Nil(t, d.Close())
+
+	require.Nil(t, os.WriteFile(filepath.Join(root, "a"), []byte("hel"), 0644))
+	require.Nil(t, os.Remove(filepath.Join(root, "b")))
+	d = created.OpenData(root)
+	defer d.Close()
+	_, err = d.ReadAt(p, 0)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = d.ReadAt(p[:2], 7)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,115 @@
+package torrentfile
+
+import (
+	"bit_torrent_cli/p2p"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// FilePath is where WriteFiles puts the file of the torrent written to out
+func (t *Torrentfile) FilePath(out string, f p2p.File) string {
+	if !t.isMultiFile() {
+		return out
+	}
+	return filepath.Join(out, filepath.FromSlash(f.Path))
+}
+
+// RemoveFiles deletes the files of the torrent written to out, the pieces under out/PartsDir and the directories
+// left empty. Nothing but the torrent's own files is removed, and nothing at all if its paths leave out.
+func (t *Torrentfile) RemoveFiles(out string) error {
+	err := t.checkPaths()
+	if err != nil {
+		return err
+	}
+	if !t.isMultiFile() {
+		return removeFile(out)
+	}
+	var dirs []string
+	for _, f := range t.Files {
+		name := t.FilePath(out, f)
+		err = errors.Join(err, removeFile(name))
+		for dir := filepath.Dir(name); dir != out && !slices.Contains(dirs, dir); dir = filepath.Dir(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	err = errors.Join(err, os.RemoveAll(filepath.Join(out, PartsDir)))
+	// the deepest first, a directory holding files of something else staying
+	slices.SortFunc(dirs, func(a, b string) int { return len(b) - len(a) })
+	for _, dir := range append(dirs, out) {
+		os.Remove(dir)
+	}
+	return err
+}
+
+// removeFile removes a file, one never written being no error
+func removeFile(name string) error {
+	err := os.Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Data reads the torrent's data back from the files WriteFiles wrote, as if they were one
+type Data struct {
+	t     *Torrentfile
+	files []*os.File
+	// errs holds why a file could not be opened, nil for the open ones
+	errs []error
+}
+
+// OpenData opens the files of the torrent written to out. Missing files are not an error here,
+// reads of their part of the data are.
+func (t *Torrentfile) OpenData(out string) *Data {
+	d := &Data{t: t, files: make([]*os.File, len(t.Files)), errs: make([]error, len(t.Files))}
+	for i, f := range t.Files {
+		d.files[i], d.errs[i] = os.Open(t.FilePath(out, f))
+	}
+	return d
+}
+
+// ReadAt reads from the files overlapping the range, failing on the first missing or short one
+func (d *Data) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for i, f := range d.t.Files {
+		begin, end := int64(f.Offset), int64(f.Offset+f.Length)
+		pos := off + int64(n)
+		if n == len(p) {
+			break
+		}
+		if end <= pos || begin >= off+int64(len(p)) {
+			continue
+		}
+		if d.errs[i] != nil {
+			return n, fmt.Errorf("%s: %w", f.Path, d.errs[i])
+		}
+		want := min(end-pos, int64(len(p)-n))
+		read, err := d.files[i].ReadAt(p[n:n+int(want)], pos-begin)
+		n += read
+		if errors.Is(err, io.EOF) {
+			return n, fmt.Errorf("%s: %w", f.Path, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *Data) Close() error {
+	var err error
+	for _, f := range d.files {
+		if f != nil {
+			err = errors.Join(err, f.Close())
+		}
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package torrentfile_test
+
+import (
+	"bit_torrent_cli/mse"
+	"bit_torrent_cli/storage"
+	"bit_torrent_cli/swarm"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadToFile(t *testing.T) {
+	content := swarm.NewContent("data.bin", 32<<10, 1, 300<<10)
+	last := len(content.Torrent.PieceHashes) - 1
+	tests := map[string][]swarm.Behavior{
+		"one seeder":      {{}},
+		"partial seeders": {{Have: []int{0, 1, 2, 3, 4}}, {Have: []int{5, 6, 7, 8, last}}},
+		"slow seeders": {
+			{Latency: 5 * time.Millisecond, Bandwidth: 1 << 20},
+			{Latency: 20 * time.Millisecond, Bandwidth: 256 << 10},
+		},
+		"drops":          {{DropRate: 0.2, DropDelay: 20 * time.Millisecond, Seed: 7}},
+		"corrupt":        {{Corrupt: []int{0, 3, last}}, {Latency: 10 * time.Millisecond}},
+		"disconnects":    {{Disconnect: 3}, {Disconnect: 5}, {Latency: 5 * time.Millisecond}},
+		"plaintext":      {{Encryption: mse.PolicyDisable}},
+		"wrong hash":     {{WrongInfoHash: true}, {}},
+		"garbage":        {{Garbage: true}, {}},
+		"never unchokes": {{Choke: true}, {Latency: 5 * time.Millisecond}},
+	}
+	for name, behaviors := range tests {
+		t.Run(name, func(t *testing.T) {
+			tracker := swarm.NewTracker()
+			defer tracker.Close()
+			tf := content.Torrent
+			tf.Announce = tracker.URL()
+			for _, b := range behaviors {
+				p, err := swarm.NewPeer(content, b)
+				require.Nil(t, err)
+				defer p.Close()
+				tracker.Add(tf.Infohash, p.Addr())
+			}
+
+			path := filepath.Join(t.TempDir(), tf.Name)
+			require.Nil(t, tf.DownloadToFile(path))
+			got, err := os.ReadFile(path)
+			require.Nil(t, err)
+			assert.Equal(t, content.Data, got)
+			assert.Equal(t, 1, tracker.Announces())
+		})
+	}
+}
+
+func TestDownloadMultiFile(t *testing.T) {
+	content := swarm.NewContent("dir", 16<<10, 2, 10<<10, 50<<10, 1, 30<<10)
+	tracker := swarm.NewTracker()
+	defer tracker.Close()
+	tf := content.Torrent
+	tf.Announce = tracker.URL()
+	p, err := swarm.NewPeer(content, swarm.Behavior{})
+	require.Nil(t, err)
+	defer p.Close()
+	tracker.Add(tf.Infohash, p.Addr())
+
+	dir := t.TempDir()
+	require.Nil(t, tf.DownloadToFile(dir))
+	for _, f := range tf.Files {
+		got, err := os.ReadFile(filepath.Join(dir, f.Path))
+		require.Nil(t, err)
+		assert.Equal(t, content.Data[f.Offset:f.Offset+f.Length], got, f.Path)
+	}
+}
+
+func TestDownloadStorage(t *testing.T) {
+	content := swarm.NewContent("dir", 16<<10, 2, 10<<10, 50<<10, 1, 30<<10)
+	for _, kind := range []string{"file", "mmap", "piece", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			tracker := swarm.NewTracker()
+			defer tracker.Close()
+			p, err := swarm.NewPeer(content, swarm.Behavior{})
+			require.Nil(t, err)
+			defer p.Close()
+			tf := content.Torrent
+			tf.Announce = tracker.URL()
+			tracker.Add(tf.Infohash, p.Addr())
+
+			dir := t.TempDir()
+			tf.Storage, err = storage.New(kind, dir)
+			require.Nil(t, err)
+			defer tf.Storage.Close()
+			require.Nil(t, tf.DownloadToFile(filepath.Join(dir, tf.Name)))
+			for _, f := range tf.Files {
+				got, err := os.ReadFile(filepath.Join(dir, tf.Name, f.Path))
+				require.Nil(t, err)
+				assert.Equal(t, content.Data[f.Offset:f.Offset+f.Length], got, f.Path)
+			}
+
+			// the next run finds the pieces stored
+			served := p.Served()
+			require.Nil(t, tf.DownloadToFile(filepath.Join(dir, tf.Name)))
+			assert.Equal(t, served, p.Served())
+		})
+	}
+}
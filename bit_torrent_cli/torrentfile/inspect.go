@@ -0,0 +1,286 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Details is everything a .torrent file says about itself, for people to look at
+type Details struct {
+	Name string `json:"name"`
+	// InfohashV2 is only set for BitTorrent v2 and hybrid torrents, InfohashV1 for v1 and hybrid ones
+	InfohashV1   string        `json:"infohashV1,omitempty"`
+	InfohashV2   string        `json:"infohashV2,omitempty"`
+	PieceLength  int           `json:"pieceLength"`
+	Pieces       int           `json:"pieces"`
+	Length       int64         `json:"length"`
+	Files        []FileDetails `json:"files"`
+	Trackers     [][]string    `json:"trackers,omitempty"`
+	WebSeeds     []string      `json:"webSeeds,omitempty"`
+	Private      bool          `json:"private,omitempty"`
+	CreatedBy    string        `json:"createdBy,omitempty"`
+	CreationDate *time.Time    `json:"creationDate,omitempty"`
+	Comment      string        `json:"comment,omitempty"`
+}
+
+// FileDetails is a file of the torrent, Padding being set for the filler files of BEP 47
+type FileDetails struct {
+	Path    string `json:"path"`
+	Length  int64  `json:"length"`
+	Padding bool   `json:"padding,omitempty"`
+}
+
+// InspectFile reads the details of a .torrent file
+func InspectFile(path string) (Details, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Details{}, err
+	}
+	return Inspect(data)
+}
+
+// Inspect reads the details of a .torrent file's content, taking the info hashes over the info dictionary as written
+func Inspect(data []byte) (Details, error) {
+	v, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Details{}, err
+	}
+	top, ok := v.(map[string]any)
+	if !ok {
+		return Details{}, errors.New("metainfo is not a dictionary")
+	}
+	info, ok := top["info"].(map[string]any)
+	if !ok {
+		return Details{}, errors.New("metainfo has no info dictionary")
+	}
+	raw, err := infoBytes(data)
+	if err != nil {
+		return Details{}, err
+	}
+
+	d := Details{
+		Name:        str(info["name"]),
+		PieceLength: int(num(info["piece length"])),
+		Private:     num(info["private"]) == 1,
+		CreatedBy:   str(top["created by"]),
+		Comment:     str(top["comment"]),
+	}
+	if date, ok := top["creation date"].(int64); ok {
+		t := time.Unix(date, 0).UTC()
+		d.CreationDate = &t
+	}
+	if pieces, ok := info["pieces"].(string); ok {
+		sum := sha1.Sum(raw)
+		d.InfohashV1 = hex.EncodeToString(sum[:])
+		d.Pieces = len(pieces) / sha1.Size
+	}
+	if num(info["meta version"]) == 2 {
+		sum := sha256.Sum256(raw)
+		d.InfohashV2 = hex.EncodeToString(sum[:])
+	}
+
+	switch {
+	case info["files"] != nil:
+		for _, f := range list(info["files"]) {
+			file, _ := f.(map[string]any)
+			var parts []string
+			for _, p := range list(file["path"]) {
+				parts = append(parts, str(p))
+			}
+			d.Files = append(d.Files, FileDetails{
+				Path:    path.Join(parts...),
+				Length:  num(file["length"]),
+				Padding: strings.Contains(str(file["attr"]), "p"),
+			})
+		}
+	case info["file tree"] != nil:
+		d.Files = fileTree(info["file tree"], "")
+	default:
+		d.Files = []FileDetails{{Path: d.Name, Length: num(info["length"])}}
+	}
+	for _, f := range d.Files {
+		d.Length += f.Length
+	}
+	if d.Pieces == 0 && d.PieceLength > 0 {
+		d.Pieces = int((d.Length + int64(d.PieceLength) - 1) / int64(d.PieceLength))
+	}
+
+	// announce-list replaces announce when present, each of its tiers tried in turn
+	for _, tier := range list(top["announce-list"]) {
+		var urls []string
+		for _, u := range list(tier) {
+			urls = append(urls, str(u))
+		}
+		if len(urls) > 0 {
+			d.Trackers = append(d.Trackers, urls)
+		}
+	}
+	if len(d.Trackers) == 0 && str(top["announce"]) != "" {
+		d.Trackers = [][]string{{str(top["announce"])}}
+	}
+	switch seeds := top["url-list"].(type) {
+	case string:
+		if seeds != "" {
+			d.WebSeeds = []string{seeds}
+		}
+	case []any:
+		for _, u := range seeds {
+			d.WebSeeds = append(d.WebSeeds, str(u))
+		}
+	}
+	return d, nil
+}
+
+// fileTree flattens the nested file tree of a v2 torrent, the files being the entries keyed by ""
+func fileTree(v any, dir string) []FileDetails {
+	tree, _ := v.(map[string]any)
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var files []FileDetails
+	for _, name := range names {
+		node, _ := tree[name].(map[string]any)
+		if leaf, ok := node[""].(map[string]any); ok {
+			files = append(files, FileDetails{Path: path.Join(dir, name), Length: num(leaf["length"])})
+			continue
+		}
+		files = append(files, fileTree(node, path.Join(dir, name))...)
+	}
+	return files
+}
+
+func str(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func num(v any) int64 {
+	n, _ := v.(int64)
+	return n
+}
+
+func list(v any) []any {
+	l, _ := v.([]any)
+	return l
+}
+
+// Raw decodes a .torrent file's content into values encoding/json writes as is: strings that are not
+// UTF-8, like the piece hashes, become {"hex": "..."} objects
+func Raw(data []byte) (any, error) {
+	v, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return jsonValue(v), nil
+}
+
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case string:
+		if utf8.ValidString(v) {
+			return v
+		}
+		return map[string]string{"hex": hex.EncodeToString([]byte(v))}
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = jsonValue(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = jsonValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+// infoBytes finds the info dictionary as written in the metainfo, which the info hash is taken over.
+// Encoding it again would drop the keys Info does not know, like private, and change the hash.
+func infoBytes(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errors.New("metainfo is not a dictionary")
+	}
+	i := 1
+	for i < len(data) && data[i] != 'e' {
+		keyEnd, err := skipValue(data, i)
+		if err != nil {
+			return nil, err
+		}
+		valueEnd, err := skipValue(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		if key, _ := stringValue(data, i); key == "info" {
+			return data[keyEnd:valueEnd], nil
+		}
+		i = valueEnd
+	}
+	return nil, errors.New("metainfo has no info dictionary")
+}
+
+// skipValue returns where the bencoded value starting at i ends
+func skipValue(data []byte, i int) (int, error) {
+	if i >= len(data) {
+		return 0, errors.New("metainfo ends early")
+	}
+	switch c := data[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[i:], 'e')
+		if end < 0 {
+			return 0, errors.New("metainfo ends in an integer")
+		}
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+		for i < len(data) && data[i] != 'e' {
+			var err error
+			i, err = skipValue(data, i)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(data) {
+			return 0, errors.New("metainfo ends in a list or dictionary")
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		_, end := stringValue(data, i)
+		if end < 0 {
+			return 0, fmt.Errorf("bad string at offset %d of the metainfo", i)
+		}
+		return end, nil
+	}
+	return 0, fmt.Errorf("bad value at offset %d of the metainfo", i)
+}
+
+// stringValue reads the bencoded string at i, returning where it ends or -1 if it is not one
+func stringValue(data []byte, i int) (string, int) {
+	colon := bytes.IndexByte(data[i:], ':')
+	if colon < 0 {
+		return "", -1
+	}
+	n, err := strconv.Atoi(string(data[i : i+colon]))
+	start := i + colon + 1
+	if err != nil || n < 0 || start+n > len(data) {
+		return "", -1
+	}
+	return string(data[start : start+n]), start + n
+}
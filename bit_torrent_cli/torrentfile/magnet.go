@@ -0,0 +1,93 @@
+package torrentfile
+
+import (
+	"bit_torrent_cli/peers"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Magnet is a parsed magnet link
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	// Logger is where the announces log, the default logger if nil
+	Logger *slog.Logger
+}
+
+// ParseMagnet parses a magnet link with a BitTorrent v1 info hash
+func ParseMagnet(uri string) (Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Magnet{}, err
+	}
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("not a magnet link: %q", uri)
+	}
+	q := u.Query()
+	m := Magnet{Name: q.Get("dn"), Trackers: q["tr"]}
+	for _, xt := range q["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		var b []byte
+		switch len(hash) {
+		case 40:
+			b, err = hex.DecodeString(hash)
+		case 32:
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("bad length %d", len(hash))
+		}
+		if err != nil {
+			return Magnet{}, fmt.Errorf("bad info hash %q: %w", hash, err)
+		}
+		copy(m.InfoHash[:], b)
+		return m, nil
+	}
+	return Magnet{}, fmt.Errorf("magnet link without a btih info hash: %q", uri)
+}
+
+// RequestPeers announces to every HTTP tracker of the magnet link and returns the peers they know
+func (m Magnet) RequestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
+	var all []peers.Peer
+	var lastErr error
+	for _, tr := range m.Trackers {
+		if !strings.HasPrefix(tr, "http://") && !strings.HasPrefix(tr, "https://") {
+			continue
+		}
+		t := Torrentfile{Announce: tr, Infohash: m.InfoHash, Logger: m.Logger}
+		ps, err := t.RequestPeers(peerID, port)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		all = append(all, ps...)
+	}
+	if len(all) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return all, nil
+}
+
+// FromMetadata builds the torrent from the info dictionary fetched from peers, checking it against the info hash
+func FromMetadata(metadata []byte, infoHash [20]byte, announce string) (Torrentfile, error) {
+	if sha1.Sum(metadata) != infoHash {
+		return Torrentfile{}, fmt.Errorf("metadata does not match info hash %x", infoHash)
+	}
+	info := Info{}
+	err := bencode.Unmarshal(bytes.NewReader(metadata), &info)
+	if err != nil {
+		return Torrentfile{}, err
+	}
+	return info.toTorrentFile(announce, infoHash)
+}
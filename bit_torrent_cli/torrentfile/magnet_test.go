@@ -0,0 +1,58 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hash := [20]byte{0xdd, 0x82, 0x55, 0xec, 0xdc, 0x7c, 0xa5, 0x5f, 0xb0, 0xbb, 0xf8, 0x13, 0x23, 0xd8, 0x70, 0x62, 0xdb, 0x1f, 0x6d, 0x1c}
+	tests := map[string]struct {
+		input  string
+		output Magnet
+		fails  bool
+	}{
+		"hex": {
+			input:  "magnet:?xt=urn:btih:dd8255ecdc7ca55fb0bbf81323d87062db1f6d1c&dn=Big+Buck+Bunny&tr=http%3A%2F%2Ftracker.example%2Fannounce",
+			output: Magnet{InfoHash: hash, Name: "Big Buck Bunny", Trackers: []string{"http://tracker.example/announce"}},
+		},
+		"base32": {
+			input:  "magnet:?xt=urn:btih:3WBFL3G4PSSV7MF37AJSHWDQMLNR63I4",
+			output: Magnet{InfoHash: hash},
+		},
+		"not a magnet":  {input: "http://example.com/a.torrent", fails: true},
+		"no info hash":  {input: "magnet:?dn=nothing", fails: true},
+		"bad info hash": {input: "magnet:?xt=urn:btih:zz", fails: true},
+	}
+	for name, test := range tests {
+		m, err := ParseMagnet(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, test.output, m, name)
+	}
+}
+
+func TestFromMetadata(t *testing.T) {
+	info := Info{PieceLength: 4, Pieces: string(make([]byte, 40)), Name: "a", Files: []File{{Length: 3, Path: []string{"x"}}, {Length: 5, Path: []string{"d", "y"}}}}
+	var buf bytes.Buffer
+	require.Nil(t, bencode.Marshal(&buf, info))
+	infoHash := sha1.Sum(buf.Bytes())
+
+	tf, err := FromMetadata(buf.Bytes(), infoHash, "http://tracker.example/announce")
+	require.Nil(t, err)
+	assert.Equal(t, "a", tf.Name)
+	assert.Equal(t, 8, tf.Length)
+	assert.Len(t, tf.PieceHashes, 2)
+	assert.Equal(t, "d/y", tf.Files[1].Path)
+
+	_, err = FromMetadata(buf.Bytes(), [20]byte{1}, "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,171 @@
+package torrentfile
+
+import (
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/tracing"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PartsDir is the directory under the output path holding pieces that straddle skipped files
+const PartsDir = ".parts"
+
+// FileRule selects the files matching Pattern and gives them Priority
+type FileRule struct {
+	Pattern  string
+	Priority p2p.Priority
+}
+
+// ParseFileRule parses a rule of the form "[skip:|normal:|high:]pattern".
+// The pattern is a path.Match glob or a directory prefix, relative to the torrent root.
+func ParseFileRule(s string) (FileRule, error) {
+	rule := FileRule{Pattern: s, Priority: p2p.PriorityNormal}
+	prefix, pattern, found := strings.Cut(s, ":")
+	if found {
+		rule.Pattern = pattern
+		switch prefix {
+		case "skip":
+			rule.Priority = p2p.PrioritySkip
+		case "normal":
+			rule.Priority = p2p.PriorityNormal
+		case "high":
+			rule.Priority = p2p.PriorityHigh
+		default:
+			// not a priority, the colon is part of the pattern
+			rule.Pattern = s
+		}
+	}
+	if _, err := path.Match(rule.Pattern, ""); err != nil {
+		return FileRule{}, fmt.Errorf("bad file pattern %q: %w", rule.Pattern, err)
+	}
+	return rule, nil
+}
+
+// Match reports whether the slash-separated file path is selected by the rule
+func (r FileRule) Match(name string) bool {
+	pattern := strings.TrimSuffix(r.Pattern, "/")
+	if ok, _ := path.Match(pattern, name); ok {
+		return true
+	}
+	if ok, _ := path.Match(pattern, path.Base(name)); ok && !strings.Contains(pattern, "/") {
+		return true
+	}
+	return strings.HasPrefix(name, pattern+"/")
+}
+
+// RulePriority returns the priority the rules give to the file, the last matching rule winning.
+// Files matching no rule are skipped unless every rule is a skip rule.
+func RulePriority(rules []FileRule, name string) p2p.Priority {
+	prio := p2p.PriorityNormal
+	for _, r := range rules {
+		if r.Priority != p2p.PrioritySkip {
+			prio = p2p.PrioritySkip
+			break
+		}
+	}
+	for _, r := range rules {
+		if r.Match(name) {
+			prio = r.Priority
+		}
+	}
+	return prio
+}
+
+// SelectFiles sets the priority of every file according to the rules
+func (t *Torrentfile) SelectFiles(rules []FileRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	selected := 0
+	for i := range t.Files {
+		t.Files[i].Priority = RulePriority(rules, t.Files[i].Path)
+		if t.Files[i].Priority != p2p.PrioritySkip {
+			selected++
+		}
+	}
+	if selected == 0 {
+		return fmt.Errorf("no file of %s matches the selection", t.Name)
+	}
+	return nil
+}
+
+func (t *Torrentfile) isMultiFile() bool {
+	return len(t.Files) != 1 || t.Files[0].Path != t.Name
+}
+
+// WriteFiles writes the selected files of a downloaded torrent to out, a directory for multi-file torrents.
+// The pieces they share with skipped files go under out/PartsDir.
+func (t *Torrentfile) WriteFiles(torrent *p2p.Torrent, out string) (err error) {
+	ctx, span := tracer.Start(torrent.TraceContext(), "storage.write_files", trace.WithAttributes(attribute.String("storage.path", out)))
+	defer func() { tracing.End(span, err) }()
+	if !t.isMultiFile() {
+		if t.Files[0].Priority == p2p.PrioritySkip {
+			return nil
+		}
+		return writeSection(ctx, out, io.NewSectionReader(torrent, 0, int64(t.Length)))
+	}
+	for _, f := range t.Files {
+		if f.Priority == p2p.PrioritySkip {
+			continue
+		}
+		// the paths of a parsed torrent are checked already, not those of one built otherwise
+		if !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+			return fmt.Errorf("file %s is not under %s", f.Path, out)
+		}
+		name := t.FilePath(out, f)
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			return err
+		}
+		err = writeSection(ctx, name, io.NewSectionReader(torrent, int64(f.Offset), int64(f.Length)))
+		if err != nil {
+			return err
+		}
+	}
+	boundary := torrent.BoundaryPieces()
+	if len(boundary) == 0 {
+		return nil
+	}
+	parts := filepath.Join(out, PartsDir)
+	err = os.MkdirAll(parts, 0755)
+	if err != nil {
+		return err
+	}
+	for _, index := range boundary {
+		begin := index * t.PieceLength
+		end := begin + t.PieceLength
+		if end > t.Length {
+			end = t.Length
+		}
+		name := filepath.Join(parts, fmt.Sprintf("%d.piece", index))
+		err = writeSection(ctx, name, io.NewSectionReader(torrent, int64(begin), int64(end-begin)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSection(ctx context.Context, name string, r io.Reader) (err error) {
+	_, span := tracer.Start(ctx, "storage.write", trace.WithAttributes(attribute.String("storage.path", name)))
+	defer func() { tracing.End(span, err) }()
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	span.SetAttributes(attribute.Int64("storage.bytes", n))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
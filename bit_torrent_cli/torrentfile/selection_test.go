@@ -0,0 +1,123 @@
+package torrentfile
+
+import (
+	"bit_torrent_cli/p2p"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFileRule(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output FileRule
+		fails  bool
+	}{
+		"plain pattern": {
+			input:  "data/*.csv",
+			output: FileRule{Pattern: "data/*.csv", Priority: p2p.PriorityNormal},
+		},
+		"high priority": {
+			input:  "high:README",
+			output: FileRule{Pattern: "README", Priority: p2p.PriorityHigh},
+		},
+		"skip": {
+			input:  "skip:*.iso",
+			output: FileRule{Pattern: "*.iso", Priority: p2p.PrioritySkip},
+		},
+		"colon in name": {
+			input:  "a:b",
+			output: FileRule{Pattern: "a:b", Priority: p2p.PriorityNormal},
+		},
+		"bad glob": {
+			input: "high:[",
+			fails: true,
+		},
+		"bad glob with a colon": {
+			input: "a:[",
+			fails: true,
+		},
+	}
+	for name, test := range tests {
+		rule, err := ParseFileRule(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, rule, name)
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	tf := Torrentfile{
+		Name:        "dataset",
+		PieceLength: 10,
+		Length:      45,
+		Files: []p2p.File{
+			{Path: "README", Length: 5, Offset: 0},
+			{Path: "data/a.csv", Length: 20, Offset: 5},
+			{Path: "data/b.csv", Length: 20, Offset: 25},
+		},
+	}
+	rules := []FileRule{
+		{Pattern: "data", Priority: p2p.PriorityNormal},
+		{Pattern: "b.csv", Priority: p2p.PrioritySkip},
+		{Pattern: "README", Priority: p2p.PriorityHigh},
+	}
+	require.Nil(t, tf.SelectFiles(rules))
+	assert.Equal(t, p2p.PriorityHigh, tf.Files[0].Priority)
+	assert.Equal(t, p2p.PriorityNormal, tf.Files[1].Priority)
+	assert.Equal(t, p2p.PrioritySkip, tf.Files[2].Priority)
+
+	torrent := p2p.Torrent{PieceLength: tf.PieceLength, Length: tf.Length, PieceHashes: make([][20]byte, 5), Files: tf.Files}
+	// piece 2 holds the end of a.csv and the start of b.csv
+	assert.Equal(t, []int{2}, torrent.BoundaryPieces())
+
+	err := tf.SelectFiles([]FileRule{{Pattern: "*.bin", Priority: p2p.PriorityHigh}})
+	assert.NotNil(t, err)
+}
+
+func TestWriteFilesOutside(t *testing.T) {
+	tf := Torrentfile{
+		Name:        "dir",
+		PieceLength: 10,
+		Length:      10,
+		Files:       []p2p.File{{Path: "a", Length: 5}, {Path: "../escaped.txt", Length: 5, Offset: 5, Priority: p2p.PriorityNormal}},
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	err := tf.WriteFiles(&p2p.Torrent{}, out)
+	assert.ErrorContains(t, err, "not under")
+	assert.NoFileExists(t, filepath.Join(out, "..", "escaped.txt"))
+}
+
+func TestRemoveFiles(t *testing.T) {
+	tf := Torrentfile{
+		Name:  "dir",
+		Files: []p2p.File{{Path: "a/b/c", Length: 5}, {Path: "a/d", Length: 5, Offset: 5}, {Path: "e", Length: 5, Offset: 10}},
+	}
+	parent := t.TempDir()
+	out := filepath.Join(parent, "dir")
+	for _, name := range []string{"a/b/c", "a/d", "other", PartsDir + "/0.piece"} {
+		require.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(out, name)), 0755))
+		require.Nil(t, os.WriteFile(filepath.Join(out, name), []byte("x"), 0644))
+	}
+	require.Nil(t, tf.RemoveFiles(out), "e was never written")
+	entries, err := os.ReadDir(out)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "other", entries[0].Name())
+
+	require.Nil(t, os.Remove(filepath.Join(out, "other")))
+	require.Nil(t, tf.RemoveFiles(out))
+	assert.NoDirExists(t, out)
+
+	for _, name := range []string{"..", ""} {
+		tf = Torrentfile{Name: name, Files: []p2p.File{{Path: name, Length: 5}}}
+		assert.NotNil(t, tf.RemoveFiles(parent), name)
+		assert.DirExists(t, parent)
+	}
+}
@@ -2,18 +2,23 @@ package torrentfile
 
 import (
 	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/peerid"
+	"bit_torrent_cli/peers"
+	"bit_torrent_cli/storage"
+	"bit_torrent_cli/wiretrace"
 	"bytes"
-	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/jackpal/bencode-go"
 )
 
-// Port to listen on
-const Port uint16 = 6881
-
 type Torrentfile struct {
 	Announce    string
 	Name        string
@@ -21,14 +26,34 @@ type Torrentfile struct {
 	PieceLength int
 	Length      int
 	Infohash    [20]byte
+	Files       []p2p.File
+	// Bandwidth limits the download, it is not part of the metainfo
+	Bandwidth p2p.Bandwidth `json:"-"`
+	// PeerID identifies us to the tracker and peers, generated with peerid.DefaultPrefix if zero.
+	// It is not part of the metainfo either.
+	PeerID [20]byte `json:"-"`
+	// Port is where the torrents built from this file take connections, announced to the tracker and to peers.
+	// It is 0 when nothing listens, which is announced as is since trackers want the parameter.
+	Port uint16 `json:"-"`
+	// Logger is where the tracker announces and the torrents built from this file log, the default logger if nil
+	Logger *slog.Logger `json:"-"`
+	// Recorder, if set, captures the peer connections of the torrents built from this file
+	Recorder *wiretrace.Recorder `json:"-"`
+	// Data, if set, holds data of the torrent already there, its verified pieces not downloaded again
+	Data io.ReaderAt `json:"-"`
+	// Hasher, if set, checks the pieces of the torrents built from this file, each having its own otherwise
+	Hasher *p2p.Hasher `json:"-"`
+	// Storage, if set, keeps the data of the torrents StartDownload and DownloadToFile start, memory otherwise
+	Storage storage.Backend `json:"-"`
 }
 
 // 定义种子文件的结构体
 type Torrent struct {
-	Announce     string   `bencode:"announce"`
+	Announce     string   `bencode:"announce,omitempty"`
 	Info         Info     `bencode:"info"`
 	CreationDate int64    `bencode:"creation date,omitempty"`
 	Comment      string   `bencode:"comment,omitempty"`
+	CreatedBy    string   `bencode:"created by,omitempty"`
 	URLList      []string `bencode:"url-list,omitempty"`
 }
 
@@ -45,17 +70,9 @@ type File struct {
 	Path   []string `bencode:"path"`
 }
 
-func (t *Torrentfile) DownloadToFile(path string) error {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
-	if err != nil {
-		return err
-	}
-	peers, err := t.requestPeers(peerID, Port)
-	if err != nil {
-		return err
-	}
-	torrent := p2p.Torrent{
+// NewTorrent builds the p2p torrent downloading the selected files from the peers
+func (t *Torrentfile) NewTorrent(peerID [20]byte, peers []peers.Peer) *p2p.Torrent {
+	return &p2p.Torrent{
 		Peers:       peers,
 		PeerID:      peerID,
 		InfoHash:    t.Infohash,
@@ -63,21 +80,84 @@ func (t *Torrentfile) DownloadToFile(path string) error {
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Files:       t.Files,
+		Bandwidth:   t.Bandwidth,
+		Logger:      t.Logger,
+		Recorder:    t.Recorder,
+		Data:        t.Data,
+		Hasher:      t.Hasher,
+		Port:        t.Port,
+	}
+}
+
+// Layout places the files under the torrent's name, as WriteFiles does under the path it is given
+func (t *Torrentfile) Layout() storage.Layout {
+	l := storage.Layout{InfoHash: t.Infohash, PieceLength: t.PieceLength, Length: t.Length}
+	for _, f := range t.Files {
+		name := t.Name
+		if t.isMultiFile() {
+			name = path.Join(t.Name, f.Path)
+		}
+		l.Files = append(l.Files, storage.File{Path: name, Offset: f.Offset, Length: f.Length})
+	}
+	return l
+}
+
+// StoredInPlace tells whether the storage writes the files where they go, leaving WriteFiles nothing to do
+func (t *Torrentfile) StoredInPlace() bool {
+	return t.Storage != nil && t.Storage.InPlace()
+}
+
+// newTorrent asks the tracker for peers and builds the p2p torrent that downloads from them
+func (t *Torrentfile) newTorrent() (*p2p.Torrent, error) {
+	peerID := t.PeerID
+	if peerID == [20]byte{} {
+		var err error
+		peerID, err = peerid.New("")
+		if err != nil {
+			return nil, err
+		}
 	}
-	buf, err := torrent.Download()
+	peers, err := t.RequestPeers(peerID, t.Port)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	torrent := t.NewTorrent(peerID, peers)
+	if t.Storage != nil {
+		torrent.Storage, err = t.Storage.Open(t.Layout())
+		if err != nil {
+			return nil, err
+		}
 	}
-	outfile, err := os.Create(path)
+	return torrent, nil
+}
+
+// StartDownload starts downloading the selected files in the background, for reading with p2p.Reader
+func (t *Torrentfile) StartDownload() (*p2p.Torrent, error) {
+	torrent, err := t.newTorrent()
+	if err != nil {
+		return nil, err
+	}
+	torrent.Start()
+	return torrent, nil
+}
+
+// DownloadToFile downloads the selected files and writes them to path, unless the storage already did
+func (t *Torrentfile) DownloadToFile(path string) error {
+	torrent, err := t.newTorrent()
 	if err != nil {
 		return err
 	}
-	defer outfile.Close()
-	_, err = outfile.Write(buf)
+	torrent.Start()
+	defer torrent.Close()
+	err = torrent.Wait()
 	if err != nil {
 		return err
 	}
-	return nil
+	if t.StoredInPlace() {
+		return nil
+	}
+	return t.WriteFiles(torrent, path)
 }
 
 func Open(path string) (Torrentfile, error) {
@@ -86,22 +166,25 @@ func Open(path string) (Torrentfile, error) {
 		return Torrentfile{}, err
 	}
 	defer file.Close()
+	return Parse(file)
+}
+
+// Parse reads a .torrent file's content
+func Parse(r io.Reader) (Torrentfile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Torrentfile{}, err
+	}
 	bto := Torrent{}
-	err = bencode.Unmarshal(file, &bto)
+	err = bencode.Unmarshal(bytes.NewReader(data), &bto)
 	if err != nil {
 		return Torrentfile{}, err
 	}
-	return bto.toTorrentFile()
-}
-
-func (i *Info) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
+	info, err := infoBytes(data)
 	if err != nil {
-		return [20]byte{}, err
+		return Torrentfile{}, err
 	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+	return bto.Info.toTorrentFile(bto.Announce, sha1.Sum(info))
 }
 
 func (i *Info) splitPieceHashes() ([][20]byte, error) {
@@ -118,22 +201,97 @@ func (i *Info) splitPieceHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
-func (bto *Torrent) toTorrentFile() (Torrentfile, error) {
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return Torrentfile{}, err
+// files lays out the torrent's files back to back, a single-file torrent being one file named after the torrent
+func (i *Info) files() []p2p.File {
+	if len(i.Files) == 0 {
+		return []p2p.File{{Path: i.Name, Length: i.Length, Priority: p2p.PriorityNormal}}
 	}
-	pieceHases, err := bto.Info.splitPieceHashes()
+	files := make([]p2p.File, len(i.Files))
+	offset := 0
+	for idx, f := range i.Files {
+		files[idx] = p2p.File{
+			Path:     strings.Join(f.Path, "/"),
+			Length:   f.Length,
+			Offset:   offset,
+			Priority: p2p.PriorityNormal,
+		}
+		offset += f.Length
+	}
+	return files
+}
+
+func (i *Info) toTorrentFile(announce string, infoHash [20]byte) (Torrentfile, error) {
+	pieceHases, err := i.splitPieceHashes()
 	if err != nil {
 		return Torrentfile{}, err
 	}
 	t := Torrentfile{
-		Announce:    bto.URLList[19],
+		Announce:    announce,
 		Infohash:    infoHash,
 		PieceHashes: pieceHases,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
+		PieceLength: i.PieceLength,
+		Length:      i.Length,
+		Name:        i.Name,
+		Files:       i.files(),
+	}
+	if len(i.Files) > 0 {
+		t.Length = 0
+		for _, f := range t.Files {
+			t.Length += f.Length
+		}
+	}
+	err = t.Validate()
+	if err != nil {
+		return Torrentfile{}, err
 	}
 	return t, nil
 }
+
+// Validate checks what downloading relies on: hashes for every piece of the data,
+// and file paths that stay under the directory the files are written to
+func (t *Torrentfile) Validate() error {
+	if t.PieceLength <= 0 {
+		return fmt.Errorf("invalid piece length %d", t.PieceLength)
+	}
+	if t.Length < 0 {
+		return fmt.Errorf("invalid length %d", t.Length)
+	}
+	pieces := (t.Length + t.PieceLength - 1) / t.PieceLength
+	if len(t.PieceHashes) != pieces {
+		return fmt.Errorf("%d piece hashes for %d bytes in pieces of %d, want %d", len(t.PieceHashes), t.Length, t.PieceLength, pieces)
+	}
+	for _, f := range t.Files {
+		if f.Length < 0 {
+			return fmt.Errorf("file %s: invalid length %d", f.Path, f.Length)
+		}
+	}
+	return t.checkPaths()
+}
+
+// checkPaths refuses a name that is not a single path element and file paths leaving the torrent's directory
+func (t *Torrentfile) checkPaths() error {
+	err := checkPathElement(t.Name)
+	if err != nil {
+		return fmt.Errorf("name: %w", err)
+	}
+	if !t.isMultiFile() {
+		return nil
+	}
+	for _, f := range t.Files {
+		for _, elem := range strings.Split(f.Path, "/") {
+			err = checkPathElement(elem)
+			if err != nil {
+				return fmt.Errorf("file %s: %w", f.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkPathElement refuses the names that are not a single file or directory of their own under the output directory
+func checkPathElement(name string) error {
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) || !filepath.IsLocal(name) {
+		return fmt.Errorf("invalid path element %q", name)
+	}
+	return nil
+}
@@ -1,36 +1,227 @@
 package torrentfile
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"flag"
-	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/jackpal/bencode-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-var update = flag.Bool("update", false, "update .golden.json  file")
+var update = flag.Bool("update", false, "update the .json golden files")
 
+// TestOpen checks the torrents of testdata against their details in the golden files, the output of info -json
 func TestOpen(t *testing.T) {
-	torrent, err := Open("C:/Users/user/Desktop/workspace/go/build-my-own/bit_torrent_cli/torrentfile/testdata/archlinux-2019.12.01-x86_64.iso.torrent")
+	paths, err := filepath.Glob("testdata/*.torrent")
 	require.Nil(t, err)
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			details, err := InspectFile(path)
+			require.Nil(t, err)
+			goldenPath := strings.TrimSuffix(path, ".torrent") + ".json"
+			if *update {
+				serialized, err := json.MarshalIndent(details, "", "  ")
+				require.Nil(t, err)
+				require.Nil(t, os.WriteFile(goldenPath, append(serialized, '\n'), 0644))
+			}
+			golden, err := os.ReadFile(goldenPath)
+			require.Nil(t, err)
+			expected := Details{}
+			require.Nil(t, json.Unmarshal(golden, &expected))
+			assert.Equal(t, expected, details)
 
-	golddenPath := "C:/Users/user/Desktop/workspace/go/build-my-own/bit_torrent_cli/torrentfile/testdata/archlinux-2019.12.01-x86_64.iso.torrent.golden (1).json"
-	if *update {
-		serialized, err := json.MarshalIndent(torrent, "", " ")
-		require.Nil(t, err)
-		ioutil.WriteFile(golddenPath, serialized, 0644)
+			mi, err := metainfo.LoadFromFile(path)
+			require.Nil(t, err)
+			assert.Equal(t, mi.HashInfoBytes().HexString(), details.InfohashV1)
+
+			torrent, err := Open(path)
+			require.Nil(t, err)
+			assert.Equal(t, details.Name, torrent.Name)
+			assert.Equal(t, details.InfohashV1, hexString(torrent.Infohash))
+			if len(details.Trackers) > 0 {
+				assert.Equal(t, details.Trackers[0][0], torrent.Announce)
+			} else {
+				assert.Empty(t, torrent.Announce)
+			}
+			assert.Equal(t, details.PieceLength, torrent.PieceLength)
+			assert.Equal(t, details.Pieces, len(torrent.PieceHashes))
+			assert.Equal(t, details.Length, int64(torrent.Length))
+			require.Len(t, torrent.Files, len(details.Files))
+			for i, f := range details.Files {
+				assert.Equal(t, f.Path, torrent.Files[i].Path)
+				assert.Equal(t, f.Length, int64(torrent.Files[i].Length))
+			}
+		})
+	}
+}
+
+func TestInspect(t *testing.T) {
+	info := map[string]any{
+		"name":         "dir",
+		"piece length": 16384,
+		"pieces":       strings.Repeat("x", 60),
+		"private":      1,
+		"files": []any{
+			map[string]any{"length": 20000, "path": []any{"a", "b.bin"}},
+			map[string]any{"length": 12768, "path": []any{".pad", "12768"}, "attr": "p"},
+			map[string]any{"length": 5, "path": []any{"c.txt"}},
+		},
+	}
+	meta := map[string]any{
+		"announce":      "http://a/announce",
+		"announce-list": []any{[]any{"http://a/announce", "http://b/announce"}, []any{"udp://c:80"}},
+		"url-list":      "http://seed/",
+		"created by":    "test",
+		"creation date": 1700000000,
+		"comment":       "hello",
+		"info":          info,
 	}
+	var buf strings.Builder
+	require.Nil(t, bencode.Marshal(&buf, meta))
 
-	expected := Torrentfile{}
-	golden, err := ioutil.ReadFile(golddenPath)
+	d, err := Inspect([]byte(buf.String()))
 	require.Nil(t, err)
-	json.Unmarshal(golden, &expected)
+	assert.Equal(t, "dir", d.Name)
+	assert.Equal(t, 16384, d.PieceLength)
+	assert.Equal(t, 3, d.Pieces)
+	assert.Equal(t, int64(32773), d.Length)
+	assert.True(t, d.Private)
+	assert.Equal(t, []FileDetails{{"a/b.bin", 20000, false}, {".pad/12768", 12768, true}, {"c.txt", 5, false}}, d.Files)
+	assert.Equal(t, [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}}, d.Trackers)
+	assert.Equal(t, []string{"http://seed/"}, d.WebSeeds)
+	assert.Equal(t, "test", d.CreatedBy)
+	assert.Equal(t, "hello", d.Comment)
+	assert.Equal(t, int64(1700000000), d.CreationDate.Unix())
+	assert.Empty(t, d.InfohashV2)
+
+	// the private flag is part of the info hash, which Parse has to take over the dictionary as written
+	mi, err := metainfo.Load(strings.NewReader(buf.String()))
 	require.Nil(t, err)
+	assert.Equal(t, mi.HashInfoBytes().HexString(), d.InfohashV1)
+	tf, err := Parse(strings.NewReader(buf.String()))
+	require.Nil(t, err)
+	assert.Equal(t, d.InfohashV1, hexString(tf.Infohash))
+
+	// a v2 torrent only has the file tree, hybrids both
+	info = map[string]any{
+		"name":         "v2",
+		"piece length": 16384,
+		"meta version": 2,
+		"file tree": map[string]any{
+			"z.txt": map[string]any{"": map[string]any{"length": 3}},
+			"sub":   map[string]any{"y.bin": map[string]any{"": map[string]any{"length": 20000}}},
+		},
+	}
+	buf.Reset()
+	require.Nil(t, bencode.Marshal(&buf, map[string]any{"info": info}))
+	d, err = Inspect([]byte(buf.String()))
+	require.Nil(t, err)
+	assert.Len(t, d.InfohashV2, 64)
+	assert.Empty(t, d.InfohashV1)
+	assert.Equal(t, []FileDetails{{"sub/y.bin", 20000, false}, {"z.txt", 3, false}}, d.Files)
+	assert.Equal(t, 2, d.Pieces)
+
+	_, err = Inspect([]byte("d4:name1:xe"))
+	assert.NotNil(t, err)
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := map[string]struct {
+		info map[string]any
+		err  string
+	}{
+		"zero piece length": {
+			info: map[string]any{"name": "a", "piece length": 0, "pieces": "", "length": 10},
+			err:  "invalid piece length 0",
+		},
+		"truncated hash": {
+			info: map[string]any{"name": "a", "piece length": 16, "pieces": strings.Repeat("x", 30), "length": 10},
+			err:  "malformed pieces",
+		},
+		"missing hash": {
+			info: map[string]any{"name": "a", "piece length": 16, "pieces": strings.Repeat("x", 20), "length": 20},
+			err:  "want 2",
+		},
+		"extra hash": {
+			info: map[string]any{"name": "a", "piece length": 16, "pieces": strings.Repeat("x", 40), "length": 10},
+			err:  "want 1",
+		},
+		"parent name": {
+			info: map[string]any{"name": "..", "piece length": 16, "pieces": strings.Repeat("x", 20), "length": 10},
+			err:  "invalid path element",
+		},
+		"empty name": {
+			info: map[string]any{"piece length": 16, "pieces": strings.Repeat("x", 20), "length": 10},
+			err:  "invalid path element",
+		},
+		"name with a separator": {
+			info: map[string]any{"name": "a/b", "piece length": 16, "pieces": strings.Repeat("x", 20), "length": 10},
+			err:  "invalid path element",
+		},
+		"escaping file": {
+			info: multiFile([]any{"..", "escaped.txt"}),
+			err:  "invalid path element",
+		},
+		"empty path": {
+			info: multiFile([]any{}),
+			err:  "invalid path element",
+		},
+		"empty path element": {
+			info: multiFile([]any{"a", "", "b"}),
+			err:  "invalid path element",
+		},
+		"current directory": {
+			info: multiFile([]any{".", "b"}),
+			err:  "invalid path element",
+		},
+		"absolute path": {
+			info: multiFile([]any{"/etc", "passwd"}),
+			err:  "invalid path element",
+		},
+		"backslash": {
+			info: multiFile([]any{`..\escaped.txt`}),
+			err:  "invalid path element",
+		},
+	}
+	for name, test := range tests {
+		var buf strings.Builder
+		require.Nil(t, bencode.Marshal(&buf, map[string]any{"info": test.info}), name)
+		_, err := Parse(strings.NewReader(buf.String()))
+		assert.ErrorContains(t, err, test.err, name)
+
+		var info strings.Builder
+		require.Nil(t, bencode.Marshal(&info, test.info), name)
+		_, err = FromMetadata([]byte(info.String()), sha1.Sum([]byte(info.String())), "")
+		assert.ErrorContains(t, err, test.err, name)
+	}
+}
 
-	assert.Equal(t, expected, torrent)
+// multiFile is the info of a torrent with one file of 10 bytes at path
+func multiFile(path []any) map[string]any {
+	return map[string]any{
+		"name":         "dir",
+		"piece length": 16,
+		"pieces":       strings.Repeat("x", 20),
+		"files":        []any{map[string]any{"length": 10, "path": path}},
+	}
+}
+
+func TestRaw(t *testing.T) {
+	raw, err := Raw([]byte("d4:infod6:pieces2:\xff\x00e4:listli1e3:abcee"))
+	require.Nil(t, err)
+	out, err := json.Marshal(raw)
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"info":{"pieces":{"hex":"ff00"}},"list":[1,"abc"]}`, string(out))
 }
 
-func TestTorrentFile(t *testing.T) {
+func hexString(h [20]byte) string {
+	return metainfo.Hash(h).HexString()
 }
@@ -1,15 +1,32 @@
 package torrentfile
 
 import (
+	"bit_torrent_cli/logging"
+	"bit_torrent_cli/metrics"
 	"bit_torrent_cli/peers"
+	"bit_torrent_cli/tracing"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackpal/bencode-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("bit_torrent_cli/torrentfile")
+
+var announceSeconds = metrics.NewHistogram("bittorrent_tracker_announce_seconds",
+	"Time taken by HTTP tracker announces, by result.", metrics.DefBuckets, "result")
+
 type bencodeTrackerResp struct {
 	Peers    string
 	Interval int
@@ -33,7 +50,32 @@ func (t *Torrentfile) buildTrackerURL(peerID [20]byte, port uint16) (string, err
 	return base.String(), nil
 }
 
-func (t *Torrentfile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
+// RequestPeers announces to the tracker and returns the peers it knows
+func (t *Torrentfile) RequestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
+	_, span := tracer.Start(context.Background(), "tracker.announce", trace.WithAttributes(
+		attribute.String("tracker.url", t.Announce),
+		attribute.String("torrent.info_hash", hex.EncodeToString(t.Infohash[:])),
+	))
+	start := time.Now()
+	ps, err := t.announce(peerID, port)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	took := time.Since(start)
+	announceSeconds.Observe(took.Seconds(), result)
+	span.SetAttributes(attribute.Int("tracker.peers", len(ps)))
+	tracing.End(span, err)
+	log := logging.For(t.Logger, "tracker").With(logging.KeyInfohash, hex.EncodeToString(t.Infohash[:]), "tracker", t.Announce)
+	if err != nil {
+		log.Warn("announce failed", "took", took, logging.Err(err))
+	} else {
+		log.Debug("announced", "peers", len(ps), "took", took)
+	}
+	return ps, err
+}
+
+func (t *Torrentfile) announce(peerID [20]byte, port uint16) ([]peers.Peer, error) {
 	url, err := t.buildTrackerURL(peerID, port)
 	if err != nil {
 		return nil, err
@@ -52,3 +94,66 @@ func (t *Torrentfile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer,
 	}
 	return peers.Unmarshal([]byte(trackerResp.Peers))
 }
+
+// Swarm is what a tracker knows of the peers of a torrent
+type Swarm struct {
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+// ScrapeURL derives the scrape URL from an announce URL, which the convention only allows
+// when the last part of its path starts with "announce"
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	dir, last := path.Split(u.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return "", fmt.Errorf("tracker %s does not support scraping", announce)
+	}
+	u.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	return u.String(), nil
+}
+
+// Scrape asks the tracker how many peers the torrent has without announcing
+func (t *Torrentfile) Scrape() (Swarm, error) {
+	base, err := ScrapeURL(t.Announce)
+	if err != nil {
+		return Swarm{}, err
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return Swarm{}, err
+	}
+	q := u.Query()
+	q.Set("info_hash", string(t.Infohash[:]))
+	u.RawQuery = q.Encode()
+	c := http.Client{Timeout: time.Second * 15}
+	resp, err := c.Get(u.String())
+	if err != nil {
+		return Swarm{}, err
+	}
+	defer resp.Body.Close()
+
+	// bencode-go cannot unmarshal a map of structs, the files being keyed by info hash
+	v, err := bencode.Decode(resp.Body)
+	if err != nil {
+		return Swarm{}, err
+	}
+	dict, _ := v.(map[string]any)
+	if failure, ok := dict["failure reason"].(string); ok {
+		return Swarm{}, errors.New(failure)
+	}
+	files, _ := dict["files"].(map[string]any)
+	file, ok := files[string(t.Infohash[:])].(map[string]any)
+	if !ok {
+		return Swarm{}, fmt.Errorf("tracker %s does not know %x", t.Announce, t.Infohash)
+	}
+	count := func(key string) int {
+		n, _ := file[key].(int64)
+		return int(n)
+	}
+	return Swarm{Seeders: count("complete"), Leechers: count("incomplete"), Completed: count("downloaded")}, nil
+}
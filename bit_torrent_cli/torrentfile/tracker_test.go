@@ -0,0 +1,74 @@
+package torrentfile_test
+
+import (
+	"bit_torrent_cli/swarm"
+	"bit_torrent_cli/torrentfile"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := map[string]struct {
+		announce string
+		want     string
+	}{
+		"plain":         {"http://example.com/announce", "http://example.com/scrape"},
+		"query":         {"http://example.com/x/announce?key=1", "http://example.com/x/scrape?key=1"},
+		"suffix":        {"http://example.com/announce.php", "http://example.com/scrape.php"},
+		"passkey":       {"https://example.com/abc/announce", "https://example.com/abc/scrape"},
+		"unsupported":   {"http://example.com/a", ""},
+		"in the middle": {"http://example.com/announce/x", ""},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := torrentfile.ScrapeURL(test.announce)
+			if test.want == "" {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestScrape(t *testing.T) {
+	content := swarm.NewContent("data.bin", 16<<10, 1, 40<<10)
+	tracker := swarm.NewTracker()
+	defer tracker.Close()
+	tf := content.Torrent
+	tf.Announce = tracker.URL()
+	p, err := swarm.NewPeer(content, swarm.Behavior{})
+	require.Nil(t, err)
+	defer p.Close()
+	tracker.Add(tf.Infohash, p.Addr())
+
+	_, err = tf.RequestPeers([20]byte{1}, 6881)
+	require.Nil(t, err)
+	s, err := tf.Scrape()
+	require.Nil(t, err)
+	assert.Equal(t, torrentfile.Swarm{Seeders: 1, Completed: 1}, s)
+}
+
+func TestAnnouncedPort(t *testing.T) {
+	ports := make(chan string, 1)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ports <- r.URL.Query().Get("port")
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	tf := swarm.NewContent("data.bin", 16<<10, 1, 40<<10).Torrent
+	tf.Announce = tracker.URL
+
+	for port, want := range map[uint16]string{0: "0", 51413: "51413"} {
+		tf.Port = port
+		torrent, err := tf.StartDownload()
+		require.Nil(t, err)
+		torrent.Close()
+		assert.Equal(t, want, <-ports)
+	}
+}
@@ -0,0 +1,102 @@
+package torrentfile
+
+import (
+	"bit_torrent_cli/p2p"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// BadPiece is a piece whose data is missing or does not match its hash
+type BadPiece struct {
+	Index int
+	// Err says why the data could not be read, nil when it was read but its hash is wrong
+	Err error
+	// Files are the paths of the files the piece overlaps
+	Files []string
+}
+
+// Missing is whether the data of the piece could not be read at all
+func (b BadPiece) Missing() bool {
+	return b.Err != nil
+}
+
+// Verify hashes every piece of data on workers goroutines, GOMAXPROCS of them when 0, returning the bad pieces
+// in order. checked is called with the length of each piece once hashed, from any worker. The error is only
+// set when ctx is done first.
+func (t *Torrentfile) Verify(ctx context.Context, data io.ReaderAt, workers int, checked func(n int)) ([]BadPiece, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	indexes := make(chan int)
+	results := make([]*BadPiece, len(t.PieceHashes))
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, t.PieceLength)
+			for i := range indexes {
+				results[i] = t.verifyPiece(data, i, buf)
+				if checked != nil {
+					begin, end := t.pieceBounds(i)
+					checked(end - begin)
+				}
+			}
+		}()
+	}
+	var err error
+feed:
+	for i := range t.PieceHashes {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	var bad []BadPiece
+	for _, b := range results {
+		if b != nil {
+			bad = append(bad, *b)
+		}
+	}
+	return bad, err
+}
+
+// verifyPiece reads and hashes the piece into buf, returning nil when it is good
+func (t *Torrentfile) verifyPiece(data io.ReaderAt, index int, buf []byte) *BadPiece {
+	begin, end := t.pieceBounds(index)
+	_, err := data.ReadAt(buf[:end-begin], int64(begin))
+	if err == nil {
+		sum := sha1.Sum(buf[:end-begin])
+		if bytes.Equal(sum[:], t.PieceHashes[index][:]) {
+			return nil
+		}
+	}
+	return &BadPiece{Index: index, Err: err, Files: t.PieceFiles(index)}
+}
+
+func (t *Torrentfile) pieceBounds(index int) (begin, end int) {
+	begin = index * t.PieceLength
+	end = min(begin+t.PieceLength, t.Length)
+	return begin, end
+}
+
+// PieceFiles returns the paths of the files overlapping the piece, mapped as the downloader does
+func (t *Torrentfile) PieceFiles(index int) []string {
+	var paths []string
+	for _, f := range t.Files {
+		begin, end := p2p.PieceRange(f, t.PieceLength)
+		if index >= begin && index < end {
+			paths = append(paths, f.Path)
+		}
+	}
+	return paths
+}
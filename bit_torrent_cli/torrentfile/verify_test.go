@@ -0,0 +1,71 @@
+package torrentfile_test
+
+import (
+	"bit_torrent_cli/torrentfile"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "dir")
+	require.Nil(t, os.MkdirAll(root, 0755))
+	// 16KiB pieces: a.bin holds pieces 0-2 and the start of 3, b.bin the rest of 3 and 4
+	files := map[string][]byte{
+		"a.bin": bytes.Repeat([]byte("a"), 50<<10),
+		"b.bin": bytes.Repeat([]byte("b"), 20<<10),
+	}
+	for name, data := range files {
+		require.Nil(t, os.WriteFile(filepath.Join(root, name), data, 0644))
+	}
+	mi, err := torrentfile.Create(root, torrentfile.CreateOptions{PieceLength: 16 << 10})
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	require.Nil(t, mi.Write(&buf))
+	tf, err := torrentfile.Parse(&buf)
+	require.Nil(t, err)
+	require.Len(t, tf.PieceHashes, 5)
+	assert.Equal(t, []string{"a.bin", "b.bin"}, tf.PieceFiles(3))
+
+	verify := func() []torrentfile.BadPiece {
+		d := tf.OpenData(root)
+		defer d.Close()
+		var checked atomic.Int64
+		bad, err := tf.Verify(context.Background(), d, 3, func(n int) { checked.Add(int64(n)) })
+		require.Nil(t, err)
+		assert.Equal(t, int64(tf.Length), checked.Load())
+		return bad
+	}
+	assert.Empty(t, verify())
+
+	// a flipped byte in piece 1 and a truncated b.bin, cutting off the end of piece 4
+	f, err := os.OpenFile(filepath.Join(root, "a.bin"), os.O_WRONLY, 0)
+	require.Nil(t, err)
+	_, err = f.WriteAt([]byte("x"), 20<<10)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	require.Nil(t, os.Truncate(filepath.Join(root, "b.bin"), 15<<10))
+	bad := verify()
+	require.Len(t, bad, 2)
+	assert.Equal(t, 1, bad[0].Index)
+	assert.False(t, bad[0].Missing())
+	assert.Equal(t, []string{"a.bin"}, bad[0].Files)
+	assert.Equal(t, 4, bad[1].Index)
+	assert.True(t, bad[1].Missing())
+	assert.Equal(t, []string{"b.bin"}, bad[1].Files)
+
+	// everything is missing without the files
+	require.Nil(t, os.RemoveAll(root))
+	assert.Len(t, verify(), 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tf.Verify(ctx, tf.OpenData(root), 1, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// JSONExporter writes each span as a JSON object on its own line, for reading traces without a collector
+type JSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+	// c is closed on shutdown, set for the files Setup opens
+	c io.Closer
+}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+// Span is the JSON form of an exported span
+type Span struct {
+	Name       string         `json:"name"`
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	ParentID   string         `json:"parentSpanId,omitempty"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	DurationMs float64        `json:"durationMs"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Events     []Event        `json:"events,omitempty"`
+	Status     string         `json:"status,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type Event struct {
+	Name       string         `json:"name"`
+	Time       time.Time      `json:"time"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+func attributes(kvs []attribute.KeyValue) map[string]any {
+	if len(kvs) == 0 {
+		return nil
+	}
+	m := make(map[string]any, len(kvs))
+	for _, kv := range kvs {
+		m[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	return m
+}
+
+// toSpan converts a finished span to its JSON form
+func toSpan(s sdktrace.ReadOnlySpan) Span {
+	out := Span{
+		Name:       s.Name(),
+		TraceID:    s.SpanContext().TraceID().String(),
+		SpanID:     s.SpanContext().SpanID().String(),
+		Start:      s.StartTime(),
+		End:        s.EndTime(),
+		DurationMs: float64(s.EndTime().Sub(s.StartTime())) / float64(time.Millisecond),
+		Attributes: attributes(s.Attributes()),
+	}
+	if s.Parent().IsValid() {
+		out.ParentID = s.Parent().SpanID().String()
+	}
+	for _, e := range s.Events() {
+		out.Events = append(out.Events, Event{Name: e.Name, Time: e.Time, Attributes: attributes(e.Attributes)})
+	}
+	if s.Status().Code != codes.Unset {
+		out.Status = s.Status().Code.String()
+		out.Error = s.Status().Description
+	}
+	return out
+}
+
+func (e *JSONExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		err := enc.Encode(toSpan(s))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *JSONExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.c != nil {
+		return e.c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName names this program in the exported spans
+const ServiceName = "bit_torrent_cli"
+
+// Usage describes the exporter specs taken by Setup, for flag help
+const Usage = "export trace spans: otlp (collector from OTEL_EXPORTER_OTLP_ENDPOINT), otlp:host:port (plaintext), stdout, or file:path for JSON lines"
+
+// Setup installs the global tracer provider exporting to spec, one of
+//
+//	otlp            OTLP over gRPC, configured by the OTEL_EXPORTER_OTLP_* variables
+//	otlp:host:port  OTLP over gRPC without TLS to the collector at host:port
+//	stdout          a JSON object per span on stdout
+//	file:path       a JSON object per span appended to the file
+//
+// An empty spec leaves tracing off. The returned func flushes and stops the exporter.
+func Setup(ctx context.Context, spec string) (shutdown func(context.Context) error, err error) {
+	if spec == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var exporter sdktrace.SpanExporter
+	switch {
+	case spec == "otlp":
+		exporter, err = otlptracegrpc.New(ctx)
+	case strings.HasPrefix(spec, "otlp:"):
+		exporter, err = otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpoint(strings.TrimPrefix(spec, "otlp:")), otlptracegrpc.WithInsecure())
+	case spec == "stdout":
+		exporter = NewJSONExporter(os.Stdout)
+	case strings.HasPrefix(spec, "file:"):
+		var f *os.File
+		f, err = os.OpenFile(strings.TrimPrefix(spec, "file:"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err == nil {
+			exporter = &JSONExporter{w: f, c: f}
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, want otlp, otlp:host:port, stdout or file:path", spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating trace exporter: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// End records err on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(NewJSONExporter(&buf)))
+	tracer := tp.Tracer("test")
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child")
+	child.SetAttributes(attribute.Int("piece.index", 3))
+	child.AddEvent("dropped")
+	End(child, errors.New("bad hash"))
+	End(parent, nil)
+	require.Nil(t, tp.Shutdown(context.Background()))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var spans [2]Span
+	for i, line := range lines {
+		require.Nil(t, json.Unmarshal([]byte(line), &spans[i]))
+	}
+	c, p := spans[0], spans[1]
+	assert.Equal(t, "child", c.Name)
+	assert.Equal(t, "parent", p.Name)
+	assert.Equal(t, p.TraceID, c.TraceID)
+	assert.Equal(t, p.SpanID, c.ParentID)
+	assert.Empty(t, p.ParentID)
+	assert.Equal(t, map[string]any{"piece.index": 3.0}, c.Attributes)
+	assert.Equal(t, "Error", c.Status)
+	assert.Equal(t, "bad hash", c.Error)
+	assert.Equal(t, []string{"dropped", "exception"}, []string{c.Events[0].Name, c.Events[1].Name})
+	assert.Empty(t, p.Status)
+}
+
+func TestSetup(t *testing.T) {
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	tests := map[string]bool{
+		"":       true,
+		"stdout": true,
+		"zipkin": false,
+		"file:" + filepath.Join(t.TempDir(), "no", "such", "dir"): false,
+	}
+	for spec, ok := range tests {
+		shutdown, err := Setup(context.Background(), spec)
+		if !ok {
+			assert.NotNil(t, err, spec)
+			continue
+		}
+		require.Nil(t, err, spec)
+		assert.Nil(t, shutdown(context.Background()), spec)
+	}
+
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Setup(context.Background(), "file:"+path)
+	require.Nil(t, err)
+	_, span := otel.Tracer("test").Start(context.Background(), "announce")
+	span.End()
+	require.Nil(t, shutdown(context.Background()))
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	assert.Contains(t, string(data), `"name":"announce"`)
+}
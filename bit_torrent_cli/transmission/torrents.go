@@ -0,0 +1,487 @@
+package transmission
+
+import (
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/session"
+	"bit_torrent_cli/torrentfile"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status values of torrent-get
+const (
+	statusStopped      = 0
+	statusDownloadWait = 3
+	statusDownload     = 4
+	statusSeedWait     = 5
+	statusSeed         = 6
+)
+
+// Transmission file priorities, there being no low priority here
+const (
+	priorityNormal = 0
+	priorityHigh   = 1
+)
+
+// FetchTimeout bounds fetching a .torrent URL or a magnet link's metadata in torrent-add
+const FetchTimeout = 2 * time.Minute
+
+func status(st session.Status) int {
+	downloaded := st.Stats.Wanted > 0 && st.Stats.WantedDone == st.Stats.Wanted
+	switch st.State {
+	case session.Downloading:
+		return statusDownload
+	case session.Seeding:
+		return statusSeed
+	case session.Queued:
+		if downloaded {
+			return statusSeedWait
+		}
+		return statusDownloadWait
+	default:
+		return statusStopped
+	}
+}
+
+func filePriority(p p2p.Priority) int {
+	if p == p2p.PriorityHigh {
+		return priorityHigh
+	}
+	return priorityNormal
+}
+
+// fileName is the path of a file as Transmission shows it, below the torrent's directory for multi-file torrents
+func fileName(st session.Status, f p2p.File) string {
+	if len(st.Files) == 1 && f.Path == st.Name {
+		return f.Path
+	}
+	return path.Join(st.Name, f.Path)
+}
+
+func magnetLink(st session.Status) string {
+	q := url.Values{"dn": {st.Name}}
+	if st.Announce != "" {
+		q.Set("tr", st.Announce)
+	}
+	return "magnet:?xt=urn:btih:" + hex.EncodeToString(st.InfoHash[:]) + "&" + q.Encode()
+}
+
+// torrentFields returns the requested fields of a torrent, leaving out those not supported
+func (h *Handler) torrentFields(st session.Status, fields []string) map[string]any {
+	pt := h.s.Torrent(st.InfoHash)
+	completed := make([]int64, len(st.Files))
+	var total, wanted, wantedDone int64
+	for i, f := range st.Files {
+		if pt != nil {
+			completed[i] = int64(pt.BytesCompleted(f))
+		}
+		total += int64(f.Length)
+		if f.Priority != p2p.PrioritySkip {
+			wanted += int64(f.Length)
+			wantedDone += completed[i]
+		}
+	}
+	var peers []p2p.PeerStats
+	if pt != nil {
+		peers = pt.PeerStats()
+	}
+
+	h.mu.Lock()
+	id := h.ids[st.InfoHash]
+	down, up := h.ratesLocked(st)
+	limits, ok := h.torrentLimits[st.InfoHash]
+	if !ok {
+		limits = newSpeedLimits(st.Limits)
+	}
+	h.mu.Unlock()
+
+	out := make(map[string]any, len(fields))
+	for _, field := range fields {
+		var v any
+		switch field {
+		case "id":
+			v = id
+		case "hashString":
+			v = hex.EncodeToString(st.InfoHash[:])
+		case "name":
+			v = st.Name
+		case "status":
+			v = status(st)
+		case "addedDate":
+			v = st.AddedAt.Unix()
+		case "downloadDir":
+			v = h.s.Config().DataDir
+		case "totalSize":
+			v = total
+		case "sizeWhenDone":
+			v = wanted
+		case "leftUntilDone":
+			v = wanted - wantedDone
+		case "haveValid":
+			v = st.Stats.Completed
+		case "percentDone":
+			v = 1.0
+			if wanted > 0 {
+				v = float64(wantedDone) / float64(wanted)
+			}
+		case "metadataPercentComplete":
+			v = 1
+		case "recheckProgress":
+			v = 0
+		case "downloadedEver":
+			v = st.Stats.Downloaded
+		case "uploadedEver":
+			v = st.Stats.Uploaded
+		case "uploadRatio":
+			v = -1.0
+			if st.Stats.Downloaded > 0 {
+				v = float64(st.Stats.Uploaded) / float64(st.Stats.Downloaded)
+			}
+		case "rateDownload":
+			v = down
+		case "rateUpload":
+			v = up
+		case "eta":
+			v = -1
+			if down > 0 {
+				v = (wanted - wantedDone) / down
+			}
+		case "error":
+			v = 0
+			if st.Err != nil {
+				v = 3 // local error
+			}
+		case "errorString":
+			v = ""
+			if st.Err != nil {
+				v = st.Err.Error()
+			}
+		case "isFinished":
+			v = false
+		case "isStalled":
+			v = false
+		case "queuePosition":
+			v = id - 1
+		case "peersConnected":
+			v = len(peers)
+		case "peersSendingToUs":
+			n := 0
+			for _, p := range peers {
+				if !p.Choked {
+					n++
+				}
+			}
+			v = n
+		case "peersGettingFromUs":
+			n := 0
+			for _, p := range peers {
+				if p.Uploaded > 0 {
+					n++
+				}
+			}
+			v = n
+		case "peers":
+			list := make([]map[string]any, len(peers))
+			for i, p := range peers {
+				host, port, _ := net.SplitHostPort(p.Addr)
+				portNum, _ := strconv.Atoi(port)
+				progress := 0.0
+				if st.Stats.Pieces > 0 {
+					progress = float64(p.Pieces) / float64(st.Stats.Pieces)
+				}
+				list[i] = map[string]any{
+					"address":            host,
+					"port":               portNum,
+					"clientName":         p.Client,
+					"clientIsChoked":     p.Choked,
+					"peerIsChoked":       false,
+					"clientIsInterested": p.Interested,
+					"peerIsInterested":   p.PeerInterested,
+					"isDownloadingFrom":  p.Piece >= 0,
+					"progress":           progress,
+				}
+			}
+			v = list
+		case "pieceCount":
+			v = st.Stats.Pieces
+		case "pieceSize":
+			v = st.PieceLength
+		case "magnetLink":
+			v = magnetLink(st)
+		case "files":
+			files := make([]map[string]any, len(st.Files))
+			for i, f := range st.Files {
+				files[i] = map[string]any{"name": fileName(st, f), "length": f.Length, "bytesCompleted": completed[i]}
+			}
+			v = files
+		case "fileStats":
+			stats := make([]map[string]any, len(st.Files))
+			for i, f := range st.Files {
+				stats[i] = map[string]any{
+					"bytesCompleted": completed[i],
+					"wanted":         f.Priority != p2p.PrioritySkip,
+					"priority":       filePriority(f.Priority),
+				}
+			}
+			v = stats
+		case "priorities":
+			prios := make([]int, len(st.Files))
+			for i, f := range st.Files {
+				prios[i] = filePriority(f.Priority)
+			}
+			v = prios
+		case "wanted":
+			wanted := make([]int, len(st.Files))
+			for i, f := range st.Files {
+				if f.Priority != p2p.PrioritySkip {
+					wanted[i] = 1
+				}
+			}
+			v = wanted
+		case "downloadLimit":
+			v = limits.Down
+		case "downloadLimited":
+			v = limits.DownEnabled
+		case "uploadLimit":
+			v = limits.Up
+		case "uploadLimited":
+			v = limits.UpEnabled
+		default:
+			continue
+		}
+		out[field] = v
+	}
+	return out
+}
+
+func (h *Handler) torrentGet(raw json.RawMessage) (any, error) {
+	var args struct {
+		IDs    json.RawMessage `json:"ids"`
+		Fields []string        `json:"fields"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args.Fields) == 0 {
+		return nil, errors.New("no fields specified")
+	}
+	list, err := h.resolve(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	torrents := make([]map[string]any, 0, len(list))
+	for _, st := range list {
+		torrents = append(torrents, h.torrentFields(st, args.Fields))
+	}
+	res := map[string]any{"torrents": torrents}
+	if string(args.IDs) == `"recently-active"` {
+		res["removed"] = []int{}
+	}
+	return res, nil
+}
+
+// fileArgs are the file selection arguments shared by torrent-add and torrent-set
+type fileArgs struct {
+	FilesWanted    []int `json:"files-wanted"`
+	FilesUnwanted  []int `json:"files-unwanted"`
+	PriorityHigh   []int `json:"priority-high"`
+	PriorityNormal []int `json:"priority-normal"`
+	PriorityLow    []int `json:"priority-low"`
+}
+
+// apply changes the priorities of a torrent's files. There is no low priority, low files are normal ones,
+// and as a file is either skipped or has a priority, priorities only apply to wanted files.
+func (fa fileArgs) apply(s *session.Session, infoHash [20]byte) error {
+	st, ok := s.Get(infoHash)
+	if !ok {
+		return session.ErrNotFound
+	}
+	prios := make([]p2p.Priority, len(st.Files))
+	for i, f := range st.Files {
+		prios[i] = f.Priority
+	}
+	set := func(indices []int, f func(p2p.Priority) p2p.Priority) error {
+		for _, i := range indices {
+			if i < 0 || i >= len(prios) {
+				return fmt.Errorf("file index %d out of range", i)
+			}
+			prios[i] = f(prios[i])
+		}
+		return nil
+	}
+	err := errors.Join(
+		set(fa.FilesUnwanted, func(p2p.Priority) p2p.Priority { return p2p.PrioritySkip }),
+		set(fa.FilesWanted, func(p p2p.Priority) p2p.Priority { return max(p, p2p.PriorityNormal) }),
+		set(fa.PriorityHigh, func(p p2p.Priority) p2p.Priority { return wantedOr(p, p2p.PriorityHigh) }),
+		set(fa.PriorityNormal, func(p p2p.Priority) p2p.Priority { return wantedOr(p, p2p.PriorityNormal) }),
+		set(fa.PriorityLow, func(p p2p.Priority) p2p.Priority { return wantedOr(p, p2p.PriorityNormal) }),
+	)
+	if err != nil {
+		return err
+	}
+	for i, prio := range prios {
+		if prio == st.Files[i].Priority {
+			continue
+		}
+		err = s.SetFilePriority(infoHash, i, prio)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func wantedOr(current, prio p2p.Priority) p2p.Priority {
+	if current == p2p.PrioritySkip {
+		return current
+	}
+	return prio
+}
+
+func (h *Handler) torrentAdd(raw json.RawMessage) (any, error) {
+	var args struct {
+		Filename string `json:"filename"`
+		Metainfo string `json:"metainfo"`
+		Paused   bool   `json:"paused"`
+		fileArgs
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), FetchTimeout)
+	defer cancel()
+
+	var ih [20]byte
+	switch {
+	case args.Metainfo != "":
+		var b []byte
+		b, err = base64.StdEncoding.DecodeString(args.Metainfo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metainfo: %w", err)
+		}
+		ih, err = h.addTorrent(bytes.NewReader(b), args.Paused)
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		ih, err = h.s.AddMagnet(ctx, args.Filename)
+		if err == nil && args.Paused {
+			err = h.s.Pause(ih)
+		}
+	case strings.HasPrefix(args.Filename, "http://"), strings.HasPrefix(args.Filename, "https://"):
+		ih, err = h.addURL(ctx, args.Filename, args.Paused)
+	case args.Filename != "":
+		var tf torrentfile.Torrentfile
+		tf, err = torrentfile.Open(args.Filename)
+		if err == nil {
+			ih, err = h.add(tf, args.Paused)
+		}
+	default:
+		return nil, errors.New("no filename or metainfo specified")
+	}
+	if errors.Is(err, session.ErrExists) {
+		return map[string]any{"torrent-duplicate": h.addedInfo(ih)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	h.added++
+	h.mu.Unlock()
+	err = args.fileArgs.apply(h.s, ih)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"torrent-added": h.addedInfo(ih)}, nil
+}
+
+// addedInfo describes a torrent added by torrent-add
+func (h *Handler) addedInfo(ih [20]byte) map[string]any {
+	st, _ := h.s.Get(ih)
+	return map[string]any{"id": h.id(ih), "name": st.Name, "hashString": hex.EncodeToString(ih[:])}
+}
+
+func (h *Handler) add(tf torrentfile.Torrentfile, paused bool) ([20]byte, error) {
+	if paused {
+		return h.s.AddPaused(tf)
+	}
+	return h.s.Add(tf)
+}
+
+func (h *Handler) addTorrent(r *bytes.Reader, paused bool) ([20]byte, error) {
+	tf, err := torrentfile.Parse(r)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return h.add(tf, paused)
+}
+
+func (h *Handler) addURL(ctx context.Context, u string, paused bool) ([20]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return [20]byte{}, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(resp.Body)
+	if err != nil {
+		return [20]byte{}, err
+	}
+	return h.addTorrent(bytes.NewReader(buf.Bytes()), paused)
+}
+
+func (h *Handler) torrentSet(raw json.RawMessage) (any, error) {
+	var args struct {
+		IDs             json.RawMessage `json:"ids"`
+		DownloadLimit   *int64          `json:"downloadLimit"`
+		DownloadLimited *bool           `json:"downloadLimited"`
+		UploadLimit     *int64          `json:"uploadLimit"`
+		UploadLimited   *bool           `json:"uploadLimited"`
+		fileArgs
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	list, err := h.resolve(args.IDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range list {
+		err = args.fileArgs.apply(h.s, st.InfoHash)
+		if err != nil {
+			return nil, err
+		}
+		h.mu.Lock()
+		limits, ok := h.torrentLimits[st.InfoHash]
+		if !ok {
+			limits = newSpeedLimits(st.Limits)
+		}
+		setLimits(&limits, args.DownloadLimit, args.DownloadLimited, args.UploadLimit, args.UploadLimited)
+		h.torrentLimits[st.InfoHash] = limits
+		h.mu.Unlock()
+		err = h.s.SetTorrentLimits(st.InfoHash, limits.limits())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
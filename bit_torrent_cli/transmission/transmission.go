@@ -0,0 +1,423 @@
+package transmission
+
+import (
+	"bit_torrent_cli/mse"
+	"bit_torrent_cli/ratelimit"
+	"bit_torrent_cli/session"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Path is where Transmission clients expect the RPC endpoint
+	Path = "/transmission/rpc"
+	// SessionIDHeader carries the token protecting the endpoint against cross-site requests
+	SessionIDHeader = "X-Transmission-Session-Id"
+	// RPCVersion is the protocol version whose subset is implemented
+	RPCVersion = 17
+	// Version is reported to clients in session-get
+	Version = "4.0.0 (bit_torrent_cli)"
+
+	// speedBytes is how many bytes make the kB of the speed limits, as in Transmission
+	speedBytes = 1000
+)
+
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string          `json:"result"`
+	Arguments any             `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// speedLimits keeps the limits clients may set while they are disabled, like Transmission does
+type speedLimits struct {
+	Down, Up               int64 // kB/s
+	DownEnabled, UpEnabled bool
+}
+
+func newSpeedLimits(l ratelimit.Limits) speedLimits {
+	return speedLimits{
+		Down:        l.Down.Rate / speedBytes,
+		Up:          l.Up.Rate / speedBytes,
+		DownEnabled: l.Down.Rate > 0,
+		UpEnabled:   l.Up.Rate > 0,
+	}
+}
+
+func (sl speedLimits) limits() ratelimit.Limits {
+	var l ratelimit.Limits
+	if sl.DownEnabled {
+		l.Down.Rate = sl.Down * speedBytes
+	}
+	if sl.UpEnabled {
+		l.Up.Rate = sl.Up * speedBytes
+	}
+	return l
+}
+
+// rate estimates transfer speeds from the byte counters between two polls
+type rate struct {
+	at               time.Time
+	down, up         int64
+	downRate, upRate int64
+}
+
+// Handler serves a subset of the Transmission RPC protocol over a session
+type Handler struct {
+	s         *session.Session
+	sessionID string
+	methods   map[string]func(args json.RawMessage) (any, error)
+	started   time.Time
+
+	mu            sync.Mutex
+	ids           map[[20]byte]int
+	hashes        map[int][20]byte
+	nextID        int
+	limits        speedLimits
+	torrentLimits map[[20]byte]speedLimits
+	rates         map[[20]byte]*rate
+	added         int
+}
+
+func NewHandler(s *session.Session) *Handler {
+	token := make([]byte, 36)
+	rand.Read(token)
+	h := &Handler{
+		s:             s,
+		sessionID:     base64.RawURLEncoding.EncodeToString(token),
+		started:       time.Now(),
+		ids:           make(map[[20]byte]int),
+		hashes:        make(map[int][20]byte),
+		nextID:        1,
+		limits:        newSpeedLimits(s.Limits()),
+		torrentLimits: make(map[[20]byte]speedLimits),
+		rates:         make(map[[20]byte]*rate),
+	}
+	h.methods = map[string]func(json.RawMessage) (any, error){
+		"session-get":       h.sessionGet,
+		"session-set":       h.sessionSet,
+		"session-stats":     h.sessionStats,
+		"torrent-get":       h.torrentGet,
+		"torrent-add":       h.torrentAdd,
+		"torrent-start":     h.torrentStart,
+		"torrent-start-now": h.torrentStart,
+		"torrent-stop":      h.torrentStop,
+		"torrent-remove":    h.torrentRemove,
+		"torrent-set":       h.torrentSet,
+	}
+	return h
+}
+
+// SessionID returns the token clients must send in SessionIDHeader
+func (h *Handler) SessionID() string {
+	return h.sessionID
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// clients learn the token from the 409 answering their first request
+	if r.Header.Get(SessionIDHeader) != h.sessionID {
+		w.Header().Set(SessionIDHeader, h.sessionID)
+		http.Error(w, "409: Conflict\nYour request had an invalid session-id header.", http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "405: Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req request
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "400: Bad Request\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := response{Result: "success", Arguments: struct{}{}, Tag: req.Tag}
+	method, ok := h.methods[req.Method]
+	if !ok {
+		res.Result = fmt.Sprintf("method name not recognized: %q", req.Method)
+	} else {
+		args, err := method(req.Arguments)
+		if err != nil {
+			res.Result = err.Error()
+		} else if args != nil {
+			res.Arguments = args
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// decodeArgs decodes the arguments of a method, which may be missing
+func decodeArgs(raw json.RawMessage, v any) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	err := json.Unmarshal(raw, v)
+	if err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+// syncIDsLocked gives the torrents added since the last call their Transmission IDs
+func (h *Handler) syncIDsLocked(list []session.Status) {
+	for _, st := range list {
+		if _, ok := h.ids[st.InfoHash]; ok {
+			continue
+		}
+		h.ids[st.InfoHash] = h.nextID
+		h.hashes[h.nextID] = st.InfoHash
+		h.nextID++
+	}
+}
+
+func (h *Handler) id(infoHash [20]byte) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.syncIDsLocked(h.s.List())
+	return h.ids[infoHash]
+}
+
+// resolve returns the torrents the ids argument selects: all of them when missing,
+// else a number, a hash string, "recently-active" or an array of numbers and hash strings
+func (h *Handler) resolve(raw json.RawMessage) ([]session.Status, error) {
+	list := h.s.List()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.syncIDsLocked(list)
+	if len(raw) == 0 || string(raw) == "null" || string(raw) == `"recently-active"` {
+		return list, nil
+	}
+	var items []json.RawMessage
+	if raw[0] == '[' {
+		err := json.Unmarshal(raw, &items)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ids: %w", err)
+		}
+	} else {
+		items = []json.RawMessage{raw}
+	}
+	wanted := make(map[[20]byte]bool)
+	for _, item := range items {
+		var id int
+		var hash string
+		switch {
+		case json.Unmarshal(item, &id) == nil:
+			if ih, ok := h.hashes[id]; ok {
+				wanted[ih] = true
+			}
+		case json.Unmarshal(item, &hash) == nil:
+			b, err := hex.DecodeString(hash)
+			if err != nil || len(b) != 20 {
+				return nil, fmt.Errorf("invalid hash %q", hash)
+			}
+			wanted[[20]byte(b)] = true
+		default:
+			return nil, fmt.Errorf("invalid id %s", item)
+		}
+	}
+	var selected []session.Status
+	for _, st := range list {
+		if wanted[st.InfoHash] {
+			selected = append(selected, st)
+		}
+	}
+	return selected, nil
+}
+
+// ratesLocked updates and returns the speeds of a torrent, at most once a second
+func (h *Handler) ratesLocked(st session.Status) (down, up int64) {
+	now := time.Now()
+	r, ok := h.rates[st.InfoHash]
+	if !ok {
+		r = &rate{at: now, down: st.Stats.Downloaded, up: st.Stats.Uploaded}
+		h.rates[st.InfoHash] = r
+	}
+	if elapsed := now.Sub(r.at); elapsed >= time.Second {
+		r.downRate = int64(float64(st.Stats.Downloaded-r.down) / elapsed.Seconds())
+		r.upRate = int64(float64(st.Stats.Uploaded-r.up) / elapsed.Seconds())
+		r.at, r.down, r.up = now, st.Stats.Downloaded, st.Stats.Uploaded
+	}
+	return r.downRate, r.upRate
+}
+
+func (h *Handler) sessionGet(raw json.RawMessage) (any, error) {
+	cfg := h.s.Config()
+	h.mu.Lock()
+	limits := h.limits
+	h.mu.Unlock()
+	return map[string]any{
+		"version":                  Version,
+		"rpc-version":              RPCVersion,
+		"rpc-version-minimum":      14,
+		"session-id":               h.sessionID,
+		"download-dir":             cfg.DataDir,
+		"peer-port":                h.s.Port(),
+		"port-forwarding-enabled":  cfg.PortMapping,
+		"dht-enabled":              cfg.DHT,
+		"pex-enabled":              false,
+		"lpd-enabled":              cfg.LSD,
+		"utp-enabled":              cfg.UTP,
+		"encryption":               encryptionName(cfg.Encryption),
+		"download-queue-enabled":   cfg.MaxActiveDownloads > 0,
+		"download-queue-size":      cfg.MaxActiveDownloads,
+		"seed-queue-enabled":       cfg.MaxActiveSeeds > 0,
+		"seed-queue-size":          cfg.MaxActiveSeeds,
+		"peer-limit-global":        cfg.MaxConns,
+		"peer-limit-per-torrent":   cfg.MaxConnsPerTorrent,
+		"speed-limit-down":         limits.Down,
+		"speed-limit-down-enabled": limits.DownEnabled,
+		"speed-limit-up":           limits.Up,
+		"speed-limit-up-enabled":   limits.UpEnabled,
+		"alt-speed-enabled":        false,
+		"start-added-torrents":     true,
+		"rename-partial-files":     false,
+		"units": map[string]any{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  speedBytes,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}, nil
+}
+
+func (h *Handler) sessionSet(raw json.RawMessage) (any, error) {
+	var args struct {
+		SpeedLimitDown        *int64 `json:"speed-limit-down"`
+		SpeedLimitDownEnabled *bool  `json:"speed-limit-down-enabled"`
+		SpeedLimitUp          *int64 `json:"speed-limit-up"`
+		SpeedLimitUpEnabled   *bool  `json:"speed-limit-up-enabled"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	setLimits(&h.limits, args.SpeedLimitDown, args.SpeedLimitDownEnabled, args.SpeedLimitUp, args.SpeedLimitUpEnabled)
+	h.s.SetLimits(h.limits.limits())
+	return nil, nil
+}
+
+func setLimits(sl *speedLimits, down *int64, downEnabled *bool, up *int64, upEnabled *bool) {
+	if down != nil {
+		sl.Down = *down
+	}
+	if downEnabled != nil {
+		sl.DownEnabled = *downEnabled
+	}
+	if up != nil {
+		sl.Up = *up
+	}
+	if upEnabled != nil {
+		sl.UpEnabled = *upEnabled
+	}
+}
+
+func (h *Handler) sessionStats(raw json.RawMessage) (any, error) {
+	list := h.s.List()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var active, paused int
+	var downRate, upRate, downloaded, uploaded int64
+	for _, st := range list {
+		if st.State == session.Paused {
+			paused++
+		} else if st.State != session.Queued {
+			active++
+		}
+		down, up := h.ratesLocked(st)
+		downRate += down
+		upRate += up
+		downloaded += st.Stats.Downloaded
+		uploaded += st.Stats.Uploaded
+	}
+	stats := map[string]any{
+		"uploadedBytes":   uploaded,
+		"downloadedBytes": downloaded,
+		"filesAdded":      h.added,
+		"sessionCount":    1,
+		"secondsActive":   int64(time.Since(h.started).Seconds()),
+	}
+	return map[string]any{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(list),
+		"downloadSpeed":      downRate,
+		"uploadSpeed":        upRate,
+		"cumulative-stats":   stats,
+		"current-stats":      stats,
+	}, nil
+}
+
+func (h *Handler) torrentStart(raw json.RawMessage) (any, error) {
+	return nil, h.each(raw, h.s.Resume)
+}
+
+func (h *Handler) torrentStop(raw json.RawMessage) (any, error) {
+	return nil, h.each(raw, h.s.Pause)
+}
+
+// each applies f to the torrents selected by the ids argument
+func (h *Handler) each(raw json.RawMessage, f func([20]byte) error) error {
+	var args struct {
+		IDs json.RawMessage `json:"ids"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return err
+	}
+	list, err := h.resolve(args.IDs)
+	if err != nil {
+		return err
+	}
+	for _, st := range list {
+		err = f(st.InfoHash)
+		if err != nil && !errors.Is(err, session.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) torrentRemove(raw json.RawMessage) (any, error) {
+	var args struct {
+		DeleteLocalData bool `json:"delete-local-data"`
+	}
+	err := decodeArgs(raw, &args)
+	if err != nil {
+		return nil, err
+	}
+	return nil, h.each(raw, func(ih [20]byte) error {
+		h.mu.Lock()
+		delete(h.rates, ih)
+		delete(h.torrentLimits, ih)
+		h.mu.Unlock()
+		return h.s.Remove(ih, args.DeleteLocalData)
+	})
+}
+
+// encryptionName maps a policy to Transmission's encryption setting
+func encryptionName(p mse.Policy) string {
+	switch p {
+	case mse.PolicyRequire:
+		return "required"
+	case mse.PolicyDisable:
+		return "tolerated"
+	default:
+		return "preferred"
+	}
+}
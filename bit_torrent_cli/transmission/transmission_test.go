@@ -0,0 +1,180 @@
+package transmission
+
+import (
+	"bit_torrent_cli/p2p"
+	"bit_torrent_cli/session"
+	"bit_torrent_cli/torrentfile"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient speaks the protocol like Transmission frontends do, fetching the session id on a 409
+type fakeClient struct {
+	t         *testing.T
+	url       string
+	sessionID string
+}
+
+func (c *fakeClient) call(method string, args any) (string, map[string]any) {
+	body, err := json.Marshal(map[string]any{"method": method, "arguments": args, "tag": 7})
+	require.Nil(c.t, err)
+	for {
+		req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+		require.Nil(c.t, err)
+		req.Header.Set(SessionIDHeader, c.sessionID)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(c.t, err)
+		if resp.StatusCode == http.StatusConflict {
+			resp.Body.Close()
+			require.NotEqual(c.t, c.sessionID, resp.Header.Get(SessionIDHeader))
+			c.sessionID = resp.Header.Get(SessionIDHeader)
+			continue
+		}
+		defer resp.Body.Close()
+		require.Equal(c.t, http.StatusOK, resp.StatusCode)
+		var res struct {
+			Result    string         `json:"result"`
+			Arguments map[string]any `json:"arguments"`
+			Tag       int            `json:"tag"`
+		}
+		require.Nil(c.t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Equal(c.t, 7, res.Tag)
+		return res.Result, res.Arguments
+	}
+}
+
+func newFakeClient(t *testing.T) (*fakeClient, *session.Session) {
+	s, err := session.New(session.Config{DataDir: t.TempDir()})
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	srv := httptest.NewServer(NewHandler(s))
+	t.Cleanup(srv.Close)
+	return &fakeClient{t: t, url: srv.URL + Path}, s
+}
+
+func testTorrent(id byte) torrentfile.Torrentfile {
+	return torrentfile.Torrentfile{
+		Name:        "dir",
+		Announce:    "http://tracker.example/announce",
+		PieceHashes: [][20]byte{{1}, {2}},
+		PieceLength: 16,
+		Length:      32,
+		Infohash:    [20]byte{id},
+		Files: []p2p.File{
+			{Path: "a", Length: 16, Priority: p2p.PriorityNormal},
+			{Path: "b", Length: 16, Offset: 16, Priority: p2p.PriorityNormal},
+		},
+	}
+}
+
+func TestSessionIDHandshake(t *testing.T) {
+	c, _ := newFakeClient(t)
+	resp, err := http.Post(c.url, "application/json", bytes.NewReader([]byte(`{"method":"session-get"}`)))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get(SessionIDHeader))
+
+	result, args := c.call("session-get", nil)
+	assert.Equal(t, "success", result)
+	assert.Equal(t, float64(RPCVersion), args["rpc-version"])
+	assert.Equal(t, c.sessionID, args["session-id"])
+}
+
+func TestUnknownMethod(t *testing.T) {
+	c, _ := newFakeClient(t)
+	result, _ := c.call("blocklist-update", nil)
+	assert.Contains(t, result, "not recognized")
+}
+
+func TestTorrentLifecycle(t *testing.T) {
+	c, s := newFakeClient(t)
+	_, err := s.Add(testTorrent(1))
+	require.Nil(t, err)
+	_, err = s.AddPaused(testTorrent(2))
+	require.Nil(t, err)
+
+	fields := []string{"id", "name", "status", "hashString", "totalSize", "sizeWhenDone", "wanted", "priorities", "files", "bogus"}
+	result, args := c.call("torrent-get", map[string]any{"fields": fields})
+	require.Equal(t, "success", result)
+	torrents := args["torrents"].([]any)
+	require.Len(t, torrents, 2)
+	first := torrents[0].(map[string]any)
+	assert.Equal(t, float64(1), first["id"])
+	assert.Equal(t, float64(statusDownload), first["status"])
+	assert.Equal(t, "0100000000000000000000000000000000000000", first["hashString"])
+	assert.Equal(t, float64(32), first["totalSize"])
+	assert.Equal(t, "dir/b", first["files"].([]any)[1].(map[string]any)["name"])
+	assert.NotContains(t, first, "bogus")
+	assert.Equal(t, float64(statusStopped), torrents[1].(map[string]any)["status"])
+
+	result, _ = c.call("torrent-set", map[string]any{"ids": []any{1}, "files-unwanted": []int{1}, "priority-high": []int{0}, "downloadLimit": 100, "downloadLimited": true})
+	require.Equal(t, "success", result)
+	_, args = c.call("torrent-get", map[string]any{"ids": 1, "fields": []string{"wanted", "priorities", "sizeWhenDone", "downloadLimit", "downloadLimited"}})
+	first = args["torrents"].([]any)[0].(map[string]any)
+	assert.Equal(t, []any{float64(1), float64(0)}, first["wanted"])
+	assert.Equal(t, []any{float64(1), float64(0)}, first["priorities"])
+	assert.Equal(t, float64(16), first["sizeWhenDone"])
+	assert.Equal(t, float64(100), first["downloadLimit"])
+	assert.Equal(t, true, first["downloadLimited"])
+	st, _ := s.Get([20]byte{1})
+	assert.Equal(t, int64(100*speedBytes), st.Limits.Down.Rate)
+
+	result, _ = c.call("torrent-stop", map[string]any{"ids": []any{"0100000000000000000000000000000000000000"}})
+	require.Equal(t, "success", result)
+	result, _ = c.call("torrent-start", map[string]any{"ids": 2})
+	require.Equal(t, "success", result)
+	_, args = c.call("torrent-get", map[string]any{"fields": []string{"status"}})
+	torrents = args["torrents"].([]any)
+	assert.Equal(t, float64(statusStopped), torrents[0].(map[string]any)["status"])
+	assert.Equal(t, float64(statusDownload), torrents[1].(map[string]any)["status"])
+
+	result, _ = c.call("torrent-remove", map[string]any{"ids": []any{1}, "delete-local-data": true})
+	require.Equal(t, "success", result)
+	_, args = c.call("torrent-get", map[string]any{"fields": []string{"id"}})
+	torrents = args["torrents"].([]any)
+	require.Len(t, torrents, 1)
+	// ids stay stable once given
+	assert.Equal(t, float64(2), torrents[0].(map[string]any)["id"])
+}
+
+func TestTorrentAdd(t *testing.T) {
+	c, s := newFakeClient(t)
+	result, _ := c.call("torrent-add", map[string]any{})
+	assert.NotEqual(t, "success", result)
+	result, _ = c.call("torrent-add", map[string]any{"metainfo": "not base64!"})
+	assert.NotEqual(t, "success", result)
+
+	_, err := s.Add(testTorrent(1))
+	require.Nil(t, err)
+	result, args := c.call("torrent-add", map[string]any{"filename": "magnet:?xt=urn:btih:0100000000000000000000000000000000000000"})
+	require.Equal(t, "success", result)
+	dup := args["torrent-duplicate"].(map[string]any)
+	assert.Equal(t, float64(1), dup["id"])
+	assert.Equal(t, "dir", dup["name"])
+}
+
+func TestSessionSetAndStats(t *testing.T) {
+	c, s := newFakeClient(t)
+	result, _ := c.call("session-set", map[string]any{"speed-limit-down": 500, "speed-limit-down-enabled": true, "speed-limit-up": 50})
+	require.Equal(t, "success", result)
+	assert.Equal(t, int64(500*speedBytes), s.Limits().Down.Rate)
+	// a limit set while disabled is kept for when it is enabled
+	assert.Equal(t, int64(0), s.Limits().Up.Rate)
+	_, args := c.call("session-get", nil)
+	assert.Equal(t, float64(50), args["speed-limit-up"])
+	assert.Equal(t, false, args["speed-limit-up-enabled"])
+
+	_, err := s.Add(testTorrent(1))
+	require.Nil(t, err)
+	result, args = c.call("session-stats", nil)
+	require.Equal(t, "success", result)
+	assert.Equal(t, float64(1), args["torrentCount"])
+	assert.Equal(t, float64(1), args["activeTorrentCount"])
+}
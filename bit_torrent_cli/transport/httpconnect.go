@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// HTTPConnect dials through an HTTP proxy with the CONNECT method
+type HTTPConnect struct {
+	Addr     string
+	Username string
+	Password string
+	// Forward reaches the proxy, nil meaning TCP
+	Forward Dialer
+}
+
+func (h *HTTPConnect) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	conn, err := dialProxy(ctx, h.Forward, h.Addr)
+	if err != nil {
+		return nil, err
+	}
+	done := handshakeDeadline(ctx, conn)
+	tunnel, err := h.connect(conn, addr)
+	done()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %w", h.Addr, err)
+	}
+	return tunnel, nil
+}
+
+func (h *HTTPConnect) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.Username != "" {
+		req.SetBasicAuth(h.Username, h.Password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT answered %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// the peer already spoke, keep what the reader took
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,232 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const memoryBacklog = 64
+
+// Memory is an in-memory network for tests. Addresses are host:port strings that need not resolve.
+type Memory struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+	nextPort  int
+}
+
+func NewMemory() *Memory {
+	return &Memory{listeners: make(map[string]*memListener), nextPort: 40000}
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "memory" }
+func (a memAddr) String() string  { return string(a) }
+
+// Listen accepts connections dialed to addr. Port 0 picks a free port.
+func (m *Memory) Listen(addr string) (Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if port == "0" {
+		port = strconv.Itoa(m.portLocked())
+		addr = net.JoinHostPort(host, port)
+	}
+	if m.listeners[addr] != nil {
+		return nil, fmt.Errorf("listen memory %s: address already in use", addr)
+	}
+	l := &memListener{m: m, addr: memAddr(addr), backlog: make(chan net.Conn, memoryBacklog), done: make(chan struct{})}
+	m.listeners[addr] = l
+	return l, nil
+}
+
+func (m *Memory) portLocked() int {
+	m.nextPort++
+	return m.nextPort
+}
+
+// DialContext connects to the listener on addr, failing right away if there is none
+func (m *Memory) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	l := m.listeners[addr]
+	local := memAddr(net.JoinHostPort("127.0.0.1", strconv.Itoa(m.portLocked())))
+	m.mu.Unlock()
+	if l == nil {
+		return nil, fmt.Errorf("dial memory %s: connection refused", addr)
+	}
+	a, b := newPipe()
+	client := &memConn{r: a, w: b, local: local, remote: l.addr}
+	server := &memConn{r: b, w: a, local: l.addr, remote: local}
+	select {
+	case l.backlog <- server:
+		return client, nil
+	case <-l.done:
+	default:
+	}
+	return nil, fmt.Errorf("dial memory %s: connection refused", addr)
+}
+
+type memListener struct {
+	m       *Memory
+	addr    memAddr
+	backlog chan net.Conn
+	once    sync.Once
+	done    chan struct{}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.backlog:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.m.mu.Lock()
+		delete(l.m.listeners, string(l.addr))
+		l.m.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pipe is one direction of a connection, buffering without bound like a roomy socket
+type pipe struct {
+	mu           sync.Mutex
+	cond         *sync.Cond
+	data         []byte
+	writerClosed bool
+	readerClosed bool
+	deadline     time.Time
+	timer        *time.Timer
+}
+
+func newPipe() (*pipe, *pipe) {
+	a, b := &pipe{}, &pipe{}
+	a.cond = sync.NewCond(&a.mu)
+	b.cond = sync.NewCond(&b.mu)
+	return a, b
+}
+
+// memConn reads from r, which the peer writes, and writes to w, which the peer reads
+type memConn struct {
+	r, w          *pipe
+	local, remote net.Addr
+	wmu           sync.Mutex
+	writeDeadline time.Time
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	p := c.r
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.data) == 0 {
+		switch {
+		case p.readerClosed:
+			return 0, net.ErrClosed
+		case p.writerClosed:
+			return 0, io.EOF
+		case !p.deadline.IsZero() && !time.Now().Before(p.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		p.cond.Wait()
+	}
+	n := copy(b, p.data)
+	p.data = p.data[n:]
+	if len(p.data) == 0 {
+		p.data = nil
+	}
+	return n, nil
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	deadline := c.writeDeadline
+	c.wmu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	p := c.w
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.writerClosed:
+		return 0, net.ErrClosed
+	case p.readerClosed:
+		return 0, io.ErrClosedPipe
+	}
+	p.data = append(p.data, b...)
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	for _, p := range []*pipe{c.r, c.w} {
+		p.mu.Lock()
+		if p == c.r {
+			p.readerClosed = true
+		} else {
+			p.writerClosed = true
+		}
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	p := c.r
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.cond.Broadcast()
+	if !t.IsZero() {
+		p.timer = time.AfterFunc(time.Until(t), func() {
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		})
+	}
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksUserPass     = 2
+	socksNoAcceptable = 0xff
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// SOCKS5 dials through a SOCKS5 proxy (RFC 1928), with username and password authentication if set (RFC 1929)
+type SOCKS5 struct {
+	Addr     string
+	Username string
+	Password string
+	// Forward reaches the proxy, nil meaning TCP
+	Forward Dialer
+}
+
+func (s *SOCKS5) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	conn, err := dialProxy(ctx, s.Forward, s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	done := handshakeDeadline(ctx, conn)
+	err = s.connect(conn, addr)
+	done()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 proxy %s: %w", s.Addr, err)
+	}
+	return conn, nil
+}
+
+func (s *SOCKS5) connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{socksNoAuth}
+	if s.Username != "" {
+		methods = []byte{socksUserPass}
+	}
+	_, err = conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	var choice [2]byte
+	_, err = io.ReadFull(conn, choice[:])
+	if err != nil {
+		return err
+	}
+	switch {
+	case choice[0] != socksVersion:
+		return fmt.Errorf("unexpected version %d", choice[0])
+	case choice[1] == socksNoAcceptable:
+		return errors.New("no acceptable authentication method")
+	case choice[1] == socksUserPass:
+		err = s.authenticate(conn)
+		if err != nil {
+			return err
+		}
+	case choice[1] != socksNoAuth:
+		return fmt.Errorf("unexpected authentication method %d", choice[1])
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		req = append(append(req, socksIPv4), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, socksIPv6), ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(append(req, socksDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		msg, ok := socksReplies[reply[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply %d", reply[1])
+		}
+		return errors.New(msg)
+	}
+	// skip the bound address
+	var skip int
+	switch reply[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		var n [1]byte
+		_, err = io.ReadFull(conn, n[:])
+		if err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func (s *SOCKS5) authenticate(conn net.Conn) error {
+	if len(s.Username) > 255 || len(s.Password) > 255 {
+		return errors.New("username or password too long")
+	}
+	req := []byte{1, byte(len(s.Username))}
+	req = append(req, s.Username...)
+	req = append(req, byte(len(s.Password)))
+	req = append(req, s.Password...)
+	_, err := conn.Write(req)
+	if err != nil {
+		return err
+	}
+	var res [2]byte
+	_, err = io.ReadFull(conn, res[:])
+	if err != nil {
+		return err
+	}
+	if res[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
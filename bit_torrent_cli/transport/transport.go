@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DialTimeout bounds how long TCP and the proxies take to connect
+const DialTimeout = 3 * time.Second
+
+// Dialer makes outgoing peer connections. Dialers bound their own dial time.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Listener accepts incoming peer connections
+type Listener = net.Listener
+
+// TCP is the default dialer
+var TCP Dialer = &net.Dialer{Timeout: DialTimeout}
+
+// ListenTCP listens for peers on a TCP address, whose port may be a range like 6881-6889 tried in order
+func ListenTCP(addr string) (Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	first, last, ok := strings.Cut(port, "-")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	lo, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port range %q", port)
+	}
+	hi, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || hi < lo {
+		return nil, fmt.Errorf("bad port range %q", port)
+	}
+	for p := lo; ; p++ {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.FormatUint(p, 10)))
+		if err == nil || p == hi {
+			return l, err
+		}
+	}
+}
+
+// Fallback tries each dialer in turn until one connects
+type Fallback []Dialer
+
+func (f Fallback) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var errs []error
+	for _, d := range f {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// ParseProxy returns the dialer for a socks5://[user:pass@]host:port or http://[user:pass@]host:port proxy
+func ParseProxy(proxy string) (Dialer, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", proxy)
+	}
+	var user, password string
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	switch u.Scheme {
+	case "socks5":
+		return &SOCKS5{Addr: u.Host, Username: user, Password: password}, nil
+	case "http":
+		return &HTTPConnect{Addr: u.Host, Username: user, Password: password}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, want socks5 or http", u.Scheme)
+	}
+}
+
+// dialProxy connects to a proxy through forward, nil meaning TCP
+func dialProxy(ctx context.Context, forward Dialer, addr string) (net.Conn, error) {
+	if forward == nil {
+		forward = TCP
+	}
+	return forward.DialContext(ctx, "tcp", addr)
+}
+
+// handshakeDeadline bounds a proxy handshake by the context and DialTimeout, undone by the returned func
+func handshakeDeadline(ctx context.Context, conn net.Conn) func() {
+	deadline := time.Now().Add(DialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	return func() {
+		stop()
+		conn.SetDeadline(time.Time{})
+	}
+}
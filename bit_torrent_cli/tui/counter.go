@@ -0,0 +1,120 @@
+package tui
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Count is the progress of a job over a known number of bytes, like hashing data on disk
+type Count struct {
+	Time      time.Time `json:"time"`
+	Name      string    `json:"name"`
+	Length    int64     `json:"length"`
+	Completed int64     `json:"completed"`
+	// Rate is in bytes per second
+	Rate int64 `json:"rate"`
+}
+
+// Fraction is how much of the job is done, between 0 and 1
+func (c Count) Fraction() float64 {
+	if c.Length == 0 {
+		return 1
+	}
+	return float64(c.Completed) / float64(c.Length)
+}
+
+// RenderCount draws the count on one line width columns wide
+func RenderCount(c Count, width int) string {
+	width = max(width, 40)
+	head := c.Name + " "
+	tail := fmt.Sprintf(" %5.1f%%  %s / %s  %s/s", c.Fraction()*100,
+		humanize.IBytes(uint64(c.Completed)), humanize.IBytes(uint64(c.Length)), humanize.IBytes(uint64(c.Rate)))
+	return head + bar(c.Fraction(), width-len([]rune(head))-len([]rune(tail))) + tail
+}
+
+// Counter shows the progress of a job that is not a download until stopped, redrawing one line in bar mode
+type Counter struct {
+	mode  Mode
+	w     io.Writer
+	width int
+	count Count
+	done  atomic.Int64
+	rate  meter
+	stop  chan struct{}
+	ended chan struct{}
+}
+
+// NewCounter prepares the display of a job over length bytes on w. The mode must have been resolved.
+func NewCounter(w io.Writer, mode Mode, name string, length int64) *Counter {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	return &Counter{
+		mode:  mode,
+		w:     w,
+		width: width - 1,
+		count: Count{Name: name, Length: length},
+		stop:  make(chan struct{}),
+		ended: make(chan struct{}),
+	}
+}
+
+// Add counts n more bytes done, safe for concurrent use
+func (c *Counter) Add(n int64) {
+	c.done.Add(n)
+}
+
+// Start shows the progress in the background
+func (c *Counter) Start() {
+	interval := BarInterval
+	if c.mode == ModeJSON {
+		interval = JSONInterval
+	}
+	go func() {
+		defer close(c.ended)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			c.update(time.Now())
+			select {
+			case <-ticker.C:
+			case <-c.stop:
+				c.update(time.Now())
+				if c.mode == ModeBar {
+					io.WriteString(c.w, "\n")
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Stop shows the final count and stops updating it
+func (c *Counter) Stop() {
+	close(c.stop)
+	<-c.ended
+}
+
+func (c *Counter) update(now time.Time) {
+	c.count.Time = now
+	c.count.Completed = c.done.Load()
+	c.count.Rate = c.rate.add(now, c.count.Completed)
+	switch c.mode {
+	case ModeBar:
+		fmt.Fprintf(c.w, "\r%s\x1b[K", RenderCount(c.count, c.width))
+	case ModeJSON:
+		line, err := json.Marshal(c.count)
+		if err != nil {
+			return
+		}
+		c.w.Write(append(line, '\n'))
+	}
+}
@@ -0,0 +1,172 @@
+package tui
+
+import (
+	"bit_torrent_cli/p2p"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+// Mode is how the progress is shown
+type Mode int
+
+const (
+	// ModeAuto draws bars on a terminal and writes JSON lines otherwise
+	ModeAuto Mode = iota
+	// ModeBar redraws progress bars in place
+	ModeBar
+	// ModeJSON writes a Snapshot per line
+	ModeJSON
+	// ModeQuiet shows nothing
+	ModeQuiet
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeAuto:
+		return "auto"
+	case ModeBar:
+		return "bar"
+	case ModeJSON:
+		return "json"
+	case ModeQuiet:
+		return "quiet"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseMode reads a mode as printed by String
+func ParseMode(s string) (Mode, error) {
+	for m := ModeAuto; m <= ModeQuiet; m++ {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown progress mode %q, want auto, bar, json or quiet", s)
+}
+
+// Resolve turns ModeAuto into ModeBar when f is a terminal and ModeJSON otherwise
+func (m Mode) Resolve(f *os.File) Mode {
+	if m != ModeAuto {
+		return m
+	}
+	if isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd()) {
+		return ModeBar
+	}
+	return ModeJSON
+}
+
+const (
+	// BarInterval is how often the bars are redrawn
+	BarInterval = 250 * time.Millisecond
+	// JSONInterval is how often a JSON line is written
+	JSONInterval = time.Second
+)
+
+// Display shows the progress of a torrent until stopped.
+// In bar mode, whatever is written to the Display, like log output, is printed above the bars.
+type Display struct {
+	mode  Mode
+	w     io.Writer
+	width int
+	tr    tracker
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu    sync.Mutex
+	lines int // how many lines the last frame took
+	frame string
+}
+
+// New prepares a display of the torrent's progress on w, counting only the files not skipped.
+// The mode must have been resolved.
+func New(w io.Writer, mode Mode, name string, t Torrent, files []p2p.File) *Display {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	return &Display{
+		mode:  mode,
+		w:     w,
+		width: width - 1,
+		tr:    tracker{name: name, files: files, t: t},
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start shows the progress in the background
+func (d *Display) Start() {
+	interval := BarInterval
+	if d.mode == ModeJSON {
+		interval = JSONInterval
+	}
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			d.update(time.Now())
+			select {
+			case <-ticker.C:
+			case <-d.stop:
+				d.update(time.Now())
+				return
+			}
+		}
+	}()
+}
+
+// Stop shows the final progress and stops updating it
+func (d *Display) Stop() {
+	close(d.stop)
+	<-d.done
+}
+
+func (d *Display) update(now time.Time) {
+	s := d.tr.snapshot(now)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch d.mode {
+	case ModeBar:
+		lines := Render(s, d.width)
+		d.clearLocked()
+		d.frame = strings.Join(lines, "\n") + "\n"
+		d.lines = len(lines)
+		io.WriteString(d.w, d.frame)
+	case ModeJSON:
+		line, err := json.Marshal(s)
+		if err != nil {
+			return
+		}
+		d.w.Write(append(line, '\n'))
+	}
+}
+
+// clearLocked erases the last frame, leaving the cursor where it started
+func (d *Display) clearLocked() {
+	if d.lines > 0 {
+		fmt.Fprintf(d.w, "\x1b[%dA\x1b[J", d.lines)
+	}
+}
+
+// Write prints p above the bars, for use as the log output
+func (d *Display) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mode != ModeBar {
+		return d.w.Write(p)
+	}
+	d.clearLocked()
+	n, err := d.w.Write(p)
+	io.WriteString(d.w, d.frame)
+	return n, err
+}
@@ -0,0 +1,247 @@
+package tui
+
+import (
+	"bit_torrent_cli/p2p"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// RateWindow is how far back the transfer rates are averaged
+const RateWindow = 10 * time.Second
+
+// MaxFiles caps the files listed under the overall progress, the rest being summed up in one line
+const MaxFiles = 8
+
+// Torrent is what the progress is read from, implemented by *p2p.Torrent
+type Torrent interface {
+	Stats() p2p.Stats
+	PeerStats() []p2p.PeerStats
+	PieceStats() []p2p.PieceStats
+	BytesCompleted(f p2p.File) int
+}
+
+// Snapshot is the progress of a download at one moment
+type Snapshot struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name"`
+	// Length and Completed count the bytes of the wanted files only
+	Length     int64 `json:"length"`
+	Completed  int64 `json:"completed"`
+	Downloaded int64 `json:"downloaded"`
+	Uploaded   int64 `json:"uploaded"`
+	// DownRate and UpRate are in bytes per second
+	DownRate int64 `json:"downRate"`
+	UpRate   int64 `json:"upRate"`
+	// ETA is in seconds, -1 while the download is stalled
+	ETA        int64 `json:"eta"`
+	Peers      int   `json:"peers"`
+	Choking    int   `json:"choking"`
+	Interested int   `json:"interested"`
+	// Interesting counts the peers wanting our pieces
+	Interesting int            `json:"interesting"`
+	Pieces      int            `json:"pieces"`
+	PiecesDone  int            `json:"piecesDone"`
+	Files       []FileProgress `json:"files,omitempty"`
+	// PieceStates holds the state of every piece for the piece map, left out of the JSON lines
+	PieceStates []p2p.PieceStats `json:"-"`
+}
+
+// FileProgress is the progress of one wanted file
+type FileProgress struct {
+	Path      string `json:"path"`
+	Length    int64  `json:"length"`
+	Completed int64  `json:"completed"`
+}
+
+// Fraction is how much of the wanted data is verified, between 0 and 1
+func (s Snapshot) Fraction() float64 {
+	if s.Length == 0 {
+		return 1
+	}
+	return float64(s.Completed) / float64(s.Length)
+}
+
+type sample struct {
+	at    time.Time
+	bytes int64
+}
+
+// meter averages a growing byte count over the last RateWindow
+type meter struct {
+	samples []sample
+}
+
+// add records the count at a moment and returns the bytes per second since the oldest sample kept
+func (m *meter) add(at time.Time, bytes int64) int64 {
+	m.samples = append(m.samples, sample{at, bytes})
+	for len(m.samples) > 2 && at.Sub(m.samples[1].at) >= RateWindow {
+		m.samples = m.samples[1:]
+	}
+	first := m.samples[0]
+	elapsed := at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(bytes-first.bytes) / elapsed)
+}
+
+// tracker builds snapshots of one torrent, keeping the samples the rates are computed from
+type tracker struct {
+	name     string
+	files    []p2p.File
+	t        Torrent
+	down, up meter
+}
+
+func (tr *tracker) snapshot(now time.Time) Snapshot {
+	st := tr.t.Stats()
+	s := Snapshot{
+		Time:        now,
+		Name:        tr.name,
+		Downloaded:  st.Downloaded,
+		Uploaded:    st.Uploaded,
+		Pieces:      st.Pieces,
+		PiecesDone:  st.PiecesDone,
+		PieceStates: tr.t.PieceStats(),
+	}
+	s.DownRate = tr.down.add(now, st.Downloaded)
+	s.UpRate = tr.up.add(now, st.Uploaded)
+	for _, f := range tr.files {
+		if f.Priority == p2p.PrioritySkip {
+			continue
+		}
+		fp := FileProgress{Path: f.Path, Length: int64(f.Length), Completed: int64(tr.t.BytesCompleted(f))}
+		s.Files = append(s.Files, fp)
+		s.Length += fp.Length
+		s.Completed += fp.Completed
+	}
+	s.ETA = -1
+	switch {
+	case s.Completed >= s.Length:
+		s.ETA = 0
+	case s.DownRate > 0:
+		s.ETA = (s.Length - s.Completed + s.DownRate - 1) / s.DownRate
+	}
+	for _, p := range tr.t.PeerStats() {
+		s.Peers++
+		if p.Choked {
+			s.Choking++
+		}
+		if p.Interested {
+			s.Interested++
+		}
+		if p.PeerInterested {
+			s.Interesting++
+		}
+	}
+	return s
+}
+
+// bar draws a progress bar width cells wide
+func bar(fraction float64, width int) string {
+	if width < 1 {
+		return ""
+	}
+	fraction = min(max(fraction, 0), 1)
+	full := int(fraction * float64(width))
+	return strings.Repeat("█", full) + strings.Repeat("░", width-full)
+}
+
+// pieceMap draws the pieces in width cells, each cell standing for a run of pieces:
+// █ all verified, ▓ half or more verified, ▒ some verified or downloading, ░ none yet, blank all skipped
+func pieceMap(pieces []p2p.PieceStats, width int) string {
+	if len(pieces) == 0 || width < 1 {
+		return ""
+	}
+	width = min(width, len(pieces))
+	var b strings.Builder
+	for cell := 0; cell < width; cell++ {
+		begin := cell * len(pieces) / width
+		end := (cell + 1) * len(pieces) / width
+		var wanted, done, active int
+		for _, p := range pieces[begin:end] {
+			if p.State == "done" {
+				done++
+			}
+			if p.State == "downloading" {
+				active++
+			}
+			if p.Priority != p2p.PrioritySkip || p.State == "done" {
+				wanted++
+			}
+		}
+		switch {
+		case wanted == 0:
+			b.WriteByte(' ')
+		case done == end-begin:
+			b.WriteString("█")
+		case 2*done >= end-begin:
+			b.WriteString("▓")
+		case done > 0 || active > 0:
+			b.WriteString("▒")
+		default:
+			b.WriteString("░")
+		}
+	}
+	return b.String()
+}
+
+// formatETA prints the seconds left like 1h02m03s
+func formatETA(eta int64) string {
+	switch {
+	case eta < 0:
+		return "∞"
+	case eta == 0:
+		return "done"
+	}
+	d := time.Duration(eta) * time.Second
+	h, m, sec := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%dh%02dm%02ds", h, m, sec)
+	}
+	if m > 0 {
+		return fmt.Sprintf("%dm%02ds", m, sec)
+	}
+	return fmt.Sprintf("%ds", sec)
+}
+
+// Render draws the snapshot for a terminal width columns wide, one line per row
+func Render(s Snapshot, width int) []string {
+	width = max(width, 40)
+	lines := []string{s.Name}
+	percent := fmt.Sprintf(" %5.1f%%  %s / %s", s.Fraction()*100,
+		humanize.IBytes(uint64(s.Completed)), humanize.IBytes(uint64(s.Length)))
+	lines = append(lines, bar(s.Fraction(), width-len([]rune(percent)))+percent)
+	lines = append(lines, fmt.Sprintf("↓ %s/s  ↑ %s/s  ETA %s  pieces %d/%d",
+		humanize.IBytes(uint64(s.DownRate)), humanize.IBytes(uint64(s.UpRate)), formatETA(s.ETA), s.PiecesDone, s.Pieces))
+	lines = append(lines, fmt.Sprintf("peers %d connected, %d choking us, %d interesting, %d interested in us",
+		s.Peers, s.Choking, s.Interested, s.Interesting))
+	lines = append(lines, pieceMap(s.PieceStates, width))
+	if len(s.Files) < 2 {
+		return lines
+	}
+	shown := s.Files
+	if len(shown) > MaxFiles {
+		shown = shown[:MaxFiles]
+	}
+	for _, f := range shown {
+		fraction := 1.0
+		if f.Length > 0 {
+			fraction = float64(f.Completed) / float64(f.Length)
+		}
+		prefix := fmt.Sprintf("  %5.1f%% ", fraction*100)
+		name := []rune(f.Path)
+		room := width - len(prefix) - 12
+		if len(name) > room {
+			name = append([]rune("…"), name[len(name)-room+1:]...)
+		}
+		lines = append(lines, prefix+bar(fraction, 10)+"  "+string(name))
+	}
+	if rest := len(s.Files) - len(shown); rest > 0 {
+		lines = append(lines, fmt.Sprintf("  … and %d more files", rest))
+	}
+	return lines
+}
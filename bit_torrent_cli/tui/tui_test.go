@@ -0,0 +1,214 @@
+package tui
+
+import (
+	"bit_torrent_cli/p2p"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTorrent reports fixed progress, completed giving the verified bytes of each file by path
+type fakeTorrent struct {
+	stats     p2p.Stats
+	peers     []p2p.PeerStats
+	pieces    []p2p.PieceStats
+	completed map[string]int
+}
+
+func (f *fakeTorrent) Stats() p2p.Stats                 { return f.stats }
+func (f *fakeTorrent) PeerStats() []p2p.PeerStats       { return f.peers }
+func (f *fakeTorrent) PieceStats() []p2p.PieceStats     { return f.pieces }
+func (f *fakeTorrent) BytesCompleted(file p2p.File) int { return f.completed[file.Path] }
+
+func TestSnapshot(t *testing.T) {
+	ft := &fakeTorrent{
+		stats: p2p.Stats{Pieces: 4, PiecesDone: 1},
+		peers: []p2p.PeerStats{
+			{Choked: true, Interested: true},
+			{Interested: true, PeerInterested: true},
+			{Choked: true},
+		},
+		completed: map[string]int{"a": 100, "b": 50},
+	}
+	files := []p2p.File{
+		{Path: "a", Length: 100, Priority: p2p.PriorityNormal},
+		{Path: "b", Length: 300, Priority: p2p.PriorityHigh},
+		{Path: "skipped", Length: 1000, Priority: p2p.PrioritySkip},
+	}
+	tr := tracker{name: "t", files: files, t: ft}
+	start := time.Unix(1000, 0)
+
+	s := tr.snapshot(start)
+	assert.Equal(t, int64(400), s.Length)
+	assert.Equal(t, int64(150), s.Completed)
+	assert.Equal(t, int64(-1), s.ETA, "stalled")
+	assert.Equal(t, []FileProgress{{"a", 100, 100}, {"b", 300, 50}}, s.Files)
+	assert.Equal(t, 3, s.Peers)
+	assert.Equal(t, 2, s.Choking)
+	assert.Equal(t, 2, s.Interested)
+	assert.Equal(t, 1, s.Interesting)
+
+	ft.stats.Downloaded, ft.stats.Uploaded = 100, 20
+	ft.completed["b"] = 200
+	s = tr.snapshot(start.Add(2 * time.Second))
+	assert.Equal(t, int64(50), s.DownRate)
+	assert.Equal(t, int64(10), s.UpRate)
+	assert.Equal(t, int64(2), s.ETA)
+
+	ft.completed["b"] = 300
+	s = tr.snapshot(start.Add(4 * time.Second))
+	assert.Equal(t, int64(0), s.ETA, "done")
+	assert.Equal(t, 1.0, s.Fraction())
+}
+
+func TestMeter(t *testing.T) {
+	var m meter
+	start := time.Unix(1000, 0)
+	assert.Equal(t, int64(0), m.add(start, 0))
+	assert.Equal(t, int64(100), m.add(start.Add(time.Second), 100))
+	// the burst at the start falls out of the window
+	for i := 2; i <= 20; i++ {
+		m.add(start.Add(time.Duration(i)*time.Second), 100)
+	}
+	assert.Equal(t, int64(0), m.add(start.Add(21*time.Second), 100))
+}
+
+func TestPieceMap(t *testing.T) {
+	idle := p2p.PieceStats{Priority: p2p.PriorityNormal, State: "idle"}
+	active := p2p.PieceStats{Priority: p2p.PriorityNormal, State: "downloading"}
+	done := p2p.PieceStats{Priority: p2p.PriorityNormal, State: "done"}
+	skipped := p2p.PieceStats{Priority: p2p.PrioritySkip, State: "idle"}
+	tests := map[string]struct {
+		pieces []p2p.PieceStats
+		width  int
+		output string
+	}{
+		"one cell per piece": {
+			pieces: []p2p.PieceStats{done, active, idle, skipped},
+			width:  10,
+			output: "█▒░ ",
+		},
+		"runs of pieces": {
+			pieces: []p2p.PieceStats{done, done, done, idle, active, idle, idle, idle, skipped, skipped},
+			width:  5,
+			output: "█▓▒░ ",
+		},
+		"no pieces": {
+			width:  10,
+			output: "",
+		},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.output, pieceMap(test.pieces, test.width), name)
+	}
+}
+
+func TestFormatETA(t *testing.T) {
+	tests := map[int64]string{
+		-1:   "∞",
+		0:    "done",
+		42:   "42s",
+		125:  "2m05s",
+		3723: "1h02m03s",
+	}
+	for input, output := range tests {
+		assert.Equal(t, output, formatETA(input), input)
+	}
+}
+
+func TestRender(t *testing.T) {
+	s := Snapshot{
+		Name:       "linux.iso",
+		Length:     1 << 20,
+		Completed:  1 << 19,
+		DownRate:   1 << 10,
+		ETA:        512,
+		Peers:      3,
+		Choking:    1,
+		Pieces:     4,
+		PiecesDone: 2,
+		Files:      []FileProgress{{"a", 1 << 19, 1 << 19}, {"b", 1 << 19, 0}},
+	}
+	lines := Render(s, 60)
+	require.Len(t, lines, 7)
+	assert.Equal(t, "linux.iso", lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], " 50.0%  512 KiB / 1.0 MiB"), lines[1])
+	assert.Equal(t, 60, len([]rune(lines[1])))
+	assert.Equal(t, "↓ 1.0 KiB/s  ↑ 0 B/s  ETA 8m32s  pieces 2/4", lines[2])
+	assert.Equal(t, "peers 3 connected, 1 choking us, 0 interesting, 0 interested in us", lines[3])
+	assert.Equal(t, "  100.0% ██████████  a", lines[5])
+	assert.Equal(t, "    0.0% ░░░░░░░░░░  b", lines[6])
+}
+
+func TestParseMode(t *testing.T) {
+	for m := ModeAuto; m <= ModeQuiet; m++ {
+		parsed, err := ParseMode(m.String())
+		require.Nil(t, err)
+		assert.Equal(t, m, parsed)
+	}
+	_, err := ParseMode("fancy")
+	assert.NotNil(t, err)
+}
+
+func TestDisplay(t *testing.T) {
+	ft := &fakeTorrent{stats: p2p.Stats{Pieces: 1}, completed: map[string]int{}}
+	files := []p2p.File{{Path: "a", Length: 10, Priority: p2p.PriorityNormal}}
+
+	var out bytes.Buffer
+	d := New(&out, ModeBar, "t", ft, files)
+	d.Start()
+	time.Sleep(BarInterval / 2)
+	d.Write([]byte("a log line\n"))
+	d.Stop()
+	// the log line is printed where the frame was, and the frame drawn again below it
+	frames := strings.Split(out.String(), "a log line\n")
+	require.Len(t, frames, 2)
+	assert.Contains(t, frames[0], "\x1b[5A\x1b[J", "first frame erased")
+	assert.True(t, strings.HasPrefix(frames[1], "t\n"))
+
+	out.Reset()
+	d = New(&out, ModeJSON, "t", ft, files)
+	d.Start()
+	d.Stop()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	var s Snapshot
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &s))
+	assert.Equal(t, "t", s.Name)
+	assert.Equal(t, int64(10), s.Length)
+}
+
+func TestRenderCount(t *testing.T) {
+	line := RenderCount(Count{Name: "verify", Length: 4 << 20, Completed: 1 << 20, Rate: 512 << 10}, 70)
+	assert.Equal(t, 70, len([]rune(line)))
+	assert.True(t, strings.HasPrefix(line, "verify ██"), line)
+	assert.True(t, strings.HasSuffix(line, " 25.0%  1.0 MiB / 4.0 MiB  512 KiB/s"), line)
+}
+
+func TestCounter(t *testing.T) {
+	var out bytes.Buffer
+	c := NewCounter(&out, ModeJSON, "verify", 10)
+	c.Start()
+	c.Add(4)
+	c.Add(6)
+	c.Stop()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	var last Count
+	require.Nil(t, json.Unmarshal([]byte(lines[len(lines)-1]), &last))
+	assert.Equal(t, int64(10), last.Completed)
+	assert.Equal(t, 1.0, last.Fraction())
+
+	out.Reset()
+	c = NewCounter(&out, ModeBar, "verify", 10)
+	c.Start()
+	c.Add(10)
+	c.Stop()
+	assert.True(t, strings.HasPrefix(out.String(), "\r"))
+	assert.True(t, strings.HasSuffix(out.String(), "\x1b[K\n"), out.String())
+	assert.Contains(t, out.String(), "100.0%  10 B / 10 B")
+}
@@ -0,0 +1,482 @@
+package utp
+
+import (
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPayload keeps datagrams under common path MTUs
+	maxPayload = 1200
+	// recvWindow is how much unread data a connection buffers
+	recvWindow = 1 << 20
+
+	initialWindow = 4 * maxPayload
+	minWindow     = 2 * maxPayload
+	maxWindow     = recvWindow
+
+	// LEDBAT keeps the queuing delay we add around targetDelay
+	targetDelay     = 100 * time.Millisecond
+	maxCwndIncrease = 3000 // bytes per RTT
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 8 * time.Second
+	maxTimeouts    = 6
+
+	// reorderLimit is how far ahead of the next expected packet data is kept
+	reorderLimit = 1024
+	// fastResendAfter is how many later packets must be acked before a hole is resent
+	fastResendAfter = 3
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateFinSent
+)
+
+type packet struct {
+	typ     byte
+	seq     uint16
+	payload []byte
+	sentAt  time.Time
+	sends   int
+}
+
+// delayHistory tracks the base delay, the lowest one way delay of the last two minutes
+type delayHistory struct {
+	cur, prev uint32
+	full      bool
+	since     time.Time
+}
+
+func (d *delayHistory) add(delay uint32, now time.Time) {
+	if d.since.IsZero() || now.Sub(d.since) > time.Minute {
+		d.prev, d.full = d.cur, !d.since.IsZero()
+		d.cur, d.since = delay, now
+		return
+	}
+	d.cur = min(d.cur, delay)
+}
+
+func (d *delayHistory) base() uint32 {
+	if d.full {
+		return min(d.cur, d.prev)
+	}
+	return d.cur
+}
+
+// Conn is a uTP connection. All of its state is guarded by the socket's mutex.
+type Conn struct {
+	s              *Socket
+	raddr          net.Addr
+	recvID, sendID uint16
+	state          int
+	cond           *sync.Cond
+	connected      chan struct{}
+	closed         bool
+	err            error
+
+	// sending
+	seqNr      uint16
+	outbound   []*packet
+	inFlight   int
+	cwnd       float64
+	peerWnd    int
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	timeouts   int
+	delays     delayHistory
+	lastAck    uint16
+	dupAcks    int
+	fastResent int // seq+1 of the last packet resent early, 0 for none
+	replyMicro uint32
+
+	// receiving
+	ackNr      uint16
+	reorder    map[uint16][]byte
+	readBuf    []byte
+	advertised int
+	gotFin     bool
+	finSeq     uint16
+	eof        bool
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	for len(c.readBuf) == 0 {
+		switch {
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.closed:
+			return 0, net.ErrClosed
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+	// tell a peer we stalled that there is room again
+	if c.advertised < maxPayload && c.window() >= maxPayload && c.state != stateSynSent {
+		c.sendStateLocked()
+	}
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		size := min(len(b), maxPayload)
+		for c.inFlight > 0 && c.inFlight+size > min(int(c.cwnd), c.peerWnd) {
+			if err := c.writeErrLocked(); err != nil {
+				return n, err
+			}
+			c.cond.Wait()
+		}
+		if err := c.writeErrLocked(); err != nil {
+			return n, err
+		}
+		p := &packet{typ: stData, seq: c.seqNr, payload: append([]byte(nil), b[:size]...)}
+		c.seqNr++
+		c.outbound = append(c.outbound, p)
+		c.inFlight += size
+		c.sendLocked(p)
+		b = b[size:]
+		n += size
+	}
+	return n, nil
+}
+
+func (c *Conn) writeErrLocked() error {
+	switch {
+	case c.err != nil:
+		return c.err
+	case c.closed:
+		return net.ErrClosed
+	case expired(c.writeDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Close sends a FIN. The connection stays on the socket until everything sent is acked.
+func (c *Conn) Close() error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.stopTimersLocked()
+	c.cond.Broadcast()
+	if c.err != nil || c.state != stateConnected {
+		c.s.removeLocked(c)
+		return nil
+	}
+	fin := &packet{typ: stFin, seq: c.seqNr}
+	c.seqNr++
+	c.outbound = append(c.outbound, fin)
+	c.sendLocked(fin)
+	c.state = stateFinSent
+	return nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.readDeadline = t
+	c.armLocked(&c.readTimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.writeDeadline = t
+	c.armLocked(&c.writeTimer, t)
+	return nil
+}
+
+// armLocked wakes the waiting readers or writers when the deadline passes
+func (c *Conn) armLocked(timer **time.Timer, t time.Time) {
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	c.cond.Broadcast()
+	if t.IsZero() {
+		return
+	}
+	*timer = time.AfterFunc(time.Until(t), func() {
+		c.s.mu.Lock()
+		c.cond.Broadcast()
+		c.s.mu.Unlock()
+	})
+}
+
+func (c *Conn) stopTimersLocked() {
+	for _, t := range []*time.Timer{c.readTimer, c.writeTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// failLocked ends the connection with err and takes it off the socket
+func (c *Conn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	select {
+	case <-c.connected:
+	default:
+		close(c.connected)
+	}
+	c.stopTimersLocked()
+	c.s.removeLocked(c)
+	c.cond.Broadcast()
+}
+
+// window is the receive window advertised to the peer
+func (c *Conn) window() int {
+	return max(recvWindow-len(c.readBuf), 0)
+}
+
+func (c *Conn) sendLocked(p *packet) {
+	p.sentAt = time.Now()
+	p.sends++
+	c.writeLocked(p.typ, p.seq, p.payload)
+}
+
+func (c *Conn) sendStateLocked() {
+	c.writeLocked(stState, c.seqNr, nil)
+}
+
+func (c *Conn) writeLocked(typ byte, seq uint16, payload []byte) {
+	id := c.sendID
+	if typ == stSyn {
+		id = c.recvID
+	}
+	c.advertised = c.window()
+	h := header{
+		typ:       typ,
+		connID:    id,
+		timestamp: c.s.now(),
+		timeDiff:  c.replyMicro,
+		wnd:       uint32(c.advertised),
+		seq:       seq,
+		ack:       c.ackNr,
+		sack:      c.sackLocked(),
+	}
+	c.s.pc.WriteTo(h.marshal(payload), c.raddr)
+}
+
+// sackLocked describes the out of order packets received, nil if there are none
+func (c *Conn) sackLocked() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	last := 0
+	for seq := range c.reorder {
+		last = max(last, int(seq-c.ackNr-2))
+	}
+	sack := make([]byte, (last/32+1)*4)
+	for seq := range c.reorder {
+		i := int(seq - c.ackNr - 2)
+		sack[i/8] |= 1 << (i % 8)
+	}
+	return sack
+}
+
+func (c *Conn) handleLocked(h header, payload []byte) {
+	c.replyMicro = c.s.now() - h.timestamp
+	c.peerWnd = int(h.wnd)
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ackNr = h.seq - 1
+		close(c.connected)
+	}
+	c.ackLocked(h)
+	if h.typ == stData || h.typ == stFin {
+		c.receiveLocked(h, payload)
+		c.sendStateLocked()
+	}
+	c.cond.Broadcast()
+	if c.state == stateFinSent && len(c.outbound) == 0 {
+		c.s.removeLocked(c)
+	}
+}
+
+// receiveLocked queues data in order, keeping what arrives early
+func (c *Conn) receiveLocked(h header, payload []byte) {
+	if h.typ == stFin {
+		c.gotFin, c.finSeq = true, h.seq
+	}
+	if d := h.seq - c.ackNr; d == 0 || d > reorderLimit {
+		return
+	}
+	if h.typ == stData {
+		c.reorder[h.seq] = payload
+	}
+	for {
+		next := c.ackNr + 1
+		if p, ok := c.reorder[next]; ok {
+			delete(c.reorder, next)
+			c.readBuf = append(c.readBuf, p...)
+			c.ackNr = next
+		} else if c.gotFin && next == c.finSeq {
+			c.ackNr = next
+			c.eof = true
+		} else {
+			return
+		}
+	}
+}
+
+// ackLocked drops the packets the peer acked and adapts the window
+func (c *Conn) ackLocked(h header) {
+	if len(c.outbound) == 0 {
+		return
+	}
+	now := time.Now()
+	acked, ackedPackets := 0, 0
+	kept := c.outbound[:0]
+	for _, p := range c.outbound {
+		if !seqLess(h.ack, p.seq) || sacked(h.sack, h.ack, p.seq) {
+			acked += len(p.payload)
+			ackedPackets++
+			if p.sends == 1 {
+				c.rttSampleLocked(now.Sub(p.sentAt))
+			}
+			continue
+		}
+		kept = append(kept, p)
+	}
+	clear(c.outbound[len(kept):])
+	c.outbound = kept
+	c.inFlight -= acked
+	if ackedPackets > 0 && c.timeouts > 0 {
+		// the peer is back, forget the backoff
+		c.timeouts = 0
+		if c.rtt > 0 {
+			c.rto = min(max(c.rtt+4*c.rttVar, minTimeout), maxTimeout)
+		}
+	}
+	if acked > 0 && h.timeDiff != 0 {
+		c.ledbatLocked(h.timeDiff, acked, now)
+	}
+
+	if len(kept) == 0 {
+		c.dupAcks = 0
+		return
+	}
+	// a hole the peer keeps acking around is lost
+	if ackedPackets == 0 && h.typ == stState && h.ack == c.lastAck {
+		c.dupAcks++
+	} else {
+		c.dupAcks = 0
+	}
+	c.lastAck = h.ack
+	later := 0
+	for i := range h.sack {
+		for bit := 0; bit < 8; bit++ {
+			if h.sack[i]&(1<<bit) != 0 {
+				later++
+			}
+		}
+	}
+	first := kept[0]
+	if (later >= fastResendAfter || c.dupAcks >= fastResendAfter) && c.fastResent != int(first.seq)+1 {
+		c.fastResent = int(first.seq) + 1
+		c.cwnd = max(c.cwnd/2, minWindow)
+		c.sendLocked(first)
+	}
+}
+
+func (c *Conn) rttSampleLocked(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = min(max(c.rtt+4*c.rttVar, minTimeout), maxTimeout)
+}
+
+// ledbatLocked grows the window while the delay we add stays under target and shrinks it above
+func (c *Conn) ledbatLocked(delay uint32, acked int, now time.Time) {
+	c.delays.add(delay, now)
+	ourDelay := float64(delay - c.delays.base())
+	target := float64(targetDelay.Microseconds())
+	offTarget := (target - ourDelay) / target
+	windowFactor := math.Min(float64(acked), c.cwnd) / math.Max(c.cwnd, float64(acked))
+	c.cwnd += maxCwndIncrease * offTarget * windowFactor
+	c.cwnd = min(max(c.cwnd, minWindow), maxWindow)
+}
+
+// tickLocked resends the overdue packets once the oldest one is
+func (c *Conn) tickLocked(now time.Time) {
+	if len(c.outbound) == 0 {
+		return
+	}
+	first := c.outbound[0]
+	if now.Sub(first.sentAt) < c.rto {
+		return
+	}
+	c.timeouts++
+	if c.timeouts > maxTimeouts {
+		c.failLocked(errTimeout)
+		return
+	}
+	c.cwnd = minWindow
+	rto := c.rto
+	c.rto = min(c.rto*2, maxTimeout)
+	for _, p := range c.outbound {
+		if now.Sub(p.sentAt) >= rto {
+			c.sendLocked(p)
+		}
+	}
+	c.cond.Broadcast()
+}
@@ -0,0 +1,93 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// packet types
+const (
+	stData  byte = 0
+	stFin   byte = 1
+	stState byte = 2
+	stReset byte = 3
+	stSyn   byte = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+
+	extSelectiveAck = 1
+)
+
+var errBadPacket = errors.New("malformed uTP packet")
+
+type header struct {
+	typ       byte
+	connID    uint16
+	timestamp uint32
+	timeDiff  uint32
+	wnd       uint32
+	seq       uint16
+	ack       uint16
+	// sack is the selective ack bitmask, bit i acking seq ack+2+i. nil without the extension.
+	sack []byte
+}
+
+func (h header) marshal(payload []byte) []byte {
+	b := make([]byte, headerSize, headerSize+2+len(h.sack)+len(payload))
+	b[0] = h.typ<<4 | version
+	if h.sack != nil {
+		b[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timeDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wnd)
+	binary.BigEndian.PutUint16(b[16:], h.seq)
+	binary.BigEndian.PutUint16(b[18:], h.ack)
+	if h.sack != nil {
+		b = append(b, 0, byte(len(h.sack)))
+		b = append(b, h.sack...)
+	}
+	return append(b, payload...)
+}
+
+// parsePacket splits a datagram into its header and payload, which share b
+func parsePacket(b []byte) (header, []byte, error) {
+	var h header
+	if len(b) < headerSize || b[0]&0xf != version || b[0]>>4 > stSyn {
+		return h, nil, errBadPacket
+	}
+	h.typ = b[0] >> 4
+	h.connID = binary.BigEndian.Uint16(b[2:])
+	h.timestamp = binary.BigEndian.Uint32(b[4:])
+	h.timeDiff = binary.BigEndian.Uint32(b[8:])
+	h.wnd = binary.BigEndian.Uint32(b[12:])
+	h.seq = binary.BigEndian.Uint16(b[16:])
+	h.ack = binary.BigEndian.Uint16(b[18:])
+	ext, rest := b[1], b[headerSize:]
+	for ext != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return h, nil, errBadPacket
+		}
+		next, length := rest[0], int(rest[1])
+		if ext == extSelectiveAck {
+			h.sack = rest[2 : 2+length]
+		}
+		ext, rest = next, rest[2+length:]
+	}
+	return h, rest, nil
+}
+
+// seqLess compares sequence numbers that wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// sacked reports whether the selective ack of a packet acking ack covers seq
+func sacked(sack []byte, ack, seq uint16) bool {
+	i := int(seq - ack - 2)
+	return i >= 0 && i < len(sack)*8 && sack[i/8]&(1<<(i%8)) != 0
+}
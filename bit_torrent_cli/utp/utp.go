@@ -0,0 +1,260 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DialTimeout bounds how long Dial waits for the peer to answer the SYN
+	DialTimeout = 3 * time.Second
+
+	acceptBacklog = 64
+	tickInterval  = 50 * time.Millisecond
+)
+
+var (
+	errReset   = errors.New("uTP connection reset by peer")
+	errTimeout = errors.New("uTP connection timed out")
+)
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over one UDP socket. It is a net.Listener for the inbound ones.
+type Socket struct {
+	pc    net.PacketConn
+	start time.Time
+
+	mu      sync.Mutex
+	conns   map[connKey]*Conn
+	backlog chan *Conn
+	closed  bool
+	done    chan struct{}
+}
+
+// Listen opens a UDP socket on addr for uTP connections
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP over pc, which the socket owns from now on
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:      pc,
+		start:   time.Now(),
+		conns:   make(map[connKey]*Conn),
+		backlog: make(chan *Conn, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.timerLoop()
+	return s
+}
+
+// now is the microsecond timestamp put in packets
+func (s *Socket) now() uint32 {
+	return uint32(time.Since(s.start).Microseconds())
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Accept waits for the next inbound connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Dial connects to a uTP peer at addr
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), "utp", addr)
+}
+
+// DialContext connects to a uTP peer at addr. The network is ignored, uTP always runs over UDP.
+func (s *Socket) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	id := uint16(rand.Uint32())
+	for s.conns[connKey{raddr.String(), id}] != nil {
+		id++
+	}
+	c := s.newConnLocked(raddr, id, id+1)
+	c.state = stateSynSent
+	syn := &packet{typ: stSyn, seq: c.seqNr}
+	c.seqNr++
+	c.outbound = append(c.outbound, syn)
+	c.sendLocked(syn)
+	s.mu.Unlock()
+
+	select {
+	case <-c.connected:
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.state == stateSynSent && c.err == nil {
+		c.failLocked(ctx.Err())
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// Close closes the UDP socket and every connection on it
+func (s *Socket) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for _, c := range s.conns {
+		c.failLocked(net.ErrClosed)
+	}
+	s.mu.Unlock()
+	return s.pc.Close()
+}
+
+func (s *Socket) newConnLocked(addr net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		s:         s,
+		raddr:     addr,
+		recvID:    recvID,
+		sendID:    sendID,
+		seqNr:     1,
+		cwnd:      initialWindow,
+		peerWnd:   initialWindow,
+		rto:       initialTimeout,
+		reorder:   make(map[uint16][]byte),
+		connected: make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&s.mu)
+	s.conns[connKey{addr.String(), recvID}] = c
+	return c
+}
+
+func (s *Socket) removeLocked(c *Conn) {
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.handle(addr, h, append([]byte(nil), payload...))
+	}
+}
+
+func (s *Socket) handle(addr net.Addr, h header, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	switch h.typ {
+	case stSyn:
+		s.handleSynLocked(addr, h)
+		return
+	case stReset:
+		// a reset carries either of our ids depending on which side sends it
+		for _, id := range []uint16{h.connID, h.connID + 1, h.connID - 1} {
+			c := s.conns[connKey{addr.String(), id}]
+			if c != nil && (c.recvID == h.connID || c.sendID == h.connID) {
+				c.failLocked(errReset)
+				return
+			}
+		}
+		return
+	}
+	c := s.conns[connKey{addr.String(), h.connID}]
+	if c == nil {
+		s.sendResetLocked(addr, h)
+		return
+	}
+	c.handleLocked(h, payload)
+}
+
+func (s *Socket) handleSynLocked(addr net.Addr, h header) {
+	if c := s.conns[connKey{addr.String(), h.connID + 1}]; c != nil {
+		// our answer got lost
+		c.sendStateLocked()
+		return
+	}
+	if len(s.backlog) == cap(s.backlog) {
+		s.sendResetLocked(addr, h)
+		return
+	}
+	c := s.newConnLocked(addr, h.connID+1, h.connID)
+	c.state = stateConnected
+	c.seqNr = uint16(rand.Uint32())
+	c.ackNr = h.seq
+	c.peerWnd = int(h.wnd)
+	c.replyMicro = s.now() - h.timestamp
+	close(c.connected)
+	c.sendStateLocked()
+	s.backlog <- c
+}
+
+func (s *Socket) sendResetLocked(addr net.Addr, h header) {
+	r := header{typ: stReset, connID: h.connID, timestamp: s.now(), seq: uint16(rand.Uint32()), ack: h.seq}
+	s.pc.WriteTo(r.marshal(nil), addr)
+}
+
+// timerLoop retransmits on timeouts
+func (s *Socket) timerLoop() {
+	t := time.NewTicker(tickInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-t.C:
+			s.mu.Lock()
+			for _, c := range s.conns {
+				c.tickLocked(now)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacket(t *testing.T) {
+	h := header{typ: stData, connID: 7, timestamp: 1, timeDiff: 2, wnd: 3, seq: 65535, ack: 9, sack: []byte{0b101, 0, 0, 0}}
+	got, payload, err := parsePacket(h.marshal([]byte("data")))
+	require.Nil(t, err)
+	assert.Equal(t, h, got)
+	assert.Equal(t, "data", string(payload))
+
+	assert.True(t, sacked(h.sack, 9, 11))
+	assert.False(t, sacked(h.sack, 9, 12))
+	assert.True(t, sacked(h.sack, 9, 13))
+	assert.True(t, seqLess(65535, 0))
+	assert.False(t, seqLess(0, 65535))
+
+	_, _, err = parsePacket([]byte{0x01, 0, 0})
+	assert.NotNil(t, err)
+}
+
+// lossyConn drops every nth datagram it sends
+type lossyConn struct {
+	net.PacketConn
+	n     int64
+	count atomic.Int64
+}
+
+func (l *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if l.count.Add(1)%l.n == 0 {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+func newPair(t *testing.T, drop int64) (*Socket, *Socket) {
+	socket := func() *Socket {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.Nil(t, err)
+		if drop > 0 {
+			pc = &lossyConn{PacketConn: pc, n: drop}
+		}
+		s := NewSocket(pc)
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	return socket(), socket()
+}
+
+func transfer(t *testing.T, a, b *Socket, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := b.Accept()
+		require.Nil(t, err)
+		accepted <- c
+	}()
+	out, err := a.Dial(b.Addr().String())
+	require.Nil(t, err)
+	in := <-accepted
+
+	// both directions at once
+	go out.Write(data)
+	go in.Write(data[:size/2])
+	got := make([]byte, size)
+	_, err = io.ReadFull(in, got)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(data, got), "inbound data differs")
+	back := make([]byte, size/2)
+	_, err = io.ReadFull(out, back)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(data[:size/2], back), "outbound data differs")
+
+	out.Close()
+	_, err = in.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	in.Close()
+}
+
+func TestTransfer(t *testing.T) {
+	a, b := newPair(t, 0)
+	transfer(t, a, b, 4<<20)
+}
+
+func TestLossyTransfer(t *testing.T) {
+	a, b := newPair(t, 13)
+	transfer(t, a, b, 512<<10)
+}
+
+func TestDialTimeout(t *testing.T) {
+	a, b := newPair(t, 0)
+	addr := b.Addr().String()
+	b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := a.DialContext(ctx, "utp", addr)
+	assert.NotNil(t, err)
+}
+
+func TestReset(t *testing.T) {
+	a, b := newPair(t, 0)
+	go b.Accept()
+	c, err := a.Dial(b.Addr().String())
+	require.Nil(t, err)
+	// the peer forgets the connection and resets the next packet
+	b.mu.Lock()
+	for _, conn := range b.conns {
+		b.removeLocked(conn)
+	}
+	b.mu.Unlock()
+	c.Write([]byte("hello"))
+	_, err = c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, errReset)
+}
+
+func TestDeadline(t *testing.T) {
+	a, b := newPair(t, 0)
+	go b.Accept()
+	c, err := a.Dial(b.Addr().String())
+	require.Nil(t, err)
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
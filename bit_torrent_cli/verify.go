@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bit_torrent_cli/torrentfile"
+	"bit_torrent_cli/tui"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// badPieceJSON is a bad piece in the report of verify -json
+type badPieceJSON struct {
+	Index   int      `json:"index"`
+	Missing bool     `json:"missing"`
+	Err     string   `json:"err,omitempty"`
+	Files   []string `json:"files"`
+}
+
+// verifyCmd hashes the data of a torrent in -dir against its pieces, failing when any is missing or corrupt
+func verifyCmd(args []string) error {
+	fs := newFlagSet("verify", "[flags] <torrent>")
+	dir := fs.String("dir", ".", "directory the torrent was downloaded to, as by download -dir")
+	workers := fs.Int("workers", 0, "pieces hashed at once, 0 for one per CPU")
+	progress := fs.String("progress", "auto", "how to show progress: bar, json lines, quiet, or auto for a bar on a terminal and nothing otherwise")
+	asJSON := fs.Bool("json", false, "print the report as one JSON line")
+	err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	mode, err := tui.ParseMode(*progress)
+	if err != nil {
+		return usageError(fs, err)
+	}
+	if mode == tui.ModeAuto {
+		// unlike a download, verifying is quick enough not to need progress in logs
+		mode = mode.Resolve(os.Stderr)
+		if mode == tui.ModeJSON {
+			mode = tui.ModeQuiet
+		}
+	}
+	tf, err := torrentfile.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	data := tf.OpenData(filepath.Join(*dir, tf.Name))
+	defer data.Close()
+	out := os.Stderr
+	if mode == tui.ModeJSON {
+		out = os.Stdout
+	}
+	counter := tui.NewCounter(out, mode, "verifying "+tf.Name, int64(tf.Length))
+	counter.Start()
+	bad, err := tf.Verify(ctx, data, *workers, func(n int) { counter.Add(int64(n)) })
+	counter.Stop()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		report := struct {
+			Pieces int            `json:"pieces"`
+			Bad    []badPieceJSON `json:"bad"`
+		}{Pieces: len(tf.PieceHashes), Bad: []badPieceJSON{}}
+		for _, b := range bad {
+			p := badPieceJSON{Index: b.Index, Missing: b.Missing(), Files: b.Files}
+			if b.Err != nil {
+				p.Err = b.Err.Error()
+			}
+			report.Bad = append(report.Bad, p)
+		}
+		err = json.NewEncoder(os.Stdout).Encode(report)
+		if err != nil {
+			return err
+		}
+	} else {
+		printVerify(tf, bad)
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%d of %d pieces bad", len(bad), len(tf.PieceHashes))
+	}
+	return nil
+}
+
+// printVerify sums the bad pieces up by the files they touch, in the order of the torrent,
+// then lists why the missing data could not be read
+func printVerify(tf torrentfile.Torrentfile, bad []torrentfile.BadPiece) {
+	type fileReport struct{ corrupt, missing int }
+	files := make(map[string]*fileReport)
+	missing := 0
+	var reasons []string
+	seen := make(map[string]bool)
+	for _, b := range bad {
+		if b.Missing() {
+			missing++
+			if reason := b.Err.Error(); !seen[reason] {
+				seen[reason] = true
+				reasons = append(reasons, reason)
+			}
+		}
+		for _, path := range b.Files {
+			r := files[path]
+			if r == nil {
+				r = &fileReport{}
+				files[path] = r
+			}
+			if b.Missing() {
+				r.missing++
+			} else {
+				r.corrupt++
+			}
+		}
+	}
+	for _, f := range tf.Files {
+		if r := files[f.Path]; r != nil {
+			fmt.Printf("%s: %d bad pieces, %d corrupt and %d missing\n", f.Path, r.corrupt+r.missing, r.corrupt, r.missing)
+		}
+	}
+	for _, reason := range reasons {
+		fmt.Printf("missing: %s\n", reason)
+	}
+	fmt.Printf("%d of %d pieces ok, %d corrupt, %d missing\n",
+		len(tf.PieceHashes)-len(bad), len(tf.PieceHashes), len(bad)-missing, missing)
+}
@@ -0,0 +1,240 @@
+package wiretrace
+
+import (
+	"bit_torrent_cli/bitfield"
+	"bit_torrent_cli/handshake"
+	"bit_torrent_cli/message"
+	"bit_torrent_cli/peerid"
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// the directions of a record, from our side of the connection
+const (
+	Sent     = "send"
+	Received = "recv"
+)
+
+// the kinds of records
+const (
+	KindHandshake = "handshake"
+	KindMessage   = "message"
+	KindError     = "error"
+)
+
+// maxPayload caps the payload kept in a record, piece messages keeping only their index and offset
+const maxPayload = 256
+
+// Record is a handshake, message or read error of a peer connection, one JSON object per line in a capture
+type Record struct {
+	Time time.Time `json:"time"`
+	Peer string    `json:"peer"`
+	Dir  string    `json:"dir"`
+	Kind string    `json:"kind"`
+
+	// InfoHash, PeerID, Client and Extensions are set for handshakes
+	InfoHash   string `json:"infoHash,omitempty"`
+	PeerID     string `json:"peerId,omitempty"`
+	Client     string `json:"client,omitempty"`
+	Extensions bool   `json:"extensions,omitempty"`
+
+	// Msg is Message.String() of the message and Summary its decoded payload.
+	// ID is missing for keep-alives, and Payload is cut to maxPayload bytes while Length is the full length.
+	Msg     string `json:"msg,omitempty"`
+	ID      *int   `json:"id,omitempty"`
+	Length  int    `json:"length,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+	Summary string `json:"summary,omitempty"`
+
+	Err string `json:"err,omitempty"`
+}
+
+// Recorder writes the records of every connection it is given to, safe for concurrent use
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	w   io.Writer
+	c   io.Closer
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w), w: w}
+}
+
+// Create records to a new capture file at path
+func Create(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(f)
+	return &Recorder{enc: json.NewEncoder(bw), w: bw, c: f}, nil
+}
+
+func (r *Recorder) write(rec Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// a capture is a debugging aid, failing to write it does not fail the connection
+	r.enc.Encode(rec)
+}
+
+// Handshake records a handshake sent or received at t
+func (r *Recorder) Handshake(t time.Time, peer, dir string, hs *handshake.Handshake) {
+	r.write(Record{
+		Time:       t,
+		Peer:       peer,
+		Dir:        dir,
+		Kind:       KindHandshake,
+		InfoHash:   hex.EncodeToString(hs.InfoHash[:]),
+		PeerID:     hex.EncodeToString(hs.PeerID[:]),
+		Client:     peerid.Client(hs.PeerID),
+		Extensions: hs.SupportsExtensions(),
+	})
+}
+
+// Message records a message sent or received at t, nil being a keep-alive
+func (r *Recorder) Message(t time.Time, peer, dir string, m *message.Message) {
+	rec := Record{Time: t, Peer: peer, Dir: dir, Kind: KindMessage, Msg: m.String()}
+	if m != nil {
+		id := int(m.ID)
+		rec.ID = &id
+		rec.Length = len(m.Payload)
+		payload := m.Payload
+		if m.ID == message.MsgPiece {
+			payload = payload[:min(len(payload), 8)]
+		}
+		rec.Payload = payload[:min(len(payload), maxPayload)]
+		rec.Summary = Summarize(m)
+	}
+	r.write(rec)
+}
+
+// Error records the error ending the connection
+func (r *Recorder) Error(t time.Time, peer string, err error) {
+	r.write(Record{Time: t, Peer: peer, Dir: Received, Kind: KindError, Err: err.Error()})
+}
+
+// Close flushes the capture, closing its file if Create opened it
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	if bw, ok := r.w.(*bufio.Writer); ok {
+		err = bw.Flush()
+	}
+	if r.c != nil {
+		err = errors.Join(err, r.c.Close())
+	}
+	return err
+}
+
+// Summarize describes the payload of a message
+func Summarize(m *message.Message) string {
+	if m == nil {
+		return ""
+	}
+	p := m.Payload
+	switch m.ID {
+	case message.MsgHave:
+		index, err := message.ParseHave(m)
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("piece %d", index)
+	case message.MsgBitfield:
+		return fmt.Sprintf("has %d of up to %d pieces", bitfield.Bitfield(p).Count(), len(p)*8)
+	case message.MsgRequest, message.MsgCancel:
+		index, begin, length, err := message.ParseRequest(m)
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("piece %d offset %d length %d", index, begin, length)
+	case message.MsgPiece:
+		if len(p) < 8 {
+			return fmt.Sprintf("payload too short: %d bytes", len(p))
+		}
+		return fmt.Sprintf("piece %d offset %d, %d bytes", binary.BigEndian.Uint32(p[0:4]), binary.BigEndian.Uint32(p[4:8]), len(p)-8)
+	case message.MsgExtended:
+		id, payload, err := message.ParseExtended(m)
+		if err != nil {
+			return err.Error()
+		}
+		if id == 0 {
+			return fmt.Sprintf("extension handshake, %d bytes", len(payload))
+		}
+		return fmt.Sprintf("extension %d, %d bytes", id, len(payload))
+	}
+	return ""
+}
+
+// Reader reads back the records of a capture
+type Reader struct {
+	dec *json.Decoder
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+}
+
+// Next returns the next record, io.EOF at the end of the capture
+func (r *Reader) Next() (Record, error) {
+	var rec Record
+	err := r.dec.Decode(&rec)
+	return rec, err
+}
+
+// Timeline writes the records of the capture as lines of text, the time relative to the first record.
+// With peer set only the records of that peer are written.
+func Timeline(w io.Writer, r io.Reader, peer string) error {
+	records := NewReader(r)
+	var start time.Time
+	for {
+		rec, err := records.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading capture: %w", err)
+		}
+		if peer != "" && rec.Peer != peer {
+			continue
+		}
+		if start.IsZero() {
+			start = rec.Time
+		}
+		_, err = fmt.Fprintf(w, "%10.3fs %-21s %s\n", rec.Time.Sub(start).Seconds(), rec.Peer, rec.describe())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// describe is the timeline text of the record after its time and peer
+func (rec Record) describe() string {
+	arrow := "->"
+	if rec.Dir == Received {
+		arrow = "<-"
+	}
+	switch rec.Kind {
+	case KindHandshake:
+		s := fmt.Sprintf("%s handshake info hash %s, peer ID %s (%s)", arrow, rec.InfoHash, rec.PeerID, rec.Client)
+		if rec.Extensions {
+			s += ", extensions"
+		}
+		return s
+	case KindError:
+		return "xx " + rec.Err
+	}
+	if rec.Summary == "" {
+		return fmt.Sprintf("%s %s", arrow, rec.Msg)
+	}
+	return fmt.Sprintf("%s %s: %s", arrow, rec.Msg, rec.Summary)
+}
@@ -0,0 +1,64 @@
+package wiretrace
+
+import (
+	"bit_torrent_cli/handshake"
+	"bit_torrent_cli/message"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	tests := map[string]struct {
+		msg  *message.Message
+		want string
+	}{
+		"keep-alive":    {nil, ""},
+		"choke":         {&message.Message{ID: message.MsgChoke}, ""},
+		"have":          {message.FormatHave(7), "piece 7"},
+		"bitfield":      {&message.Message{ID: message.MsgBitfield, Payload: []byte{0xf0, 0x01}}, "has 5 of up to 16 pieces"},
+		"request":       {message.FormatRequest(1, 16384, 16384), "piece 1 offset 16384 length 16384"},
+		"cancel":        {&message.Message{ID: message.MsgCancel, Payload: message.FormatRequest(1, 0, 5).Payload}, "piece 1 offset 0 length 5"},
+		"piece":         {message.FormatPiece(3, 32, make([]byte, 100)), "piece 3 offset 32, 100 bytes"},
+		"short piece":   {&message.Message{ID: message.MsgPiece, Payload: []byte{1}}, "payload too short: 1 bytes"},
+		"ext handshake": {message.FormatExtended(0, []byte("d1:md6:ut_pexi1eee")), "extension handshake, 18 bytes"},
+		"ext message":   {message.FormatExtended(2, []byte("de")), "extension 2, 2 bytes"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.want, Summarize(test.msg))
+		})
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecorder(&buf)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hs := handshake.New([20]byte{0xab}, [20]byte{'-', 'q', 'B', '4', '5', '0', '0', '-'})
+	hs.EnableExtensions()
+	r.Handshake(start, "10.0.0.1:6881", Sent, hs)
+	r.Message(start.Add(time.Second), "10.0.0.2:6881", Received, message.FormatHave(4))
+	r.Message(start.Add(1500*time.Millisecond), "10.0.0.1:6881", Received, message.FormatPiece(0, 0, make([]byte, 1<<10)))
+	r.Message(start.Add(2*time.Second), "10.0.0.1:6881", Sent, nil)
+	r.Error(start.Add(3*time.Second), "10.0.0.1:6881", errors.New("EOF"))
+	require.Nil(t, r.Close())
+
+	// piece data is left out of the capture
+	assert.Less(t, buf.Len(), 1<<10)
+
+	var out strings.Builder
+	require.Nil(t, Timeline(&out, bytes.NewReader(buf.Bytes()), "10.0.0.1:6881"))
+	assert.Equal(t, `     0.000s 10.0.0.1:6881         -> handshake info hash ab00000000000000000000000000000000000000, peer ID 2d7142343530302d000000000000000000000000 (qBittorrent 4.5.0), extensions
+     1.500s 10.0.0.1:6881         <- Piece [1032]: piece 0 offset 0, 1024 bytes
+     2.000s 10.0.0.1:6881         -> KeepAlive
+     3.000s 10.0.0.1:6881         xx EOF
+`, out.String())
+
+	assert.NotNil(t, Timeline(&out, strings.NewReader("not json"), ""))
+}